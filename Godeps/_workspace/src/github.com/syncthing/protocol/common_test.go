@@ -14,6 +14,7 @@ type TestModel struct {
 	offset   int64
 	size     int
 	closedCh chan bool
+	closeErr error
 }
 
 func newTestModel() *TestModel {
@@ -37,12 +38,16 @@ func (t *TestModel) Request(deviceID DeviceID, folder, name string, offset int64
 }
 
 func (t *TestModel) Close(deviceID DeviceID, err error) {
+	t.closeErr = err
 	close(t.closedCh)
 }
 
 func (t *TestModel) ClusterConfig(deviceID DeviceID, config ClusterConfigMessage) {
 }
 
+func (t *TestModel) Latency(deviceID DeviceID, rtt time.Duration) {
+}
+
 func (t *TestModel) isClosed() bool {
 	select {
 	case <-t.closedCh:
@@ -0,0 +1,235 @@
+// Copyright (C) 2015 The Protocol Authors.
+
+package protocol
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/calmh/xdr"
+)
+
+// Features of the index encoding added since the first version of the
+// protocol. Each device lists the ones it supports in the features option of
+// its cluster config, and the indexes sent between two devices use only those
+// they both support. The message header version stays zero, so that devices
+// without any of them can still connect.
+const (
+	featureModifiedNs uint32 = 1 << iota // FileInfo.ModifiedNs
+	featurePosix                          // FileInfo.Posix
+	featureWeakHash                       // BlockInfo.WeakHash
+	featureBlockSize                      // FileInfo.RawBlockSize
+)
+
+const featuresOptionKey = "features"
+
+var featureNames = map[string]uint32{
+	"modifiedNs": featureModifiedNs,
+	"posix":      featurePosix,
+	"weakHash":   featureWeakHash,
+	"blockSize":  featureBlockSize,
+}
+
+// supportedFeatures are the features this implementation supports.
+const supportedFeatures = featureModifiedNs | featurePosix | featureWeakHash | featureBlockSize
+
+// featuresOption returns the cluster config option announcing the given
+// features.
+func featuresOption(features uint32) Option {
+	var names []string
+	for name, feature := range featureNames {
+		if features&feature != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return Option{Key: featuresOptionKey, Value: strings.Join(names, ",")}
+}
+
+// parseFeatures returns the features listed in the option value. Unknown
+// ones are ignored.
+func parseFeatures(value string) uint32 {
+	var features uint32
+	for _, name := range strings.Split(value, ",") {
+		features |= featureNames[name]
+	}
+	return features
+}
+
+// An indexMessage is an IndexMessage encoded for a device supporting the
+// given features.
+type indexMessage struct {
+	IndexMessage
+	features uint32
+}
+
+func (o indexMessage) AppendXDR(bs []byte) ([]byte, error) {
+	var aw = xdr.AppendWriter(bs)
+	var xw = xdr.NewWriter(&aw)
+	_, err := o.encodeXDR(xw)
+	return []byte(aw), err
+}
+
+func (o indexMessage) encodeXDR(xw *xdr.Writer) (int, error) {
+	if l := len(o.Folder); l > 64 {
+		return xw.Tot(), xdr.ElementSizeExceeded("Folder", l, 64)
+	}
+	xw.WriteString(o.Folder)
+	xw.WriteUint32(uint32(len(o.Files)))
+	for i := range o.Files {
+		_, err := encodeFileInfo(xw, o.Files[i], o.features)
+		if err != nil {
+			return xw.Tot(), err
+		}
+	}
+	xw.WriteUint32(o.Flags)
+	if l := len(o.Options); l > 64 {
+		return xw.Tot(), xdr.ElementSizeExceeded("Options", l, 64)
+	}
+	xw.WriteUint32(uint32(len(o.Options)))
+	for i := range o.Options {
+		_, err := o.Options[i].encodeXDR(xw)
+		if err != nil {
+			return xw.Tot(), err
+		}
+	}
+	return xw.Tot(), xw.Error()
+}
+
+func (o *indexMessage) UnmarshalXDR(bs []byte) error {
+	var br = bytes.NewReader(bs)
+	var xr = xdr.NewReader(br)
+	return o.decodeXDR(xr)
+}
+
+func (o *indexMessage) decodeXDR(xr *xdr.Reader) error {
+	o.Folder = xr.ReadStringMax(64)
+	_FilesSize := int(xr.ReadUint32())
+	o.Files = make([]FileInfo, _FilesSize)
+	for i := range o.Files {
+		if err := decodeFileInfo(xr, &o.Files[i], o.features); err != nil {
+			return err
+		}
+	}
+	o.Flags = xr.ReadUint32()
+	_OptionsSize := int(xr.ReadUint32())
+	if _OptionsSize > 64 {
+		return xdr.ElementSizeExceeded("Options", _OptionsSize, 64)
+	}
+	o.Options = make([]Option, _OptionsSize)
+	for i := range o.Options {
+		if err := (&o.Options[i]).decodeXDR(xr); err != nil {
+			return err
+		}
+	}
+	return xr.Error()
+}
+
+// encodeFileInfo writes the file like FileInfo.encodeXDR, leaving out the
+// fields of the features not given. Without featureBlockSize, files with
+// other than the standard block size are written as invalid and without
+// blocks, as the device can't get them from us.
+func encodeFileInfo(xw *xdr.Writer, o FileInfo, features uint32) (int, error) {
+	if features&featureBlockSize == 0 && o.BlockSize() != BlockSize {
+		o.Flags |= FlagInvalid
+		o.Blocks = nil
+	}
+	if l := len(o.Name); l > 8192 {
+		return xw.Tot(), xdr.ElementSizeExceeded("Name", l, 8192)
+	}
+	xw.WriteString(o.Name)
+	xw.WriteUint32(o.Flags)
+	xw.WriteUint64(uint64(o.Modified))
+	if features&featureModifiedNs != 0 {
+		xw.WriteUint32(uint32(o.ModifiedNs))
+	}
+	xw.WriteUint64(uint64(o.Version))
+	xw.WriteUint64(uint64(o.LocalVersion))
+	if features&featureBlockSize != 0 {
+		xw.WriteUint32(uint32(o.RawBlockSize))
+	}
+	xw.WriteUint32(uint32(len(o.Blocks)))
+	for i := range o.Blocks {
+		_, err := encodeBlockInfo(xw, o.Blocks[i], features)
+		if err != nil {
+			return xw.Tot(), err
+		}
+	}
+	if features&featurePosix != 0 {
+		if l := len(o.Posix); l > 1 {
+			return xw.Tot(), xdr.ElementSizeExceeded("Posix", l, 1)
+		}
+		xw.WriteUint32(uint32(len(o.Posix)))
+		for i := range o.Posix {
+			_, err := o.Posix[i].encodeXDR(xw)
+			if err != nil {
+				return xw.Tot(), err
+			}
+		}
+	}
+	return xw.Tot(), xw.Error()
+}
+
+// decodeFileInfo reads a file written by encodeFileInfo with the same
+// features. The fields of the other features are left zero. Unlike the
+// generated decoders it stops at the first error, as the rest of the
+// message can't be decoded after an invalid element.
+func decodeFileInfo(xr *xdr.Reader, o *FileInfo, features uint32) error {
+	o.Name = xr.ReadStringMax(8192)
+	o.Flags = xr.ReadUint32()
+	o.Modified = int64(xr.ReadUint64())
+	if features&featureModifiedNs != 0 {
+		o.ModifiedNs = int32(xr.ReadUint32())
+	}
+	o.Version = int64(xr.ReadUint64())
+	o.LocalVersion = int64(xr.ReadUint64())
+	if features&featureBlockSize != 0 {
+		o.RawBlockSize = int32(xr.ReadUint32())
+	}
+	_BlocksSize := int(xr.ReadUint32())
+	o.Blocks = make([]BlockInfo, _BlocksSize)
+	for i := range o.Blocks {
+		if err := decodeBlockInfo(xr, &o.Blocks[i], features); err != nil {
+			return err
+		}
+	}
+	if features&featurePosix != 0 {
+		_PosixSize := int(xr.ReadUint32())
+		if _PosixSize > 1 {
+			return xdr.ElementSizeExceeded("Posix", _PosixSize, 1)
+		}
+		o.Posix = make([]PosixMetadata, _PosixSize)
+		for i := range o.Posix {
+			if err := (&o.Posix[i]).decodeXDR(xr); err != nil {
+				return err
+			}
+		}
+	}
+	return xr.Error()
+}
+
+// encodeBlockInfo writes the block like BlockInfo.encodeXDR, leaving out the
+// fields of the features not given.
+func encodeBlockInfo(xw *xdr.Writer, o BlockInfo, features uint32) (int, error) {
+	xw.WriteUint32(uint32(o.Size))
+	if l := len(o.Hash); l > 64 {
+		return xw.Tot(), xdr.ElementSizeExceeded("Hash", l, 64)
+	}
+	xw.WriteBytes(o.Hash)
+	if features&featureWeakHash != 0 {
+		xw.WriteUint32(o.WeakHash)
+	}
+	return xw.Tot(), xw.Error()
+}
+
+// decodeBlockInfo reads a block written by encodeBlockInfo with the same
+// features. The fields of the other features are left zero.
+func decodeBlockInfo(xr *xdr.Reader, o *BlockInfo, features uint32) error {
+	o.Size = int32(xr.ReadUint32())
+	o.Hash = xr.ReadBytesMax(64)
+	if features&featureWeakHash != 0 {
+		o.WeakHash = xr.ReadUint32()
+	}
+	return xr.Error()
+}
@@ -0,0 +1,263 @@
+// Copyright (C) 2015 The Protocol Authors.
+
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/calmh/xdr"
+)
+
+func TestFeaturesOption(t *testing.T) {
+	opt := featuresOption(supportedFeatures)
+	if opt.Key != featuresOptionKey {
+		t.Errorf("Option key %q, expected %q", opt.Key, featuresOptionKey)
+	}
+	if f := parseFeatures(opt.Value); f != supportedFeatures {
+		t.Errorf("Parsed features %x, expected %x", f, supportedFeatures)
+	}
+
+	if f := parseFeatures(""); f != 0 {
+		t.Errorf("Empty option parsed as features %x", f)
+	}
+	if f := parseFeatures("unknown,posix,"); f != featurePosix {
+		t.Errorf("Parsed features %x, expected %x", f, featurePosix)
+	}
+}
+
+var featuresTestIndex = IndexMessage{
+	Folder: "default",
+	Files: []FileInfo{
+		{
+			Name:         "foo",
+			Flags:        0644,
+			Modified:     1234567890,
+			ModifiedNs:   123456789,
+			Version:      42,
+			LocalVersion: 43,
+			Blocks: []BlockInfo{
+				{Size: 1234, Hash: []byte{1, 2, 3, 4}, WeakHash: 0x01020304},
+			},
+			Posix: []PosixMetadata{
+				{UID: 1000, GID: 100, Xattrs: []Xattr{}},
+			},
+		},
+	},
+}
+
+func TestIndexMessageEncoding(t *testing.T) {
+	// Without any features the message is encoded like by the first
+	// version of the protocol.
+	var legacy bytes.Buffer
+	xw := xdr.NewWriter(&legacy)
+	xw.WriteString("default")
+	xw.WriteUint32(1)
+	xw.WriteString("foo")
+	xw.WriteUint32(0644)
+	xw.WriteUint64(1234567890)
+	xw.WriteUint64(42)
+	xw.WriteUint64(43)
+	xw.WriteUint32(1)
+	xw.WriteUint32(1234)
+	xw.WriteBytes([]byte{1, 2, 3, 4})
+	xw.WriteUint32(0) // flags
+	xw.WriteUint32(0) // options
+
+	bs, err := indexMessage{featuresTestIndex, 0}.AppendXDR(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, legacy.Bytes()) {
+		t.Errorf("Incorrect legacy encoding\n%x\n%x", bs, legacy.Bytes())
+	}
+
+	// With all features it is the full message.
+	bs, err = indexMessage{featuresTestIndex, supportedFeatures}.AppendXDR(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full := featuresTestIndex.MustMarshalXDR(); !bytes.Equal(bs, full) {
+		t.Errorf("Incorrect full encoding\n%x\n%x", bs, full)
+	}
+}
+
+func TestIndexMessageBlockSize(t *testing.T) {
+	im := IndexMessage{
+		Folder: "default",
+		Files: []FileInfo{
+			{Name: "large", RawBlockSize: 1 << 20, Blocks: []BlockInfo{{Size: 1 << 20}, {Size: 100}}},
+			{Name: "small", Blocks: []BlockInfo{{Size: 100}}},
+		},
+	}
+
+	for _, features := range []uint32{0, featureBlockSize} {
+		bs, err := indexMessage{im, features}.AppendXDR(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec := indexMessage{features: features}
+		if err := dec.UnmarshalXDR(bs); err != nil {
+			t.Fatal(err)
+		}
+
+		// Devices without the feature can't get files with large blocks
+		// from us, so they're sent as invalid.
+		large, small := dec.Files[0], dec.Files[1]
+		if features == 0 && (!large.IsInvalid() || len(large.Blocks) != 0) {
+			t.Errorf("Large file sent as %v without the block size feature", large)
+		}
+		if features != 0 && (large.IsInvalid() || large.BlockSize() != 1<<20 || len(large.Blocks) != 2) {
+			t.Errorf("Large file sent as %v with the block size feature", large)
+		}
+		if small.IsInvalid() || len(small.Blocks) != 1 {
+			t.Errorf("Features %x: small file sent as %v", features, small)
+		}
+	}
+
+	// The files to send are not modified.
+	if im.Files[0].IsInvalid() || len(im.Files[0].Blocks) != 2 {
+		t.Errorf("Encoding modified the file to %v", im.Files[0])
+	}
+}
+
+func TestIndexMessageRoundTrip(t *testing.T) {
+	for _, features := range []uint32{0, featureModifiedNs, featurePosix, featureWeakHash, featureBlockSize, supportedFeatures} {
+		bs, err := indexMessage{featuresTestIndex, features}.AppendXDR(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		im := indexMessage{features: features}
+		if err := im.UnmarshalXDR(bs); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := featuresTestIndex
+		expected.Files = []FileInfo{featuresTestIndex.Files[0]}
+		if features&featureModifiedNs == 0 {
+			expected.Files[0].ModifiedNs = 0
+		}
+		expected.Files[0].Blocks = []BlockInfo{featuresTestIndex.Files[0].Blocks[0]}
+		if features&featureWeakHash == 0 {
+			expected.Files[0].Blocks[0].WeakHash = 0
+		}
+		if features&featurePosix == 0 {
+			expected.Files[0].Posix = nil
+		}
+		expected.Options = []Option{}
+		if !reflect.DeepEqual(im.IndexMessage, expected) {
+			t.Errorf("Features %x: decoded %+v, expected %+v", features, im.IndexMessage, expected)
+		}
+	}
+}
+
+func TestIndexMessageDecodeError(t *testing.T) {
+	// A message claiming two files, the first with two Posix entries. If
+	// the error were lost, the entries would decode as a second, empty,
+	// file.
+	var buf bytes.Buffer
+	xw := xdr.NewWriter(&buf)
+	xw.WriteString("default")
+	xw.WriteUint32(2)
+	xw.WriteString("foo")
+	xw.WriteUint32(0644)
+	xw.WriteUint64(1234567890)
+	xw.WriteUint64(42)
+	xw.WriteUint64(43)
+	xw.WriteUint32(0) // blocks
+	xw.WriteUint32(2) // posix
+	for i := 0; i < 2; i++ {
+		PosixMetadata{}.encodeXDR(xw)
+	}
+	xw.WriteUint32(0) // flags
+	xw.WriteUint32(0) // options
+
+	im := indexMessage{features: featurePosix}
+	if err := im.UnmarshalXDR(buf.Bytes()); err == nil {
+		t.Error("Unexpected nil error for too many Posix entries")
+	}
+
+	// Likewise for a block hash that's too long.
+	buf.Reset()
+	xw = xdr.NewWriter(&buf)
+	xw.WriteString("default")
+	xw.WriteUint32(1)
+	xw.WriteString("foo")
+	xw.WriteUint32(0644)
+	xw.WriteUint64(1234567890)
+	xw.WriteUint64(42)
+	xw.WriteUint64(43)
+	xw.WriteUint32(1) // blocks
+	xw.WriteUint32(1234)
+	xw.WriteBytes(make([]byte, 65))
+	xw.WriteUint32(0) // flags
+	xw.WriteUint32(0) // options
+
+	im = indexMessage{}
+	if err := im.UnmarshalXDR(buf.Bytes()); err == nil {
+		t.Error("Unexpected nil error for a too long block hash")
+	}
+}
+
+type indexModel struct {
+	*TestModel
+	indexes chan []FileInfo
+}
+
+func (t *indexModel) Index(deviceID DeviceID, folder string, files []FileInfo) {
+	t.indexes <- files
+}
+
+func TestNegotiateFeatures(t *testing.T) {
+	m1 := &indexModel{newTestModel(), make(chan []FileInfo, 1)}
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, newTestModel(), "name", true).(wireFormatConnection).next.(*rawConnection)
+	c1 := NewConnection(c1ID, br, aw, m1, "name", true).(wireFormatConnection).next.(*rawConnection)
+
+	c0.ClusterConfig(ClusterConfigMessage{})
+	c1.ClusterConfig(ClusterConfigMessage{})
+
+	if err := c0.Index("default", featuresTestIndex.Files); err != nil {
+		t.Fatal(err)
+	}
+	if c0.features != supportedFeatures {
+		t.Errorf("Negotiated features %x, expected %x", c0.features, supportedFeatures)
+	}
+
+	select {
+	case files := <-m1.indexes:
+		if len(files) != 1 || !reflect.DeepEqual(files[0], featuresTestIndex.Files[0]) {
+			t.Errorf("Incorrect index received: %+v", files)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No index received")
+	}
+}
+
+func TestNegotiateFeaturesLegacy(t *testing.T) {
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, newTestModel(), "name", true).(wireFormatConnection).next.(*rawConnection)
+	c1 := NewConnection(c1ID, br, aw, newTestModel(), "name", true).(wireFormatConnection).next.(*rawConnection)
+
+	// A cluster config without the features option, as sent by older
+	// devices.
+	c1.send(-1, messageTypeClusterConfig, ClusterConfigMessage{})
+
+	select {
+	case <-c0.ccRcvd:
+	case <-time.After(time.Second):
+		t.Fatal("No cluster config received")
+	}
+	if c0.features != 0 {
+		t.Errorf("Negotiated features %x with a legacy device", c0.features)
+	}
+}
@@ -4,7 +4,10 @@
 
 package protocol
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 type IndexMessage struct {
 	Folder  string // max:64
@@ -17,14 +20,22 @@ type FileInfo struct {
 	Name         string // max:8192
 	Flags        uint32
 	Modified     int64
+	ModifiedNs   int32 // nanoseconds, zero if not known
 	Version      int64
 	LocalVersion int64
+	RawBlockSize int32 // zero for the standard BlockSize; see BlockSize()
 	Blocks       []BlockInfo
+	Posix        []PosixMetadata // max:1; present only for folders syncing ownership or extended attributes
 }
 
 func (f FileInfo) String() string {
-	return fmt.Sprintf("File{Name:%q, Flags:0%o, Modified:%d, Version:%d, Size:%d, Blocks:%v}",
-		f.Name, f.Flags, f.Modified, f.Version, f.Size(), f.Blocks)
+	return fmt.Sprintf("File{Name:%q, Flags:0%o, Modified:%d.%09d, Version:%d, Size:%d, Blocks:%v}",
+		f.Name, f.Flags, f.Modified, f.ModifiedNs, f.Version, f.Size(), f.Blocks)
+}
+
+// ModTime returns the modification time of the file.
+func (f FileInfo) ModTime() time.Time {
+	return time.Unix(f.Modified, int64(f.ModifiedNs))
 }
 
 func (f FileInfo) Size() (bytes int64) {
@@ -37,6 +48,25 @@ func (f FileInfo) Size() (bytes int64) {
 	return
 }
 
+// BlockSize returns the size of the blocks the file is divided into, which
+// is larger than the standard BlockSize for large files. All blocks but the
+// last are of this size.
+func (f FileInfo) BlockSize() int {
+	if f.RawBlockSize == 0 {
+		return BlockSize
+	}
+	return int(f.RawBlockSize)
+}
+
+// RawBlockSize returns the value of the RawBlockSize field for files
+// divided into blocks of the given size.
+func RawBlockSize(blockSize int) int32 {
+	if blockSize == BlockSize {
+		return 0
+	}
+	return int32(blockSize)
+}
+
 func (f FileInfo) IsDeleted() bool {
 	return f.Flags&FlagDeleted != 0
 }
@@ -53,18 +83,49 @@ func (f FileInfo) IsSymlink() bool {
 	return f.Flags&FlagSymlink != 0
 }
 
+// IsSparse returns true if the file was sparse on the device that scanned
+// it, so that blocks of zeroes can be left as holes when writing it.
+func (f FileInfo) IsSparse() bool {
+	return f.Flags&FlagSparse != 0
+}
+
 func (f FileInfo) HasPermissionBits() bool {
 	return f.Flags&FlagNoPermBits == 0
 }
 
+// PosixMetadata returns the ownership and extended attributes of the file,
+// if they are synced.
+func (f FileInfo) PosixMetadata() (PosixMetadata, bool) {
+	if len(f.Posix) == 0 {
+		return PosixMetadata{}, false
+	}
+	return f.Posix[0], true
+}
+
+// PosixMetadata is the ownership and extended attributes of a file. Owners
+// are identified by name, with the numeric ID used when there is no name.
+type PosixMetadata struct {
+	UID    uint32
+	GID    uint32
+	User   string  // max:256
+	Group  string  // max:256
+	Xattrs []Xattr // max:1024
+}
+
+type Xattr struct {
+	Name  string // max:256
+	Value []byte // max:65536
+}
+
 type BlockInfo struct {
-	Offset int64 // noencode (cache only)
-	Size   int32
-	Hash   []byte // max:64
+	Offset   int64 // noencode (cache only)
+	Size     int32
+	Hash     []byte // max:64
+	WeakHash uint32 // rolling checksum for finding the block at any offset; 0 if unknown
 }
 
 func (b BlockInfo) String() string {
-	return fmt.Sprintf("Block{%d/%d/%x}", b.Offset, b.Size, b.Hash)
+	return fmt.Sprintf("Block{%d/%d/%x/%08x}", b.Offset, b.Size, b.Hash, b.WeakHash)
 }
 
 type RequestMessage struct {
@@ -148,6 +148,8 @@ FileInfo Structure:
 +                      Modified (64 bits)                       +
 |                                                               |
 +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                          Modified Ns                          |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 |                                                               |
 +                       Version (64 bits)                       +
 |                                                               |
@@ -156,21 +158,32 @@ FileInfo Structure:
 +                    Local Version (64 bits)                    +
 |                                                               |
 +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                        Raw Block Size                         |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 |                       Number of Blocks                        |
 +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 /                                                               /
 \               Zero or more BlockInfo Structures               \
 /                                                               /
 +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                        Number of Posix                        |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\             Zero or more PosixMetadata Structures             \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 
 
 struct FileInfo {
 	string Name<8192>;
 	unsigned int Flags;
 	hyper Modified;
+	int ModifiedNs;
 	hyper Version;
 	hyper LocalVersion;
+	int RawBlockSize;
 	BlockInfo Blocks<>;
+	PosixMetadata Posix<1>;
 }
 
 */
@@ -206,8 +219,10 @@ func (o FileInfo) encodeXDR(xw *xdr.Writer) (int, error) {
 	xw.WriteString(o.Name)
 	xw.WriteUint32(o.Flags)
 	xw.WriteUint64(uint64(o.Modified))
+	xw.WriteUint32(uint32(o.ModifiedNs))
 	xw.WriteUint64(uint64(o.Version))
 	xw.WriteUint64(uint64(o.LocalVersion))
+	xw.WriteUint32(uint32(o.RawBlockSize))
 	xw.WriteUint32(uint32(len(o.Blocks)))
 	for i := range o.Blocks {
 		_, err := o.Blocks[i].encodeXDR(xw)
@@ -215,6 +230,16 @@ func (o FileInfo) encodeXDR(xw *xdr.Writer) (int, error) {
 			return xw.Tot(), err
 		}
 	}
+	if l := len(o.Posix); l > 1 {
+		return xw.Tot(), xdr.ElementSizeExceeded("Posix", l, 1)
+	}
+	xw.WriteUint32(uint32(len(o.Posix)))
+	for i := range o.Posix {
+		_, err := o.Posix[i].encodeXDR(xw)
+		if err != nil {
+			return xw.Tot(), err
+		}
+	}
 	return xw.Tot(), xw.Error()
 }
 
@@ -233,13 +258,220 @@ func (o *FileInfo) decodeXDR(xr *xdr.Reader) error {
 	o.Name = xr.ReadStringMax(8192)
 	o.Flags = xr.ReadUint32()
 	o.Modified = int64(xr.ReadUint64())
+	o.ModifiedNs = int32(xr.ReadUint32())
 	o.Version = int64(xr.ReadUint64())
 	o.LocalVersion = int64(xr.ReadUint64())
+	o.RawBlockSize = int32(xr.ReadUint32())
 	_BlocksSize := int(xr.ReadUint32())
 	o.Blocks = make([]BlockInfo, _BlocksSize)
 	for i := range o.Blocks {
 		(&o.Blocks[i]).decodeXDR(xr)
 	}
+	_PosixSize := int(xr.ReadUint32())
+	if _PosixSize > 1 {
+		return xdr.ElementSizeExceeded("Posix", _PosixSize, 1)
+	}
+	o.Posix = make([]PosixMetadata, _PosixSize)
+	for i := range o.Posix {
+		(&o.Posix[i]).decodeXDR(xr)
+	}
+	return xr.Error()
+}
+
+/*
+
+PosixMetadata Structure:
+
+ 0                   1                   2                   3
+ 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                              UID                              |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                              GID                              |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                        Length of User                         |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\                    User (variable length)                     \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                        Length of Group                        |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\                    Group (variable length)                    \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                       Number of Xattrs                        |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\                 Zero or more Xattr Structures                 \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+
+struct PosixMetadata {
+	unsigned int UID;
+	unsigned int GID;
+	string User<256>;
+	string Group<256>;
+	Xattr Xattrs<1024>;
+}
+
+*/
+
+func (o PosixMetadata) EncodeXDR(w io.Writer) (int, error) {
+	var xw = xdr.NewWriter(w)
+	return o.encodeXDR(xw)
+}
+
+func (o PosixMetadata) MarshalXDR() ([]byte, error) {
+	return o.AppendXDR(make([]byte, 0, 128))
+}
+
+func (o PosixMetadata) MustMarshalXDR() []byte {
+	bs, err := o.MarshalXDR()
+	if err != nil {
+		panic(err)
+	}
+	return bs
+}
+
+func (o PosixMetadata) AppendXDR(bs []byte) ([]byte, error) {
+	var aw = xdr.AppendWriter(bs)
+	var xw = xdr.NewWriter(&aw)
+	_, err := o.encodeXDR(xw)
+	return []byte(aw), err
+}
+
+func (o PosixMetadata) encodeXDR(xw *xdr.Writer) (int, error) {
+	xw.WriteUint32(o.UID)
+	xw.WriteUint32(o.GID)
+	if l := len(o.User); l > 256 {
+		return xw.Tot(), xdr.ElementSizeExceeded("User", l, 256)
+	}
+	xw.WriteString(o.User)
+	if l := len(o.Group); l > 256 {
+		return xw.Tot(), xdr.ElementSizeExceeded("Group", l, 256)
+	}
+	xw.WriteString(o.Group)
+	if l := len(o.Xattrs); l > 1024 {
+		return xw.Tot(), xdr.ElementSizeExceeded("Xattrs", l, 1024)
+	}
+	xw.WriteUint32(uint32(len(o.Xattrs)))
+	for i := range o.Xattrs {
+		_, err := o.Xattrs[i].encodeXDR(xw)
+		if err != nil {
+			return xw.Tot(), err
+		}
+	}
+	return xw.Tot(), xw.Error()
+}
+
+func (o *PosixMetadata) DecodeXDR(r io.Reader) error {
+	xr := xdr.NewReader(r)
+	return o.decodeXDR(xr)
+}
+
+func (o *PosixMetadata) UnmarshalXDR(bs []byte) error {
+	var br = bytes.NewReader(bs)
+	var xr = xdr.NewReader(br)
+	return o.decodeXDR(xr)
+}
+
+func (o *PosixMetadata) decodeXDR(xr *xdr.Reader) error {
+	o.UID = xr.ReadUint32()
+	o.GID = xr.ReadUint32()
+	o.User = xr.ReadStringMax(256)
+	o.Group = xr.ReadStringMax(256)
+	_XattrsSize := int(xr.ReadUint32())
+	if _XattrsSize > 1024 {
+		return xdr.ElementSizeExceeded("Xattrs", _XattrsSize, 1024)
+	}
+	o.Xattrs = make([]Xattr, _XattrsSize)
+	for i := range o.Xattrs {
+		(&o.Xattrs[i]).decodeXDR(xr)
+	}
+	return xr.Error()
+}
+
+/*
+
+Xattr Structure:
+
+ 0                   1                   2                   3
+ 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                        Length of Name                         |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\                    Name (variable length)                     \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                        Length of Value                        |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\                    Value (variable length)                    \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+
+struct Xattr {
+	string Name<256>;
+	opaque Value<65536>;
+}
+
+*/
+
+func (o Xattr) EncodeXDR(w io.Writer) (int, error) {
+	var xw = xdr.NewWriter(w)
+	return o.encodeXDR(xw)
+}
+
+func (o Xattr) MarshalXDR() ([]byte, error) {
+	return o.AppendXDR(make([]byte, 0, 128))
+}
+
+func (o Xattr) MustMarshalXDR() []byte {
+	bs, err := o.MarshalXDR()
+	if err != nil {
+		panic(err)
+	}
+	return bs
+}
+
+func (o Xattr) AppendXDR(bs []byte) ([]byte, error) {
+	var aw = xdr.AppendWriter(bs)
+	var xw = xdr.NewWriter(&aw)
+	_, err := o.encodeXDR(xw)
+	return []byte(aw), err
+}
+
+func (o Xattr) encodeXDR(xw *xdr.Writer) (int, error) {
+	if l := len(o.Name); l > 256 {
+		return xw.Tot(), xdr.ElementSizeExceeded("Name", l, 256)
+	}
+	xw.WriteString(o.Name)
+	if l := len(o.Value); l > 65536 {
+		return xw.Tot(), xdr.ElementSizeExceeded("Value", l, 65536)
+	}
+	xw.WriteBytes(o.Value)
+	return xw.Tot(), xw.Error()
+}
+
+func (o *Xattr) DecodeXDR(r io.Reader) error {
+	xr := xdr.NewReader(r)
+	return o.decodeXDR(xr)
+}
+
+func (o *Xattr) UnmarshalXDR(bs []byte) error {
+	var br = bytes.NewReader(bs)
+	var xr = xdr.NewReader(br)
+	return o.decodeXDR(xr)
+}
+
+func (o *Xattr) decodeXDR(xr *xdr.Reader) error {
+	o.Name = xr.ReadStringMax(256)
+	o.Value = xr.ReadBytesMax(65536)
 	return xr.Error()
 }
 
@@ -258,11 +490,14 @@ BlockInfo Structure:
 \                    Hash (variable length)                     \
 /                                                               /
 +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                           Weak Hash                           |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 
 
 struct BlockInfo {
 	int Size;
 	opaque Hash<64>;
+	unsigned int WeakHash;
 }
 
 */
@@ -297,6 +532,7 @@ func (o BlockInfo) encodeXDR(xw *xdr.Writer) (int, error) {
 		return xw.Tot(), xdr.ElementSizeExceeded("Hash", l, 64)
 	}
 	xw.WriteBytes(o.Hash)
+	xw.WriteUint32(o.WeakHash)
 	return xw.Tot(), xw.Error()
 }
 
@@ -314,6 +550,7 @@ func (o *BlockInfo) UnmarshalXDR(bs []byte) error {
 func (o *BlockInfo) decodeXDR(xr *xdr.Reader) error {
 	o.Size = int32(xr.ReadUint32())
 	o.Hash = xr.ReadBytesMax(64)
+	o.WeakHash = xr.ReadUint32()
 	return xr.Error()
 }
 
@@ -6,7 +6,11 @@ package protocol
 
 // Darwin uses NFD normalization
 
-import "golang.org/x/text/unicode/norm"
+import (
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
 
 type nativeModel struct {
 	next Model
@@ -38,3 +42,7 @@ func (m nativeModel) ClusterConfig(deviceID DeviceID, config ClusterConfigMessag
 func (m nativeModel) Close(deviceID DeviceID, err error) {
 	m.next.Close(deviceID, err)
 }
+
+func (m nativeModel) Latency(deviceID DeviceID, rtt time.Duration) {
+	m.next.Latency(deviceID, rtt)
+}
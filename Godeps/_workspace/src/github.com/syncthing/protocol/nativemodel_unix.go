@@ -4,6 +4,8 @@
 
 package protocol
 
+import "time"
+
 // Normal Unixes uses NFC and slashes, which is the wire format.
 
 type nativeModel struct {
@@ -29,3 +31,7 @@ func (m nativeModel) ClusterConfig(deviceID DeviceID, config ClusterConfigMessag
 func (m nativeModel) Close(deviceID DeviceID, err error) {
 	m.next.Close(deviceID, err)
 }
+
+func (m nativeModel) Latency(deviceID DeviceID, rtt time.Duration) {
+	m.next.Latency(deviceID, rtt)
+}
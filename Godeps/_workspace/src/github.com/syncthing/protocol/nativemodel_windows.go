@@ -10,6 +10,7 @@ package protocol
 import (
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 var disallowedCharacters = string([]rune{
@@ -68,3 +69,7 @@ func (m nativeModel) ClusterConfig(deviceID DeviceID, config ClusterConfigMessag
 func (m nativeModel) Close(deviceID DeviceID, err error) {
 	m.next.Close(deviceID, err)
 }
+
+func (m nativeModel) Latency(deviceID DeviceID, rtt time.Duration) {
+	m.next.Latency(deviceID, rtt)
+}
@@ -15,9 +15,34 @@ import (
 )
 
 const (
+	// BlockSize is the smallest block size, and the one used for all but
+	// large files.
 	BlockSize = 128 * 1024
+	// MaxBlockSize is the largest block size, used for the largest files.
+	MaxBlockSize = 16 * 1024 * 1024
 )
 
+// desiredBlocks is the number of blocks per file that BlockSizeFor aims
+// at; larger blocks mean smaller indexes for large files.
+const desiredBlocks = 2000
+
+// BlockSizeFor returns the block size to use for a file of the given size:
+// the smallest power of two from BlockSize to MaxBlockSize that divides the
+// file into at most desiredBlocks blocks, if any.
+func BlockSizeFor(size int64) int {
+	bs := BlockSize
+	for bs < MaxBlockSize && size > int64(bs)*desiredBlocks {
+		bs *= 2
+	}
+	return bs
+}
+
+// ValidBlockSize returns true if the size is one that BlockSizeFor may
+// return.
+func ValidBlockSize(size int) bool {
+	return size >= BlockSize && size <= MaxBlockSize && size&(size-1) == 0
+}
+
 const (
 	messageTypeClusterConfig = 0
 	messageTypeIndex         = 1
@@ -42,6 +67,7 @@ const (
 	FlagNoPermBits                  = 1 << 15
 	FlagSymlink                     = 1 << 16
 	FlagSymlinkMissingTarget        = 1 << 17
+	FlagSparse                      = 1 << 18
 
 	SymlinkTypeMask = FlagDirectory | FlagSymlinkMissingTarget
 )
@@ -73,6 +99,8 @@ type Model interface {
 	ClusterConfig(deviceID DeviceID, config ClusterConfigMessage)
 	// The peer device closed the connection
 	Close(deviceID DeviceID, err error)
+	// The round trip time to the peer device was measured
+	Latency(deviceID DeviceID, rtt time.Duration)
 }
 
 type Connection interface {
@@ -83,6 +111,27 @@ type Connection interface {
 	Request(folder string, name string, offset int64, size int) ([]byte, error)
 	ClusterConfig(config ClusterConfigMessage)
 	Statistics() Statistics
+	Closed() bool
+	Close(reason string, code int32)
+}
+
+// Codes sent in a Close message, telling the peer why the connection is
+// being closed.
+const (
+	CloseCodeGeneric  int32 = 0 // no particular reason given
+	CloseCodeShutdown int32 = 1 // the device is shutting down
+	CloseCodeRestart  int32 = 2 // the device is restarting and expected back shortly
+)
+
+// A CloseError is passed to Model.Close when the peer closed the connection
+// with a Close message.
+type CloseError struct {
+	Reason string
+	Code   int32
+}
+
+func (e CloseError) Error() string {
+	return "closed by peer: " + e.Reason
 }
 
 type rawConnection struct {
@@ -99,6 +148,9 @@ type rawConnection struct {
 
 	idxMut sync.Mutex // ensures serialization of Index calls
 
+	ccRcvd   chan struct{} // closed when the peer's cluster config has been received
+	features uint32        // the index features of both us and the peer; set before ccRcvd is closed
+
 	nextID chan int
 	outbox chan hdrMsg
 	closed chan struct{}
@@ -108,6 +160,10 @@ type rawConnection struct {
 
 	rdbuf0 []byte // used & reused by readMessage
 	rdbuf1 []byte // used & reused by readMessage
+
+	latency    time.Duration // smoothed round trip time
+	latencyVar time.Duration // smoothed round trip time variation
+	latencyMut sync.Mutex
 }
 
 type asyncResult struct {
@@ -116,8 +172,9 @@ type asyncResult struct {
 }
 
 type hdrMsg struct {
-	hdr header
-	msg encodable
+	hdr  header
+	msg  encodable
+	done chan struct{} // closed when the message has been written, if not nil
 }
 
 type encodable interface {
@@ -130,7 +187,8 @@ type isEofer interface {
 
 const (
 	pingTimeout  = 30 * time.Second
-	pingIdleTime = 60 * time.Second
+	pingInterval = 30 * time.Second
+	closeTimeout = 5 * time.Second
 )
 
 func NewConnection(deviceID DeviceID, reader io.Reader, writer io.Writer, receiver Model, name string, compress bool) Connection {
@@ -151,6 +209,7 @@ func NewConnection(deviceID DeviceID, reader io.Reader, writer io.Writer, receiv
 		outbox:               make(chan hdrMsg),
 		nextID:               make(chan int),
 		closed:               make(chan struct{}),
+		ccRcvd:               make(chan struct{}),
 		compressionThreshold: compThres,
 	}
 
@@ -177,11 +236,17 @@ func (c *rawConnection) Index(folder string, idx []FileInfo) error {
 		return ErrClosed
 	default:
 	}
+	// The encoding depends on the features the peer announces.
+	select {
+	case <-c.ccRcvd:
+	case <-c.closed:
+		return ErrClosed
+	}
 	c.idxMut.Lock()
-	c.send(-1, messageTypeIndex, IndexMessage{
+	c.send(-1, messageTypeIndex, indexMessage{IndexMessage{
 		Folder: folder,
 		Files:  idx,
-	})
+	}, c.features})
 	c.idxMut.Unlock()
 	return nil
 }
@@ -193,11 +258,17 @@ func (c *rawConnection) IndexUpdate(folder string, idx []FileInfo) error {
 		return ErrClosed
 	default:
 	}
+	// The encoding depends on the features the peer announces.
+	select {
+	case <-c.ccRcvd:
+	case <-c.closed:
+		return ErrClosed
+	}
 	c.idxMut.Lock()
-	c.send(-1, messageTypeIndexUpdate, IndexMessage{
+	c.send(-1, messageTypeIndexUpdate, indexMessage{IndexMessage{
 		Folder: folder,
 		Files:  idx,
-	})
+	}, c.features})
 	c.idxMut.Unlock()
 	return nil
 }
@@ -238,6 +309,7 @@ func (c *rawConnection) Request(folder string, name string, offset int64, size i
 
 // ClusterConfig send the cluster configuration message to the peer and returns any error
 func (c *rawConnection) ClusterConfig(config ClusterConfigMessage) {
+	config.Options = append(config.Options[:len(config.Options):len(config.Options)], featuresOption(supportedFeatures))
 	c.send(-1, messageTypeClusterConfig, config)
 }
 
@@ -263,6 +335,34 @@ func (c *rawConnection) ping() bool {
 	return ok && res.err == nil
 }
 
+// Close sends a Close message with the given reason and code to the peer and
+// then closes the connection. It waits up to closeTimeout for the message to
+// be written.
+func (c *rawConnection) Close(reason string, code int32) {
+	done := make(chan struct{})
+	if c.sendDone(-1, messageTypeClose, CloseMessage{reason, code}, done) {
+		select {
+		case <-done:
+		case <-c.closed:
+		case <-time.After(closeTimeout):
+			if debug {
+				l.Debugln(c.id, "timeout writing close message")
+			}
+		}
+	}
+	c.close(fmt.Errorf("closed: %s", reason))
+}
+
+// Closed returns true if the connection has been closed, for whatever reason.
+func (c *rawConnection) Closed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
 func (c *rawConnection) readerLoop() (err error) {
 	defer func() {
 		c.close(err)
@@ -307,14 +407,17 @@ func (c *rawConnection) readerLoop() (err error) {
 				// We don't currently support or expect any flags.
 				return fmt.Errorf("protocol error: unknown flags 0x%x in Request message", msg.Flags)
 			}
-			if c.state < stateIdxRcvd {
+			// Requests and responses are valid once the cluster config has
+			// been received. Additional connections to an already connected
+			// device carry no index data, so we don't wait for one.
+			if c.state < stateCCRcvd {
 				return fmt.Errorf("protocol error: request message in state %d", c.state)
 			}
 			// Requests are handled asynchronously
 			go c.handleRequest(hdr.msgID, msg)
 
 		case ResponseMessage:
-			if c.state < stateIdxRcvd {
+			if c.state < stateCCRcvd {
 				return fmt.Errorf("protocol error: response message in state %d", c.state)
 			}
 			c.handleResponse(hdr.msgID, msg)
@@ -329,11 +432,13 @@ func (c *rawConnection) readerLoop() (err error) {
 			if c.state != stateInitial {
 				return fmt.Errorf("protocol error: cluster config message in state %d", c.state)
 			}
+			c.features = supportedFeatures & parseFeatures(msg.GetOption(featuresOptionKey))
+			close(c.ccRcvd)
 			go c.receiver.ClusterConfig(c.id, msg)
 			c.state = stateCCRcvd
 
 		case CloseMessage:
-			return errors.New(msg.Reason)
+			return CloseError{msg.Reason, msg.Code}
 
 		default:
 			return fmt.Errorf("protocol error: %s: unknown message type %#x", c.id, hdr.msgType)
@@ -408,12 +513,14 @@ func (c *rawConnection) readMessage() (hdr header, msg encodable, err error) {
 
 	switch hdr.msgType {
 	case messageTypeIndex, messageTypeIndexUpdate:
-		var idx IndexMessage
+		// Indexes are only valid after the cluster config, so the
+		// features are known.
+		idx := indexMessage{features: c.features}
 		err = idx.UnmarshalXDR(msgBuf)
 		if xdrErr, ok := err.(isEofer); ok && xdrErr.IsEOF() {
 			err = nil
 		}
-		msg = idx
+		msg = idx.IndexMessage
 
 	case messageTypeRequest:
 		var req RequestMessage
@@ -529,6 +636,12 @@ func (c *rawConnection) handlePong(msgID int) {
 }
 
 func (c *rawConnection) send(msgID int, msgType int, msg encodable) bool {
+	return c.sendDone(msgID, msgType, msg, nil)
+}
+
+// sendDone queues the message like send, closing done once it has been
+// written.
+func (c *rawConnection) sendDone(msgID int, msgType int, msg encodable, done chan struct{}) bool {
 	if msgID < 0 {
 		select {
 		case id := <-c.nextID:
@@ -545,7 +658,7 @@ func (c *rawConnection) send(msgID int, msgType int, msg encodable) bool {
 	}
 
 	select {
-	case c.outbox <- hdrMsg{hdr, msg}:
+	case c.outbox <- hdrMsg{hdr, msg, done}:
 		return true
 	case <-c.closed:
 		return false
@@ -625,6 +738,9 @@ func (c *rawConnection) writerLoop() {
 				c.close(err)
 				return
 			}
+			if hm.done != nil {
+				close(hm.done)
+			}
 		case <-c.closed:
 			return
 		}
@@ -660,39 +776,51 @@ func (c *rawConnection) idGenerator() {
 	}
 }
 
+// pingerLoop sends a ping every pingInterval, both to keep the connection
+// alive and to measure the latency to the peer.
 func (c *rawConnection) pingerLoop() {
-	var rc = make(chan bool, 1)
-	ticker := time.Tick(pingIdleTime / 2)
+	type pingResult struct {
+		ok  bool
+		rtt time.Duration
+	}
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
 	for {
 		select {
-		case <-ticker:
-			if d := time.Since(c.cr.Last()); d < pingIdleTime {
-				if debug {
-					l.Debugln(c.id, "ping skipped after rd", d)
-				}
-				continue
-			}
-			if d := time.Since(c.cw.Last()); d < pingIdleTime {
-				if debug {
-					l.Debugln(c.id, "ping skipped after wr", d)
-				}
-				continue
-			}
+		case <-ticker.C:
+			// Each ping gets its own result channel, so that a pong arriving
+			// after we've given up on it doesn't get mixed up with the next.
+			rc := make(chan pingResult, 1)
 			go func() {
 				if debug {
 					l.Debugln(c.id, "ping ->")
 				}
-				rc <- c.ping()
+				t0 := time.Now()
+				ok := c.ping()
+				rc <- pingResult{ok, time.Since(t0)}
 			}()
 			select {
-			case ok := <-rc:
+			case res := <-rc:
 				if debug {
-					l.Debugln(c.id, "<- pong")
+					l.Debugln(c.id, "<- pong", res.rtt)
 				}
-				if !ok {
+				if !res.ok {
 					c.close(fmt.Errorf("ping failure"))
+					continue
 				}
+				c.updateLatency(res.rtt)
+				c.receiver.Latency(c.id, res.rtt)
 			case <-time.After(pingTimeout):
+				// On a busy connection the pong may be queued behind a lot of
+				// other data. That's not a reason to give up on it, as long
+				// as data is still arriving.
+				if d := time.Since(c.cr.Last()); d < pingTimeout {
+					if debug {
+						l.Debugln(c.id, "ping timeout ignored after rd", d)
+					}
+					continue
+				}
 				c.close(fmt.Errorf("ping timeout"))
 			case <-c.closed:
 				return
@@ -704,16 +832,42 @@ func (c *rawConnection) pingerLoop() {
 	}
 }
 
+// updateLatency adds a round trip time measurement to the smoothed latency
+// and variation, using the same weights as TCP (RFC 6298).
+func (c *rawConnection) updateLatency(rtt time.Duration) {
+	c.latencyMut.Lock()
+	if c.latency == 0 {
+		c.latency = rtt
+		c.latencyVar = rtt / 2
+	} else {
+		diff := c.latency - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		c.latencyVar = (3*c.latencyVar + diff) / 4
+		c.latency = (7*c.latency + rtt) / 8
+	}
+	c.latencyMut.Unlock()
+}
+
 type Statistics struct {
 	At            time.Time
 	InBytesTotal  int64
 	OutBytesTotal int64
+	Latency       time.Duration // smoothed ping round trip time, zero if not yet measured
+	LatencyJitter time.Duration // smoothed variation of the round trip time
 }
 
 func (c *rawConnection) Statistics() Statistics {
+	c.latencyMut.Lock()
+	latency, jitter := c.latency, c.latencyVar
+	c.latencyMut.Unlock()
+
 	return Statistics{
 		At:            time.Now(),
 		InBytesTotal:  c.cr.Tot(),
 		OutBytesTotal: c.cw.Tot(),
+		Latency:       latency,
+		LatencyJitter: jitter,
 	}
 }
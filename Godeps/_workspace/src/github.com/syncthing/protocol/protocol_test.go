@@ -15,6 +15,7 @@ import (
 	"strings"
 	"testing"
 	"testing/quick"
+	"time"
 
 	"github.com/calmh/xdr"
 )
@@ -78,6 +79,20 @@ func TestPing(t *testing.T) {
 	}
 }
 
+func TestUpdateLatency(t *testing.T) {
+	c := rawConnection{cr: &countingReader{}, cw: &countingWriter{}}
+
+	c.updateLatency(100 * time.Millisecond)
+	if s := c.Statistics(); s.Latency != 100*time.Millisecond || s.LatencyJitter != 50*time.Millisecond {
+		t.Errorf("unexpected initial latency %v, jitter %v", s.Latency, s.LatencyJitter)
+	}
+
+	c.updateLatency(20 * time.Millisecond)
+	if s := c.Statistics(); s.Latency != 90*time.Millisecond || s.LatencyJitter != 57500*time.Microsecond {
+		t.Errorf("unexpected latency %v, jitter %v", s.Latency, s.LatencyJitter)
+	}
+}
+
 func TestPingErr(t *testing.T) {
 	e := errors.New("something broke")
 
@@ -237,6 +252,37 @@ func TestClose(t *testing.T) {
 	}
 }
 
+func TestCloseMessage(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", true)
+	NewConnection(c1ID, br, aw, m1, "name", true)
+
+	c0.Close("shutting down", CloseCodeShutdown)
+
+	if !c0.Closed() {
+		t.Error("Connection should be closed")
+	}
+	if !m0.isClosed() {
+		t.Fatal("Local model should be notified of the close")
+	}
+	if !m1.isClosed() {
+		t.Fatal("Remote model should be notified of the close")
+	}
+
+	cerr, ok := m1.closeErr.(CloseError)
+	if !ok {
+		t.Fatalf("Unexpected close error %#v", m1.closeErr)
+	}
+	if cerr.Reason != "shutting down" || cerr.Code != CloseCodeShutdown {
+		t.Errorf("Unexpected close error %#v", cerr)
+	}
+}
+
 func TestElementSizeExceededNested(t *testing.T) {
 	m := ClusterConfigMessage{
 		Folders: []Folder{
@@ -380,3 +426,40 @@ func testMarshal(t *testing.T, prefix string, m1, m2 message) bool {
 	}
 	return ok
 }
+
+func TestBlockSizeFor(t *testing.T) {
+	cases := []struct {
+		size      int64
+		blockSize int
+	}{
+		{0, BlockSize},
+		{1, BlockSize},
+		{desiredBlocks * BlockSize, BlockSize},
+		{desiredBlocks*BlockSize + 1, 2 * BlockSize},
+		{200 << 30, MaxBlockSize},
+		{1 << 50, MaxBlockSize},
+	}
+
+	for _, tc := range cases {
+		if bs := BlockSizeFor(tc.size); bs != tc.blockSize {
+			t.Errorf("BlockSizeFor(%d) = %d, expected %d", tc.size, bs, tc.blockSize)
+		}
+		if !ValidBlockSize(tc.blockSize) {
+			t.Errorf("Block size %d is not valid", tc.blockSize)
+		}
+	}
+}
+
+func TestFileInfoBlockSize(t *testing.T) {
+	f := FileInfo{RawBlockSize: RawBlockSize(1 << 20), Blocks: []BlockInfo{{Size: 100}}}
+	if bs := f.BlockSize(); bs != 1<<20 {
+		t.Errorf("Block size %d, expected %d", bs, 1<<20)
+	}
+	f.RawBlockSize = RawBlockSize(BlockSize)
+	if f.RawBlockSize != 0 {
+		t.Errorf("Standard block size recorded as %d", f.RawBlockSize)
+	}
+	if bs := f.BlockSize(); bs != BlockSize {
+		t.Errorf("Block size %d, expected %d", bs, BlockSize)
+	}
+}
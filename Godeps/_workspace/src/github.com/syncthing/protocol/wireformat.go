@@ -54,3 +54,11 @@ func (c wireFormatConnection) ClusterConfig(config ClusterConfigMessage) {
 func (c wireFormatConnection) Statistics() Statistics {
 	return c.next.Statistics()
 }
+
+func (c wireFormatConnection) Closed() bool {
+	return c.next.Closed()
+}
+
+func (c wireFormatConnection) Close(reason string, code int32) {
+	c.next.Close(reason, code)
+}
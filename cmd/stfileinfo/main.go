@@ -75,7 +75,7 @@ func main() {
 
 		blockSize := int(fi.Size())
 		if *standardBlocks || blockSize < protocol.BlockSize {
-			blockSize = protocol.BlockSize
+			blockSize = protocol.BlockSizeFor(fi.Size())
 		}
 		bs, err := scanner.Blocks(fd, blockSize, fi.Size())
 		if err != nil {
@@ -0,0 +1,136 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/db"
+)
+
+// A difference between the files of two devices, as shown in JSON output.
+type difference struct {
+	Name    string
+	Reasons []string
+	Device  *file
+	Other   *file
+}
+
+// diff shows the files that the two devices disagree on, and why.
+func diff(fs *db.FileSet, device, other protocol.DeviceID) {
+	header("*** Differences for folder %q between device %q and %q", folder, device, other)
+
+	names := make(map[string]struct{})
+	collect := func(fi db.FileIntf) bool {
+		f := fi.(db.FileInfoTruncated)
+		names[f.Name] = struct{}{}
+		return true
+	}
+	fs.WithHaveTruncated(device, collect)
+	fs.WithHaveTruncated(other, collect)
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var n int
+	for _, name := range sorted {
+		a, aok := fs.Get(device, name)
+		b, bok := fs.Get(other, name)
+		if !(aok && show(name, a.Flags) || bok && show(name, b.Flags)) {
+			continue
+		}
+
+		reasons := differences(a, aok, b, bok)
+		if len(reasons) == 0 {
+			continue
+		}
+		n++
+
+		if jsonOut {
+			d := difference{Name: name, Reasons: reasons}
+			if aok {
+				d.Device = fileOf(truncate(a))
+			}
+			if bok {
+				d.Other = fileOf(truncate(b))
+			}
+			enc.Encode(d)
+		} else {
+			fmt.Printf("%s: %s\n", name, reasons[0])
+			for _, r := range reasons[1:] {
+				fmt.Printf("\t%s\n", r)
+			}
+		}
+	}
+	header("*** %d files differ", n)
+}
+
+// differences returns the ways in which the files differ, if any.
+func differences(a protocol.FileInfo, aok bool, b protocol.FileInfo, bok bool) []string {
+	switch {
+	case !aok:
+		return []string{"missing on device"}
+	case !bok:
+		return []string{"missing on other device"}
+	}
+
+	var reasons []string
+	if a.Version != b.Version {
+		reasons = append(reasons, fmt.Sprintf("version %d != %d", a.Version, b.Version))
+	}
+	if a.Flags != b.Flags {
+		reasons = append(reasons, fmt.Sprintf("flags 0%o != 0%o", a.Flags, b.Flags))
+	}
+	if a.Modified != b.Modified || a.ModifiedNs != b.ModifiedNs {
+		reasons = append(reasons, fmt.Sprintf("modified %d.%09d != %d.%09d", a.Modified, a.ModifiedNs, b.Modified, b.ModifiedNs))
+	}
+	if a.IsDeleted() || b.IsDeleted() {
+		return reasons
+	}
+	if len(a.Blocks) != len(b.Blocks) {
+		reasons = append(reasons, fmt.Sprintf("%d != %d blocks", len(a.Blocks), len(b.Blocks)))
+	} else {
+		var differ int
+		for i := range a.Blocks {
+			if !bytes.Equal(a.Blocks[i].Hash, b.Blocks[i].Hash) {
+				differ++
+			}
+		}
+		if differ > 0 {
+			reasons = append(reasons, fmt.Sprintf("%d of %d block hashes differ", differ, len(a.Blocks)))
+		}
+	}
+	return reasons
+}
+
+func truncate(f protocol.FileInfo) db.FileInfoTruncated {
+	return db.FileInfoTruncated{
+		Name:         f.Name,
+		Flags:        f.Flags,
+		Modified:     f.Modified,
+		ModifiedNs:   f.ModifiedNs,
+		Version:      f.Version,
+		LocalVersion: f.LocalVersion,
+		RawBlockSize: f.RawBlockSize,
+		NumBlocks:    int32(len(f.Blocks)),
+	}
+}
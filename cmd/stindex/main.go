@@ -16,49 +16,207 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/db"
-	"github.com/syndtr/goleveldb/leveldb"
+)
+
+var (
+	folder  string
+	prefix  string
+	jsonOut bool
+	filter  flagFilter
+	enc     = json.NewEncoder(os.Stdout)
 )
 
 func main() {
 	log.SetFlags(0)
 	log.SetOutput(os.Stdout)
 
-	folder := flag.String("folder", "default", "Folder ID")
-	device := flag.String("device", "", "Device ID (blank for global)")
+	mode := flag.String("mode", "dump", "What to show: dump, need or diff")
+	device := flag.String("device", "", "Device ID (blank for global in dump mode, the local device otherwise)")
+	other := flag.String("other", "", "Device ID to compare to in diff mode (blank for the local device)")
+	flags := flag.String("flags", "", "Show only files with these flags, a comma separated list of deleted, invalid, directory, symlink and noperms, each optionally negated with !")
+	flag.StringVar(&folder, "folder", "default", "Folder ID")
+	flag.StringVar(&prefix, "prefix", "", "Show only files with names starting with this prefix")
+	flag.BoolVar(&jsonOut, "json", false, "Print one JSON object per file instead of text")
 	flag.Parse()
 
-	ldb, err := leveldb.OpenFile(flag.Arg(0), nil)
+	if flag.NArg() != 1 {
+		log.Printf("Usage: %s [options] <index directory>", os.Args[0])
+		os.Exit(64)
+	}
+
+	var err error
+	filter, err = parseFlagFilter(*flags)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The database is only looked at, never migrated or repaired, as it
+	// may belong to a running or differently versioned syncthing.
+	ldb, err := db.OpenReadOnly(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fs, err := db.NewReadOnlyFileSet(folder, ldb)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	fs := db.NewFileSet(*folder, ldb)
+	switch *mode {
+	case "dump":
+		if *device == "" {
+			dumpGlobal(fs)
+		} else {
+			dumpHave(fs, parseDevice(*device))
+		}
+	case "need":
+		need(fs, parseDevice(*device))
+	case "diff":
+		diff(fs, parseDevice(*device), parseDevice(*other))
+	default:
+		log.Fatalf("Unknown mode %q", *mode)
+	}
+}
 
-	if *device == "" {
-		log.Printf("*** Global index for folder %q", *folder)
-		fs.WithGlobalTruncated(func(fi db.FileIntf) bool {
-			f := fi.(db.FileInfoTruncated)
+// parseDevice returns the device with the given ID, or the local device if
+// the ID is blank.
+func parseDevice(s string) protocol.DeviceID {
+	if s == "" {
+		return protocol.LocalDeviceID
+	}
+	id, err := protocol.DeviceIDFromString(s)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return id
+}
+
+func dumpGlobal(fs *db.FileSet) {
+	header("*** Global index for folder %q", folder)
+	fs.WithGlobalTruncated(func(fi db.FileIntf) bool {
+		f := fi.(db.FileInfoTruncated)
+		if !show(f.Name, f.Flags) {
+			return true
+		}
+		if jsonOut {
+			out := fileOf(f)
+			for _, dev := range fs.Availability(f.Name) {
+				out.Availability = append(out.Availability, dev.String())
+			}
+			enc.Encode(out)
+		} else {
 			fmt.Println(f)
 			fmt.Println("\t", fs.Availability(f.Name))
-			return true
-		})
+		}
+		return true
+	})
+}
+
+func dumpHave(fs *db.FileSet, device protocol.DeviceID) {
+	header("*** Have index for folder %q device %q", folder, device)
+	fs.WithHaveTruncated(device, printFile)
+}
+
+func need(fs *db.FileSet, device protocol.DeviceID) {
+	header("*** Need index for folder %q device %q", folder, device)
+	fs.WithNeedTruncated(device, printFile)
+	c := fs.NeedCounts(device)
+	header("*** Needs %d files, %d directories, %d deletes, %d bytes in total", c.Files, c.Directories, c.Deleted, c.Bytes)
+}
+
+func printFile(fi db.FileIntf) bool {
+	f := fi.(db.FileInfoTruncated)
+	if !show(f.Name, f.Flags) {
+		return true
+	}
+	if jsonOut {
+		enc.Encode(fileOf(f))
 	} else {
-		n, err := protocol.DeviceIDFromString(*device)
-		if err != nil {
-			log.Fatal(err)
+		fmt.Println(f)
+	}
+	return true
+}
+
+// header prints informational lines, which are left out of JSON output.
+func header(format string, args ...interface{}) {
+	if !jsonOut {
+		log.Printf(format, args...)
+	}
+}
+
+func show(name string, flags uint32) bool {
+	return strings.HasPrefix(name, prefix) && filter.match(flags)
+}
+
+// A file as shown in JSON output, with the same fields as in the REST
+// interface.
+type file struct {
+	Name         string
+	Flags        uint32
+	Modified     int64
+	ModifiedNs   int32
+	Version      int64
+	LocalVersion int64
+	NumBlocks    int32
+	Size         int64
+	Availability []string `json:",omitempty"`
+}
+
+func fileOf(f db.FileInfoTruncated) *file {
+	return &file{
+		Name:         f.Name,
+		Flags:        f.Flags,
+		Modified:     f.Modified,
+		ModifiedNs:   f.ModifiedNs,
+		Version:      f.Version,
+		LocalVersion: f.LocalVersion,
+		NumBlocks:    f.NumBlocks,
+		Size:         f.Size(),
+	}
+}
+
+var flagNames = map[string]uint32{
+	"deleted":   protocol.FlagDeleted,
+	"invalid":   protocol.FlagInvalid,
+	"directory": protocol.FlagDirectory,
+	"symlink":   protocol.FlagSymlink,
+	"noperms":   protocol.FlagNoPermBits,
+}
+
+// A flagFilter matches files with all of the set flags and none of the
+// unset ones.
+type flagFilter struct {
+	set, unset uint32
+}
+
+func parseFlagFilter(s string) (flagFilter, error) {
+	var f flagFilter
+	if s == "" {
+		return f, nil
+	}
+	for _, name := range strings.Split(s, ",") {
+		negated := strings.HasPrefix(name, "!")
+		flag, ok := flagNames[strings.TrimPrefix(name, "!")]
+		if !ok {
+			return f, fmt.Errorf("unknown flag %q", name)
+		}
+		if negated {
+			f.unset |= flag
+		} else {
+			f.set |= flag
 		}
-		log.Printf("*** Have index for folder %q device %q", *folder, n)
-		fs.WithHaveTruncated(n, func(fi db.FileIntf) bool {
-			f := fi.(db.FileInfoTruncated)
-			fmt.Println(f)
-			return true
-		})
 	}
+	return f, nil
+}
+
+func (f flagFilter) match(flags uint32) bool {
+	return flags&f.set == f.set && flags&f.unset == 0
 }
@@ -132,6 +132,8 @@ func startGUI(cfg config.GUIConfiguration, assetDir string, m *model.Model) erro
 	getRestMux.HandleFunc("/rest/version", restGetVersion)
 	getRestMux.HandleFunc("/rest/stats/device", withModel(m, restGetDeviceStats))
 	getRestMux.HandleFunc("/rest/stats/folder", withModel(m, restGetFolderStats))
+	getRestMux.HandleFunc("/rest/folder/history", withModel(m, restGetFolderHistory))
+	getRestMux.HandleFunc("/rest/folder/errors", withModel(m, restGetFolderErrors))
 
 	// Debug endpoints, not for general use
 	getRestMux.HandleFunc("/rest/debug/peerCompletion", withModel(m, restGetPeerCompletion))
@@ -301,6 +303,9 @@ func restGetModel(m *model.Model, w http.ResponseWriter, r *http.Request) {
 
 	res["state"], res["stateChanged"] = m.State(folder)
 	res["version"] = m.CurrentLocalVersion(folder) + m.RemoteLocalVersion(folder)
+	if progress := m.ScanProgress(folder); progress != nil {
+		res["scanProgress"] = progress
+	}
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(res)
@@ -346,6 +351,44 @@ func restGetFolderStats(m *model.Model, w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(res)
 }
 
+// restGetFolderHistory returns the recorded changes to the folder, or to one
+// file in it. The device of a change pulled from another device is a best
+// guess, flagged by DeviceGuessed.
+func restGetFolderHistory(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var folder = qs.Get("folder")
+	var file = qs.Get("file")
+
+	res, err := m.FolderHistory(folder, file)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	// Changes made by scanning are recorded as coming from the local device.
+	for i := range res {
+		if res[i].Device == protocol.LocalDeviceID {
+			res[i].Device = myID
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+func restGetFolderErrors(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var folder = qs.Get("folder")
+
+	res, err := m.FolderErrors(folder)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
 func restGetConfig(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(cfg.Raw())
@@ -439,7 +482,7 @@ func restGetSystem(w http.ResponseWriter, r *http.Request) {
 	res["alloc"] = m.Alloc
 	res["sys"] = m.Sys - m.HeapReleased
 	res["tilde"] = tilde
-	if cfg.Options().GlobalAnnEnabled && discoverer != nil {
+	if globalDiscoveryEnabled(cfg.Options()) && discoverer != nil {
 		res["extAnnounceOK"] = discoverer.ExtAnnounceOK()
 	}
 	cpuUsageLock.RLock()
@@ -791,10 +834,11 @@ func toNeedSlice(fs []db.FileInfoTruncated) []map[string]interface{} {
 			"Name":         file.Name,
 			"Flags":        file.Flags,
 			"Modified":     file.Modified,
+			"ModifiedNs":   file.ModifiedNs,
 			"Version":      file.Version,
 			"LocalVersion": file.LocalVersion,
 			"NumBlocks":    file.NumBlocks,
-			"Size":         db.BlocksToSize(int(file.NumBlocks)),
+			"Size":         file.Size(),
 		}
 	}
 	return output
@@ -40,6 +40,7 @@ import (
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/dialer"
 	"github.com/syncthing/syncthing/internal/discover"
 	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/model"
@@ -72,6 +73,9 @@ const (
 	exitUpgrading          = 4
 )
 
+// How long to wait for scanners and pullers to stop when shutting down.
+const shutdownTimeout = 10 * time.Second
+
 var l = logger.DefaultLogger
 
 func init() {
@@ -148,6 +152,7 @@ are mostly useful for developers. Use with care.
                facility strings are:
 
                - "beacon"   (the beacon package)
+               - "dialer"   (the dialer package)
                - "discover" (the discover package)
                - "events"   (the events package)
                - "files"    (the files package)
@@ -179,6 +184,10 @@ are mostly useful for developers. Use with care.
 // Command line and environment options
 var (
 	reset             bool
+	verifyDB          bool
+	repairDB          bool
+	exportIndex       string
+	importIndex       string
 	showVersion       bool
 	doUpgrade         bool
 	doUpgradeCheck    bool
@@ -225,6 +234,10 @@ func main() {
 	flag.BoolVar(&noBrowser, "no-browser", false, "Do not start browser")
 	flag.BoolVar(&noRestart, "no-restart", noRestart, "Do not restart; just exit")
 	flag.BoolVar(&reset, "reset", false, "Prepare to resync from cluster")
+	flag.BoolVar(&verifyDB, "verify-db", false, "Check the database for inconsistencies, then exit")
+	flag.BoolVar(&repairDB, "repair-db", false, "Check the database and repair any inconsistencies, then exit")
+	flag.StringVar(&exportIndex, "export-index", "", "Export the local index of all folders to the given file, then exit")
+	flag.StringVar(&importIndex, "import-index", "", "Import the files that are unchanged on disk from an exported index, then exit")
 	flag.BoolVar(&doUpgrade, "upgrade", false, "Perform upgrade")
 	flag.BoolVar(&doUpgradeCheck, "upgrade-check", false, "Check for available upgrade")
 	flag.BoolVar(&showVersion, "version", false, "Show version")
@@ -361,6 +374,21 @@ func main() {
 		return
 	}
 
+	if verifyDB || repairDB {
+		verifyDatabase(repairDB)
+		return
+	}
+
+	if exportIndex != "" {
+		exportIndexFile(exportIndex)
+		return
+	}
+
+	if importIndex != "" {
+		importIndexFile(importIndex)
+		return
+	}
+
 	if noRestart {
 		syncthingMain()
 	} else {
@@ -482,6 +510,23 @@ func syncthingMain() {
 		symlinks.Supported = false
 	}
 
+	// Outgoing connections and HTTP requests go through the proxy, if one
+	// is configured.
+
+	if err := dialer.SetProxy(opts.ProxyURL); err != nil {
+		l.Fatalln("Proxy:", err)
+	}
+	dialer.SetBypassPrivate(opts.ProxyBypassPrivate)
+	if dialer.UsingProxy() {
+		l.Infoln("Using proxy", dialer.ProxyURL(), "for outgoing connections")
+		if opts.ProxyBypassPrivate {
+			l.Infoln("Connecting directly to devices on private networks")
+		}
+		if opts.GlobalAnnEnabled {
+			l.Warnln("Global discovery is disabled, as its UDP traffic can't go through the proxy")
+		}
+	}
+
 	if opts.MaxSendKbps > 0 {
 		writeRateLimit = ratelimit.NewBucketWithRate(float64(1000*opts.MaxSendKbps), int64(5*1000*opts.MaxSendKbps))
 	}
@@ -489,8 +534,10 @@ func syncthingMain() {
 		readRateLimit = ratelimit.NewBucketWithRate(float64(1000*opts.MaxRecvKbps), int64(5*1000*opts.MaxRecvKbps))
 	}
 
-	ldb, err := leveldb.OpenFile(filepath.Join(confDir, "index"), &opt.Options{OpenFilesCacheCapacity: 100})
-	if err != nil {
+	ldb, err := db.Open(filepath.Join(confDir, "index"))
+	if _, ok := err.(db.VersionError); ok {
+		l.Fatalln("Cannot open database:", err, "- It was written by a newer version of Syncthing.")
+	} else if err != nil {
 		l.Fatalln("Cannot open database:", err, "- Is another copy of Syncthing already running?")
 	}
 
@@ -619,6 +666,15 @@ func syncthingMain() {
 
 	code := <-stop
 
+	reason, closeCode := "shutting down", protocol.CloseCodeShutdown
+	if code == exitRestarting || code == exitUpgrading {
+		reason, closeCode = "restarting", protocol.CloseCodeRestart
+	}
+	m.Shutdown(reason, closeCode, shutdownTimeout)
+	if err := ldb.Close(); err != nil {
+		l.Warnln("Closing database:", err)
+	}
+
 	l.Okln("Exiting")
 	os.Exit(code)
 }
@@ -848,8 +904,10 @@ func renewUPnP(port int) {
 		forwardedPort := setupExternalPort(igd, port)
 		if forwardedPort != 0 {
 			externalPort = forwardedPort
-			discoverer.StopGlobal()
-			discoverer.StartGlobal(opts.GlobalAnnServers, uint16(forwardedPort))
+			if globalDiscoveryEnabled(opts) {
+				discoverer.StopGlobal()
+				discoverer.StartGlobal(opts.GlobalAnnServers, uint16(forwardedPort))
+			}
 			if debugNet {
 				l.Debugf("Updated UPnP port mapping for external port %d on device %s.", forwardedPort, igd.FriendlyIdentifier())
 			}
@@ -883,6 +941,108 @@ func resetFolders() {
 	os.RemoveAll(idx)
 }
 
+func verifyDatabase(repair bool) {
+	confDir, err := osutil.ExpandTilde(confDir)
+	if err != nil {
+		l.Fatalln("home:", err)
+	}
+
+	ldb, err := db.Open(filepath.Join(confDir, "index"))
+	if err != nil {
+		l.Fatalln("Cannot open database:", err)
+	}
+
+	problems := db.Verify(ldb, repair)
+	for _, p := range problems {
+		l.Infoln(p)
+	}
+	if err := ldb.Close(); err != nil {
+		l.Fatalln("Close database:", err)
+	}
+
+	switch {
+	case len(problems) == 0:
+		l.Okln("Database verified; no problems found")
+	case repair:
+		l.Okf("Repaired %d database problems", len(problems))
+	default:
+		l.Warnf("Found %d database problems; run with -repair-db to repair them", len(problems))
+		os.Exit(exitError)
+	}
+}
+
+func exportIndexFile(file string) {
+	confDir, err := osutil.ExpandTilde(confDir)
+	if err != nil {
+		l.Fatalln("home:", err)
+	}
+
+	cfg, err := config.Load(filepath.Join(confDir, "config.xml"), myID)
+	if err != nil {
+		l.Fatalln("Configuration:", err)
+	}
+
+	ldb, err := db.Open(filepath.Join(confDir, "index"))
+	if err != nil {
+		l.Fatalln("Cannot open database:", err)
+	}
+	defer ldb.Close()
+
+	var folders []string
+	for id := range cfg.Folders() {
+		folders = append(folders, id)
+	}
+
+	fd, err := os.Create(file)
+	if err != nil {
+		l.Fatalln("Export index:", err)
+	}
+	if err := db.ExportIndex(ldb, folders, fd); err != nil {
+		fd.Close()
+		l.Fatalln("Export index:", err)
+	}
+	if err := fd.Close(); err != nil {
+		l.Fatalln("Export index:", err)
+	}
+
+	l.Okf("Exported the index of %d folders to %s", len(folders), file)
+}
+
+func importIndexFile(file string) {
+	confDir, err := osutil.ExpandTilde(confDir)
+	if err != nil {
+		l.Fatalln("home:", err)
+	}
+
+	cfg, err := config.Load(filepath.Join(confDir, "config.xml"), myID)
+	if err != nil {
+		l.Fatalln("Configuration:", err)
+	}
+
+	ldb, err := db.Open(filepath.Join(confDir, "index"))
+	if err != nil {
+		l.Fatalln("Cannot open database:", err)
+	}
+	defer ldb.Close()
+
+	m := model.NewModel(cfg, "", "syncthing", Version, ldb)
+	for _, folder := range cfg.Folders() {
+		m.AddFolder(folder)
+	}
+
+	fd, err := os.Open(file)
+	if err != nil {
+		l.Fatalln("Import index:", err)
+	}
+	defer fd.Close()
+
+	n, err := m.ImportIndex(fd)
+	if err != nil {
+		l.Fatalln("Import index:", err)
+	}
+	l.Okf("Imported %d files from %s; they will not be hashed by the initial scan", n, file)
+}
+
 func restart() {
 	l.Infoln("Restarting")
 	stop <- exitRestarting
@@ -921,7 +1081,7 @@ next:
 			continue
 		}
 
-		if m.ConnectedTo(remoteID) {
+		if m.NumConnections(remoteID) >= cfg.Options().ConnectionsPerDevice {
 			l.Infof("Connected to already connected device (%s)", remoteID)
 			conn.Close()
 			continue
@@ -965,10 +1125,12 @@ next:
 				if debugNet {
 					l.Debugf("cipher suite %04X", conn.ConnectionState().CipherSuite)
 				}
-				events.Default.Log(events.DeviceConnected, map[string]string{
-					"id":   remoteID.String(),
-					"addr": conn.RemoteAddr().String(),
-				})
+				if !m.ConnectedTo(remoteID) {
+					events.Default.Log(events.DeviceConnected, map[string]string{
+						"id":   remoteID.String(),
+						"addr": conn.RemoteAddr().String(),
+					})
+				}
 
 				m.AddConnection(conn, protoConn)
 				continue next
@@ -1039,7 +1201,9 @@ func dialTLS(m *model.Model, conns chan *tls.Conn, tlsCfg *tls.Config) {
 				continue
 			}
 
-			if m.ConnectedTo(deviceID) {
+			// We may want more than one connection to each device.
+			need := cfg.Options().ConnectionsPerDevice - m.NumConnections(deviceID)
+			if need <= 0 {
 				continue
 			}
 
@@ -1067,38 +1231,39 @@ func dialTLS(m *model.Model, conns chan *tls.Conn, tlsCfg *tls.Config) {
 					// addr is on the form "1.2.3.4:"
 					addr = net.JoinHostPort(host, "22000")
 				}
-				if debugNet {
-					l.Debugln("dial", deviceCfg.DeviceID, addr)
-				}
 
-				raddr, err := net.ResolveTCPAddr("tcp", addr)
-				if err != nil {
+				for need > 0 {
 					if debugNet {
-						l.Debugln(err)
+						l.Debugln("dial", deviceCfg.DeviceID, addr)
 					}
-					continue
-				}
 
-				conn, err := net.DialTCP("tcp", nil, raddr)
-				if err != nil {
-					if debugNet {
-						l.Debugln(err)
+					conn, err := dialer.Dial("tcp", addr)
+					if err != nil {
+						if debugNet {
+							l.Debugln(err)
+						}
+						break
 					}
-					continue
-				}
 
-				setTCPOptions(conn)
+					if tcpConn, ok := conn.(*net.TCPConn); ok {
+						setTCPOptions(tcpConn)
+					}
 
-				tc := tls.Client(conn, tlsCfg)
-				err = tc.Handshake()
-				if err != nil {
-					l.Infoln("TLS handshake:", err)
-					tc.Close()
-					continue
+					tc := tls.Client(conn, tlsCfg)
+					err = tc.Handshake()
+					if err != nil {
+						l.Infoln("TLS handshake:", err)
+						tc.Close()
+						break
+					}
+
+					conns <- tc
+					need--
 				}
 
-				conns <- tc
-				continue nextDevice
+				if need <= 0 {
+					continue nextDevice
+				}
 			}
 		}
 
@@ -1135,7 +1300,7 @@ func discovery(extPort int) *discover.Discoverer {
 		disc.StartLocal(opts.LocalAnnPort, opts.LocalAnnMCAddr)
 	}
 
-	if opts.GlobalAnnEnabled {
+	if globalDiscoveryEnabled(opts) {
 		l.Infoln("Starting global discovery announcements")
 		disc.StartGlobal(opts.GlobalAnnServers, uint16(extPort))
 	}
@@ -1143,6 +1308,13 @@ func discovery(extPort int) *discover.Discoverer {
 	return disc
 }
 
+// globalDiscoveryEnabled returns true if global discovery is enabled and can
+// be used. It talks UDP to the announce servers, which doesn't go through the
+// proxy, so it's not used when there is one.
+func globalDiscoveryEnabled(opts config.OptionsConfiguration) bool {
+	return opts.GlobalAnnEnabled && !dialer.UsingProxy()
+}
+
 func ensureDir(dir string, mode int) {
 	fi, err := os.Stat(dir)
 	if os.IsNotExist(err) {
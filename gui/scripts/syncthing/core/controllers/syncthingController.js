@@ -21,6 +21,7 @@ angular.module('syncthing.core')
         $scope.config = {};
         $scope.configInSync = true;
         $scope.connections = {};
+        $scope.closedConnections = {};
         $scope.errors = [];
         $scope.model = {};
         $scope.myID = '';
@@ -155,6 +156,7 @@ angular.module('syncthing.core')
         $scope.$on('DeviceDisconnected', function (event, arg) {
             delete $scope.connections[arg.data.id];
             refreshDeviceStats();
+            refreshConnectionStats();
         });
 
         $scope.$on('DeviceConnected', function (event, arg) {
@@ -354,6 +356,7 @@ angular.module('syncthing.core')
             $http.get(urlbase + '/connections').success(function (data) {
                 var now = Date.now(),
                     td = (now - prevDate) / 1000,
+                    closed = {},
                     id;
 
                 prevDate = now;
@@ -361,6 +364,13 @@ angular.module('syncthing.core')
                     if (!data.hasOwnProperty(id)) {
                         continue;
                     }
+                    if (data[id].Closed) {
+                        // A disconnected device, listed only to tell why
+                        // the connection was closed.
+                        closed[id] = data[id].Closed;
+                        delete data[id];
+                        continue;
+                    }
                     try {
                         data[id].inbps = Math.max(0, (data[id].InBytesTotal - $scope.connections[id].InBytesTotal) / td);
                         data[id].outbps = Math.max(0, (data[id].OutBytesTotal - $scope.connections[id].OutBytesTotal) / td);
@@ -370,6 +380,7 @@ angular.module('syncthing.core')
                     }
                 }
                 $scope.connections = data;
+                $scope.closedConnections = closed;
                 console.log("refreshConnections", data);
             }).error($scope.emitHTTPError);
         }
@@ -52,17 +52,23 @@ type Configuration struct {
 }
 
 type FolderConfiguration struct {
-	ID              string                      `xml:"id,attr"`
-	Path            string                      `xml:"path,attr"`
-	Devices         []FolderDeviceConfiguration `xml:"device"`
-	ReadOnly        bool                        `xml:"ro,attr"`
-	RescanIntervalS int                         `xml:"rescanIntervalS,attr" default:"60"`
-	IgnorePerms     bool                        `xml:"ignorePerms,attr"`
-	Versioning      VersioningConfiguration     `xml:"versioning"`
-	LenientMtimes   bool                        `xml:"lenientMtimes"`
-	Copiers         int                         `xml:"copiers" default:"1"`  // This defines how many files are handled concurrently.
-	Pullers         int                         `xml:"pullers" default:"16"` // Defines how many blocks are fetched at the same time, possibly between separate copier routines.
-	Hashers         int                         `xml:"hashers" default:"0"`  // Less than one sets the value to the number of cores. These are CPU bound due to hashing.
+	ID               string                      `xml:"id,attr"`
+	Path             string                      `xml:"path,attr"`
+	Devices          []FolderDeviceConfiguration `xml:"device"`
+	ReadOnly         bool                        `xml:"ro,attr"`
+	RescanIntervalS  int                         `xml:"rescanIntervalS,attr" default:"60"`
+	IgnorePerms      bool                        `xml:"ignorePerms,attr"`
+	Versioning       VersioningConfiguration     `xml:"versioning"`
+	LenientMtimes    bool                        `xml:"lenientMtimes"`
+	Copiers          int                         `xml:"copiers" default:"1"`  // This defines how many files are handled concurrently.
+	Pullers          int                         `xml:"pullers" default:"16"` // Defines how many blocks are fetched at the same time, possibly between separate copier routines.
+	Hashers          int                         `xml:"hashers" default:"0"`  // Less than one sets the value to the number of cores. These are CPU bound due to hashing.
+	AutoNormalize    bool                        `xml:"autoNormalize"`        // Rename files with names not in NFC form instead of skipping them.
+	MaxHashMiBps     int                         `xml:"maxHashMiBps"`         // Limit on the hashing rate when scanning this folder; 0 for no limit
+	ModTimeWindowS   int                         `xml:"modTimeWindowS"`       // Modification times differing by up to this many seconds are considered equal; 2 suits FAT filesystems.
+	SyncOwnership    bool                        `xml:"syncOwnership"`        // Sync the owner and group of files, which usually requires running as root.
+	SyncXattrs       bool                        `xml:"syncXattrs"`           // Sync the extended attributes of files, including POSIX ACLs.
+	PreallocateFiles bool                        `xml:"preallocateFiles"`     // Reserve disk space for files before writing them, where supported.
 
 	Invalid string `xml:"-"` // Set at runtime when there is an error, not saved
 
@@ -182,6 +188,13 @@ type OptionsConfiguration struct {
 	CacheIgnoredFiles       bool     `xml:"cacheIgnoredFiles" default:"true"`
 	ProgressUpdateIntervalS int      `xml:"progressUpdateIntervalS" default:"5"`
 	SymlinksEnabled         bool     `xml:"symlinksEnabled" default:"true"`
+	ProxyURL                string   `xml:"proxyURL"`                           // socks5://, socks5h:// or http:// URL; overridden by the all_proxy and https_proxy environment variables
+	ProxyBypassPrivate      bool     `xml:"proxyBypassPrivate"`                 // Connect directly to devices on private networks instead of through the proxy
+	ConnectionsPerDevice    int      `xml:"connectionsPerDevice" default:"1"`   // Parallel connections to open to each device; requests are spread over them
+	MaxPullInFlightKiB      int      `xml:"maxPullInFlightKiB" default:"32768"` // Limit on data requested but not yet received, over all folders; 0 for no limit
+	KeepHistoryD            int      `xml:"keepHistoryD" default:"30"`          // Days to keep the change history of files for; 0 for no age limit
+	MaxHashMiBps            int      `xml:"maxHashMiBps"`                       // Limit on the hashing rate when scanning, over all folders; 0 for no limit
+	SerializeScans          bool     `xml:"serializeScans"`                     // Scan only one folder at a time
 
 	Deprecated_RescanIntervalS int    `xml:"rescanIntervalS,omitempty" json:"-"`
 	Deprecated_UREnabled       bool   `xml:"urEnabled,omitempty" json:"-"`
@@ -369,6 +382,14 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 		}
 	}
 
+	if cfg.Options.ConnectionsPerDevice < 1 {
+		cfg.Options.ConnectionsPerDevice = 1
+	}
+
+	if cfg.Options.MaxPullInFlightKiB < 0 {
+		cfg.Options.MaxPullInFlightKiB = 0
+	}
+
 	cfg.Options.ListenAddress = uniqueStrings(cfg.Options.ListenAddress)
 	cfg.Options.GlobalAnnServers = uniqueStrings(cfg.Options.GlobalAnnServers)
 
@@ -400,6 +421,9 @@ func ChangeRequiresRestart(from, to Configuration) bool {
 	to.Options.URAccepted = from.Options.URAccepted
 	to.Options.URUniqueID = from.Options.URUniqueID
 
+	// The limit on bytes in flight is applied at runtime.
+	to.Options.MaxPullInFlightKiB = from.Options.MaxPullInFlightKiB
+
 	// All of the generic options require restart
 	if !reflect.DeepEqual(from.Options, to.Options) || !reflect.DeepEqual(from.GUI, to.GUI) {
 		return true
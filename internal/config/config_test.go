@@ -54,6 +54,9 @@ func TestDefaultValues(t *testing.T) {
 		CacheIgnoredFiles:       true,
 		ProgressUpdateIntervalS: 5,
 		SymlinksEnabled:         true,
+		ConnectionsPerDevice:    1,
+		MaxPullInFlightKiB:      32768,
+		KeepHistoryD:            30,
 	}
 
 	cfg := New(device1)
@@ -157,6 +160,12 @@ func TestOverriddenValues(t *testing.T) {
 		CacheIgnoredFiles:       false,
 		ProgressUpdateIntervalS: 10,
 		SymlinksEnabled:         false,
+		ProxyBypassPrivate:      true,
+		ConnectionsPerDevice:    4,
+		MaxPullInFlightKiB:      8192,
+		KeepHistoryD:            7,
+		MaxHashMiBps:            50,
+		SerializeScans:          true,
 	}
 
 	cfg, err := Load("testdata/overridenvalues.xml", device1)
@@ -384,6 +393,12 @@ func TestRequiresRestart(t *testing.T) {
 		t.Error("Changing general options requires restart")
 	}
 
+	newCfg = cfg
+	newCfg.Options.MaxPullInFlightKiB = cfg.Options.MaxPullInFlightKiB + 1
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Changing the pull limit does not require restart")
+	}
+
 	newCfg = cfg
 	newCfg.GUI.UseTLS = !cfg.GUI.UseTLS
 	if !ChangeRequiresRestart(cfg, newCfg) {
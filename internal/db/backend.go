@@ -0,0 +1,91 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import "errors"
+
+// ErrNotFound is returned by Get when the key does not exist.
+var ErrNotFound = errors.New("db: key not found")
+
+// ErrReadOnly is returned when writing to a database opened read only.
+var ErrReadOnly = errors.New("db: read only")
+
+// A Backend is the key-value store holding the database. Keys are ordered
+// bytewise, and iterators return them in that order.
+type Backend interface {
+	Reader
+	Put(key, val []byte) error
+	Delete(key []byte) error
+	// NewBatch returns a batch to be applied atomically by Write.
+	NewBatch() Batch
+	Write(batch Batch) error
+	// NewSnapshot returns a consistent, read only view of the current
+	// contents, unaffected by later writes. It must be released when done.
+	NewSnapshot() (Snapshot, error)
+	Close() error
+}
+
+// A Reader is a Backend or a Snapshot of one.
+type Reader interface {
+	// Get returns the value for the key, or ErrNotFound.
+	Get(key []byte) ([]byte, error)
+	// NewPrefixIterator returns an iterator over all keys with the given
+	// prefix. Iterators see the contents as they were when created. They
+	// must be released when done.
+	NewPrefixIterator(prefix []byte) KeyValueIterator
+}
+
+// A Snapshot is a frozen view of a Backend.
+type Snapshot interface {
+	Reader
+	Release()
+}
+
+// A Batch collects changes to be written at once.
+type Batch interface {
+	Put(key, val []byte)
+	Delete(key []byte)
+	Len() int
+	Reset()
+}
+
+// A KeyValueIterator steps through a range of keys. It starts before the
+// first key, so Next must be called before Key and Value. The returned slices
+// must not be modified and are only valid until the next call to Next.
+type KeyValueIterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Error() error
+	Release()
+}
+
+// readOnlyBackend is a Backend that refuses all changes.
+type readOnlyBackend struct {
+	Backend
+}
+
+func (readOnlyBackend) Put(key, val []byte) error {
+	return ErrReadOnly
+}
+
+func (readOnlyBackend) Delete(key []byte) error {
+	return ErrReadOnly
+}
+
+func (readOnlyBackend) Write(batch Batch) error {
+	return ErrReadOnly
+}
@@ -0,0 +1,106 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// leveldbBackend is a Backend stored on disk by goleveldb.
+type leveldbBackend struct {
+	db *leveldb.DB
+}
+
+// NewLevelDBBackend opens, or creates, the goleveldb database at the given
+// path.
+func NewLevelDBBackend(path string) (Backend, error) {
+	db, err := leveldb.OpenFile(path, &opt.Options{OpenFilesCacheCapacity: 100})
+	if err != nil {
+		return nil, err
+	}
+	return &leveldbBackend{db}, nil
+}
+
+// openLevelDBBackend opens the existing goleveldb database at the given
+// path.
+func openLevelDBBackend(path string) (Backend, error) {
+	db, err := leveldb.OpenFile(path, &opt.Options{OpenFilesCacheCapacity: 100, ErrorIfMissing: true})
+	if err != nil {
+		return nil, err
+	}
+	return &leveldbBackend{db}, nil
+}
+
+func (b *leveldbBackend) Get(key []byte) ([]byte, error) {
+	return leveldbGet(b.db.Get(key, nil))
+}
+
+func (b *leveldbBackend) NewPrefixIterator(prefix []byte) KeyValueIterator {
+	return b.db.NewIterator(util.BytesPrefix(prefix), nil)
+}
+
+func (b *leveldbBackend) Put(key, val []byte) error {
+	return b.db.Put(key, val, nil)
+}
+
+func (b *leveldbBackend) Delete(key []byte) error {
+	return b.db.Delete(key, nil)
+}
+
+func (b *leveldbBackend) NewBatch() Batch {
+	return new(leveldb.Batch)
+}
+
+func (b *leveldbBackend) Write(batch Batch) error {
+	return b.db.Write(batch.(*leveldb.Batch), nil)
+}
+
+func (b *leveldbBackend) NewSnapshot() (Snapshot, error) {
+	snap, err := b.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return leveldbSnapshot{snap}, nil
+}
+
+func (b *leveldbBackend) Close() error {
+	return b.db.Close()
+}
+
+type leveldbSnapshot struct {
+	snap *leveldb.Snapshot
+}
+
+func (s leveldbSnapshot) Get(key []byte) ([]byte, error) {
+	return leveldbGet(s.snap.Get(key, nil))
+}
+
+func (s leveldbSnapshot) NewPrefixIterator(prefix []byte) KeyValueIterator {
+	return s.snap.NewIterator(util.BytesPrefix(prefix), nil)
+}
+
+func (s leveldbSnapshot) Release() {
+	s.snap.Release()
+}
+
+func leveldbGet(val []byte, err error) ([]byte, error) {
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return val, err
+}
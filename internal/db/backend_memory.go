@@ -0,0 +1,243 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memoryBackend is a Backend kept in memory only. The contents are shared
+// with snapshots and iterators and copied on the first write after one is
+// created, so they're cheap as long as writes are done in batches.
+type memoryBackend struct {
+	data *memoryData
+	mut  sync.Mutex
+}
+
+type memoryData struct {
+	keys   []string // sorted
+	vals   map[string][]byte
+	shared bool
+}
+
+// NewMemoryBackend returns an empty Backend that lives in memory only.
+func NewMemoryBackend() Backend {
+	return &memoryBackend{
+		data: &memoryData{vals: make(map[string][]byte)},
+	}
+}
+
+// frozen returns the current contents, which are not modified again.
+func (b *memoryBackend) frozen() *memoryData {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.data.shared = true
+	return b.data
+}
+
+func (b *memoryBackend) Get(key []byte) ([]byte, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return b.data.get(key)
+}
+
+func (b *memoryBackend) NewPrefixIterator(prefix []byte) KeyValueIterator {
+	return b.frozen().newPrefixIterator(prefix)
+}
+
+func (b *memoryBackend) Put(key, val []byte) error {
+	batch := b.NewBatch()
+	batch.Put(key, val)
+	return b.Write(batch)
+}
+
+func (b *memoryBackend) Delete(key []byte) error {
+	batch := b.NewBatch()
+	batch.Delete(key)
+	return b.Write(batch)
+}
+
+func (b *memoryBackend) NewBatch() Batch {
+	return &memoryBatch{}
+}
+
+func (b *memoryBackend) Write(batch Batch) error {
+	ops := batch.(*memoryBatch).ops
+	if len(ops) == 0 {
+		return nil
+	}
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	if b.data.shared {
+		vals := make(map[string][]byte, len(b.data.vals))
+		for k, v := range b.data.vals {
+			vals[k] = v
+		}
+		b.data = &memoryData{keys: b.data.keys, vals: vals}
+	}
+	b.data.apply(ops)
+	return nil
+}
+
+func (b *memoryBackend) NewSnapshot() (Snapshot, error) {
+	return memorySnapshot{b.frozen()}, nil
+}
+
+func (b *memoryBackend) Close() error {
+	return nil
+}
+
+func (d *memoryData) get(key []byte) ([]byte, error) {
+	val, ok := d.vals[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), val...), nil
+}
+
+func (d *memoryData) newPrefixIterator(prefix []byte) KeyValueIterator {
+	return &memoryIterator{
+		data:   d,
+		prefix: string(prefix),
+		next:   sort.SearchStrings(d.keys, string(prefix)),
+	}
+}
+
+// apply performs the operations on the values, and then merges the added
+// keys into the sorted key list while dropping deleted ones. The key list is
+// rebuilt rather than modified in place, as it may be shared.
+func (d *memoryData) apply(ops []memoryOp) {
+	var added []string
+	var deleted bool
+	for _, op := range ops {
+		_, exists := d.vals[op.key]
+		if op.delete {
+			if exists {
+				delete(d.vals, op.key)
+				deleted = true
+			}
+			continue
+		}
+		if !exists {
+			added = append(added, op.key)
+		}
+		d.vals[op.key] = op.val
+	}
+	if len(added) == 0 && !deleted {
+		return
+	}
+
+	sort.Strings(added)
+	keys := make([]string, 0, len(d.keys)+len(added))
+	i, j := 0, 0
+	for i < len(d.keys) || j < len(added) {
+		var k string
+		if j == len(added) || i < len(d.keys) && d.keys[i] < added[j] {
+			k = d.keys[i]
+			i++
+		} else {
+			k = added[j]
+			j++
+		}
+		if _, ok := d.vals[k]; !ok {
+			// Deleted, possibly after being added in the same batch
+			continue
+		}
+		if len(keys) > 0 && keys[len(keys)-1] == k {
+			// Added more than once
+			continue
+		}
+		keys = append(keys, k)
+	}
+	d.keys = keys
+}
+
+type memoryOp struct {
+	key    string
+	val    []byte
+	delete bool
+}
+
+type memoryBatch struct {
+	ops []memoryOp
+}
+
+func (b *memoryBatch) Put(key, val []byte) {
+	b.ops = append(b.ops, memoryOp{key: string(key), val: append([]byte(nil), val...)})
+}
+
+func (b *memoryBatch) Delete(key []byte) {
+	b.ops = append(b.ops, memoryOp{key: string(key), delete: true})
+}
+
+func (b *memoryBatch) Len() int {
+	return len(b.ops)
+}
+
+func (b *memoryBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+type memorySnapshot struct {
+	data *memoryData
+}
+
+func (s memorySnapshot) Get(key []byte) ([]byte, error) {
+	return s.data.get(key)
+}
+
+func (s memorySnapshot) NewPrefixIterator(prefix []byte) KeyValueIterator {
+	return s.data.newPrefixIterator(prefix)
+}
+
+func (s memorySnapshot) Release() {}
+
+type memoryIterator struct {
+	data   *memoryData
+	prefix string
+	next   int
+	key    string
+}
+
+func (i *memoryIterator) Next() bool {
+	if i.data == nil || i.next >= len(i.data.keys) || !strings.HasPrefix(i.data.keys[i.next], i.prefix) {
+		i.key = ""
+		return false
+	}
+	i.key = i.data.keys[i.next]
+	i.next++
+	return true
+}
+
+func (i *memoryIterator) Key() []byte {
+	return []byte(i.key)
+}
+
+func (i *memoryIterator) Value() []byte {
+	return i.data.vals[i.key]
+}
+
+func (i *memoryIterator) Error() error {
+	return nil
+}
+
+func (i *memoryIterator) Release() {
+	i.data = nil
+}
@@ -0,0 +1,148 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func testBackends(t *testing.T, fn func(t *testing.T, b Backend)) {
+	fn(t, NewMemoryBackend())
+
+	dir, err := ioutil.TempDir("", "syncthing-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := NewLevelDBBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	fn(t, b)
+}
+
+func keys(r Reader, prefix string) []string {
+	var keys []string
+	dbi := r.NewPrefixIterator([]byte(prefix))
+	defer dbi.Release()
+	for dbi.Next() {
+		keys = append(keys, fmt.Sprintf("%s=%s", dbi.Key(), dbi.Value()))
+	}
+	return keys
+}
+
+func TestBackendGetPut(t *testing.T) {
+	testBackends(t, func(t *testing.T, b Backend) {
+		if _, err := b.Get([]byte("a")); err != ErrNotFound {
+			t.Errorf("unexpected error %v for missing key", err)
+		}
+		if err := b.Put([]byte("a"), []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		if val, err := b.Get([]byte("a")); err != nil || string(val) != "1" {
+			t.Errorf("unexpected value %q, %v", val, err)
+		}
+		if err := b.Delete([]byte("a")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Get([]byte("a")); err != ErrNotFound {
+			t.Errorf("unexpected error %v for deleted key", err)
+		}
+	})
+}
+
+func TestBackendBatchIterator(t *testing.T) {
+	testBackends(t, func(t *testing.T, b Backend) {
+		batch := b.NewBatch()
+		for _, k := range []string{"b2", "a", "b1", "c", "b3", "b"} {
+			batch.Put([]byte(k), []byte(k))
+		}
+		batch.Delete([]byte("b3"))
+		batch.Put([]byte("b1"), []byte("new"))
+		if batch.Len() != 8 {
+			t.Errorf("unexpected batch length %d", batch.Len())
+		}
+		if err := b.Write(batch); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := "[b=b b1=new b2=b2]"
+		if k := fmt.Sprint(keys(b, "b")); k != expected {
+			t.Errorf("iterated %s, expected %s", k, expected)
+		}
+		expected = "[a=a b=b b1=new b2=b2 c=c]"
+		if k := fmt.Sprint(keys(b, "")); k != expected {
+			t.Errorf("iterated %s, expected %s", k, expected)
+		}
+		if k := keys(b, "d"); len(k) != 0 {
+			t.Errorf("iterated %s, expected nothing", k)
+		}
+
+		batch.Reset()
+		batch.Delete([]byte("b"))
+		batch.Delete([]byte("b2"))
+		if err := b.Write(batch); err != nil {
+			t.Fatal(err)
+		}
+		expected = "[a=a b1=new c=c]"
+		if k := fmt.Sprint(keys(b, "")); k != expected {
+			t.Errorf("iterated %s, expected %s", k, expected)
+		}
+	})
+}
+
+func TestBackendSnapshot(t *testing.T) {
+	testBackends(t, func(t *testing.T, b Backend) {
+		b.Put([]byte("a"), []byte("1"))
+		b.Put([]byte("b"), []byte("1"))
+
+		snap, err := b.NewSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer snap.Release()
+		dbi := b.NewPrefixIterator(nil)
+		defer dbi.Release()
+
+		b.Put([]byte("a"), []byte("2"))
+		b.Delete([]byte("b"))
+		b.Put([]byte("c"), []byte("2"))
+
+		expected := "[a=1 b=1]"
+		if k := fmt.Sprint(keys(snap, "")); k != expected {
+			t.Errorf("snapshot has %s, expected %s", k, expected)
+		}
+		if val, err := snap.Get([]byte("a")); err != nil || string(val) != "1" {
+			t.Errorf("unexpected snapshot value %q, %v", val, err)
+		}
+		var k []string
+		for dbi.Next() {
+			k = append(k, fmt.Sprintf("%s=%s", dbi.Key(), dbi.Value()))
+		}
+		if fmt.Sprint(k) != expected {
+			t.Errorf("iterator has %s, expected %s", k, expected)
+		}
+
+		expected = "[a=2 c=2]"
+		if k := fmt.Sprint(keys(b, "")); k != expected {
+			t.Errorf("backend has %s, expected %s", k, expected)
+		}
+	})
+}
@@ -23,7 +23,6 @@
 package db
 
 import (
-	"bytes"
 	"encoding/binary"
 	"sort"
 	"sync"
@@ -31,28 +30,27 @@ import (
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/osutil"
-
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 var blockFinder *BlockFinder
 
 type BlockMap struct {
-	db     *leveldb.DB
-	folder string
+	db       *Instance
+	folder   string
+	folderID []byte
 }
 
-func NewBlockMap(db *leveldb.DB, folder string) *BlockMap {
+func NewBlockMap(db *Instance, folder string) *BlockMap {
 	return &BlockMap{
-		db:     db,
-		folder: folder,
+		db:       db,
+		folder:   folder,
+		folderID: db.folderID(folder),
 	}
 }
 
 // Add files to the block map, ignoring any deleted or invalid files.
 func (m *BlockMap) Add(files []protocol.FileInfo) error {
-	batch := new(leveldb.Batch)
+	batch := m.db.NewBatch()
 	buf := make([]byte, 4)
 	for _, file := range files {
 		if file.IsDirectory() || file.IsDeleted() || file.IsInvalid() {
@@ -64,12 +62,12 @@ func (m *BlockMap) Add(files []protocol.FileInfo) error {
 			batch.Put(m.blockKey(block.Hash, file.Name), buf)
 		}
 	}
-	return m.db.Write(batch, nil)
+	return m.db.Write(batch)
 }
 
 // Update block map state, removing any deleted or invalid files.
 func (m *BlockMap) Update(files []protocol.FileInfo) error {
-	batch := new(leveldb.Batch)
+	batch := m.db.NewBatch()
 	buf := make([]byte, 4)
 	for _, file := range files {
 		if file.IsDirectory() {
@@ -88,24 +86,24 @@ func (m *BlockMap) Update(files []protocol.FileInfo) error {
 			batch.Put(m.blockKey(block.Hash, file.Name), buf)
 		}
 	}
-	return m.db.Write(batch, nil)
+	return m.db.Write(batch)
 }
 
 // Discard block map state, removing the given files
 func (m *BlockMap) Discard(files []protocol.FileInfo) error {
-	batch := new(leveldb.Batch)
+	batch := m.db.NewBatch()
 	for _, file := range files {
 		for _, block := range file.Blocks {
 			batch.Delete(m.blockKey(block.Hash, file.Name))
 		}
 	}
-	return m.db.Write(batch, nil)
+	return m.db.Write(batch)
 }
 
 // Drop block map, removing all entries related to this block map from the db.
 func (m *BlockMap) Drop() error {
-	batch := new(leveldb.Batch)
-	iter := m.db.NewIterator(util.BytesPrefix(m.blockKey(nil, "")[:1+64]), nil)
+	batch := m.db.NewBatch()
+	iter := m.db.NewPrefixIterator(m.blockKey(nil, "")[:1+4])
 	defer iter.Release()
 	for iter.Next() {
 		batch.Delete(iter.Key())
@@ -113,20 +111,20 @@ func (m *BlockMap) Drop() error {
 	if iter.Error() != nil {
 		return iter.Error()
 	}
-	return m.db.Write(batch, nil)
+	return m.db.Write(batch)
 }
 
 func (m *BlockMap) blockKey(hash []byte, file string) []byte {
-	return toBlockKey(hash, m.folder, file)
+	return toBlockKey(hash, m.folderID, file)
 }
 
 type BlockFinder struct {
-	db      *leveldb.DB
+	db      *Instance
 	folders []string
 	mut     sync.RWMutex
 }
 
-func NewBlockFinder(db *leveldb.DB, cfg *config.Wrapper) *BlockFinder {
+func NewBlockFinder(db *Instance, cfg *config.Wrapper) *BlockFinder {
 	if blockFinder != nil {
 		return blockFinder
 	}
@@ -165,12 +163,12 @@ func (f *BlockFinder) Iterate(hash []byte, iterFn func(string, string, int32) bo
 	folders := f.folders
 	f.mut.RUnlock()
 	for _, folder := range folders {
-		key := toBlockKey(hash, folder, "")
-		iter := f.db.NewIterator(util.BytesPrefix(key), nil)
+		key := toBlockKey(hash, f.db.folderID(folder), "")
+		iter := f.db.NewPrefixIterator(key)
 		defer iter.Release()
 
 		for iter.Next() && iter.Error() == nil {
-			folder, file := fromBlockKey(iter.Key())
+			file := blockKeyName(iter.Key())
 			index := int32(binary.BigEndian.Uint32(iter.Value()))
 			if iterFn(folder, osutil.NativeFilename(file), index) {
 				return true
@@ -186,40 +184,34 @@ func (f *BlockFinder) Fix(folder, file string, index int32, oldHash, newHash []b
 	buf := make([]byte, 4)
 	binary.BigEndian.PutUint32(buf, uint32(index))
 
-	batch := new(leveldb.Batch)
-	batch.Delete(toBlockKey(oldHash, folder, file))
-	batch.Put(toBlockKey(newHash, folder, file), buf)
-	return f.db.Write(batch, nil)
+	batch := f.db.NewBatch()
+	folderID := f.db.folderID(folder)
+	batch.Delete(toBlockKey(oldHash, folderID, file))
+	batch.Put(toBlockKey(newHash, folderID, file), buf)
+	return f.db.Write(batch)
 }
 
-// m.blockKey returns a byte slice encoding the following information:
+// toBlockKey returns a byte slice encoding the following information:
 //	   keyTypeBlock (1 byte)
-//	   folder (64 bytes)
+//	   folder (4 bytes)
 //	   block hash (32 bytes)
 //	   file name (variable size)
-func toBlockKey(hash []byte, folder, file string) []byte {
-	o := make([]byte, 1+64+32+len(file))
+func toBlockKey(hash, folder []byte, file string) []byte {
+	o := make([]byte, 1+4+32+len(file))
 	o[0] = keyTypeBlock
-	copy(o[1:], []byte(folder))
-	copy(o[1+64:], []byte(hash))
-	copy(o[1+64+32:], []byte(file))
+	copy(o[1:], folder)
+	copy(o[1+4:], hash)
+	copy(o[1+4+32:], []byte(file))
 	return o
 }
 
-func fromBlockKey(data []byte) (string, string) {
-	if len(data) < 1+64+32+1 {
+func blockKeyName(data []byte) string {
+	if len(data) < 1+4+32+1 {
 		panic("Incorrect key length")
 	}
 	if data[0] != keyTypeBlock {
 		panic("Incorrect key type")
 	}
 
-	file := string(data[1+64+32:])
-
-	slice := data[1 : 1+64]
-	izero := bytes.IndexByte(slice, 0)
-	if izero > -1 {
-		return string(slice[:izero]), file
-	}
-	return string(slice), file
+	return string(data[1+4+32:])
 }
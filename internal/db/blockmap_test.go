@@ -21,8 +21,6 @@ import (
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/config"
 
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/storage"
 )
 
 func genBlocks(n int) []protocol.BlockInfo {
@@ -59,13 +57,10 @@ func init() {
 	}
 }
 
-func setup() (*leveldb.DB, *BlockFinder) {
+func setup() (*Instance, *BlockFinder) {
 	// Setup
 
-	db, err := leveldb.Open(storage.NewMemStorage(), nil)
-	if err != nil {
-		panic(err)
-	}
+	db := OpenMemory()
 
 	wrapper := config.Wrap("", config.Configuration{})
 	wrapper.SetFolder(config.FolderConfiguration{
@@ -78,8 +73,8 @@ func setup() (*leveldb.DB, *BlockFinder) {
 	return db, NewBlockFinder(db, wrapper)
 }
 
-func dbEmpty(db *leveldb.DB) bool {
-	iter := db.NewIterator(nil, nil)
+func dbEmpty(db *Instance) bool {
+	iter := db.NewPrefixIterator([]byte{keyTypeBlock})
 	defer iter.Release()
 	if iter.Next() {
 		return false
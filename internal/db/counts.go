@@ -0,0 +1,314 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+//go:generate -command genxdr go run ../../Godeps/_workspace/src/github.com/calmh/xdr/cmd/genxdr/main.go
+//go:generate genxdr -o counts_xdr.go counts.go
+
+package db
+
+import (
+	"bytes"
+	"runtime"
+
+	"github.com/syncthing/protocol"
+)
+
+// Counts are the number of files, directories and deleted entries in a set
+// of files, and the total size of the files and directories. Sizes are
+// estimated from the number of blocks, as by FileInfoTruncated.Size().
+type Counts struct {
+	Files       int64
+	Directories int64
+	Deleted     int64
+	Bytes       int64
+}
+
+func countsOf(f FileInfoTruncated) Counts {
+	switch {
+	case f.IsDeleted():
+		return Counts{Deleted: 1}
+	case f.IsDirectory():
+		return Counts{Directories: 1, Bytes: f.Size()}
+	default:
+		return Counts{Files: 1, Bytes: f.Size()}
+	}
+}
+
+func (c *Counts) add(o Counts, sign int64) {
+	c.Files += sign * o.Files
+	c.Directories += sign * o.Directories
+	c.Deleted += sign * o.Deleted
+	c.Bytes += sign * o.Bytes
+}
+
+// deviceCounts are counts kept for a single device.
+type deviceCounts struct {
+	device []byte // max:32
+	counts Counts
+}
+
+// folderCounts are the counters kept for a folder. They are updated in the
+// same batch as the files they count, and are thus always in sync with the
+// database. What a device needs is derived from what is in the global view
+// and what the device has in sync with it.
+type folderCounts struct {
+	// The global files.
+	global Counts
+	// The files each device has, except invalid ones.
+	local []deviceCounts
+	// The global files that each device has the global version of, except
+	// that Deleted is the number of deleted global files that the device
+	// has an older version of, i.e. needs.
+	inSync []deviceCounts
+}
+
+func (c *folderCounts) clone() *folderCounts {
+	n := &folderCounts{
+		global: c.global,
+		local:  make([]deviceCounts, len(c.local)),
+		inSync: make([]deviceCounts, len(c.inSync)),
+	}
+	copy(n.local, c.local)
+	copy(n.inSync, c.inSync)
+	return n
+}
+
+// findDevice returns the counts for the given device, or nil.
+func findDevice(list []deviceCounts, device []byte) *Counts {
+	for i := range list {
+		if bytes.Equal(list[i].device, device) {
+			return &list[i].counts
+		}
+	}
+	return nil
+}
+
+// addDevice returns the counts for the given device, adding them if needed.
+// The returned pointer is valid until the next call to addDevice.
+func addDevice(list *[]deviceCounts, device []byte) *Counts {
+	if d := findDevice(*list, device); d != nil {
+		return d
+	}
+	*list = append(*list, deviceCounts{device: append([]byte(nil), device...)})
+	return &(*list)[len(*list)-1].counts
+}
+
+// updateLocal accounts for the device replacing the old file with the new.
+// Either may be nil.
+func (c *folderCounts) updateLocal(device []byte, old, new *FileInfoTruncated) {
+	if c == nil {
+		return
+	}
+	if old != nil && !old.IsInvalid() {
+		addDevice(&c.local, device).add(countsOf(*old), -1)
+	}
+	if new != nil && !new.IsInvalid() {
+		addDevice(&c.local, device).add(countsOf(*new), 1)
+	}
+}
+
+// updateGlobal adds (sign 1) or removes (sign -1) the global file described
+// by the version list. The global file is the known one if it belongs to the
+// known device, and is otherwise read from the database.
+func (c *folderCounts) updateGlobal(db dbReader, folder, name []byte, vl versionList, knownDevice []byte, known FileInfoTruncated, sign int64) {
+	if c == nil || len(vl.versions) == 0 {
+		return
+	}
+
+	gf := known
+	if !bytes.Equal(vl.versions[0].device, knownDevice) {
+		var ok bool
+		gf, ok = ldbGetTruncated(db, folder, vl.versions[0].device, name)
+		if !ok {
+			// The database is inconsistent; ldbCheckGlobals repairs this
+			// on startup and the counts are then recalculated.
+			return
+		}
+	}
+
+	gc := countsOf(gf)
+	c.global.add(gc, sign)
+	for _, v := range vl.versions {
+		switch {
+		case v.version == vl.versions[0].version && !gf.IsDeleted():
+			addDevice(&c.inSync, v.device).add(gc, sign)
+		case v.version != vl.versions[0].version && gf.IsDeleted() && !gf.IsInvalid():
+			// An invalid file may end up in the global list by being
+			// marked deleted, but is never needed.
+			addDevice(&c.inSync, v.device).Deleted += sign
+		}
+	}
+}
+
+func (c *folderCounts) localOf(device []byte) Counts {
+	if d := findDevice(c.local, device); d != nil {
+		return *d
+	}
+	return Counts{}
+}
+
+// need returns the counts of the files that the device needs to be in sync
+// with the global view, as given by ldbWithNeed.
+func (c *folderCounts) need(device []byte) Counts {
+	n := c.global
+	n.Deleted = 0
+	if d := findDevice(c.inSync, device); d != nil {
+		n.Files -= d.Files
+		n.Directories -= d.Directories
+		n.Bytes -= d.Bytes
+		n.Deleted = d.Deleted
+	}
+	return n
+}
+
+// localEqual returns true if the local counts for all devices are equal.
+func (c *folderCounts) localEqual(o *folderCounts) bool {
+	for _, d := range c.local {
+		if o.localOf(d.device) != d.counts {
+			return false
+		}
+	}
+	for _, d := range o.local {
+		if c.localOf(d.device) != d.counts {
+			return false
+		}
+	}
+	return true
+}
+
+// countsKey returns a byte slice encoding the following information:
+//	   keyTypeCounts (1 byte)
+//	   folder (4 bytes)
+func countsKey(folder []byte) []byte {
+	k := make([]byte, 1+4)
+	k[0] = keyTypeCounts
+	copy(k[1:], folder)
+	return k
+}
+
+func ldbPutCounts(batch dbWriter, folder []byte, counts *folderCounts) {
+	if counts == nil {
+		return
+	}
+	ck := countsKey(folder)
+	if debugDB {
+		l.Debugf("batch.Put %p %x", batch, ck)
+	}
+	batch.Put(ck, counts.MustMarshalXDR())
+}
+
+func ldbGetCounts(db dbReader, folder []byte) (*folderCounts, bool) {
+	bs, err := db.Get(countsKey(folder))
+	if err == ErrNotFound {
+		return nil, false
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	var counts folderCounts
+	if err := counts.UnmarshalXDR(bs); err != nil {
+		l.Infof("Discarding invalid file counts for folder %x: %v", folder, err)
+		return nil, false
+	}
+	return &counts, true
+}
+
+func ldbGetTruncated(db dbReader, folder, device, file []byte) (FileInfoTruncated, bool) {
+	bs, err := db.Get(deviceKey(folder, device, file))
+	if err == ErrNotFound {
+		return FileInfoTruncated{}, false
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	var f FileInfoTruncated
+	if err := f.UnmarshalXDR(bs); err != nil {
+		panic(err)
+	}
+	return f, true
+}
+
+// ldbRecount calculates the counts for the folder from scratch and stores
+// them in the database.
+func ldbRecount(db Backend, folder []byte) *folderCounts {
+	counts := ldbCount(db, folder)
+
+	batch := db.NewBatch()
+	ldbPutCounts(batch, folder, counts)
+	if err := db.Write(batch); err != nil {
+		panic(err)
+	}
+
+	return counts
+}
+
+// ldbCount calculates the counts for the folder from scratch.
+func ldbCount(db Backend, folder []byte) *folderCounts {
+	runtime.GC()
+
+	snap, err := db.NewSnapshot()
+	if err != nil {
+		panic(err)
+	}
+	if debugDB {
+		l.Debugf("created snapshot %p", snap)
+	}
+	defer func() {
+		if debugDB {
+			l.Debugf("close snapshot %p", snap)
+		}
+		snap.Release()
+	}()
+
+	counts := &folderCounts{}
+
+	dbi := snap.NewPrefixIterator(deviceKeyPrefix(folder))
+	for dbi.Next() {
+		var f FileInfoTruncated
+		if err := f.UnmarshalXDR(dbi.Value()); err != nil {
+			panic(err)
+		}
+		counts.updateLocal(deviceKeyDevice(dbi.Key()), nil, &f)
+	}
+	dbi.Release()
+
+	dbi = snap.NewPrefixIterator(globalKey(folder, nil))
+	for dbi.Next() {
+		var vl versionList
+		if err := vl.UnmarshalXDR(dbi.Value()); err != nil {
+			panic(err)
+		}
+		counts.updateGlobal(snap, folder, globalKeyName(dbi.Key()), vl, nil, FileInfoTruncated{}, 1)
+	}
+	dbi.Release()
+
+	return counts
+}
+
+// truncate returns the FileInfoTruncated corresponding to the FileInfo.
+func truncate(f protocol.FileInfo) FileInfoTruncated {
+	return FileInfoTruncated{
+		Name:         f.Name,
+		Flags:        f.Flags,
+		Modified:     f.Modified,
+		ModifiedNs:   f.ModifiedNs,
+		Version:      f.Version,
+		LocalVersion: f.LocalVersion,
+		RawBlockSize: f.RawBlockSize,
+		NumBlocks:    int32(len(f.Blocks)),
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"testing"
+
+	"github.com/syncthing/protocol"
+)
+
+func TestCountsRecalculated(t *testing.T) {
+	db := OpenMemory()
+	remote := protocol.DeviceID{1, 2, 3}
+
+	s := NewFileSet("test", db)
+	s.Replace(protocol.LocalDeviceID, []protocol.FileInfo{
+		{Name: "a", Version: 1000, Blocks: genBlocks(1)},
+		{Name: "b", Version: 1000, Blocks: genBlocks(2)},
+	})
+	s.Replace(remote, []protocol.FileInfo{
+		{Name: "b", Version: 1001, Blocks: genBlocks(3)},
+	})
+	global := s.GlobalCounts()
+	need := s.NeedCounts(protocol.LocalDeviceID)
+	if need.Files != 1 {
+		t.Fatalf("unexpected need counts %+v", need)
+	}
+
+	// Losing the counts makes the set count the files again.
+
+	ck := countsKey(s.folderID)
+	if _, err := db.Get(ck); err != nil {
+		t.Fatal("counts not stored:", err)
+	}
+	db.Delete(ck)
+
+	s = NewFileSet("test", db)
+	if c := s.GlobalCounts(); c != global {
+		t.Errorf("global counts %+v != expected %+v", c, global)
+	}
+	if c := s.NeedCounts(protocol.LocalDeviceID); c != need {
+		t.Errorf("need counts %+v != expected %+v", c, need)
+	}
+
+	// So does removing a file behind the back of the set. The global
+	// version list is repaired and the file is then needed.
+
+	db.Delete(deviceKey(s.folderID, db.deviceID(protocol.LocalDeviceID), []byte("b")))
+
+	s = NewFileSet("test", db)
+	if c := s.LocalCounts(protocol.LocalDeviceID); c.Files != 1 {
+		t.Errorf("unexpected local counts %+v after file removal", c)
+	}
+	if c := s.NeedCounts(protocol.LocalDeviceID); c != need {
+		t.Errorf("need counts %+v != expected %+v", c, need)
+	}
+	if c, e := s.currentCounts(), ldbRecount(db, s.folderID); c.global != e.global || !c.localEqual(e) {
+		t.Errorf("counts %+v != recounted %+v", c, e)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/calmh/xdr"
+	"github.com/syncthing/protocol"
+)
+
+// An index export is a gzip compressed stream of XDR encoded values: the
+// magic number, the format version and then, for each file, the folder ID
+// followed by the FileInfo. Names are in wire format, so an export can be
+// imported on any platform. Version 2 added the sub-second modification
+// times to the FileInfo, version 3 the ownership and extended attributes,
+// version 4 the weak hashes of the blocks and version 5 the block size.
+const (
+	indexExportMagic   = 0x73746978 // "stix"
+	indexExportVersion = 5
+)
+
+// The longest folder ID in an index export. It's a sanity limit for the
+// reader only, as folder IDs are otherwise unlimited.
+const maxExportFolderLen = 8192
+
+var errNotIndexExport = errors.New("not an index export")
+
+// ExportIndex writes the files that the local device has in the given
+// folders, except deleted and invalid ones, to w as an index export.
+func ExportIndex(db *Instance, folders []string, w io.Writer) error {
+	gw := gzip.NewWriter(w)
+	bw := bufio.NewWriter(gw)
+	xw := xdr.NewWriter(bw)
+
+	xw.WriteUint32(indexExportMagic)
+	xw.WriteUint32(indexExportVersion)
+
+	var err error
+	for _, folder := range folders {
+		if len(folder) > maxExportFolderLen {
+			return fmt.Errorf("folder ID %q too long for index export", folder)
+		}
+		ldbWithHave(db, db.folderID(folder), db.deviceID(protocol.LocalDeviceID), nil, false, func(fi FileIntf) bool {
+			f := fi.(protocol.FileInfo)
+			if f.IsDeleted() || f.IsInvalid() {
+				return true
+			}
+			f.LocalVersion = 0
+			xw.WriteString(folder)
+			_, err = f.EncodeXDR(bw)
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := xw.Error(); err != nil {
+		return err
+	}
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// An IndexExportReader reads the files from an index export.
+type IndexExportReader struct {
+	r  io.Reader
+	xr *xdr.Reader
+}
+
+// NewIndexExportReader returns a reader for the index export read from r.
+func NewIndexExportReader(r io.Reader) (*IndexExportReader, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errNotIndexExport
+	}
+	br := bufio.NewReader(gr)
+	xr := xdr.NewReader(br)
+
+	if magic := xr.ReadUint32(); xr.Error() != nil || magic != indexExportMagic {
+		return nil, errNotIndexExport
+	}
+	if version := xr.ReadUint32(); version != indexExportVersion {
+		return nil, errors.New("unsupported index export version")
+	}
+	return &IndexExportReader{br, xr}, nil
+}
+
+// Next returns the next file and the folder it belongs to, or io.EOF at the
+// end of the export.
+func (r *IndexExportReader) Next() (string, protocol.FileInfo, error) {
+	folder := r.xr.ReadStringMax(maxExportFolderLen)
+	if err := r.xr.Error(); err != nil {
+		if xerr, ok := err.(xdr.XDRError); ok && xerr.IsEOF() {
+			return "", protocol.FileInfo{}, io.EOF
+		}
+		return "", protocol.FileInfo{}, err
+	}
+
+	var f protocol.FileInfo
+	if err := f.DecodeXDR(r.r); err != nil {
+		return "", protocol.FileInfo{}, err
+	}
+	return folder, f, nil
+}
+
+// unverifiedKey returns a byte slice encoding the following information:
+//	   keyTypeUnverified (1 byte)
+//	   folder (4 bytes)
+//	   name (variable size)
+func unverifiedKey(folder, file []byte) []byte {
+	k := make([]byte, 1+4+len(file))
+	k[0] = keyTypeUnverified
+	copy(k[1:], folder)
+	copy(k[1+4:], file)
+	return k
+}
+
+// ldbSetUnverified marks the files as imported from an index export, or
+// removes the mark if unverified is false.
+func ldbSetUnverified(db Backend, folder []byte, fs []protocol.FileInfo, unverified bool) {
+	batch := db.NewBatch()
+	for _, f := range fs {
+		if unverified {
+			batch.Put(unverifiedKey(folder, []byte(f.Name)), nil)
+		} else {
+			batch.Delete(unverifiedKey(folder, []byte(f.Name)))
+		}
+	}
+	if err := db.Write(batch); err != nil {
+		panic(err)
+	}
+}
+
+func ldbIsUnverified(db Backend, folder, file []byte) bool {
+	_, err := db.Get(unverifiedKey(folder, file))
+	if err == ErrNotFound {
+		return false
+	}
+	if err != nil {
+		panic(err)
+	}
+	return true
+}
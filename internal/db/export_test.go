@@ -0,0 +1,99 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package db_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/db"
+)
+
+func TestIndexExport(t *testing.T) {
+	ldb := db.OpenMemory()
+
+	a := db.NewFileSet("a", ldb)
+	a.Replace(protocol.LocalDeviceID, []protocol.FileInfo{
+		{Name: "file", Version: 1000, Blocks: genBlocks(2)},
+		{Name: "dir", Version: 1001, Flags: protocol.FlagDirectory},
+		{Name: "deleted", Version: 1002, Flags: protocol.FlagDeleted},
+		{Name: "invalid", Version: 1003, Flags: protocol.FlagInvalid},
+	})
+	a.Replace(remoteDevice0, []protocol.FileInfo{
+		{Name: "remote", Version: 1004, Blocks: genBlocks(1)},
+	})
+	// A folder ID longer than the 64 bytes allowed on the wire
+	long := strings.Repeat("b", 100)
+	b := db.NewFileSet(long, ldb)
+	b.Replace(protocol.LocalDeviceID, []protocol.FileInfo{
+		{Name: "other", Version: 1005, Blocks: genBlocks(3)},
+	})
+
+	var buf bytes.Buffer
+	if err := db.ExportIndex(ldb, []string{"a", long}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := db.NewIndexExportReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for {
+		folder, f, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s:%s:%d:%d", folder, f.Name, f.Version, len(f.Blocks)))
+	}
+	expected := []string{"a:dir:1001:0", "a:file:1000:2", long + ":other:1005:3"}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("Exported %v != expected %v", got, expected)
+	}
+
+	if _, err := db.NewIndexExportReader(bytes.NewReader([]byte("garbage"))); err == nil {
+		t.Error("Unexpected nil error reading garbage")
+	}
+}
+
+func TestUnverified(t *testing.T) {
+	ldb := db.OpenMemory()
+	s := db.NewFileSet("test", ldb)
+
+	f := protocol.FileInfo{Name: "a", Version: 1000, Blocks: genBlocks(1)}
+	s.UpdateUnverified([]protocol.FileInfo{f})
+	if !s.IsUnverified("a") {
+		t.Error("Imported file is not unverified")
+	}
+	if s.IsUnverified("b") {
+		t.Error("Unknown file is unverified")
+	}
+
+	// Updating the file, as when rescanning it, removes the mark.
+
+	f.Version++
+	s.Update(protocol.LocalDeviceID, []protocol.FileInfo{f})
+	if s.IsUnverified("a") {
+		t.Error("Updated file is still unverified")
+	}
+}
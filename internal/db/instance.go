@@ -0,0 +1,485 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/syncthing/protocol"
+)
+
+// The number of entries written per batch when migrating or backing up.
+const convertBatchSize = 1000
+
+// An Instance is the database holding the files of all folders, along with
+// the index tables mapping folder and device IDs to the small integers that
+// represent them in keys.
+type Instance struct {
+	Backend
+	location  string
+	folderIdx *smallIndex
+	deviceIdx *smallIndex
+}
+
+// Open opens the database at the given path, migrating it to the current
+// schema version if necessary. A VersionError is returned if the database
+// is of a newer version.
+func Open(file string) (*Instance, error) {
+	db, err := NewLevelDBBackend(file)
+	if err != nil {
+		return nil, err
+	}
+	i, err := newDBInstance(db, file)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return i, nil
+}
+
+// OpenReadOnly opens the existing database at the given path for reading
+// only. Nothing is written to it; in particular it isn't migrated, so an
+// error is returned unless it's of the current schema version.
+func OpenReadOnly(file string) (*Instance, error) {
+	db, err := openLevelDBBackend(file)
+	if err != nil {
+		return nil, err
+	}
+	i := &Instance{
+		Backend:  readOnlyBackend{db},
+		location: file,
+	}
+
+	version, err := i.schemaVersion()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if version > CurrentVersion {
+		db.Close()
+		return nil, VersionError{version}
+	}
+	if version < CurrentVersion {
+		db.Close()
+		return nil, fmt.Errorf("database schema version %d needs migration to version %d", version, CurrentVersion)
+	}
+
+	i.folderIdx = newSmallIndex(i.Backend, keyTypeFolderIdx)
+	i.deviceIdx = newSmallIndex(i.Backend, keyTypeDeviceIdx)
+	return i, nil
+}
+
+// OpenMemory returns an empty database that lives in memory only.
+func OpenMemory() *Instance {
+	i, err := newDBInstance(NewMemoryBackend(), "")
+	if err != nil {
+		panic(err)
+	}
+	return i
+}
+
+// OpenBackend returns the database stored in the given backend, migrating
+// it to the current schema version if necessary. No backup is made before
+// migrating.
+func OpenBackend(db Backend) (*Instance, error) {
+	return newDBInstance(db, "")
+}
+
+func newDBInstance(db Backend, location string) (*Instance, error) {
+	i := &Instance{
+		Backend:  db,
+		location: location,
+	}
+
+	// The version must be checked before anything else is read, as a newer
+	// version may store it differently.
+	version, err := i.schemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version > CurrentVersion {
+		return nil, VersionError{version}
+	}
+
+	i.folderIdx = newSmallIndex(db, keyTypeFolderIdx)
+	i.deviceIdx = newSmallIndex(db, keyTypeDeviceIdx)
+	if err := i.migrate(version); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// folderID returns the folder as represented in keys.
+func (db *Instance) folderID(folder string) []byte {
+	return db.folderIdx.id([]byte(folder))
+}
+
+// folderName returns the folder represented by the given key bytes.
+func (db *Instance) folderName(id []byte) (string, bool) {
+	folder, ok := db.folderIdx.val(id)
+	return string(folder), ok
+}
+
+// deviceID returns the device as represented in keys and version lists.
+func (db *Instance) deviceID(device protocol.DeviceID) []byte {
+	return db.deviceIdx.id(device[:])
+}
+
+// device returns the device represented by the given key bytes.
+func (db *Instance) device(id []byte) (protocol.DeviceID, bool) {
+	var device protocol.DeviceID
+	bs, ok := db.deviceIdx.val(id)
+	copy(device[:], bs)
+	return device, ok
+}
+
+// convertKeys rewrites the keys used before the introduction of the index
+// tables, padded with the full folder name and device ID, to the current
+// format. It's done in batches and resumes where it left off if interrupted.
+func (db *Instance) convertKeys(int) error {
+	batch := db.NewBatch()
+	var n int
+	for keyType := byte(keyTypeOldDevice); keyType <= keyTypeOldCounts; keyType++ {
+		if err := db.convertKeyType(keyType, batch, &n); err != nil {
+			return err
+		}
+	}
+	if err := db.Write(batch); err != nil {
+		return err
+	}
+
+	if n > 0 {
+		l.Infof("Converted %d database entries to compact keys", n)
+	}
+	return nil
+}
+
+func (db *Instance) convertKeyType(keyType byte, batch Batch, n *int) error {
+	dbi := db.NewPrefixIterator([]byte{keyType})
+	defer dbi.Release()
+
+	for dbi.Next() {
+		if *n == 0 {
+			l.Infoln("Converting database to compact keys; this may take a while")
+		}
+
+		key := dbi.Key()
+		switch key[0] {
+		case keyTypeOldDevice:
+			// keyTypeOldDevice, folder (64 bytes), device (32 bytes), name
+			folder, device, name := oldKeyFolder(key), key[1+64:1+64+32], key[1+64+32:]
+			batch.Put(deviceKey(db.folderIdx.id(folder), db.deviceIdx.id(device), name), dbi.Value())
+
+		case keyTypeOldGlobal:
+			// keyTypeOldGlobal, folder (64 bytes), name
+			folder, name := oldKeyFolder(key), key[1+64:]
+			var vl versionList
+			if err := vl.UnmarshalXDR(dbi.Value()); err != nil {
+				return err
+			}
+			for i := range vl.versions {
+				vl.versions[i].device = db.deviceIdx.id(vl.versions[i].device)
+			}
+			batch.Put(globalKey(db.folderIdx.id(folder), name), vl.MustMarshalXDR())
+
+		case keyTypeOldBlock:
+			// keyTypeOldBlock, folder (64 bytes), hash (32 bytes), name
+			folder, hash, name := oldKeyFolder(key), key[1+64:1+64+32], key[1+64+32:]
+			batch.Put(toBlockKey(hash, db.folderIdx.id(folder), string(name)), dbi.Value())
+
+		case keyTypeOldCounts:
+			// The counts refer to devices by their full ID; they're
+			// recalculated when missing.
+		}
+		batch.Delete(key)
+
+		*n++
+		if batch.Len() >= convertBatchSize {
+			if err := db.Write(batch); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+		if *n%100000 == 0 {
+			l.Infof("Converted %d database entries", *n)
+		}
+	}
+	return dbi.Error()
+}
+
+// addModifiedNs rewrites the stored files to the encoding with the
+// nanoseconds of the modification time, which are set to zero.
+func (db *Instance) addModifiedNs(version int) error {
+	return db.convertFiles(version, insertModifiedNs)
+}
+
+// addPosixMetadata rewrites the stored files to the encoding with the
+// ownership and extended attributes, which are absent.
+func (db *Instance) addPosixMetadata(version int) error {
+	return db.convertFiles(version, func(bs []byte) ([]byte, error) {
+		// An empty Posix list at the end
+		return append(bs[:len(bs):len(bs)], 0, 0, 0, 0), nil
+	})
+}
+
+// addWeakHashes rewrites the stored files to the encoding with the weak
+// hashes of the blocks, which are unknown.
+func (db *Instance) addWeakHashes(version int) error {
+	return db.convertFiles(version, insertWeakHashes)
+}
+
+// addBlockSizes rewrites the stored files to the encoding with the block
+// size, which was that of the first block for files with more than one.
+func (db *Instance) addBlockSizes(version int) error {
+	return db.convertFiles(version, insertBlockSize)
+}
+
+// convertFiles replaces the encoding of each stored file by the result of
+// the given conversion, as the migration to the given version. The
+// conversions can't be applied twice, so the key of the last converted file
+// is stored in each batch, and an interrupted run resumes after it. The last
+// batch records the new version instead.
+func (db *Instance) convertFiles(version int, convert func([]byte) ([]byte, error)) error {
+	var after []byte
+	if bs, err := db.Get(migrationKey()); err == nil && len(bs) >= 8 && int(binary.BigEndian.Uint64(bs)) == version {
+		after = bs[8:]
+		l.Infof("Resuming interrupted database migration to version %d", version)
+	} else if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	dbi := db.NewPrefixIterator([]byte{keyTypeDevice})
+	defer dbi.Release()
+
+	batch := db.NewBatch()
+	for dbi.Next() {
+		if after != nil && bytes.Compare(dbi.Key(), after) <= 0 {
+			continue
+		}
+		bs, err := convert(dbi.Value())
+		if err != nil {
+			return fmt.Errorf("%x: %v", dbi.Key(), err)
+		}
+		batch.Put(dbi.Key(), bs)
+		if batch.Len() >= convertBatchSize {
+			batch.Put(migrationKey(), append(versionBytes(version), dbi.Key()...))
+			if err := db.Write(batch); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := dbi.Error(); err != nil {
+		return err
+	}
+	batch.Delete(migrationKey())
+	batch.Put(versionKey(), versionBytes(version))
+	return db.Write(batch)
+}
+
+// insertModifiedNs returns the XDR encoded FileInfo without the ModifiedNs
+// field with a zero one added after Modified, where it now belongs.
+func insertModifiedNs(bs []byte) ([]byte, error) {
+	if len(bs) < 4 {
+		return nil, errors.New("short file info")
+	}
+	// name length, padded name, flags, modified
+	nameLen := int64(binary.BigEndian.Uint32(bs))
+	off := 4 + (nameLen+3)&^3 + 4 + 8
+	if off > int64(len(bs)) {
+		return nil, errors.New("short file info")
+	}
+	nbs := make([]byte, len(bs)+4)
+	copy(nbs, bs[:off])
+	copy(nbs[off+4:], bs[off:])
+	return nbs, nil
+}
+
+// insertWeakHashes returns the XDR encoded FileInfo with blocks without the
+// WeakHash field with a zero one added after each block hash, where it now
+// belongs.
+func insertWeakHashes(bs []byte) ([]byte, error) {
+	if len(bs) < 4 {
+		return nil, errors.New("short file info")
+	}
+	// name length, padded name, flags, modified, modified ns, version, local
+	// version
+	nameLen := int64(binary.BigEndian.Uint32(bs))
+	off := 4 + (nameLen+3)&^3 + 4 + 8 + 4 + 8 + 8
+	if off+4 > int64(len(bs)) {
+		return nil, errors.New("short file info")
+	}
+	numBlocks := int64(binary.BigEndian.Uint32(bs[off:]))
+	off += 4
+	if numBlocks*8 > int64(len(bs))-off {
+		return nil, errors.New("short file info")
+	}
+
+	nbs := make([]byte, 0, int64(len(bs))+4*numBlocks)
+	nbs = append(nbs, bs[:off]...)
+	for i := int64(0); i < numBlocks; i++ {
+		// size, hash length, padded hash
+		if off+8 > int64(len(bs)) {
+			return nil, errors.New("short block info")
+		}
+		hashLen := int64(binary.BigEndian.Uint32(bs[off+4:]))
+		end := off + 8 + (hashLen+3)&^3
+		if end > int64(len(bs)) {
+			return nil, errors.New("short block info")
+		}
+		nbs = append(nbs, bs[off:end]...)
+		nbs = append(nbs, 0, 0, 0, 0)
+		off = end
+	}
+	return append(nbs, bs[off:]...), nil
+}
+
+// insertBlockSize returns the XDR encoded FileInfo without the RawBlockSize
+// field with one added after LocalVersion, where it now belongs.
+func insertBlockSize(bs []byte) ([]byte, error) {
+	if len(bs) < 4 {
+		return nil, errors.New("short file info")
+	}
+	// name length, padded name, flags, modified, modified ns, version, local
+	// version
+	nameLen := int64(binary.BigEndian.Uint32(bs))
+	off := 4 + (nameLen+3)&^3 + 4 + 8 + 4 + 8 + 8
+	if off+4 > int64(len(bs)) {
+		return nil, errors.New("short file info")
+	}
+
+	// The block size was that of the first block, if there's more than
+	// one.
+	var blockSize int32
+	if numBlocks := binary.BigEndian.Uint32(bs[off:]); numBlocks > 1 && off+8 <= int64(len(bs)) {
+		if size := int(binary.BigEndian.Uint32(bs[off+4:])); protocol.ValidBlockSize(size) {
+			blockSize = protocol.RawBlockSize(size)
+		}
+	}
+
+	nbs := make([]byte, len(bs)+4)
+	copy(nbs, bs[:off])
+	binary.BigEndian.PutUint32(nbs[off:], uint32(blockSize))
+	copy(nbs[off+4:], bs[off:])
+	return nbs, nil
+}
+
+func oldKeyFolder(key []byte) []byte {
+	folder := key[1 : 1+64]
+	if izero := bytes.IndexByte(folder, 0); izero >= 0 {
+		return folder[:izero]
+	}
+	return folder
+}
+
+// A smallIndex maps values, such as folder names and device IDs, to small
+// integers and back. The mapping is stored in the database under the given
+// key type, and an integer is never reused for another value. The integers
+// are handled as four big endian bytes, as used in keys.
+type smallIndex struct {
+	db      Backend
+	keyType byte
+	id2val  map[uint32]string
+	val2id  map[string]uint32
+	nextID  uint32
+	mut     sync.Mutex
+}
+
+func newSmallIndex(db Backend, keyType byte) *smallIndex {
+	idx := &smallIndex{
+		db:      db,
+		keyType: keyType,
+		id2val:  make(map[uint32]string),
+		val2id:  make(map[string]uint32),
+	}
+	idx.load()
+	return idx
+}
+
+func (i *smallIndex) load() {
+	dbi := i.db.NewPrefixIterator([]byte{i.keyType})
+	defer dbi.Release()
+	for dbi.Next() {
+		id := binary.BigEndian.Uint32(dbi.Key()[1:])
+		val := string(dbi.Value())
+		i.id2val[id] = val
+		i.val2id[val] = id
+		if id >= i.nextID {
+			i.nextID = id + 1
+		}
+	}
+}
+
+// id returns the integer for the given value, allocating and storing a new
+// one if needed.
+func (i *smallIndex) id(val []byte) []byte {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+
+	id, ok := i.val2id[string(val)]
+	if !ok {
+		id = i.nextID
+		key := make([]byte, 1+4)
+		key[0] = i.keyType
+		binary.BigEndian.PutUint32(key[1:], id)
+		if err := i.db.Put(key, val); err != nil {
+			panic(err)
+		}
+		i.id2val[id] = string(val)
+		i.val2id[string(val)] = id
+		i.nextID++
+	}
+
+	bs := make([]byte, 4)
+	binary.BigEndian.PutUint32(bs, id)
+	return bs
+}
+
+// lookup returns the integer for the given value, if there is one.
+func (i *smallIndex) lookup(val []byte) ([]byte, bool) {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	id, ok := i.val2id[string(val)]
+	if !ok {
+		return nil, false
+	}
+	bs := make([]byte, 4)
+	binary.BigEndian.PutUint32(bs, id)
+	return bs, true
+}
+
+// values returns all values in the index.
+func (i *smallIndex) values() []string {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	vals := make([]string, 0, len(i.val2id))
+	for val := range i.val2id {
+		vals = append(vals, val)
+	}
+	return vals
+}
+
+// val returns the value for the given integer, if there is one.
+func (i *smallIndex) val(id []byte) ([]byte, bool) {
+	i.mut.Lock()
+	defer i.mut.Unlock()
+	val, ok := i.id2val[binary.BigEndian.Uint32(id)]
+	return []byte(val), ok
+}
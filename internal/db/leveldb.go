@@ -27,10 +27,6 @@ import (
 
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/lamport"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/iterator"
-	"github.com/syndtr/goleveldb/leveldb/opt"
-	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 var (
@@ -50,9 +46,22 @@ func clock(v int64) int64 {
 }
 
 const (
-	keyTypeDevice = iota
+	// The key types used before the index tables were introduced, with
+	// full folder names and device IDs in keys. See Instance.convertKeys.
+	keyTypeOldDevice = iota
+	keyTypeOldGlobal
+	keyTypeOldBlock
+	keyTypeOldCounts
+
+	keyTypeDevice
 	keyTypeGlobal
 	keyTypeBlock
+	keyTypeCounts
+	keyTypeFolderIdx
+	keyTypeDeviceIdx
+	keyTypeVersion
+	keyTypeUnverified
+	keyTypeMigration
 )
 
 type fileVersion struct {
@@ -93,8 +102,29 @@ func (l fileList) Less(a, b int) bool {
 	return l[a].Name < l[b].Name
 }
 
+// uniqueFiles returns the files with only the last of any duplicate names
+// kept, that being the one that would end up in the database anyway. The
+// counts rely on each file being changed at most once per batch.
+func uniqueFiles(fs []protocol.FileInfo) []protocol.FileInfo {
+	last := make(map[string]int, len(fs))
+	for i, f := range fs {
+		last[f.Name] = i
+	}
+	if len(last) == len(fs) {
+		return fs
+	}
+
+	unique := make([]protocol.FileInfo, 0, len(last))
+	for i, f := range fs {
+		if last[f.Name] == i {
+			unique = append(unique, f)
+		}
+	}
+	return unique
+}
+
 type dbReader interface {
-	Get([]byte, *opt.ReadOptions) ([]byte, error)
+	Get([]byte) ([]byte, error)
 }
 
 type dbWriter interface {
@@ -102,83 +132,109 @@ type dbWriter interface {
 	Delete([]byte)
 }
 
+// In keys and version lists, folders and devices are represented by their
+// four byte IDs from the index tables of the Instance. The folder and device
+// parameters below are such IDs, unless noted otherwise.
+
 // deviceKey returns a byte slice encoding the following information:
 //	   keyTypeDevice (1 byte)
-//	   folder (64 bytes)
-//	   device (32 bytes)
+//	   folder (4 bytes)
+//	   device (4 bytes)
 //	   name (variable size)
 func deviceKey(folder, device, file []byte) []byte {
-	k := make([]byte, 1+64+32+len(file))
+	k := make([]byte, 1+4+4+len(file))
 	k[0] = keyTypeDevice
-	if len(folder) > 64 {
-		panic("folder name too long")
-	}
-	copy(k[1:], []byte(folder))
-	copy(k[1+64:], device[:])
-	copy(k[1+64+32:], []byte(file))
+	copy(k[1:], folder)
+	copy(k[1+4:], device)
+	copy(k[1+4+4:], file)
 	return k
 }
 
+// deviceKeyPrefix returns the prefix shared by the device keys of all
+// devices in the folder.
+func deviceKeyPrefix(folder []byte) []byte {
+	return deviceKey(folder, nil, nil)[:1+4]
+}
+
 func deviceKeyName(key []byte) []byte {
-	return key[1+64+32:]
+	return key[1+4+4:]
 }
 
 func deviceKeyFolder(key []byte) []byte {
-	folder := key[1 : 1+64]
-	izero := bytes.IndexByte(folder, 0)
-	if izero < 0 {
-		return folder
-	}
-	return folder[:izero]
+	return key[1 : 1+4]
 }
 
 func deviceKeyDevice(key []byte) []byte {
-	return key[1+64 : 1+64+32]
+	return key[1+4 : 1+4+4]
 }
 
 // globalKey returns a byte slice encoding the following information:
 //	   keyTypeGlobal (1 byte)
-//	   folder (64 bytes)
+//	   folder (4 bytes)
 //	   name (variable size)
 func globalKey(folder, file []byte) []byte {
-	k := make([]byte, 1+64+len(file))
+	k := make([]byte, 1+4+len(file))
 	k[0] = keyTypeGlobal
-	if len(folder) > 64 {
-		panic("folder name too long")
-	}
-	copy(k[1:], []byte(folder))
-	copy(k[1+64:], []byte(file))
+	copy(k[1:], folder)
+	copy(k[1+4:], file)
 	return k
 }
 
 func globalKeyName(key []byte) []byte {
-	return key[1+64:]
+	return key[1+4:]
 }
 
 func globalKeyFolder(key []byte) []byte {
-	folder := key[1 : 1+64]
-	izero := bytes.IndexByte(folder, 0)
-	if izero < 0 {
-		return folder
+	return key[1 : 1+4]
+}
+
+// A subtreeIterator iterates over the keys that start with a prefix ending
+// in a name, and that are for that name or the files below it. That is,
+// "foo" and "foo/bar" but not "foobar".
+type subtreeIterator struct {
+	KeyValueIterator
+	start int // The length of the prefix
+}
+
+// newSubtreeIterator returns an iterator over the keys for the name and the
+// files below it, or over all keys with the prefix if the name is empty.
+func newSubtreeIterator(db Reader, prefix, name []byte) KeyValueIterator {
+	it := db.NewPrefixIterator(prefix)
+	if len(name) == 0 {
+		return it
+	}
+	return subtreeIterator{it, len(prefix)}
+}
+
+func (i subtreeIterator) Next() bool {
+	for i.KeyValueIterator.Next() {
+		key := i.Key()
+		switch {
+		case len(key) == i.start || key[i.start] == '/':
+			return true
+		case key[i.start] > '/':
+			// Keys are sorted, so there are no more in the subtree.
+			return false
+		}
 	}
-	return folder[:izero]
+	return false
 }
 
-type deletionHandler func(db dbReader, batch dbWriter, folder, device, name []byte, dbi iterator.Iterator) int64
+type deletionHandler func(db dbReader, batch dbWriter, folder, device, name []byte, dbi KeyValueIterator, counts *folderCounts) int64
 
-func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo, deleteFn deletionHandler) int64 {
+func ldbGenericReplace(db Backend, folder, device []byte, fs []protocol.FileInfo, deleteFn deletionHandler, counts *folderCounts) int64 {
 	runtime.GC()
 
+	fs = uniqueFiles(fs)
 	sort.Sort(fileList(fs)) // sort list on name, same as in the database
 
-	start := deviceKey(folder, device, nil)                            // before all folder/device files
-	limit := deviceKey(folder, device, []byte{0xff, 0xff, 0xff, 0xff}) // after all folder/device files
+	prefix := deviceKey(folder, device, nil)
 
-	batch := new(leveldb.Batch)
+	batch := db.NewBatch()
 	if debugDB {
 		l.Debugf("new batch %p", batch)
 	}
-	snap, err := db.GetSnapshot()
+	snap, err := db.NewSnapshot()
 	if err != nil {
 		panic(err)
 	}
@@ -192,7 +248,7 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 		snap.Release()
 	}()
 
-	dbi := snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	dbi := snap.NewPrefixIterator(prefix)
 	defer dbi.Release()
 
 	moreDb := dbi.Next()
@@ -218,7 +274,7 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 		cmp := bytes.Compare(newName, oldName)
 
 		if debugDB {
-			l.Debugf("generic replace; folder=%q device=%v moreFs=%v moreDb=%v cmp=%d newName=%q oldName=%q", folder, protocol.DeviceIDFromBytes(device), moreFs, moreDb, cmp, newName, oldName)
+			l.Debugf("generic replace; folder=%x device=%x moreFs=%v moreDb=%v cmp=%d newName=%q oldName=%q", folder, device, moreFs, moreDb, cmp, newName, oldName)
 		}
 
 		switch {
@@ -230,10 +286,12 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 			if lv := ldbInsert(batch, folder, device, fs[fsi]); lv > maxLocalVer {
 				maxLocalVer = lv
 			}
+			nf := truncate(fs[fsi])
+			counts.updateLocal(device, nil, &nf)
 			if fs[fsi].IsInvalid() {
-				ldbRemoveFromGlobal(snap, batch, folder, device, newName)
+				ldbRemoveFromGlobal(snap, batch, folder, device, newName, counts)
 			} else {
-				ldbUpdateGlobal(snap, batch, folder, device, newName, fs[fsi].Version)
+				ldbUpdateGlobal(snap, batch, folder, device, nf, counts)
 			}
 			fsi++
 
@@ -254,10 +312,12 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 				if lv := ldbInsert(batch, folder, device, fs[fsi]); lv > maxLocalVer {
 					maxLocalVer = lv
 				}
+				nf := truncate(fs[fsi])
+				counts.updateLocal(device, &ef, &nf)
 				if fs[fsi].IsInvalid() {
-					ldbRemoveFromGlobal(snap, batch, folder, device, newName)
+					ldbRemoveFromGlobal(snap, batch, folder, device, newName, counts)
 				} else {
-					ldbUpdateGlobal(snap, batch, folder, device, newName, fs[fsi].Version)
+					ldbUpdateGlobal(snap, batch, folder, device, nf, counts)
 				}
 			} else if debugDB {
 				l.Debugln("generic replace; equal - ignore")
@@ -270,17 +330,18 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 			if debugDB {
 				l.Debugln("generic replace; exists - remove")
 			}
-			if lv := deleteFn(snap, batch, folder, device, oldName, dbi); lv > maxLocalVer {
+			if lv := deleteFn(snap, batch, folder, device, oldName, dbi, counts); lv > maxLocalVer {
 				maxLocalVer = lv
 			}
 			moreDb = dbi.Next()
 		}
 	}
 
+	ldbPutCounts(batch, folder, counts)
 	if debugDB {
 		l.Debugf("db.Write %p", batch)
 	}
-	err = db.Write(batch, nil)
+	err = db.Write(batch)
 	if err != nil {
 		panic(err)
 	}
@@ -288,24 +349,31 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 	return maxLocalVer
 }
 
-func ldbReplace(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) int64 {
+func ldbReplace(db Backend, folder, device []byte, fs []protocol.FileInfo, counts *folderCounts) int64 {
 	// TODO: Return the remaining maxLocalVer?
-	return ldbGenericReplace(db, folder, device, fs, func(db dbReader, batch dbWriter, folder, device, name []byte, dbi iterator.Iterator) int64 {
+	return ldbGenericReplace(db, folder, device, fs, func(db dbReader, batch dbWriter, folder, device, name []byte, dbi KeyValueIterator, counts *folderCounts) int64 {
 		// Database has a file that we are missing. Remove it.
 		if debugDB {
-			l.Debugf("delete; folder=%q device=%v name=%q", folder, protocol.DeviceIDFromBytes(device), name)
+			l.Debugf("delete; folder=%x device=%x name=%q", folder, device, name)
+		}
+		if counts != nil {
+			var tf FileInfoTruncated
+			if err := tf.UnmarshalXDR(dbi.Value()); err != nil {
+				panic(err)
+			}
+			counts.updateLocal(device, &tf, nil)
 		}
-		ldbRemoveFromGlobal(db, batch, folder, device, name)
+		ldbRemoveFromGlobal(db, batch, folder, device, name, counts)
 		if debugDB {
 			l.Debugf("batch.Delete %p %x", batch, dbi.Key())
 		}
 		batch.Delete(dbi.Key())
 		return 0
-	})
+	}, counts)
 }
 
-func ldbReplaceWithDelete(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) int64 {
-	return ldbGenericReplace(db, folder, device, fs, func(db dbReader, batch dbWriter, folder, device, name []byte, dbi iterator.Iterator) int64 {
+func ldbReplaceWithDelete(db Backend, folder, device []byte, fs []protocol.FileInfo, counts *folderCounts) int64 {
+	return ldbGenericReplace(db, folder, device, fs, func(db dbReader, batch dbWriter, folder, device, name []byte, dbi KeyValueIterator, counts *folderCounts) int64 {
 		var tf FileInfoTruncated
 		err := tf.UnmarshalXDR(dbi.Value())
 		if err != nil {
@@ -313,7 +381,7 @@ func ldbReplaceWithDelete(db *leveldb.DB, folder, device []byte, fs []protocol.F
 		}
 		if !tf.IsDeleted() {
 			if debugDB {
-				l.Debugf("mark deleted; folder=%q device=%v name=%q", folder, protocol.DeviceIDFromBytes(device), name)
+				l.Debugf("mark deleted; folder=%x device=%x name=%q", folder, device, name)
 			}
 			ts := clock(tf.LocalVersion)
 			f := protocol.FileInfo{
@@ -322,27 +390,32 @@ func ldbReplaceWithDelete(db *leveldb.DB, folder, device []byte, fs []protocol.F
 				LocalVersion: ts,
 				Flags:        tf.Flags | protocol.FlagDeleted,
 				Modified:     tf.Modified,
+				ModifiedNs:   tf.ModifiedNs,
 			}
 			bs, _ := f.MarshalXDR()
 			if debugDB {
 				l.Debugf("batch.Put %p %x", batch, dbi.Key())
 			}
 			batch.Put(dbi.Key(), bs)
-			ldbUpdateGlobal(db, batch, folder, device, deviceKeyName(dbi.Key()), f.Version)
+			nf := truncate(f)
+			counts.updateLocal(device, &tf, &nf)
+			ldbUpdateGlobal(db, batch, folder, device, nf, counts)
 			return ts
 		}
 		return 0
-	})
+	}, counts)
 }
 
-func ldbUpdate(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) int64 {
+func ldbUpdate(db Backend, folder, device []byte, fs []protocol.FileInfo, counts *folderCounts) int64 {
 	runtime.GC()
 
-	batch := new(leveldb.Batch)
+	fs = uniqueFiles(fs)
+
+	batch := db.NewBatch()
 	if debugDB {
 		l.Debugf("new batch %p", batch)
 	}
-	snap, err := db.GetSnapshot()
+	snap, err := db.NewSnapshot()
 	if err != nil {
 		panic(err)
 	}
@@ -363,15 +436,17 @@ func ldbUpdate(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) in
 		if debugDB {
 			l.Debugf("snap.Get %p %x", snap, fk)
 		}
-		bs, err := snap.Get(fk, nil)
-		if err == leveldb.ErrNotFound {
+		bs, err := snap.Get(fk)
+		if err == ErrNotFound {
 			if lv := ldbInsert(batch, folder, device, f); lv > maxLocalVer {
 				maxLocalVer = lv
 			}
+			nf := truncate(f)
+			counts.updateLocal(device, nil, &nf)
 			if f.IsInvalid() {
-				ldbRemoveFromGlobal(snap, batch, folder, device, name)
+				ldbRemoveFromGlobal(snap, batch, folder, device, name, counts)
 			} else {
-				ldbUpdateGlobal(snap, batch, folder, device, name, f.Version)
+				ldbUpdateGlobal(snap, batch, folder, device, nf, counts)
 			}
 			continue
 		}
@@ -387,18 +462,21 @@ func ldbUpdate(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) in
 			if lv := ldbInsert(batch, folder, device, f); lv > maxLocalVer {
 				maxLocalVer = lv
 			}
+			nf := truncate(f)
+			counts.updateLocal(device, &ef, &nf)
 			if f.IsInvalid() {
-				ldbRemoveFromGlobal(snap, batch, folder, device, name)
+				ldbRemoveFromGlobal(snap, batch, folder, device, name, counts)
 			} else {
-				ldbUpdateGlobal(snap, batch, folder, device, name, f.Version)
+				ldbUpdateGlobal(snap, batch, folder, device, nf, counts)
 			}
 		}
 	}
 
+	ldbPutCounts(batch, folder, counts)
 	if debugDB {
 		l.Debugf("db.Write %p", batch)
 	}
-	err = db.Write(batch, nil)
+	err = db.Write(batch)
 	if err != nil {
 		panic(err)
 	}
@@ -408,7 +486,7 @@ func ldbUpdate(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) in
 
 func ldbInsert(batch dbWriter, folder, device []byte, file protocol.FileInfo) int64 {
 	if debugDB {
-		l.Debugf("insert; folder=%q device=%v %v", folder, protocol.DeviceIDFromBytes(device), file)
+		l.Debugf("insert; folder=%x device=%x %v", folder, device, file)
 	}
 
 	if file.LocalVersion == 0 {
@@ -427,14 +505,17 @@ func ldbInsert(batch dbWriter, folder, device []byte, file protocol.FileInfo) in
 
 // ldbUpdateGlobal adds this device+version to the version list for the given
 // file. If the device is already present in the list, the version is updated.
-// If the file does not have an entry in the global list, it is created.
-func ldbUpdateGlobal(db dbReader, batch dbWriter, folder, device, file []byte, version int64) bool {
+// If the file does not have an entry in the global list, it is created. The
+// counts, if not nil, are updated to match.
+func ldbUpdateGlobal(db dbReader, batch dbWriter, folder, device []byte, file FileInfoTruncated, counts *folderCounts) bool {
+	name := []byte(file.Name)
+	version := file.Version
 	if debugDB {
-		l.Debugf("update global; folder=%q device=%v file=%q version=%d", folder, protocol.DeviceIDFromBytes(device), file, version)
+		l.Debugf("update global; folder=%x device=%x file=%q version=%d", folder, device, name, version)
 	}
-	gk := globalKey(folder, file)
-	svl, err := db.Get(gk, nil)
-	if err != nil && err != leveldb.ErrNotFound {
+	gk := globalKey(folder, name)
+	svl, err := db.Get(gk)
+	if err != nil && err != ErrNotFound {
 		panic(err)
 	}
 
@@ -448,11 +529,14 @@ func ldbUpdateGlobal(db dbReader, batch dbWriter, folder, device, file []byte, v
 		if err != nil {
 			panic(err)
 		}
+		counts.updateGlobal(db, folder, name, fl, nil, FileInfoTruncated{}, -1)
 
 		for i := range fl.versions {
 			if bytes.Compare(fl.versions[i].device, device) == 0 {
 				if fl.versions[i].version == version {
-					// No need to do anything
+					// No need to update the version list, but the flags of
+					// the file may have changed.
+					counts.updateGlobal(db, folder, name, fl, device, file, 1)
 					return false
 				}
 				fl.versions = append(fl.versions[:i], fl.versions[i+1:]...)
@@ -479,20 +563,21 @@ done:
 		l.Debugf("new global after update: %v", fl)
 	}
 	batch.Put(gk, fl.MustMarshalXDR())
+	counts.updateGlobal(db, folder, name, fl, device, file, 1)
 
 	return true
 }
 
 // ldbRemoveFromGlobal removes the device from the global version list for the
 // given file. If the version list is empty after this, the file entry is
-// removed entirely.
-func ldbRemoveFromGlobal(db dbReader, batch dbWriter, folder, device, file []byte) {
+// removed entirely. The counts, if not nil, are updated to match.
+func ldbRemoveFromGlobal(db dbReader, batch dbWriter, folder, device, file []byte, counts *folderCounts) {
 	if debugDB {
-		l.Debugf("remove from global; folder=%q device=%v file=%q", folder, protocol.DeviceIDFromBytes(device), file)
+		l.Debugf("remove from global; folder=%x device=%x file=%q", folder, device, file)
 	}
 
 	gk := globalKey(folder, file)
-	svl, err := db.Get(gk, nil)
+	svl, err := db.Get(gk)
 	if err != nil {
 		// We might be called to "remove" a global version that doesn't exist
 		// if the first update for the file is already marked invalid.
@@ -504,6 +589,7 @@ func ldbRemoveFromGlobal(db dbReader, batch dbWriter, folder, device, file []byt
 	if err != nil {
 		panic(err)
 	}
+	counts.updateGlobal(db, folder, file, fl, nil, FileInfoTruncated{}, -1)
 
 	for i := range fl.versions {
 		if bytes.Compare(fl.versions[i].device, device) == 0 {
@@ -523,13 +609,13 @@ func ldbRemoveFromGlobal(db dbReader, batch dbWriter, folder, device, file []byt
 			l.Debugf("new global after remove: %v", fl)
 		}
 		batch.Put(gk, fl.MustMarshalXDR())
+		counts.updateGlobal(db, folder, file, fl, nil, FileInfoTruncated{}, 1)
 	}
 }
 
-func ldbWithHave(db *leveldb.DB, folder, device []byte, truncate bool, fn Iterator) {
-	start := deviceKey(folder, device, nil)                            // before all folder/device files
-	limit := deviceKey(folder, device, []byte{0xff, 0xff, 0xff, 0xff}) // after all folder/device files
-	snap, err := db.GetSnapshot()
+func ldbWithHave(db Backend, folder, device, sub []byte, truncate bool, fn Iterator) {
+	prefix := deviceKey(folder, device, sub)
+	snap, err := db.NewSnapshot()
 	if err != nil {
 		panic(err)
 	}
@@ -543,7 +629,7 @@ func ldbWithHave(db *leveldb.DB, folder, device []byte, truncate bool, fn Iterat
 		snap.Release()
 	}()
 
-	dbi := snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	dbi := newSubtreeIterator(snap, prefix, sub)
 	defer dbi.Release()
 
 	for dbi.Next() {
@@ -557,12 +643,10 @@ func ldbWithHave(db *leveldb.DB, folder, device []byte, truncate bool, fn Iterat
 	}
 }
 
-func ldbWithAllFolderTruncated(db *leveldb.DB, folder []byte, fn func(device []byte, f FileInfoTruncated) bool) {
+func ldbWithAllFolderTruncated(db Backend, folder []byte, fn func(device []byte, f FileInfoTruncated) bool) {
 	runtime.GC()
 
-	start := deviceKey(folder, nil, nil)                                                  // before all folder/device files
-	limit := deviceKey(folder, protocol.LocalDeviceID[:], []byte{0xff, 0xff, 0xff, 0xff}) // after all folder/device files
-	snap, err := db.GetSnapshot()
+	snap, err := db.NewSnapshot()
 	if err != nil {
 		panic(err)
 	}
@@ -576,7 +660,7 @@ func ldbWithAllFolderTruncated(db *leveldb.DB, folder []byte, fn func(device []b
 		snap.Release()
 	}()
 
-	dbi := snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	dbi := snap.NewPrefixIterator(deviceKeyPrefix(folder))
 	defer dbi.Release()
 
 	for dbi.Next() {
@@ -590,10 +674,10 @@ func ldbWithAllFolderTruncated(db *leveldb.DB, folder []byte, fn func(device []b
 		switch f.Name {
 		case "", ".", "..", "/": // A few obviously invalid filenames
 			l.Infof("Dropping invalid filename %q from database", f.Name)
-			batch := new(leveldb.Batch)
-			ldbRemoveFromGlobal(db, batch, folder, device, nil)
+			batch := db.NewBatch()
+			ldbRemoveFromGlobal(db, batch, folder, device, nil, nil)
 			batch.Delete(dbi.Key())
-			db.Write(batch, nil)
+			db.Write(batch)
 			continue
 		}
 
@@ -603,10 +687,10 @@ func ldbWithAllFolderTruncated(db *leveldb.DB, folder []byte, fn func(device []b
 	}
 }
 
-func ldbGet(db *leveldb.DB, folder, device, file []byte) (protocol.FileInfo, bool) {
+func ldbGet(db Backend, folder, device, file []byte) (protocol.FileInfo, bool) {
 	nk := deviceKey(folder, device, file)
-	bs, err := db.Get(nk, nil)
-	if err == leveldb.ErrNotFound {
+	bs, err := db.Get(nk)
+	if err == ErrNotFound {
 		return protocol.FileInfo{}, false
 	}
 	if err != nil {
@@ -621,9 +705,9 @@ func ldbGet(db *leveldb.DB, folder, device, file []byte) (protocol.FileInfo, boo
 	return f, true
 }
 
-func ldbGetGlobal(db *leveldb.DB, folder, file []byte, truncate bool) (FileIntf, bool) {
+func ldbGetGlobal(db Backend, folder, file []byte, truncate bool) (FileIntf, bool) {
 	k := globalKey(folder, file)
-	snap, err := db.GetSnapshot()
+	snap, err := db.NewSnapshot()
 	if err != nil {
 		panic(err)
 	}
@@ -640,8 +724,8 @@ func ldbGetGlobal(db *leveldb.DB, folder, file []byte, truncate bool) (FileIntf,
 	if debugDB {
 		l.Debugf("snap.Get %p %x", snap, k)
 	}
-	bs, err := snap.Get(k, nil)
-	if err == leveldb.ErrNotFound {
+	bs, err := snap.Get(k)
+	if err == ErrNotFound {
 		return nil, false
 	}
 	if err != nil {
@@ -662,7 +746,7 @@ func ldbGetGlobal(db *leveldb.DB, folder, file []byte, truncate bool) (FileIntf,
 	if debugDB {
 		l.Debugf("snap.Get %p %x", snap, k)
 	}
-	bs, err = snap.Get(k, nil)
+	bs, err = snap.Get(k)
 	if err != nil {
 		panic(err)
 	}
@@ -674,12 +758,11 @@ func ldbGetGlobal(db *leveldb.DB, folder, file []byte, truncate bool) (FileIntf,
 	return fi, true
 }
 
-func ldbWithGlobal(db *leveldb.DB, folder []byte, truncate bool, fn Iterator) {
+func ldbWithGlobal(db Backend, folder, sub []byte, truncate bool, fn Iterator) {
 	runtime.GC()
 
-	start := globalKey(folder, nil)
-	limit := globalKey(folder, []byte{0xff, 0xff, 0xff, 0xff})
-	snap, err := db.GetSnapshot()
+	prefix := globalKey(folder, sub)
+	snap, err := db.NewSnapshot()
 	if err != nil {
 		panic(err)
 	}
@@ -693,7 +776,7 @@ func ldbWithGlobal(db *leveldb.DB, folder []byte, truncate bool, fn Iterator) {
 		snap.Release()
 	}()
 
-	dbi := snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	dbi := newSubtreeIterator(snap, prefix, sub)
 	defer dbi.Release()
 
 	for dbi.Next() {
@@ -711,7 +794,7 @@ func ldbWithGlobal(db *leveldb.DB, folder []byte, truncate bool, fn Iterator) {
 		if debugDB {
 			l.Debugf("snap.Get %p %x", snap, fk)
 		}
-		bs, err := snap.Get(fk, nil)
+		bs, err := snap.Get(fk)
 		if err != nil {
 			l.Debugf("folder: %q (%x)", folder, folder)
 			l.Debugf("key: %q (%x)", dbi.Key(), dbi.Key())
@@ -719,7 +802,7 @@ func ldbWithGlobal(db *leveldb.DB, folder []byte, truncate bool, fn Iterator) {
 			l.Debugf("vl.versions[0].device: %x", vl.versions[0].device)
 			l.Debugf("name: %q (%x)", name, name)
 			l.Debugf("fk: %q", fk)
-			l.Debugf("fk: %x %x %x", fk[1:1+64], fk[1+64:1+64+32], fk[1+64+32:])
+			l.Debugf("fk: %x %x %x", deviceKeyFolder(fk), deviceKeyDevice(fk), deviceKeyName(fk))
 			panic(err)
 		}
 
@@ -734,10 +817,10 @@ func ldbWithGlobal(db *leveldb.DB, folder []byte, truncate bool, fn Iterator) {
 	}
 }
 
-func ldbAvailability(db *leveldb.DB, folder, file []byte) []protocol.DeviceID {
+func ldbAvailability(db *Instance, folder, file []byte) []protocol.DeviceID {
 	k := globalKey(folder, file)
-	bs, err := db.Get(k, nil)
-	if err == leveldb.ErrNotFound {
+	bs, err := db.Get(k)
+	if err == ErrNotFound {
 		return nil
 	}
 	if err != nil {
@@ -755,19 +838,19 @@ func ldbAvailability(db *leveldb.DB, folder, file []byte) []protocol.DeviceID {
 		if v.version != vl.versions[0].version {
 			break
 		}
-		n := protocol.DeviceIDFromBytes(v.device)
-		devices = append(devices, n)
+		if n, ok := db.device(v.device); ok {
+			devices = append(devices, n)
+		}
 	}
 
 	return devices
 }
 
-func ldbWithNeed(db *leveldb.DB, folder, device []byte, truncate bool, fn Iterator) {
+func ldbWithNeed(db Backend, folder, device, sub []byte, truncate bool, fn Iterator) {
 	runtime.GC()
 
-	start := globalKey(folder, nil)
-	limit := globalKey(folder, []byte{0xff, 0xff, 0xff, 0xff})
-	snap, err := db.GetSnapshot()
+	prefix := globalKey(folder, sub)
+	snap, err := db.NewSnapshot()
 	if err != nil {
 		panic(err)
 	}
@@ -781,7 +864,7 @@ func ldbWithNeed(db *leveldb.DB, folder, device []byte, truncate bool, fn Iterat
 		snap.Release()
 	}()
 
-	dbi := snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	dbi := newSubtreeIterator(snap, prefix, sub)
 	defer dbi.Release()
 
 outer:
@@ -821,7 +904,7 @@ outer:
 				if debugDB {
 					l.Debugf("snap.Get %p %x", snap, fk)
 				}
-				bs, err := snap.Get(fk, nil)
+				bs, err := snap.Get(fk)
 				if err != nil {
 					var id protocol.DeviceID
 					copy(id[:], device)
@@ -851,7 +934,7 @@ outer:
 				}
 
 				if debugDB {
-					l.Debugf("need folder=%q device=%v name=%q need=%v have=%v haveV=%d globalV=%d", folder, protocol.DeviceIDFromBytes(device), name, need, have, haveVersion, vl.versions[0].version)
+					l.Debugf("need folder=%x device=%x name=%q need=%v have=%v haveV=%d globalV=%d", folder, device, name, need, have, haveVersion, vl.versions[0].version)
 				}
 
 				if cont := fn(gf); !cont {
@@ -865,49 +948,26 @@ outer:
 	}
 }
 
-func ldbListFolders(db *leveldb.DB) []string {
-	runtime.GC()
-
-	start := []byte{keyTypeGlobal}
-	limit := []byte{keyTypeGlobal + 1}
-	snap, err := db.GetSnapshot()
-	if err != nil {
-		panic(err)
-	}
-	if debugDB {
-		l.Debugf("created snapshot %p", snap)
-	}
-	defer func() {
-		if debugDB {
-			l.Debugf("close snapshot %p", snap)
-		}
-		snap.Release()
-	}()
-
-	dbi := snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
-	defer dbi.Release()
-
-	folderExists := make(map[string]bool)
-	for dbi.Next() {
-		folder := string(globalKeyFolder(dbi.Key()))
-		if !folderExists[folder] {
-			folderExists[folder] = true
+// ldbListFolders returns the names of the folders that have files in the
+// database.
+func ldbListFolders(db *Instance) []string {
+	var folders []string
+	for _, folder := range db.folderIdx.values() {
+		dbi := db.NewPrefixIterator(globalKey(db.folderID(folder), nil))
+		if dbi.Next() {
+			folders = append(folders, folder)
 		}
-	}
-
-	folders := make([]string, 0, len(folderExists))
-	for k := range folderExists {
-		folders = append(folders, k)
+		dbi.Release()
 	}
 
 	sort.Strings(folders)
 	return folders
 }
 
-func ldbDropFolder(db *leveldb.DB, folder []byte) {
+func ldbDropFolder(db Backend, folder []byte) {
 	runtime.GC()
 
-	snap, err := db.GetSnapshot()
+	snap, err := db.NewSnapshot()
 	if err != nil {
 		panic(err)
 	}
@@ -922,28 +982,27 @@ func ldbDropFolder(db *leveldb.DB, folder []byte) {
 	}()
 
 	// Remove all items related to the given folder from the device->file bucket
-	start := []byte{keyTypeDevice}
-	limit := []byte{keyTypeDevice + 1}
-	dbi := snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	dbi := snap.NewPrefixIterator(deviceKeyPrefix(folder))
 	for dbi.Next() {
-		itemFolder := deviceKeyFolder(dbi.Key())
-		if bytes.Compare(folder, itemFolder) == 0 {
-			db.Delete(dbi.Key(), nil)
-		}
+		db.Delete(dbi.Key())
 	}
 	dbi.Release()
 
 	// Remove all items related to the given folder from the global bucket
-	start = []byte{keyTypeGlobal}
-	limit = []byte{keyTypeGlobal + 1}
-	dbi = snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	dbi = snap.NewPrefixIterator(globalKey(folder, nil))
 	for dbi.Next() {
-		itemFolder := globalKeyFolder(dbi.Key())
-		if bytes.Compare(folder, itemFolder) == 0 {
-			db.Delete(dbi.Key(), nil)
-		}
+		db.Delete(dbi.Key())
 	}
 	dbi.Release()
+
+	// Remove the marks on files imported from an index export
+	dbi = snap.NewPrefixIterator(unverifiedKey(folder, nil))
+	for dbi.Next() {
+		db.Delete(dbi.Key())
+	}
+	dbi.Release()
+
+	db.Delete(countsKey(folder))
 }
 
 func unmarshalTrunc(bs []byte, truncate bool) (FileIntf, error) {
@@ -958,10 +1017,12 @@ func unmarshalTrunc(bs []byte, truncate bool) (FileIntf, error) {
 	}
 }
 
-func ldbCheckGlobals(db *leveldb.DB, folder []byte) {
+// ldbCheckGlobals repairs global version lists pointing to files that don't
+// exist, and returns true if it had to.
+func ldbCheckGlobals(db Backend, folder []byte) bool {
 	defer runtime.GC()
 
-	snap, err := db.GetSnapshot()
+	snap, err := db.NewSnapshot()
 	if err != nil {
 		panic(err)
 	}
@@ -975,15 +1036,14 @@ func ldbCheckGlobals(db *leveldb.DB, folder []byte) {
 		snap.Release()
 	}()
 
-	start := globalKey(folder, nil)
-	limit := globalKey(folder, []byte{0xff, 0xff, 0xff, 0xff})
-	dbi := snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	dbi := snap.NewPrefixIterator(globalKey(folder, nil))
 	defer dbi.Release()
 
-	batch := new(leveldb.Batch)
+	batch := db.NewBatch()
 	if debugDB {
 		l.Debugf("new batch %p", batch)
 	}
+	repaired := false
 	for dbi.Next() {
 		gk := dbi.Key()
 		var vl versionList
@@ -1004,8 +1064,8 @@ func ldbCheckGlobals(db *leveldb.DB, folder []byte) {
 			if debugDB {
 				l.Debugf("snap.Get %p %x", snap, fk)
 			}
-			_, err := snap.Get(fk, nil)
-			if err == leveldb.ErrNotFound {
+			_, err := snap.Get(fk)
+			if err == ErrNotFound {
 				continue
 			}
 			if err != nil {
@@ -1015,12 +1075,14 @@ func ldbCheckGlobals(db *leveldb.DB, folder []byte) {
 		}
 
 		if len(newVL.versions) != len(vl.versions) {
-			l.Infof("db repair: rewriting global version list for %x %x", gk[1:1+64], gk[1+64:])
+			l.Infof("db repair: rewriting global version list for %x %x", globalKeyFolder(gk), globalKeyName(gk))
 			batch.Put(dbi.Key(), newVL.MustMarshalXDR())
+			repaired = true
 		}
 	}
 	if debugDB {
 		l.Infoln("db check completed for %q", folder)
 	}
-	db.Write(batch, nil)
+	db.Write(batch)
+	return repaired
 }
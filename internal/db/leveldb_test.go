@@ -17,12 +17,17 @@ package db
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"testing"
+
+	"github.com/calmh/xdr"
+	"github.com/syncthing/protocol"
 )
 
 func TestDeviceKey(t *testing.T) {
-	fld := []byte("folder6789012345678901234567890123456789012345678901234567890123")
-	dev := []byte("device67890123456789012345678901")
+	fld := []byte{0, 0, 0, 42}
+	dev := []byte{0, 0, 1, 7}
 	name := []byte("name")
 
 	key := deviceKey(fld, dev, name)
@@ -42,7 +47,7 @@ func TestDeviceKey(t *testing.T) {
 }
 
 func TestGlobalKey(t *testing.T) {
-	fld := []byte("folder6789012345678901234567890123456789012345678901234567890123")
+	fld := []byte{0, 0, 0, 42}
 	name := []byte("name")
 
 	key := globalKey(fld, name)
@@ -56,3 +61,231 @@ func TestGlobalKey(t *testing.T) {
 		t.Errorf("wrong name %q != %q", name2, name)
 	}
 }
+
+func TestConvertKeys(t *testing.T) {
+	ldb := NewMemoryBackend()
+
+	// A folder with a name longer than the 64 bytes that used to be the
+	// limit, and one file with one block in the old format.
+
+	folder := "folder6789012345678901234567890123456789012345678901234567890123"
+	remote := protocol.DeviceID{1, 2, 3}
+	f := protocol.FileInfo{Name: "a", Version: 1000, Blocks: genBlocks(1)}
+
+	oldKey := func(keyType byte, folder string, parts ...[]byte) []byte {
+		k := make([]byte, 1+64)
+		k[0] = keyType
+		copy(k[1:], folder)
+		for _, p := range parts {
+			k = append(k, p...)
+		}
+		return k
+	}
+	vl := versionList{versions: []fileVersion{{version: 1000, device: remote[:]}}}
+	ldb.Put(oldKey(keyTypeOldDevice, folder[:64], remote[:], []byte("a")), marshalV1(f))
+	ldb.Put(oldKey(keyTypeOldGlobal, folder[:64], []byte("a")), vl.MustMarshalXDR())
+	ldb.Put(oldKey(keyTypeOldBlock, folder[:64], f.Blocks[0].Hash, []byte("a")), []byte{0, 0, 0, 0})
+	ldb.Put(oldKey(keyTypeOldCounts, folder[:64]), []byte("stale"))
+
+	db, err := newDBInstance(ldb, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbi := db.NewPrefixIterator(nil)
+	for dbi.Next() {
+		if dbi.Key()[0] <= keyTypeOldCounts {
+			t.Errorf("unconverted key %x", dbi.Key())
+		}
+	}
+	dbi.Release()
+
+	if folders := ListFolders(db); len(folders) != 1 || folders[0] != folder[:64] {
+		t.Errorf("unexpected folders %q", folders)
+	}
+
+	s := NewFileSet(folder[:64], db)
+	if g, ok := s.GetGlobal("a"); !ok || g.Version != 1000 {
+		t.Errorf("unexpected global file %v", g)
+	}
+	if av := s.Availability("a"); len(av) != 1 || av[0] != remote {
+		t.Errorf("unexpected availability %v", av)
+	}
+	if c := s.NeedCounts(protocol.LocalDeviceID); c.Files != 1 {
+		t.Errorf("unexpected need counts %+v", c)
+	}
+	n := 0
+	bf := &BlockFinder{db: db, folders: []string{folder[:64]}}
+	bf.Iterate(f.Blocks[0].Hash, func(folder, file string, index int32) bool {
+		n++
+		return file != "a"
+	})
+	if n != 1 {
+		t.Errorf("block not found")
+	}
+
+	// Folder names are no longer limited in length.
+
+	s = NewFileSet(folder+folder, db)
+	s.Replace(protocol.LocalDeviceID, []protocol.FileInfo{f})
+	if _, ok := s.Get(protocol.LocalDeviceID, "a"); !ok {
+		t.Error("file not found in folder with long name")
+	}
+}
+
+func TestMigrateFileEncoding(t *testing.T) {
+	ldb := NewMemoryBackend()
+	ldb.Put(versionKey(), []byte{0, 0, 0, 0, 0, 0, 0, 1})
+
+	// A version 1 database, with files encoded without nanoseconds
+	fs := []protocol.FileInfo{
+		{Name: "a", Modified: 1234567890, Version: 1000, Blocks: genBlocks(2)},
+		{Name: "a name of some length", Flags: protocol.FlagDeleted, Modified: 42, Version: 1001},
+		{Name: "large", Modified: 1234567890, Version: 1002, RawBlockSize: 1 << 20, Blocks: []protocol.BlockInfo{
+			{Size: 1 << 20, Hash: []byte("some hash bytes")},
+			{Size: 100, Hash: []byte("other hash bytes")},
+		}},
+	}
+	for _, f := range fs {
+		ldb.Put(deviceKey([]byte{0, 0, 0, 0}, []byte{0, 0, 0, 0}, []byte(f.Name)), marshalV1(f))
+	}
+
+	db, err := newDBInstance(ldb, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range fs {
+		bs, err := db.Get(deviceKey([]byte{0, 0, 0, 0}, []byte{0, 0, 0, 0}, []byte(f.Name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var g protocol.FileInfo
+		if err := g.UnmarshalXDR(bs); err != nil {
+			t.Fatal(err)
+		}
+		if g.String() != f.String() || g.RawBlockSize != f.RawBlockSize {
+			t.Errorf("migrated file differs;\n  E: %v\n  A: %v", f, g)
+		}
+	}
+}
+
+func TestMigrateFileEncodingInterrupted(t *testing.T) {
+	// The migrations that rewrite the stored files
+	for _, version := range []int{2, 3, 4, 5} {
+		ldb := NewMemoryBackend()
+		ldb.Put(versionKey(), versionBytes(version-1))
+
+		// More files than fit in a batch, in the encoding of the previous
+		// version.
+		var fs []protocol.FileInfo
+		for i := 0; i < convertBatchSize*5/2; i++ {
+			f := protocol.FileInfo{Name: fmt.Sprintf("file%05d", i), Modified: int64(i), Version: 1000, Blocks: genBlocks(1)}
+			fs = append(fs, f)
+			ldb.Put(deviceKey([]byte{0, 0, 0, 0}, []byte{0, 0, 0, 0}, []byte(f.Name)), marshalV1(f))
+		}
+		for _, m := range migrations[1 : version-1] {
+			if err := m.fn(&Instance{Backend: ldb}, m.version); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The migration is interrupted after the first batch is written.
+		fb := &failingBackend{Backend: ldb, writes: 1}
+		db := &Instance{Backend: fb}
+		if err := migrations[version-1].fn(db, version); err == nil {
+			t.Fatalf("unexpected nil error from interrupted migration to version %d", version)
+		}
+		if v, _ := db.schemaVersion(); v != version-1 {
+			t.Fatalf("interrupted migration set version %d", v)
+		}
+
+		// Opening the database completes the migrations, without converting
+		// any file twice.
+		db, err := newDBInstance(ldb, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range fs {
+			bs, err := db.Get(deviceKey([]byte{0, 0, 0, 0}, []byte{0, 0, 0, 0}, []byte(f.Name)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var g protocol.FileInfo
+			if err := g.UnmarshalXDR(bs); err != nil {
+				t.Fatalf("version %d, %s: %v", version, f.Name, err)
+			}
+			if g.String() != f.String() {
+				t.Fatalf("version %d, migrated file differs;\n  E: %v\n  A: %v", version, f, g)
+			}
+		}
+		if _, err := db.Get(migrationKey()); err != ErrNotFound {
+			t.Errorf("version %d, migration progress left behind: %v", version, err)
+		}
+	}
+}
+
+// failingBackend is a Backend that fails all batch writes after the given
+// number of them.
+type failingBackend struct {
+	Backend
+	writes int
+}
+
+func (b *failingBackend) Write(batch Batch) error {
+	if b.writes == 0 {
+		return errors.New("write failed")
+	}
+	b.writes--
+	return b.Backend.Write(batch)
+}
+
+// marshalV1 returns the file, without ownership and extended attributes,
+// in the encoding of database version 1, from before the nanoseconds of the
+// modification time, the weak hashes of the blocks and the block size were
+// added.
+func marshalV1(f protocol.FileInfo) []byte {
+	blocks := f.Blocks
+	f.Blocks = nil
+	bs := f.MustMarshalXDR()
+	off := 4 + (len(f.Name)+3)&^3 + 4 + 8
+	bs = append(bs[:off:off], bs[off+4:]...)
+	off += 8 + 8
+	bs = append(bs[:off:off], bs[off+4:]...)
+
+	// Replace the empty block and Posix lists by the blocks without weak
+	// hashes.
+	var buf bytes.Buffer
+	xw := xdr.NewWriter(&buf)
+	xw.WriteUint32(uint32(len(blocks)))
+	for _, b := range blocks {
+		xw.WriteUint32(uint32(b.Size))
+		xw.WriteBytes(b.Hash)
+	}
+	return append(bs[:len(bs)-8], buf.Bytes()...)
+}
+
+func TestTruncatedBlockSize(t *testing.T) {
+	f := protocol.FileInfo{
+		Name:         "a",
+		RawBlockSize: 1 << 20,
+		Blocks: []protocol.BlockInfo{
+			{Size: 1 << 20, Hash: []byte("some hash bytes")},
+			{Size: 100, Hash: []byte("other hash bytes")},
+		},
+	}
+
+	var tf FileInfoTruncated
+	if err := tf.UnmarshalXDR(f.MustMarshalXDR()); err != nil {
+		t.Fatal(err)
+	}
+	if bs := tf.BlockSize(); bs != 1<<20 {
+		t.Errorf("Decoded block size %d, expected %d", bs, 1<<20)
+	}
+	if bs := truncate(f).BlockSize(); bs != 1<<20 {
+		t.Errorf("Truncated block size %d, expected %d", bs, 1<<20)
+	}
+	if s := tf.Size(); s != 1<<20+1<<19 {
+		t.Errorf("Size guess %d, expected %d", s, 1<<20+1<<19)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+)
+
+// CurrentVersion is the version of the database schema written by this
+// binary. Any change to the key layout or the encoding of stored values
+// needs a new version, and a migration to it in the migrations list.
+const CurrentVersion = 5
+
+// A migration converts the database from the previous version to the given
+// one, which it's passed. It must either be safe to run again after being
+// interrupted, or record its progress to resume from, and may record the new
+// version itself along with its last change.
+type migration struct {
+	version int
+	name    string
+	fn      func(db *Instance, version int) error
+}
+
+// The migrations, in order. A database without a version marker is version
+// 0, the padded key format used before the index tables.
+var migrations = []migration{
+	{1, "compact keys", (*Instance).convertKeys},
+	{2, "sub-second modification times", (*Instance).addModifiedNs},
+	{3, "ownership and extended attributes", (*Instance).addPosixMetadata},
+	{4, "weak block hashes", (*Instance).addWeakHashes},
+	{5, "explicit block sizes", (*Instance).addBlockSizes},
+}
+
+// A VersionError is returned when opening a database written by a newer
+// version of the program, with a schema this one doesn't know.
+type VersionError struct {
+	Version int
+}
+
+func (e VersionError) Error() string {
+	return fmt.Sprintf("database schema version %d is newer than the supported version %d", e.Version, CurrentVersion)
+}
+
+// versionKey returns a byte slice encoding the following information:
+//	   keyTypeVersion (1 byte)
+func versionKey() []byte {
+	return []byte{keyTypeVersion}
+}
+
+// schemaVersion returns the version of the database.
+func (db *Instance) schemaVersion() (int, error) {
+	bs, err := db.Get(versionKey())
+	if err == ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(bs) != 8 {
+		return 0, fmt.Errorf("invalid database version %x", bs)
+	}
+	return int(binary.BigEndian.Uint64(bs)), nil
+}
+
+func (db *Instance) setSchemaVersion(version int) error {
+	return db.Put(versionKey(), versionBytes(version))
+}
+
+func versionBytes(version int) []byte {
+	bs := make([]byte, 8)
+	binary.BigEndian.PutUint64(bs, uint64(version))
+	return bs
+}
+
+// migrationKey returns a byte slice encoding the following information:
+//	   keyTypeMigration (1 byte)
+// The value is the version being migrated to (8 bytes) followed by the key
+// of the last file converted to it.
+func migrationKey() []byte {
+	return []byte{keyTypeMigration}
+}
+
+// isEmpty returns true if there is nothing at all in the database.
+func (db *Instance) isEmpty() bool {
+	dbi := db.NewPrefixIterator(nil)
+	defer dbi.Release()
+	return !dbi.Next()
+}
+
+// migrate brings the database from the given version up to the current one
+// by running the migrations it hasn't seen, in order. A database stored on
+// disk is backed up first; the backup isn't used by us, but allows going
+// back to the previous release. The version is recorded after each
+// migration, and the migrations themselves can be run again or resume where
+// they were interrupted, so a failed or interrupted migration is completed
+// at the next start.
+func (db *Instance) migrate(version int) error {
+	if version == CurrentVersion {
+		return nil
+	}
+	if version == 0 && db.isEmpty() {
+		// A new database
+		return db.setSchemaVersion(CurrentVersion)
+	}
+
+	if db.location != "" {
+		if err := db.backup(fmt.Sprintf("%s.v%d", db.location, version)); err != nil {
+			return fmt.Errorf("database backup: %v", err)
+		}
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		l.Infof("Migrating database to version %d (%s)", m.version, m.name)
+		t0 := time.Now()
+		if err := m.fn(db, m.version); err != nil {
+			return fmt.Errorf("database migration to version %d: %v", m.version, err)
+		}
+		if err := db.setSchemaVersion(m.version); err != nil {
+			return err
+		}
+		l.Infof("Migrated database to version %d in %v", m.version, time.Since(t0))
+	}
+
+	return nil
+}
+
+// backup copies all entries of the database to a new database at the given
+// path. An existing backup is kept, as it is from before an earlier, failed,
+// attempt to migrate.
+func (db *Instance) backup(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		l.Infof("Keeping existing database backup in %s", path)
+		return nil
+	}
+
+	l.Infof("Backing up database to %s", path)
+
+	tmp := path + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	bdb, err := NewLevelDBBackend(tmp)
+	if err != nil {
+		return err
+	}
+
+	snap, err := db.NewSnapshot()
+	if err != nil {
+		bdb.Close()
+		return err
+	}
+	defer snap.Release()
+
+	dbi := snap.NewPrefixIterator(nil)
+	defer dbi.Release()
+
+	batch := bdb.NewBatch()
+	for dbi.Next() {
+		batch.Put(dbi.Key(), dbi.Value())
+		if batch.Len() >= convertBatchSize {
+			if err := bdb.Write(batch); err != nil {
+				bdb.Close()
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := dbi.Error(); err != nil {
+		bdb.Close()
+		return err
+	}
+	if err := bdb.Write(batch); err != nil {
+		bdb.Close()
+		return err
+	}
+	if err := bdb.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,176 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syncthing/protocol"
+)
+
+func TestNewDatabaseVersion(t *testing.T) {
+	db := OpenMemory()
+	if v, err := db.schemaVersion(); err != nil || v != CurrentVersion {
+		t.Errorf("new database has version %d (%v), expected %d", v, err, CurrentVersion)
+	}
+}
+
+func TestNewerDatabaseVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index")
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.setSchemaVersion(CurrentVersion + 1)
+	db.Close()
+
+	_, err = Open(path)
+	if verr, ok := err.(VersionError); !ok || verr.Version != CurrentVersion+1 {
+		t.Fatalf("unexpected error %v opening newer database", err)
+	}
+
+	// The database is closed after the failed open, and can be opened again.
+	ldb, err := NewLevelDBBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ldb.Close()
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index")
+
+	if _, err := OpenReadOnly(path); err == nil {
+		t.Fatal("unexpected success opening a missing database")
+	}
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	NewFileSet("default", db).Replace(protocol.LocalDeviceID, []protocol.FileInfo{{Name: "a", Version: 1}})
+	db.setSchemaVersion(CurrentVersion - 1)
+	db.Close()
+
+	if _, err := OpenReadOnly(path); err == nil {
+		t.Fatal("unexpected success opening an old database")
+	}
+
+	ldb, err := NewLevelDBBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	(&Instance{Backend: ldb}).setSchemaVersion(CurrentVersion)
+	ldb.Close()
+
+	db, err = OpenReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := NewReadOnlyFileSet("other", db); err == nil {
+		t.Error("unexpected success for an unknown folder")
+	}
+	s, err := NewReadOnlyFileSet("default", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, ok := s.Get(protocol.LocalDeviceID, "a"); !ok || f.Version != 1 {
+		t.Errorf("unexpected file %v, %v", f, ok)
+	}
+	if err := db.Put([]byte("x"), nil); err != ErrReadOnly {
+		t.Errorf("unexpected error %v writing", err)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	defer func(m []migration) {
+		migrations = m
+	}(migrations)
+
+	runs := 0
+	fail := true
+	migrations = []migration{
+		{CurrentVersion, "test", func(*Instance, int) error {
+			runs++
+			if fail {
+				return errors.New("failed")
+			}
+			return nil
+		}},
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index")
+
+	// A database from before the version marker
+	ldb, err := NewLevelDBBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ldb.Put([]byte{keyTypeOldGlobal, 'x'}, []byte("old data"))
+	ldb.Close()
+
+	if _, err := Open(path); err == nil {
+		t.Fatal("unexpected nil error from failed migration")
+	}
+
+	// The backup was taken from the original database.
+	bdb, err := NewLevelDBBackend(path + ".v0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs, err := bdb.Get([]byte{keyTypeOldGlobal, 'x'}); err != nil || string(bs) != "old data" {
+		t.Errorf("unexpected backup contents %q, %v", bs, err)
+	}
+	bdb.Close()
+
+	// The failed migration is retried, and not run again once it succeeded.
+	fail = false
+	for i := 0; i < 2; i++ {
+		db, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := db.schemaVersion(); v != CurrentVersion {
+			t.Errorf("unexpected version %d after migration", v)
+		}
+		db.Close()
+	}
+	if runs != 2 {
+		t.Errorf("migration ran %d times, expected 2", runs)
+	}
+}
@@ -22,20 +22,26 @@
 package db
 
 import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/lamport"
 	"github.com/syncthing/syncthing/internal/osutil"
-	"github.com/syndtr/goleveldb/leveldb"
 )
 
 type FileSet struct {
 	localVersion map[protocol.DeviceID]int64
 	mutex        sync.Mutex
 	folder       string
-	db           *leveldb.DB
+	folderID     []byte
+	db           *Instance
 	blockmap     *BlockMap
+	counts       *folderCounts
+	countsMut    sync.RWMutex
 }
 
 // FileIntf is the set of methods implemented by both protocol.FileInfo and
@@ -54,23 +60,25 @@ type FileIntf interface {
 // continue iteration, false to stop.
 type Iterator func(f FileIntf) bool
 
-func NewFileSet(folder string, db *leveldb.DB) *FileSet {
+func NewFileSet(folder string, db *Instance) *FileSet {
 	var s = FileSet{
 		localVersion: make(map[protocol.DeviceID]int64),
 		folder:       folder,
+		folderID:     db.folderID(folder),
 		db:           db,
 		blockmap:     NewBlockMap(db, folder),
 	}
 
-	ldbCheckGlobals(db, []byte(folder))
+	repaired := ldbCheckGlobals(db, s.folderID)
 
-	var deviceID protocol.DeviceID
-	ldbWithAllFolderTruncated(db, []byte(folder), func(device []byte, f FileInfoTruncated) bool {
-		copy(deviceID[:], device)
+	seen := &folderCounts{}
+	ldbWithAllFolderTruncated(db, s.folderID, func(device []byte, f FileInfoTruncated) bool {
+		deviceID, _ := db.device(device)
 		if f.LocalVersion > s.localVersion[deviceID] {
 			s.localVersion[deviceID] = f.LocalVersion
 		}
 		lamport.Default.Tick(f.Version)
+		seen.updateLocal(device, nil, &f)
 		return true
 	})
 	if debug {
@@ -78,9 +86,58 @@ func NewFileSet(folder string, db *leveldb.DB) *FileSet {
 	}
 	clock(s.localVersion[protocol.LocalDeviceID])
 
+	// The stored counts are trusted as long as they agree with the files we
+	// just went through and nothing needed repair; otherwise they are
+	// calculated anew.
+	counts, ok := ldbGetCounts(db, s.folderID)
+	if !ok || repaired || !counts.localEqual(seen) {
+		if ok {
+			l.Infof("Recalculating file counts for folder %q", folder)
+		}
+		counts = ldbRecount(db, s.folderID)
+	}
+	s.counts = counts
+	if debug {
+		l.Debugf("loaded counts for %q: global %+v", folder, counts.global)
+	}
+
 	return &s
 }
 
+// NewReadOnlyFileSet returns the set of files of an existing folder for
+// inspection. Unlike NewFileSet it doesn't check or repair the database, and
+// doesn't store counts that are missing, so it works with a database opened
+// by OpenReadOnly. The set must not be changed.
+func NewReadOnlyFileSet(folder string, db *Instance) (*FileSet, error) {
+	folderID, ok := db.folderIdx.lookup([]byte(folder))
+	if !ok {
+		return nil, fmt.Errorf("no such folder %q", folder)
+	}
+	var s = FileSet{
+		localVersion: make(map[protocol.DeviceID]int64),
+		folder:       folder,
+		folderID:     folderID,
+		db:           db,
+		blockmap:     NewBlockMap(db, folder),
+	}
+
+	ldbWithAllFolderTruncated(db, s.folderID, func(device []byte, f FileInfoTruncated) bool {
+		deviceID, _ := db.device(device)
+		if f.LocalVersion > s.localVersion[deviceID] {
+			s.localVersion[deviceID] = f.LocalVersion
+		}
+		return true
+	})
+
+	counts, ok := ldbGetCounts(db, s.folderID)
+	if !ok {
+		counts = ldbCount(db, s.folderID)
+	}
+	s.counts = counts
+
+	return &s, nil
+}
+
 func (s *FileSet) Replace(device protocol.DeviceID, fs []protocol.FileInfo) {
 	if debug {
 		l.Debugf("%s Replace(%v, [%d])", s.folder, device, len(fs))
@@ -88,7 +145,9 @@ func (s *FileSet) Replace(device protocol.DeviceID, fs []protocol.FileInfo) {
 	normalizeFilenames(fs)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.localVersion[device] = ldbReplace(s.db, []byte(s.folder), device[:], fs)
+	counts := s.currentCounts().clone()
+	s.localVersion[device] = ldbReplace(s.db, s.folderID, s.db.deviceID(device), fs, counts)
+	s.setCounts(counts)
 	if len(fs) == 0 {
 		// Reset the local version if all files were removed.
 		s.localVersion[device] = 0
@@ -106,9 +165,11 @@ func (s *FileSet) ReplaceWithDelete(device protocol.DeviceID, fs []protocol.File
 	normalizeFilenames(fs)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	if lv := ldbReplaceWithDelete(s.db, []byte(s.folder), device[:], fs); lv > s.localVersion[device] {
+	counts := s.currentCounts().clone()
+	if lv := ldbReplaceWithDelete(s.db, s.folderID, s.db.deviceID(device), fs, counts); lv > s.localVersion[device] {
 		s.localVersion[device] = lv
 	}
+	s.setCounts(counts)
 	if device == protocol.LocalDeviceID {
 		s.blockmap.Drop()
 		s.blockmap.Add(fs)
@@ -126,7 +187,7 @@ func (s *FileSet) Update(device protocol.DeviceID, fs []protocol.FileInfo) {
 		discards := make([]protocol.FileInfo, 0, len(fs))
 		updates := make([]protocol.FileInfo, 0, len(fs))
 		for _, newFile := range fs {
-			existingFile, ok := ldbGet(s.db, []byte(s.folder), device[:], []byte(newFile.Name))
+			existingFile, ok := ldbGet(s.db, s.folderID, s.db.deviceID(device), []byte(newFile.Name))
 			if !ok || existingFile.Version <= newFile.Version {
 				discards = append(discards, existingFile)
 				updates = append(updates, newFile)
@@ -135,61 +196,109 @@ func (s *FileSet) Update(device protocol.DeviceID, fs []protocol.FileInfo) {
 		s.blockmap.Discard(discards)
 		s.blockmap.Update(updates)
 	}
-	if lv := ldbUpdate(s.db, []byte(s.folder), device[:], fs); lv > s.localVersion[device] {
+	counts := s.currentCounts().clone()
+	if lv := ldbUpdate(s.db, s.folderID, s.db.deviceID(device), fs, counts); lv > s.localVersion[device] {
 		s.localVersion[device] = lv
 	}
+	s.setCounts(counts)
+	if device == protocol.LocalDeviceID {
+		// The files have been hashed, or pulled, here.
+		ldbSetUnverified(s.db, s.folderID, fs, false)
+	}
+}
+
+// UpdateUnverified is Update for local files whose blocks were not hashed
+// here but imported from an index export. They're marked as unverified
+// until changed by another update.
+func (s *FileSet) UpdateUnverified(fs []protocol.FileInfo) {
+	s.Update(protocol.LocalDeviceID, fs)
+	ldbSetUnverified(s.db, s.folderID, fs, true)
+}
+
+// IsUnverified returns true if the local file was imported from an index
+// export and its blocks may thus not match the contents on disk.
+func (s *FileSet) IsUnverified(file string) bool {
+	return ldbIsUnverified(s.db, s.folderID, []byte(osutil.NormalizedFilename(file)))
 }
 
 func (s *FileSet) WithNeed(device protocol.DeviceID, fn Iterator) {
 	if debug {
 		l.Debugf("%s WithNeed(%v)", s.folder, device)
 	}
-	ldbWithNeed(s.db, []byte(s.folder), device[:], false, nativeFileIterator(fn))
+	ldbWithNeed(s.db, s.folderID, s.db.deviceID(device), nil, false, nativeFileIterator(fn))
 }
 
 func (s *FileSet) WithNeedTruncated(device protocol.DeviceID, fn Iterator) {
 	if debug {
 		l.Debugf("%s WithNeedTruncated(%v)", s.folder, device)
 	}
-	ldbWithNeed(s.db, []byte(s.folder), device[:], true, nativeFileIterator(fn))
+	ldbWithNeed(s.db, s.folderID, s.db.deviceID(device), nil, true, nativeFileIterator(fn))
 }
 
 func (s *FileSet) WithHave(device protocol.DeviceID, fn Iterator) {
 	if debug {
 		l.Debugf("%s WithHave(%v)", s.folder, device)
 	}
-	ldbWithHave(s.db, []byte(s.folder), device[:], false, nativeFileIterator(fn))
+	ldbWithHave(s.db, s.folderID, s.db.deviceID(device), nil, false, nativeFileIterator(fn))
 }
 
 func (s *FileSet) WithHaveTruncated(device protocol.DeviceID, fn Iterator) {
 	if debug {
 		l.Debugf("%s WithHaveTruncated(%v)", s.folder, device)
 	}
-	ldbWithHave(s.db, []byte(s.folder), device[:], true, nativeFileIterator(fn))
+	ldbWithHave(s.db, s.folderID, s.db.deviceID(device), nil, true, nativeFileIterator(fn))
 }
 
 func (s *FileSet) WithGlobal(fn Iterator) {
 	if debug {
 		l.Debugf("%s WithGlobal()", s.folder)
 	}
-	ldbWithGlobal(s.db, []byte(s.folder), false, nativeFileIterator(fn))
+	ldbWithGlobal(s.db, s.folderID, nil, false, nativeFileIterator(fn))
 }
 
 func (s *FileSet) WithGlobalTruncated(fn Iterator) {
 	if debug {
 		l.Debugf("%s WithGlobalTruncated()", s.folder)
 	}
-	ldbWithGlobal(s.db, []byte(s.folder), true, nativeFileIterator(fn))
+	ldbWithGlobal(s.db, s.folderID, nil, true, nativeFileIterator(fn))
+}
+
+// WithPrefixedNeedTruncated is WithNeedTruncated limited to the given file
+// or directory and the files in it. An empty prefix is the whole folder.
+func (s *FileSet) WithPrefixedNeedTruncated(device protocol.DeviceID, prefix string, fn Iterator) {
+	if debug {
+		l.Debugf("%s WithPrefixedNeedTruncated(%v, %q)", s.folder, device, prefix)
+	}
+	ldbWithNeed(s.db, s.folderID, s.db.deviceID(device), subtreeName(prefix), true, nativeFileIterator(fn))
+}
+
+// WithPrefixedHaveTruncated is WithHaveTruncated limited to the given file
+// or directory and the files in it. An empty prefix is the whole folder.
+func (s *FileSet) WithPrefixedHaveTruncated(device protocol.DeviceID, prefix string, fn Iterator) {
+	if debug {
+		l.Debugf("%s WithPrefixedHaveTruncated(%v, %q)", s.folder, device, prefix)
+	}
+	ldbWithHave(s.db, s.folderID, s.db.deviceID(device), subtreeName(prefix), true, nativeFileIterator(fn))
+}
+
+// WithPrefixedGlobalTruncated is WithGlobalTruncated limited to the given
+// file or directory and the files in it. An empty prefix is the whole
+// folder.
+func (s *FileSet) WithPrefixedGlobalTruncated(prefix string, fn Iterator) {
+	if debug {
+		l.Debugf("%s WithPrefixedGlobalTruncated(%q)", s.folder, prefix)
+	}
+	ldbWithGlobal(s.db, s.folderID, subtreeName(prefix), true, nativeFileIterator(fn))
 }
 
 func (s *FileSet) Get(device protocol.DeviceID, file string) (protocol.FileInfo, bool) {
-	f, ok := ldbGet(s.db, []byte(s.folder), device[:], []byte(osutil.NormalizedFilename(file)))
+	f, ok := ldbGet(s.db, s.folderID, s.db.deviceID(device), []byte(osutil.NormalizedFilename(file)))
 	f.Name = osutil.NativeFilename(f.Name)
 	return f, ok
 }
 
 func (s *FileSet) GetGlobal(file string) (protocol.FileInfo, bool) {
-	fi, ok := ldbGetGlobal(s.db, []byte(s.folder), []byte(osutil.NormalizedFilename(file)), false)
+	fi, ok := ldbGetGlobal(s.db, s.folderID, []byte(osutil.NormalizedFilename(file)), false)
 	if !ok {
 		return protocol.FileInfo{}, false
 	}
@@ -199,7 +308,7 @@ func (s *FileSet) GetGlobal(file string) (protocol.FileInfo, bool) {
 }
 
 func (s *FileSet) GetGlobalTruncated(file string) (FileInfoTruncated, bool) {
-	fi, ok := ldbGetGlobal(s.db, []byte(s.folder), []byte(osutil.NormalizedFilename(file)), true)
+	fi, ok := ldbGetGlobal(s.db, s.folderID, []byte(osutil.NormalizedFilename(file)), true)
 	if !ok {
 		return FileInfoTruncated{}, false
 	}
@@ -209,7 +318,7 @@ func (s *FileSet) GetGlobalTruncated(file string) (FileInfoTruncated, bool) {
 }
 
 func (s *FileSet) Availability(file string) []protocol.DeviceID {
-	return ldbAvailability(s.db, []byte(s.folder), []byte(osutil.NormalizedFilename(file)))
+	return ldbAvailability(s.db, s.folderID, []byte(osutil.NormalizedFilename(file)))
 }
 
 func (s *FileSet) LocalVersion(device protocol.DeviceID) int64 {
@@ -218,20 +327,47 @@ func (s *FileSet) LocalVersion(device protocol.DeviceID) int64 {
 	return s.localVersion[device]
 }
 
+// GlobalCounts returns the number of files, directories and deleted files in
+// the global view of the folder, and the total size of the files and
+// directories.
+func (s *FileSet) GlobalCounts() Counts {
+	return s.currentCounts().global
+}
+
+// LocalCounts returns the counts for the files that the device has, except
+// invalid ones.
+func (s *FileSet) LocalCounts(device protocol.DeviceID) Counts {
+	return s.currentCounts().localOf(s.db.deviceID(device))
+}
+
+// NeedCounts returns the counts for the files that the device needs to be in
+// sync with the global view, as iterated over by WithNeed.
+func (s *FileSet) NeedCounts(device protocol.DeviceID) Counts {
+	return s.currentCounts().need(s.db.deviceID(device))
+}
+
+func (s *FileSet) currentCounts() *folderCounts {
+	s.countsMut.RLock()
+	defer s.countsMut.RUnlock()
+	return s.counts
+}
+
+func (s *FileSet) setCounts(counts *folderCounts) {
+	s.countsMut.Lock()
+	s.counts = counts
+	s.countsMut.Unlock()
+}
+
 // ListFolders returns the folder IDs seen in the database.
-func ListFolders(db *leveldb.DB) []string {
+func ListFolders(db *Instance) []string {
 	return ldbListFolders(db)
 }
 
 // DropFolder clears out all information related to the given folder from the
 // database.
-func DropFolder(db *leveldb.DB, folder string) {
-	ldbDropFolder(db, []byte(folder))
-	bm := &BlockMap{
-		db:     db,
-		folder: folder,
-	}
-	bm.Drop()
+func DropFolder(db *Instance, folder string) {
+	ldbDropFolder(db, db.folderID(folder))
+	NewBlockMap(db, folder).Drop()
 }
 
 func normalizeFilenames(fs []protocol.FileInfo) {
@@ -240,6 +376,16 @@ func normalizeFilenames(fs []protocol.FileInfo) {
 	}
 }
 
+// subtreeName returns the prefix as a name in the database, without any
+// trailing slash, or nil for the whole folder.
+func subtreeName(prefix string) []byte {
+	prefix = path.Clean(filepath.ToSlash(osutil.NormalizedFilename(prefix)))
+	if prefix == "." || prefix == "/" {
+		return nil
+	}
+	return []byte(strings.TrimPrefix(prefix, "/"))
+}
+
 func nativeFileIterator(fn Iterator) Iterator {
 	return func(fi FileIntf) bool {
 		switch f := fi.(type) {
@@ -18,6 +18,7 @@ package db_test
 import (
 	"bytes"
 	"fmt"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"testing"
@@ -25,8 +26,6 @@ import (
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/db"
 	"github.com/syncthing/syncthing/internal/lamport"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/storage"
 )
 
 var remoteDevice0, remoteDevice1 protocol.DeviceID
@@ -106,10 +105,7 @@ func (l fileList) String() string {
 func TestGlobalSet(t *testing.T) {
 	lamport.Default = lamport.Clock{}
 
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+	ldb := db.OpenMemory()
 
 	m := db.NewFileSet("test", ldb)
 
@@ -267,10 +263,7 @@ func TestGlobalSet(t *testing.T) {
 func TestNeedWithInvalid(t *testing.T) {
 	lamport.Default = lamport.Clock{}
 
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+	ldb := db.OpenMemory()
 
 	s := db.NewFileSet("test", ldb)
 
@@ -309,10 +302,7 @@ func TestNeedWithInvalid(t *testing.T) {
 func TestUpdateToInvalid(t *testing.T) {
 	lamport.Default = lamport.Clock{}
 
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+	ldb := db.OpenMemory()
 
 	s := db.NewFileSet("test", ldb)
 
@@ -346,10 +336,7 @@ func TestUpdateToInvalid(t *testing.T) {
 func TestInvalidAvailability(t *testing.T) {
 	lamport.Default = lamport.Clock{}
 
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+	ldb := db.OpenMemory()
 
 	s := db.NewFileSet("test", ldb)
 
@@ -387,10 +374,7 @@ func TestInvalidAvailability(t *testing.T) {
 }
 
 func TestLocalDeleted(t *testing.T) {
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+	ldb := db.OpenMemory()
 	m := db.NewFileSet("test", ldb)
 	lamport.Default = lamport.Clock{}
 
@@ -462,10 +446,7 @@ func TestLocalDeleted(t *testing.T) {
 }
 
 func Benchmark10kReplace(b *testing.B) {
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
-	if err != nil {
-		b.Fatal(err)
-	}
+	ldb := db.OpenMemory()
 
 	var local []protocol.FileInfo
 	for i := 0; i < 10000; i++ {
@@ -485,10 +466,7 @@ func Benchmark10kUpdateChg(b *testing.B) {
 		remote = append(remote, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 1000})
 	}
 
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
-	if err != nil {
-		b.Fatal(err)
-	}
+	ldb := db.OpenMemory()
 
 	m := db.NewFileSet("test", ldb)
 	m.Replace(remoteDevice0, remote)
@@ -517,10 +495,7 @@ func Benchmark10kUpdateSme(b *testing.B) {
 		remote = append(remote, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 1000})
 	}
 
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
-	if err != nil {
-		b.Fatal(err)
-	}
+	ldb := db.OpenMemory()
 	m := db.NewFileSet("test", ldb)
 	m.Replace(remoteDevice0, remote)
 
@@ -543,10 +518,7 @@ func Benchmark10kNeed2k(b *testing.B) {
 		remote = append(remote, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 1000})
 	}
 
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
-	if err != nil {
-		b.Fatal(err)
-	}
+	ldb := db.OpenMemory()
 
 	m := db.NewFileSet("test", ldb)
 	m.Replace(remoteDevice0, remote)
@@ -576,10 +548,7 @@ func Benchmark10kHaveFullList(b *testing.B) {
 		remote = append(remote, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 1000})
 	}
 
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
-	if err != nil {
-		b.Fatal(err)
-	}
+	ldb := db.OpenMemory()
 
 	m := db.NewFileSet("test", ldb)
 	m.Replace(remoteDevice0, remote)
@@ -609,10 +578,7 @@ func Benchmark10kGlobal(b *testing.B) {
 		remote = append(remote, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 1000})
 	}
 
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
-	if err != nil {
-		b.Fatal(err)
-	}
+	ldb := db.OpenMemory()
 
 	m := db.NewFileSet("test", ldb)
 	m.Replace(remoteDevice0, remote)
@@ -637,10 +603,7 @@ func Benchmark10kGlobal(b *testing.B) {
 }
 
 func TestGlobalReset(t *testing.T) {
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+	ldb := db.OpenMemory()
 
 	m := db.NewFileSet("test", ldb)
 
@@ -678,10 +641,7 @@ func TestGlobalReset(t *testing.T) {
 }
 
 func TestNeed(t *testing.T) {
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+	ldb := db.OpenMemory()
 
 	m := db.NewFileSet("test", ldb)
 
@@ -719,10 +679,7 @@ func TestNeed(t *testing.T) {
 }
 
 func TestLocalVersion(t *testing.T) {
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+	ldb := db.OpenMemory()
 
 	m := db.NewFileSet("test", ldb)
 
@@ -758,10 +715,7 @@ func TestLocalVersion(t *testing.T) {
 }
 
 func TestListDropFolder(t *testing.T) {
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+	ldb := db.OpenMemory()
 
 	s0 := db.NewFileSet("test0", ldb)
 	local1 := []protocol.FileInfo{
@@ -809,10 +763,7 @@ func TestListDropFolder(t *testing.T) {
 }
 
 func TestGlobalNeedWithInvalid(t *testing.T) {
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+	ldb := db.OpenMemory()
 
 	s := db.NewFileSet("test1", ldb)
 
@@ -849,10 +800,7 @@ func TestGlobalNeedWithInvalid(t *testing.T) {
 }
 
 func TestLongPath(t *testing.T) {
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+	ldb := db.OpenMemory()
 
 	s := db.NewFileSet("test", ldb)
 
@@ -877,3 +825,173 @@ func TestLongPath(t *testing.T) {
 			gf[0].Name, local[0].Name)
 	}
 }
+
+func countsOf(fs ...db.FileIntf) db.Counts {
+	var c db.Counts
+	for _, f := range fs {
+		switch {
+		case f.IsDeleted():
+			c.Deleted++
+		case f.IsDirectory():
+			c.Directories++
+			c.Bytes += f.Size()
+		default:
+			c.Files++
+			c.Bytes += f.Size()
+		}
+	}
+	return c
+}
+
+// checkCounts compares the counts kept by the set to those found by
+// iterating over the files.
+func checkCounts(t *testing.T, s *db.FileSet, devices ...protocol.DeviceID) {
+	var global []db.FileIntf
+	s.WithGlobalTruncated(func(f db.FileIntf) bool {
+		global = append(global, f)
+		return true
+	})
+	if c, e := s.GlobalCounts(), countsOf(global...); c != e {
+		t.Errorf("global counts %+v != expected %+v", c, e)
+	}
+
+	for _, device := range devices {
+		var have, need []db.FileIntf
+		s.WithHaveTruncated(device, func(f db.FileIntf) bool {
+			if !f.IsInvalid() {
+				have = append(have, f)
+			}
+			return true
+		})
+		s.WithNeedTruncated(device, func(f db.FileIntf) bool {
+			need = append(need, f)
+			return true
+		})
+		if c, e := s.LocalCounts(device), countsOf(have...); c != e {
+			t.Errorf("local counts for %v %+v != expected %+v", device, c, e)
+		}
+		if c, e := s.NeedCounts(device), countsOf(need...); c != e {
+			t.Errorf("need counts for %v %+v != expected %+v", device, c, e)
+		}
+	}
+}
+
+func TestCounts(t *testing.T) {
+	ldb := db.OpenMemory()
+
+	s := db.NewFileSet("test", ldb)
+	devices := []protocol.DeviceID{protocol.LocalDeviceID, remoteDevice0, remoteDevice1}
+
+	s.Replace(protocol.LocalDeviceID, fileList{
+		protocol.FileInfo{Name: "a", Version: 1000, Blocks: genBlocks(1)},
+		protocol.FileInfo{Name: "b", Version: 1000, Blocks: genBlocks(2)},
+		protocol.FileInfo{Name: "d", Version: 1000, Flags: protocol.FlagDirectory},
+		protocol.FileInfo{Name: "e", Version: 1000, Flags: protocol.FlagDeleted},
+	})
+	checkCounts(t, s, devices...)
+
+	s.Replace(remoteDevice0, fileList{
+		protocol.FileInfo{Name: "a", Version: 1000, Blocks: genBlocks(1)},
+		protocol.FileInfo{Name: "b", Version: 1001, Blocks: genBlocks(3)},
+		protocol.FileInfo{Name: "c", Version: 1000, Blocks: genBlocks(4)},
+		protocol.FileInfo{Name: "d", Version: 1001, Flags: protocol.FlagDeleted},
+		protocol.FileInfo{Name: "f", Version: 1000, Flags: protocol.FlagInvalid, Blocks: genBlocks(5)},
+	})
+	checkCounts(t, s, devices...)
+
+	s.Replace(remoteDevice1, fileList{
+		protocol.FileInfo{Name: "c", Version: 1002, Blocks: genBlocks(2)},
+		protocol.FileInfo{Name: "e", Version: 999, Blocks: genBlocks(1)},
+		protocol.FileInfo{Name: "f", Version: 1000, Blocks: genBlocks(5)},
+	})
+	checkCounts(t, s, devices...)
+
+	// Updates changing versions, flags and validity, with a duplicate
+	s.Update(remoteDevice0, fileList{
+		protocol.FileInfo{Name: "a", Version: 1000, Flags: protocol.FlagInvalid, Blocks: genBlocks(1)},
+		protocol.FileInfo{Name: "c", Version: 1002, Blocks: genBlocks(2)},
+		protocol.FileInfo{Name: "g", Version: 1000, Blocks: genBlocks(1)},
+		protocol.FileInfo{Name: "g", Version: 1001, Blocks: genBlocks(2)},
+	})
+	checkCounts(t, s, devices...)
+
+	s.Update(protocol.LocalDeviceID, fileList{
+		protocol.FileInfo{Name: "b", Version: 1001, Blocks: genBlocks(3)},
+		protocol.FileInfo{Name: "d", Version: 1001, Flags: protocol.FlagDeleted},
+		protocol.FileInfo{Name: "f", Version: 1000, Flags: protocol.FlagInvalid},
+	})
+	checkCounts(t, s, devices...)
+
+	s.ReplaceWithDelete(protocol.LocalDeviceID, fileList{
+		protocol.FileInfo{Name: "b", Version: 1001, Blocks: genBlocks(3)},
+		protocol.FileInfo{Name: "d", Version: 1001, Flags: protocol.FlagDeleted},
+	})
+	checkCounts(t, s, devices...)
+
+	s.Replace(remoteDevice1, nil)
+	checkCounts(t, s, devices...)
+
+	// The counts are loaded from the database when the set is recreated.
+	s = db.NewFileSet("test", ldb)
+	checkCounts(t, s, devices...)
+}
+
+func TestPrefixedIteration(t *testing.T) {
+	ldb := db.OpenMemory()
+	s := db.NewFileSet("test", ldb)
+
+	local := []protocol.FileInfo{
+		{Name: "foo", Version: 1000, Flags: protocol.FlagDirectory},
+		{Name: "foo-bar", Version: 1000},
+		{Name: "foo/a", Version: 1000},
+		{Name: "foo/b", Version: 1000},
+		{Name: "foo/b/c", Version: 1000},
+		{Name: "foobar", Version: 1000},
+		{Name: "foobar/a", Version: 1000},
+	}
+	remote := []protocol.FileInfo{
+		{Name: "foo/a", Version: 1001},
+		{Name: "foo/d", Version: 1001},
+		{Name: "foobar/a", Version: 1001},
+	}
+	s.Replace(protocol.LocalDeviceID, local)
+	s.Replace(remoteDevice0, remote)
+
+	names := func(iter func(db.Iterator)) []string {
+		var names []string
+		iter(func(f db.FileIntf) bool {
+			names = append(names, f.(db.FileInfoTruncated).Name)
+			return true
+		})
+		return names
+	}
+
+	tests := []struct {
+		prefix string
+		have   []string
+		global []string
+		need   []string
+	}{
+		{"foo", []string{"foo", "foo/a", "foo/b", "foo/b/c"}, []string{"foo", "foo/a", "foo/b", "foo/b/c", "foo/d"}, []string{"foo/a", "foo/d"}},
+		{"foo/", []string{"foo", "foo/a", "foo/b", "foo/b/c"}, []string{"foo", "foo/a", "foo/b", "foo/b/c", "foo/d"}, []string{"foo/a", "foo/d"}},
+		{"foo/b", []string{"foo/b", "foo/b/c"}, []string{"foo/b", "foo/b/c"}, nil},
+		{filepath.Join("foo", "b"), []string{"foo/b", "foo/b/c"}, []string{"foo/b", "foo/b/c"}, nil},
+		{"foo/d", nil, []string{"foo/d"}, []string{"foo/d"}},
+		{"fo", nil, nil, nil},
+		{"", []string{"foo", "foo-bar", "foo/a", "foo/b", "foo/b/c", "foobar", "foobar/a"}, []string{"foo", "foo-bar", "foo/a", "foo/b", "foo/b/c", "foo/d", "foobar", "foobar/a"}, []string{"foo/a", "foo/d", "foobar/a"}},
+	}
+	for _, tc := range tests {
+		have := names(func(fn db.Iterator) { s.WithPrefixedHaveTruncated(protocol.LocalDeviceID, tc.prefix, fn) })
+		if fmt.Sprint(have) != fmt.Sprint(tc.have) {
+			t.Errorf("Have %q: %v != expected %v", tc.prefix, have, tc.have)
+		}
+		global := names(func(fn db.Iterator) { s.WithPrefixedGlobalTruncated(tc.prefix, fn) })
+		if fmt.Sprint(global) != fmt.Sprint(tc.global) {
+			t.Errorf("Global %q: %v != expected %v", tc.prefix, global, tc.global)
+		}
+		need := names(func(fn db.Iterator) { s.WithPrefixedNeedTruncated(protocol.LocalDeviceID, tc.prefix, fn) })
+		if fmt.Sprint(need) != fmt.Sprint(tc.need) {
+			t.Errorf("Need %q: %v != expected %v", tc.prefix, need, tc.need)
+		}
+	}
+}
@@ -20,6 +20,7 @@ package db
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/syncthing/protocol"
 )
@@ -29,14 +30,21 @@ type FileInfoTruncated struct {
 	Name         string // max:8192
 	Flags        uint32
 	Modified     int64
+	ModifiedNs   int32
 	Version      int64
 	LocalVersion int64
+	RawBlockSize int32
 	NumBlocks    int32
 }
 
 func (f FileInfoTruncated) String() string {
-	return fmt.Sprintf("File{Name:%q, Flags:0%o, Modified:%d, Version:%d, Size:%d, NumBlocks:%d}",
-		f.Name, f.Flags, f.Modified, f.Version, f.Size(), f.NumBlocks)
+	return fmt.Sprintf("File{Name:%q, Flags:0%o, Modified:%d.%09d, Version:%d, Size:%d, NumBlocks:%d}",
+		f.Name, f.Flags, f.Modified, f.ModifiedNs, f.Version, f.Size(), f.NumBlocks)
+}
+
+// ModTime returns the modification time of the file.
+func (f FileInfoTruncated) ModTime() time.Time {
+	return time.Unix(f.Modified, int64(f.ModifiedNs))
 }
 
 // Returns a statistical guess on the size, not the exact figure
@@ -44,7 +52,16 @@ func (f FileInfoTruncated) Size() int64 {
 	if f.IsDeleted() || f.IsDirectory() {
 		return 128
 	}
-	return BlocksToSize(int(f.NumBlocks))
+	return BlocksToSize(int(f.NumBlocks), f.BlockSize())
+}
+
+// BlockSize returns the size of the blocks the file is divided into, as
+// protocol.FileInfo.BlockSize.
+func (f FileInfoTruncated) BlockSize() int {
+	if f.RawBlockSize == 0 {
+		return protocol.BlockSize
+	}
+	return int(f.RawBlockSize)
 }
 
 func (f FileInfoTruncated) IsDeleted() bool {
@@ -67,9 +84,11 @@ func (f FileInfoTruncated) HasPermissionBits() bool {
 	return f.Flags&protocol.FlagNoPermBits == 0
 }
 
-func BlocksToSize(num int) int64 {
+// BlocksToSize returns a guess on the size of a file with the given number
+// of blocks of the given size, assuming the last block is half full.
+func BlocksToSize(num, blockSize int) int64 {
 	if num < 2 {
-		return protocol.BlockSize / 2
+		return int64(blockSize / 2)
 	}
-	return int64(num-1)*protocol.BlockSize + protocol.BlockSize/2
+	return int64(num-1)*int64(blockSize) + int64(blockSize/2)
 }
@@ -30,6 +30,8 @@ FileInfoTruncated Structure:
 +                      Modified (64 bits)                       +
 |                                                               |
 +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                          Modified Ns                          |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 |                                                               |
 +                       Version (64 bits)                       +
 |                                                               |
@@ -38,6 +40,8 @@ FileInfoTruncated Structure:
 +                    Local Version (64 bits)                    +
 |                                                               |
 +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                        Raw Block Size                         |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 |                          Num Blocks                           |
 +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 
@@ -46,8 +50,10 @@ struct FileInfoTruncated {
 	string Name<8192>;
 	unsigned int Flags;
 	hyper Modified;
+	int ModifiedNs;
 	hyper Version;
 	hyper LocalVersion;
+	int RawBlockSize;
 	int NumBlocks;
 }
 
@@ -84,8 +90,10 @@ func (o FileInfoTruncated) encodeXDR(xw *xdr.Writer) (int, error) {
 	xw.WriteString(o.Name)
 	xw.WriteUint32(o.Flags)
 	xw.WriteUint64(uint64(o.Modified))
+	xw.WriteUint32(uint32(o.ModifiedNs))
 	xw.WriteUint64(uint64(o.Version))
 	xw.WriteUint64(uint64(o.LocalVersion))
+	xw.WriteUint32(uint32(o.RawBlockSize))
 	xw.WriteUint32(uint32(o.NumBlocks))
 	return xw.Tot(), xw.Error()
 }
@@ -105,8 +113,10 @@ func (o *FileInfoTruncated) decodeXDR(xr *xdr.Reader) error {
 	o.Name = xr.ReadStringMax(8192)
 	o.Flags = xr.ReadUint32()
 	o.Modified = int64(xr.ReadUint64())
+	o.ModifiedNs = int32(xr.ReadUint32())
 	o.Version = int64(xr.ReadUint64())
 	o.LocalVersion = int64(xr.ReadUint64())
+	o.RawBlockSize = int32(xr.ReadUint32())
 	o.NumBlocks = int32(xr.ReadUint32())
 	return xr.Error()
 }
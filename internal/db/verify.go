@@ -0,0 +1,359 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/syncthing/protocol"
+)
+
+// A Problem is an inconsistency found in the database by Verify.
+type Problem struct {
+	Folder      string
+	Name        string
+	Description string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("folder %q, file %q: %s", p.Folder, p.Name, p.Description)
+}
+
+// Verify checks the database for inconsistencies and returns those found.
+// The global version lists are checked against the device entries, the
+// block map against the local files, and the local files for missing or
+// reused local versions. If repair is set the problems are corrected as
+// well, and the file counts of the affected folders are recalculated.
+func Verify(db *Instance, repair bool) []Problem {
+	var problems []Problem
+	for _, folder := range db.folderIdx.values() {
+		v := newVerifier(db, folder, repair)
+		v.checkGlobals()
+		v.checkBlocks()
+		v.checkLocalVersions()
+		v.finish()
+		problems = append(problems, v.problems...)
+	}
+	return problems
+}
+
+type verifier struct {
+	db       *Instance
+	snap     Snapshot
+	batch    Batch
+	repair   bool
+	folder   string
+	folderID []byte
+	devices  [][]byte
+	localID  []byte
+	problems []Problem
+}
+
+func newVerifier(db *Instance, folder string, repair bool) *verifier {
+	snap, err := db.NewSnapshot()
+	if err != nil {
+		panic(err)
+	}
+
+	v := &verifier{
+		db:       db,
+		snap:     snap,
+		batch:    db.NewBatch(),
+		repair:   repair,
+		folder:   folder,
+		folderID: db.folderID(folder),
+		localID:  db.deviceID(protocol.LocalDeviceID),
+	}
+	for _, device := range db.deviceIdx.values() {
+		v.devices = append(v.devices, db.deviceIdx.id([]byte(device)))
+	}
+	return v
+}
+
+func (v *verifier) problem(name []byte, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{
+		Folder:      v.folder,
+		Name:        string(name),
+		Description: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *verifier) put(key, val []byte) {
+	if !v.repair {
+		return
+	}
+	v.batch.Put(key, val)
+	v.flush(convertBatchSize)
+}
+
+func (v *verifier) delete(key []byte) {
+	if !v.repair {
+		return
+	}
+	v.batch.Delete(key)
+	v.flush(convertBatchSize)
+}
+
+// flush writes the batch if it has at least the given number of entries.
+// Reads are done from the snapshot, so the repairs don't affect the checks.
+func (v *verifier) flush(size int) {
+	if v.batch.Len() < size {
+		return
+	}
+	if err := v.db.Write(v.batch); err != nil {
+		panic(err)
+	}
+	v.batch.Reset()
+}
+
+func (v *verifier) finish() {
+	v.flush(1)
+	v.snap.Release()
+	if v.repair && len(v.problems) > 0 {
+		ldbRecount(v.db, v.folderID)
+	}
+}
+
+func (v *verifier) deviceName(device []byte) string {
+	id, ok := v.db.device(device)
+	if !ok {
+		return fmt.Sprintf("unknown device %x", device)
+	}
+	return id.String()
+}
+
+// checkGlobals compares each global version list to the device entries for
+// the file, and looks for device entries that are missing from the global
+// version lists altogether.
+func (v *verifier) checkGlobals() {
+	dbi := v.snap.NewPrefixIterator(globalKey(v.folderID, nil))
+	defer dbi.Release()
+	for dbi.Next() {
+		var vl versionList
+		if err := vl.UnmarshalXDR(dbi.Value()); err != nil {
+			panic(err)
+		}
+		v.checkGlobal(globalKeyName(dbi.Key()), vl, true)
+	}
+
+	dbi = v.snap.NewPrefixIterator(deviceKeyPrefix(v.folderID))
+	defer dbi.Release()
+	for dbi.Next() {
+		var f FileInfoTruncated
+		if err := f.UnmarshalXDR(dbi.Value()); err != nil {
+			panic(err)
+		}
+		if f.IsInvalid() {
+			continue
+		}
+		name := deviceKeyName(dbi.Key())
+		if _, err := v.snap.Get(globalKey(v.folderID, name)); err == ErrNotFound {
+			v.problem(name, "file of device %s (version %d) has no global version list", v.deviceName(deviceKeyDevice(dbi.Key())), f.Version)
+			v.checkGlobal(name, versionList{}, false)
+		} else if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// checkGlobal compares the version list, if stored, to the one expected from
+// the device entries for the file, and replaces it if they differ.
+func (v *verifier) checkGlobal(name []byte, vl versionList, stored bool) {
+	files := make(map[string]FileInfoTruncated)
+	for _, device := range v.devices {
+		if f, ok := ldbGetTruncated(v.snap, v.folderID, device, name); ok {
+			files[string(device)] = f
+		}
+	}
+
+	// The expected list has the versions of all device entries except
+	// invalid ones, which are only accepted if already in the list. Equal
+	// versions keep their order from the existing list.
+
+	var expected versionList
+	seen := make(map[string]bool)
+	ok := stored
+	if stored && len(vl.versions) == 0 {
+		v.problem(name, "global version list is empty")
+		ok = false
+	}
+	for i, fv := range vl.versions {
+		f, exists := files[string(fv.device)]
+		switch {
+		case !exists:
+			v.problem(name, "global version list refers to missing file of device %s", v.deviceName(fv.device))
+			ok = false
+			continue
+		case f.Version != fv.version:
+			v.problem(name, "global version list has version %d for device %s, but the file has version %d", fv.version, v.deviceName(fv.device), f.Version)
+			ok = false
+		case i > 0 && fv.version > vl.versions[i-1].version:
+			v.problem(name, "global version list is out of order")
+			ok = false
+		}
+		if seen[string(fv.device)] {
+			v.problem(name, "global version list has device %s more than once", v.deviceName(fv.device))
+			ok = false
+			continue
+		}
+		seen[string(fv.device)] = true
+		expected.versions = append(expected.versions, fileVersion{version: f.Version, device: fv.device})
+	}
+	for _, device := range v.devices {
+		f, exists := files[string(device)]
+		if !exists || seen[string(device)] || f.IsInvalid() {
+			continue
+		}
+		if stored {
+			v.problem(name, "file of device %s (version %d) is missing from the global version list", v.deviceName(device), f.Version)
+		}
+		ok = false
+		expected.versions = append(expected.versions, fileVersion{version: f.Version, device: device})
+	}
+	if ok {
+		return
+	}
+
+	sort.Stable(byVersionDesc(expected.versions))
+	gk := globalKey(v.folderID, name)
+	if len(expected.versions) == 0 {
+		v.delete(gk)
+	} else {
+		v.put(gk, expected.MustMarshalXDR())
+	}
+}
+
+type byVersionDesc []fileVersion
+
+func (l byVersionDesc) Len() int {
+	return len(l)
+}
+
+func (l byVersionDesc) Swap(a, b int) {
+	l[a], l[b] = l[b], l[a]
+}
+
+func (l byVersionDesc) Less(a, b int) bool {
+	return l[a].version > l[b].version
+}
+
+// blockMapped returns true if the blocks of the local file should be in the
+// block map, as by BlockMap.Add.
+func blockMapped(f protocol.FileInfo) bool {
+	return !f.IsDirectory() && !f.IsDeleted() && !f.IsInvalid()
+}
+
+// checkBlocks verifies that each block map entry refers to the same block
+// of a local file, and that all blocks of local files are in the block map.
+func (v *verifier) checkBlocks() {
+	dbi := v.snap.NewPrefixIterator(toBlockKey(nil, v.folderID, "")[:1+4])
+	defer dbi.Release()
+	for dbi.Next() {
+		key := dbi.Key()
+		hash := key[1+4 : 1+4+32]
+		name := blockKeyName(key)
+		index := binary.BigEndian.Uint32(dbi.Value())
+
+		f, ok := v.getLocal([]byte(name))
+		if !ok || !blockMapped(f) || int(index) >= len(f.Blocks) || !bytes.Equal(f.Blocks[index].Hash, hash) {
+			v.problem([]byte(name), "block map entry for block %d (%x) doesn't match the local file", index, hash)
+			v.delete(key)
+		}
+	}
+
+	v.withLocal(func(f protocol.FileInfo) {
+		if !blockMapped(f) {
+			return
+		}
+		buf := make([]byte, 4)
+		missing := 0
+		for i, block := range f.Blocks {
+			key := toBlockKey(block.Hash, v.folderID, f.Name)
+			if _, err := v.snap.Get(key); err == nil {
+				continue
+			} else if err != ErrNotFound {
+				panic(err)
+			}
+			missing++
+			binary.BigEndian.PutUint32(buf, uint32(i))
+			v.put(key, buf)
+		}
+		if missing > 0 {
+			v.problem([]byte(f.Name), "%d of %d blocks are missing from the block map", missing, len(f.Blocks))
+		}
+	})
+}
+
+// checkLocalVersions verifies that all local files have a local version,
+// and that no two have the same one. Files with a missing or reused local
+// version are given new ones, so that they are sent to other devices again.
+func (v *verifier) checkLocalVersions() {
+	used := make(map[int64]bool)
+	var renumber [][]byte
+	var max int64
+	v.withLocal(func(f protocol.FileInfo) {
+		switch {
+		case f.LocalVersion <= 0:
+			v.problem([]byte(f.Name), "local file has no local version")
+			renumber = append(renumber, []byte(f.Name))
+		case used[f.LocalVersion]:
+			v.problem([]byte(f.Name), "local version %d is used by more than one local file", f.LocalVersion)
+			renumber = append(renumber, []byte(f.Name))
+		}
+		used[f.LocalVersion] = true
+		if f.LocalVersion > max {
+			max = f.LocalVersion
+		}
+	})
+
+	for _, name := range renumber {
+		f, _ := v.getLocal(name)
+		max++
+		f.LocalVersion = max
+		v.put(deviceKey(v.folderID, v.localID, name), f.MustMarshalXDR())
+	}
+}
+
+func (v *verifier) getLocal(name []byte) (protocol.FileInfo, bool) {
+	bs, err := v.snap.Get(deviceKey(v.folderID, v.localID, name))
+	if err == ErrNotFound {
+		return protocol.FileInfo{}, false
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	var f protocol.FileInfo
+	if err := f.UnmarshalXDR(bs); err != nil {
+		panic(err)
+	}
+	return f, true
+}
+
+func (v *verifier) withLocal(fn func(f protocol.FileInfo)) {
+	dbi := v.snap.NewPrefixIterator(deviceKey(v.folderID, v.localID, nil))
+	defer dbi.Release()
+	for dbi.Next() {
+		var f protocol.FileInfo
+		if err := f.UnmarshalXDR(dbi.Value()); err != nil {
+			panic(err)
+		}
+		fn(f)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"testing"
+
+	"github.com/syncthing/protocol"
+)
+
+func TestVerify(t *testing.T) {
+	db := OpenMemory()
+	remote := protocol.DeviceID{1, 2, 3}
+
+	s := NewFileSet("test", db)
+	s.Replace(protocol.LocalDeviceID, []protocol.FileInfo{
+		{Name: "a", Version: 1000, Blocks: genBlocks(2)},
+		{Name: "b", Version: 1000, Blocks: genBlocks(1)},
+		{Name: "c", Version: 1000, Blocks: genBlocks(1)},
+	})
+	s.Replace(remote, []protocol.FileInfo{
+		{Name: "a", Version: 1001, Blocks: genBlocks(3)},
+		{Name: "d", Version: 1000, Blocks: genBlocks(1)},
+	})
+
+	if problems := Verify(db, false); len(problems) != 0 {
+		t.Fatalf("unexpected problems in consistent database: %v", problems)
+	}
+
+	local, remoteID := db.deviceID(protocol.LocalDeviceID), db.deviceID(remote)
+
+	// A global version list pointing to a missing file
+	db.Delete(deviceKey(s.folderID, remoteID, []byte("d")))
+	// A file missing from the global version lists
+	db.Delete(globalKey(s.folderID, []byte("b")))
+	// A missing block map entry
+	db.Delete(toBlockKey(genBlocks(1)[0].Hash, s.folderID, "c"))
+	// A block map entry for a file that doesn't exist
+	db.Put(toBlockKey(genBlocks(1)[0].Hash, s.folderID, "e"), []byte{0, 0, 0, 0})
+	// A reused local version
+	fa, _ := ldbGet(db, s.folderID, local, []byte("a"))
+	fb, _ := ldbGet(db, s.folderID, local, []byte("b"))
+	fb.LocalVersion = fa.LocalVersion
+	db.Put(deviceKey(s.folderID, local, []byte("b")), fb.MustMarshalXDR())
+
+	problems := Verify(db, false)
+	if len(problems) != 5 {
+		t.Fatalf("found %d problems, expected 5: %v", len(problems), problems)
+	}
+	if problems := Verify(db, true); len(problems) != 5 {
+		t.Fatalf("repaired %d problems, expected 5: %v", len(problems), problems)
+	}
+	if problems := Verify(db, false); len(problems) != 0 {
+		t.Fatalf("unexpected problems after repair: %v", problems)
+	}
+
+	s = NewFileSet("test", db)
+	if _, ok := s.GetGlobal("d"); ok {
+		t.Error("global file d should have been removed")
+	}
+	if g, ok := s.GetGlobal("b"); !ok || g.Version != 1000 {
+		t.Errorf("unexpected global file b %v", g)
+	}
+	if fb, _ := s.Get(protocol.LocalDeviceID, "b"); fb.LocalVersion <= fa.LocalVersion {
+		t.Errorf("local version %d of b not renumbered above %d", fb.LocalVersion, fa.LocalVersion)
+	}
+	if c, e := s.currentCounts(), ldbRecount(db, s.folderID); c.global != e.global || !c.localEqual(e) {
+		t.Errorf("counts %+v != recounted %+v", c, e)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package dialer establishes outgoing connections, optionally through a
+// SOCKS5 or HTTP CONNECT proxy.
+package dialer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The environment variables that override the configured proxy, in order of
+// precedence.
+var proxyEnvVars = []string{"all_proxy", "ALL_PROXY", "https_proxy", "HTTPS_PROXY"}
+
+var (
+	proxy         *proxyDialer
+	bypassPrivate bool
+	proxyMut      sync.RWMutex
+)
+
+// HTTPClient is a http.Client that makes its connections using Dial, and
+// hence through the proxy when one is set. When no proxy is set, the usual
+// HTTP proxy environment variables are honored as by http.DefaultTransport.
+var HTTPClient = &http.Client{
+	Transport: &http.Transport{
+		Dial:                Dial,
+		Proxy:               environmentProxy,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// environmentProxy returns the proxy given by the environment for the
+// request, unless connections already go through our own proxy in which
+// case the request is not proxied a second time.
+func environmentProxy(req *http.Request) (*url.URL, error) {
+	if UsingProxy() {
+		return nil, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// SetProxy sets the proxy to use for outgoing connections. The URL scheme
+// selects the proxy type and must be one of "socks5", "socks5h" or "http".
+// The all_proxy and https_proxy environment variables, when set, take
+// precedence over the given URL. If neither is set, connections are made
+// directly.
+func SetProxy(proxyURL string) error {
+	for _, env := range proxyEnvVars {
+		if v := os.Getenv(env); v != "" {
+			if debug {
+				l.Debugf("using proxy %q from environment variable %s", v, env)
+			}
+			proxyURL = v
+			break
+		}
+	}
+
+	var pd *proxyDialer
+	if proxyURL != "" {
+		uri, err := url.Parse(proxyURL)
+		if err != nil {
+			return err
+		}
+		pd, err = newProxyDialer(uri)
+		if err != nil {
+			return err
+		}
+	}
+
+	proxyMut.Lock()
+	proxy = pd
+	proxyMut.Unlock()
+	return nil
+}
+
+// SetBypassPrivate sets whether connections to hosts on private networks
+// (RFC 1918 and unique local IPv6 addresses) bypass the proxy. By default
+// they go through it like any other connection.
+func SetBypassPrivate(bypass bool) {
+	proxyMut.Lock()
+	bypassPrivate = bypass
+	proxyMut.Unlock()
+}
+
+// ProxyURL returns the URL of the proxy in use, with any password removed,
+// or the empty string when connections are made directly.
+func ProxyURL() string {
+	proxyMut.RLock()
+	defer proxyMut.RUnlock()
+	if proxy == nil {
+		return ""
+	}
+	return proxy.String()
+}
+
+// UsingProxy returns true if outgoing connections go through a proxy.
+func UsingProxy() bool {
+	proxyMut.RLock()
+	defer proxyMut.RUnlock()
+	return proxy != nil
+}
+
+// Dial connects to the address on the named network. TCP connections go
+// through the proxy when one is set, without falling back to a direct
+// connection, except those to loopback and link local addresses and, if
+// SetBypassPrivate is enabled, private networks. Everything else is dialed
+// directly.
+func Dial(network, addr string) (net.Conn, error) {
+	return DialTimeout(network, addr, 0)
+}
+
+// DialTimeout acts like Dial but takes a timeout. The timeout includes the
+// proxy handshake, if any. A zero timeout means no timeout.
+func DialTimeout(network, addr string, timeout time.Duration) (net.Conn, error) {
+	proxyMut.RLock()
+	pd := proxy
+	bypass := bypassPrivate
+	proxyMut.RUnlock()
+
+	if pd == nil || !isTCP(network) || isLocal(addr) || (bypass && isPrivate(addr)) {
+		if debug {
+			l.Debugln("dial direct", network, addr)
+		}
+		return net.DialTimeout(network, addr, timeout)
+	}
+
+	if debug {
+		l.Debugln("dial", network, addr, "via", pd)
+	}
+	conn, err := pd.dial(network, addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %v", pd, err)
+	}
+	return conn, nil
+}
+
+func isTCP(network string) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return true
+	}
+	return false
+}
+
+// isLocal returns true if the host part of addr is a loopback or link local
+// address. Such hosts are not reachable through a proxy, and are instead
+// dialed directly.
+func isLocal(addr string) bool {
+	host := splitHost(addr)
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsLinkLocalUnicast())
+}
+
+// isPrivate returns true if the host part of addr is an address on a
+// private network.
+func isPrivate(addr string) bool {
+	ip := net.ParseIP(splitHost(addr))
+	if ip == nil {
+		return false
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+var privateNets = parseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7")
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
@@ -0,0 +1,396 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package dialer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	// Make sure the tests aren't affected by a proxy set in the environment.
+	for _, env := range proxyEnvVars {
+		os.Unsetenv(env)
+	}
+}
+
+// echoServer accepts connections and echoes back whatever is written.
+func echoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+// socks5Server is a minimal SOCKS5 server supporting the CONNECT command and
+// optional username/password authentication. All connections are made to
+// target, regardless of the requested address, which is recorded in
+// requested.
+type socks5Server struct {
+	net.Listener
+	target    string
+	user      string
+	pass      string
+	requested chan string
+}
+
+func newSOCKS5Server(t *testing.T, target, user, pass string) *socks5Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socks5Server{ln, target, user, pass, make(chan string, 16)}
+	go s.serve()
+	return s
+}
+
+func (s *socks5Server) serve() {
+	for {
+		conn, err := s.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *socks5Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil || hdr[0] != 5 {
+		return
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+
+	if s.user != "" {
+		conn.Write([]byte{5, 2})
+		var ver, ulen, plen [1]byte
+		io.ReadFull(conn, ver[:])
+		io.ReadFull(conn, ulen[:])
+		user := make([]byte, ulen[0])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, plen[:])
+		pass := make([]byte, plen[0])
+		io.ReadFull(conn, pass)
+		if string(user) != s.user || string(pass) != s.pass {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	} else {
+		conn.Write([]byte{5, 0})
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 4:
+		ip := make([]byte, 16)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 3:
+		var l [1]byte
+		io.ReadFull(conn, l[:])
+		name := make([]byte, l[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	}
+	port := make([]byte, 2)
+	io.ReadFull(conn, port)
+	s.requested <- net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	target, err := net.Dial("tcp", s.target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+// httpConnectServer is a minimal HTTP proxy supporting the CONNECT method.
+func httpConnectServer(t *testing.T, target string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != "CONNECT" {
+					conn.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\n\r\n"))
+					return
+				}
+				dst, err := net.Dial("tcp", target)
+				if err != nil {
+					conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer dst.Close()
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				go io.Copy(dst, conn)
+				io.Copy(conn, dst)
+			}()
+		}
+	}()
+	return ln
+}
+
+func testEcho(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("hello, proxy")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello, proxy" {
+		t.Errorf("unexpected echo %q", buf)
+	}
+}
+
+func TestSOCKS5(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	srv := newSOCKS5Server(t, echo.Addr().String(), "", "")
+	defer srv.Close()
+
+	if err := SetProxy("socks5h://" + srv.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer SetProxy("")
+
+	if !UsingProxy() {
+		t.Fatal("expected proxy to be in use")
+	}
+
+	// A host name outside the local network is passed to the proxy
+	// unresolved.
+	conn, err := Dial("tcp", "sync.example.invalid:22000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEcho(t, conn)
+
+	if req := <-srv.requested; req != "sync.example.invalid:22000" {
+		t.Errorf("unexpected requested address %q", req)
+	}
+}
+
+func TestSOCKS5Auth(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	srv := newSOCKS5Server(t, echo.Addr().String(), "jb", "s3cret")
+	defer srv.Close()
+
+	uri, _ := url.Parse("socks5://jb:s3cret@" + srv.Addr().String())
+	pd, err := newProxyDialer(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := pd.dial("tcp", "192.0.2.42:22000", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEcho(t, conn)
+
+	if req := <-srv.requested; req != "192.0.2.42:22000" {
+		t.Errorf("unexpected requested address %q", req)
+	}
+
+	if pd.String() != "socks5://jb@"+srv.Addr().String() {
+		t.Errorf("password not removed from %q", pd)
+	}
+
+	uri, _ = url.Parse("socks5://jb:wrong@" + srv.Addr().String())
+	pd, err = newProxyDialer(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pd.dial("tcp", "192.0.2.42:22000", time.Second); err != ErrAuthFailed {
+		t.Errorf("expected authentication failure, got %v", err)
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	srv := httpConnectServer(t, echo.Addr().String())
+	defer srv.Close()
+
+	uri, _ := url.Parse("http://" + srv.Addr().String())
+	pd, err := newProxyDialer(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := pd.dial("tcp", "192.0.2.42:22000", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEcho(t, conn)
+}
+
+func TestLocalBypassesProxy(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	// A proxy that isn't listening; any attempt to use it fails.
+	if err := SetProxy("socks5://127.0.0.1:1"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetProxy("")
+
+	conn, err := Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEcho(t, conn)
+
+	if _, err := Dial("tcp", "192.0.2.42:22000"); err == nil {
+		t.Error("unexpected direct connection for non-local address")
+	}
+}
+
+func TestEnvironmentOverride(t *testing.T) {
+	os.Setenv("all_proxy", "http://proxy.example.com:3128")
+	defer func() {
+		os.Unsetenv("all_proxy")
+		SetProxy("")
+	}()
+
+	if err := SetProxy("socks5://127.0.0.1:1080"); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := ProxyURL(); p != "http://proxy.example.com:3128" {
+		t.Errorf("unexpected proxy %q", p)
+	}
+}
+
+func TestNoDoubleProxy(t *testing.T) {
+	if err := SetProxy("socks5://127.0.0.1:1080"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetProxy("")
+
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+	if u, err := environmentProxy(req); u != nil || err != nil {
+		t.Errorf("unexpected HTTP proxy %v, %v while dialing through a proxy", u, err)
+	}
+}
+
+func TestIsLocal(t *testing.T) {
+	cases := []struct {
+		addr    string
+		local   bool
+		private bool
+	}{
+		{"127.0.0.1:22000", true, false},
+		{"[::1]:22000", true, false},
+		{"localhost:22000", true, false},
+		{"10.1.2.3:22000", false, true},
+		{"172.20.0.1:22000", false, true},
+		{"192.168.1.1:22000", false, true},
+		{"169.254.1.1:22000", true, false},
+		{"[fe80::1]:22000", true, false},
+		{"[fd00::1]:22000", false, true},
+		{"172.32.0.1:22000", false, false},
+		{"194.126.249.5:22000", false, false},
+		{"[2001:db8::1]:22000", false, false},
+		{"announce.syncthing.net:22026", false, false},
+	}
+
+	for _, tc := range cases {
+		if res := isLocal(tc.addr); res != tc.local {
+			t.Errorf("isLocal(%q) = %v, expected %v", tc.addr, res, tc.local)
+		}
+		if res := isPrivate(tc.addr); res != tc.private {
+			t.Errorf("isPrivate(%q) = %v, expected %v", tc.addr, res, tc.private)
+		}
+	}
+}
+
+func TestPrivateBypassesProxy(t *testing.T) {
+	// A proxy that isn't listening; any attempt to use it fails.
+	if err := SetProxy("socks5://127.0.0.1:1"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetProxy("")
+
+	// Private addresses go through the proxy unless told otherwise.
+	if _, err := DialTimeout("tcp", "10.255.255.1:22000", 100*time.Millisecond); err == nil || !strings.Contains(err.Error(), "proxy") {
+		t.Errorf("unexpected result %v for a private address through the proxy", err)
+	}
+
+	SetBypassPrivate(true)
+	defer SetBypassPrivate(false)
+	if _, err := DialTimeout("tcp", "10.255.255.1:22000", 100*time.Millisecond); err != nil && strings.Contains(err.Error(), "proxy") {
+		t.Errorf("unexpected proxy error %v for a private address with the bypass", err)
+	}
+}
+
+func TestUnsupportedScheme(t *testing.T) {
+	if err := SetProxy("ftp://proxy.example.com"); err == nil {
+		t.Error("unexpected nil error for unsupported scheme")
+	}
+	if UsingProxy() {
+		t.Error("unexpected proxy after failed SetProxy")
+	}
+}
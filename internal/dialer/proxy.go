@@ -0,0 +1,301 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package dialer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrUnsupportedScheme = errors.New("unsupported proxy scheme")
+	ErrAuthFailed        = errors.New("proxy authentication failed")
+)
+
+// A proxyDialer makes connections through a SOCKS5 or HTTP CONNECT proxy.
+type proxyDialer struct {
+	uri       *url.URL
+	handshake func(conn net.Conn, addr string) (net.Conn, error)
+}
+
+func newProxyDialer(uri *url.URL) (*proxyDialer, error) {
+	pd := &proxyDialer{uri: uri}
+
+	switch uri.Scheme {
+	case "socks5", "socks5h":
+		pd.handshake = pd.socks5Connect
+	case "http":
+		pd.handshake = pd.httpConnect
+	default:
+		return nil, fmt.Errorf("%v: %q", ErrUnsupportedScheme, uri.Scheme)
+	}
+
+	if uri.Host == "" {
+		return nil, fmt.Errorf("proxy URL %q is missing a host", uri)
+	}
+	if _, _, err := net.SplitHostPort(uri.Host); err != nil {
+		// No port given; use the default for the proxy type.
+		port := "1080"
+		if uri.Scheme == "http" {
+			port = "8080"
+		}
+		uri.Host = net.JoinHostPort(uri.Host, port)
+	}
+
+	return pd, nil
+}
+
+func (pd *proxyDialer) dial(network, addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", pd.uri.Host, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	pconn, err := pd.handshake(conn, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+	return pconn, nil
+}
+
+func (pd *proxyDialer) String() string {
+	u := *pd.uri
+	if u.User != nil {
+		u.User = url.User(u.User.Username())
+	}
+	return u.String()
+}
+
+// SOCKS5 protocol constants, as defined in RFC 1928 and RFC 1929.
+const (
+	socks5Version       = 5
+	socks5AuthNone      = 0
+	socks5AuthPassword  = 2
+	socks5NoAcceptable  = 0xff
+	socks5Connect       = 1
+	socks5AddrIPv4      = 1
+	socks5AddrDomain    = 3
+	socks5AddrIPv6      = 4
+	socks5PasswordVer   = 1
+	socks5ReplySucceded = 0
+)
+
+var socks5Errors = []string{
+	"",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+func (pd *proxyDialer) socks5Connect(conn net.Conn, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	// Method negotiation
+
+	methods := []byte{socks5AuthNone}
+	if pd.uri.User != nil {
+		methods = append(methods, socks5AuthPassword)
+	}
+	buf := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	if resp[0] != socks5Version {
+		return nil, fmt.Errorf("unexpected SOCKS version %d", resp[0])
+	}
+
+	switch resp[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if pd.uri.User == nil {
+			return nil, ErrAuthFailed
+		}
+		user := pd.uri.User.Username()
+		pass, _ := pd.uri.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return nil, errors.New("proxy username or password too long")
+		}
+		buf = []byte{socks5PasswordVer, byte(len(user))}
+		buf = append(buf, user...)
+		buf = append(buf, byte(len(pass)))
+		buf = append(buf, pass...)
+		if _, err := conn.Write(buf); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, err
+		}
+		if resp[1] != 0 {
+			return nil, ErrAuthFailed
+		}
+	case socks5NoAcceptable:
+		return nil, errors.New("no acceptable SOCKS authentication methods")
+	default:
+		return nil, fmt.Errorf("unexpected SOCKS authentication method %d", resp[1])
+	}
+
+	// Connect request. Host names are resolved locally for "socks5" and by
+	// the proxy for "socks5h", as is customary.
+
+	ip := net.ParseIP(host)
+	if ip == nil && pd.uri.Scheme == "socks5" {
+		ipAddr, err := net.ResolveIPAddr("ip", host)
+		if err != nil {
+			return nil, err
+		}
+		ip = ipAddr.IP
+	}
+
+	buf = []byte{socks5Version, socks5Connect, 0}
+	if ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name %q too long", host)
+		}
+		buf = append(buf, socks5AddrDomain, byte(len(host)))
+		buf = append(buf, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		buf = append(buf, socks5AddrIPv4)
+		buf = append(buf, ip4...)
+	} else {
+		buf = append(buf, socks5AddrIPv6)
+		buf = append(buf, ip.To16()...)
+	}
+	buf = append(buf, byte(port>>8), byte(port))
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+
+	// Reply; version, status, reserved, address type, address, port
+
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[1] != socks5ReplySucceded {
+		if int(hdr[1]) < len(socks5Errors) {
+			return nil, errors.New(socks5Errors[hdr[1]])
+		}
+		return nil, fmt.Errorf("unknown SOCKS error %d", hdr[1])
+	}
+
+	var addrLen int
+	switch hdr[3] {
+	case socks5AddrIPv4:
+		addrLen = net.IPv4len
+	case socks5AddrIPv6:
+		addrLen = net.IPv6len
+	case socks5AddrDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return nil, err
+		}
+		addrLen = int(l[0])
+	default:
+		return nil, fmt.Errorf("unknown SOCKS address type %d", hdr[3])
+	}
+	bound := make([]byte, addrLen+2)
+	if _, err := io.ReadFull(conn, bound); err != nil {
+		return nil, err
+	}
+	if debug {
+		l.Debugf("socks5 connect %s; bound port %d", addr, binary.BigEndian.Uint16(bound[addrLen:]))
+	}
+
+	return conn, nil
+}
+
+func (pd *proxyDialer) httpConnect(conn net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if pd.uri.User != nil {
+		pass, _ := pd.uri.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(pd.uri.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		return nil, ErrAuthFailed
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return nil, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		// The proxy sent data following the response headers. Make sure
+		// it's not lost.
+		return &bufferedConn{conn, br}, nil
+	}
+	return conn, nil
+}
+
+// A bufferedConn is a net.Conn that reads through a bufio.Reader.
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *bufferedConn) Read(bs []byte) (int, error) {
+	return c.br.Read(bs)
+}
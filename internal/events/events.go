@@ -39,6 +39,8 @@ const (
 	FolderRejected
 	ConfigSaved
 	DownloadProgress
+	DeviceLatency
+	FolderScanProgress
 
 	AllEvents = (1 << iota) - 1
 )
@@ -73,6 +75,10 @@ func (t EventType) String() string {
 		return "ConfigSaved"
 	case DownloadProgress:
 		return "DownloadProgress"
+	case DeviceLatency:
+		return "DeviceLatency"
+	case FolderScanProgress:
+		return "FolderScanProgress"
 	default:
 		return "Unknown"
 	}
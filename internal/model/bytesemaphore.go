@@ -0,0 +1,81 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import "sync"
+
+// A byteSemaphore limits the number of bytes in use at any one time, such as
+// the bytes requested but not yet received by the pullers. A capacity of
+// zero means no limit. The capacity can be changed at any time.
+type byteSemaphore struct {
+	max  int
+	used int
+	mut  sync.Mutex
+	cond *sync.Cond
+}
+
+func newByteSemaphore(max int) *byteSemaphore {
+	s := &byteSemaphore{
+		max: max,
+	}
+	s.cond = sync.NewCond(&s.mut)
+	return s
+}
+
+// take blocks until the given number of bytes are available and then takes
+// them. A request for more than the capacity waits until all bytes are
+// available.
+func (s *byteSemaphore) take(bytes int) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	for !s.fits(bytes) {
+		s.cond.Wait()
+	}
+	s.used += bytes
+}
+
+// tryTake takes the given number of bytes if they are available right now,
+// and returns whether it did so.
+func (s *byteSemaphore) tryTake(bytes int) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if !s.fits(bytes) {
+		return false
+	}
+	s.used += bytes
+	return true
+}
+
+// give returns bytes previously taken.
+func (s *byteSemaphore) give(bytes int) {
+	s.mut.Lock()
+	s.used -= bytes
+	s.cond.Broadcast()
+	s.mut.Unlock()
+}
+
+// setCapacity changes the capacity. Bytes already taken beyond the new
+// capacity delay further takes until enough of them are given back.
+func (s *byteSemaphore) setCapacity(max int) {
+	s.mut.Lock()
+	s.max = max
+	s.cond.Broadcast()
+	s.mut.Unlock()
+}
+
+func (s *byteSemaphore) fits(bytes int) bool {
+	return s.max == 0 || s.used == 0 || s.used+bytes <= s.max
+}
@@ -0,0 +1,114 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestByteSemaphore(t *testing.T) {
+	s := newByteSemaphore(100)
+
+	s.take(60)
+	if s.tryTake(50) {
+		t.Error("Unexpected take beyond the limit")
+	}
+	if !s.tryTake(40) {
+		t.Error("Unexpected failure to take within the limit")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.take(30)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Unexpected take beyond the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.give(40)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Take not unblocked by give")
+	}
+
+	// A request for more than the capacity is granted once all of it is
+	// available.
+	s.give(60)
+	s.give(30)
+	if !s.tryTake(1000) {
+		t.Error("Unexpected failure to take the full capacity")
+	}
+	s.give(1000)
+	if s.used != 0 {
+		t.Errorf("Unexpected used %d after give", s.used)
+	}
+}
+
+func TestByteSemaphoreUnlimited(t *testing.T) {
+	s := newByteSemaphore(0)
+	s.take(1 << 30)
+	if !s.tryTake(1 << 30) {
+		t.Error("Unexpected limit")
+	}
+	s.give(1 << 30)
+}
+
+func TestByteSemaphoreSetCapacity(t *testing.T) {
+	s := newByteSemaphore(100)
+	s.take(80)
+
+	s.setCapacity(50)
+	if s.tryTake(10) {
+		t.Error("Unexpected take beyond the reduced limit")
+	}
+	s.give(40)
+	if !s.tryTake(10) {
+		t.Error("Unexpected failure to take within the reduced limit")
+	}
+
+	// Raising the limit unblocks waiting takes.
+	done := make(chan struct{})
+	go func() {
+		s.take(100)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Unexpected take beyond the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.setCapacity(200)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Take not unblocked by raising the limit")
+	}
+
+	// Removing the limit doesn't confuse the accounting of what was taken
+	// before.
+	s.setCapacity(0)
+	s.give(50)
+	s.give(100)
+	if s.used != 0 {
+		t.Errorf("Unexpected used %d after give", s.used)
+	}
+}
@@ -17,46 +17,177 @@ package model
 
 import (
 	"sync"
+	"time"
 
 	"github.com/syncthing/protocol"
 )
 
-// deviceActivity tracks the number of outstanding requests per device and can
-// answer which device is least busy. It is safe for use from multiple
-// goroutines.
+const (
+	// The throughput of a device is sampled once it has been busy serving
+	// requests for at least this long since the last sample.
+	throughputSampleTime = time.Second
+
+	// The throughput assumed for a device when no device has been measured.
+	// Only the relative throughput of devices matters, so this is mostly
+	// arbitrary.
+	defaultThroughput = 1 << 20 // bytes per second
+
+	// A request is considered slow, and may be sent to another device as
+	// well, when it hasn't been answered after deadlineFactor times the
+	// expected time, or minRequestDeadline, whichever is longer.
+	deadlineFactor     = 4
+	minRequestDeadline = 10 * time.Second
+)
+
+// deviceActivity tracks the outstanding requests, latency and observed
+// throughput per device and can answer which device should be asked for a
+// block. It is safe for use from multiple goroutines.
 type deviceActivity struct {
-	act map[protocol.DeviceID]int
-	mut sync.Mutex
+	devices map[protocol.DeviceID]*deviceLoad
+	mut     sync.Mutex
+}
+
+type deviceLoad struct {
+	requests   int           // outstanding requests
+	bytes      int64         // outstanding bytes
+	latency    time.Duration // zero if unknown
+	throughput float64       // bytes per second, zero if unknown
+
+	busy     time.Duration // time spent with outstanding requests since the last sample
+	received int64         // bytes received since the last sample
+	changed  time.Time     // last time requests changed
 }
 
 func newDeviceActivity() *deviceActivity {
 	return &deviceActivity{
-		act: make(map[protocol.DeviceID]int),
+		devices: make(map[protocol.DeviceID]*deviceLoad),
+	}
+}
+
+func (m *deviceActivity) load(device protocol.DeviceID) *deviceLoad {
+	d, ok := m.devices[device]
+	if !ok {
+		d = &deviceLoad{}
+		m.devices[device] = d
 	}
+	return d
 }
 
-func (m *deviceActivity) leastBusy(availability []protocol.DeviceID) protocol.DeviceID {
+// leastBusy returns the device among availability expected to deliver a
+// block of the given size the soonest, and the time that is expected to
+// take. The expected time is the latency of the device plus the time to
+// transfer the outstanding bytes and the new block at the observed
+// throughput. Requests are thus allocated in proportion to the throughput of
+// each device. Devices with unknown latency or throughput are assumed to be
+// average.
+func (m *deviceActivity) leastBusy(availability []protocol.DeviceID, size int) (protocol.DeviceID, time.Duration) {
 	m.mut.Lock()
-	low := 2<<30 - 1
-	var selected protocol.DeviceID
+	defer m.mut.Unlock()
+
+	var totLatency time.Duration
+	var totThroughput float64
+	var nLatency, nThroughput int
 	for _, device := range availability {
-		if usage := m.act[device]; usage < low {
-			low = usage
+		if d, ok := m.devices[device]; ok {
+			if d.latency > 0 {
+				totLatency += d.latency
+				nLatency++
+			}
+			if d.throughput > 0 {
+				totThroughput += d.throughput
+				nThroughput++
+			}
+		}
+	}
+	var defLatency time.Duration
+	if nLatency > 0 {
+		defLatency = totLatency / time.Duration(nLatency)
+	}
+	defThroughput := float64(defaultThroughput)
+	if nThroughput > 0 {
+		defThroughput = totThroughput / float64(nThroughput)
+	}
+
+	var low float64
+	var selected protocol.DeviceID
+	for i, device := range availability {
+		latency, throughput := defLatency, defThroughput
+		var queued int64
+		if d, ok := m.devices[device]; ok {
+			if d.latency > 0 {
+				latency = d.latency
+			}
+			if d.throughput > 0 {
+				throughput = d.throughput
+			}
+			queued = d.bytes
+		}
+		cost := latency.Seconds() + float64(queued+int64(size))/throughput
+		if i == 0 || cost < low {
+			low = cost
 			selected = device
 		}
 	}
+
+	return selected, time.Duration(low * float64(time.Second))
+}
+
+// using marks a request for the given number of bytes as outstanding to the
+// device.
+func (m *deviceActivity) using(device protocol.DeviceID, size int) {
+	m.mut.Lock()
+	d := m.load(device)
+	d.accountBusy(time.Now())
+	d.requests++
+	d.bytes += int64(size)
 	m.mut.Unlock()
-	return selected
 }
 
-func (m *deviceActivity) using(device protocol.DeviceID) {
+// done marks a request as answered. Only successful requests count towards
+// the received bytes, while the time spent on all of them counts towards the
+// time the device was busy.
+func (m *deviceActivity) done(device protocol.DeviceID, size int, ok bool) {
 	m.mut.Lock()
-	m.act[device]++
+	d := m.load(device)
+	d.accountBusy(time.Now())
+	d.requests--
+	d.bytes -= int64(size)
+	if ok {
+		d.received += int64(size)
+	}
+	if d.busy >= throughputSampleTime {
+		sample := float64(d.received) / d.busy.Seconds()
+		if d.throughput == 0 {
+			d.throughput = sample
+		} else {
+			d.throughput = (3*d.throughput + sample) / 4
+		}
+		d.busy = 0
+		d.received = 0
+	}
 	m.mut.Unlock()
 }
 
-func (m *deviceActivity) done(device protocol.DeviceID) {
+// setLatency records the latency of the given device. A zero latency means
+// unknown.
+func (m *deviceActivity) setLatency(device protocol.DeviceID, latency time.Duration) {
 	m.mut.Lock()
-	m.act[device]--
+	m.load(device).latency = latency
 	m.mut.Unlock()
 }
+
+// requestDeadline returns the time after which a request expected to take
+// the given time is considered slow.
+func requestDeadline(expected time.Duration) time.Duration {
+	if d := deadlineFactor * expected; d > minRequestDeadline {
+		return d
+	}
+	return minRequestDeadline
+}
+
+func (d *deviceLoad) accountBusy(now time.Time) {
+	if d.requests > 0 {
+		d.busy += now.Sub(d.changed)
+	}
+	d.changed = now
+}
@@ -17,6 +17,7 @@ package model
 
 import (
 	"testing"
+	"time"
 
 	"github.com/syncthing/protocol"
 )
@@ -28,40 +29,135 @@ func TestDeviceActivity(t *testing.T) {
 	devices := []protocol.DeviceID{n0, n1, n2}
 	na := newDeviceActivity()
 
-	if lb := na.leastBusy(devices); lb != n0 {
+	if lb := leastBusy(na, devices); lb != n0 {
 		t.Errorf("Least busy device should be n0 (%v) not %v", n0, lb)
 	}
-	if lb := na.leastBusy(devices); lb != n0 {
+	if lb := leastBusy(na, devices); lb != n0 {
 		t.Errorf("Least busy device should still be n0 (%v) not %v", n0, lb)
 	}
 
-	na.using(na.leastBusy(devices))
-	if lb := na.leastBusy(devices); lb != n1 {
+	na.using(leastBusy(na, devices), protocol.BlockSize)
+	if lb := leastBusy(na, devices); lb != n1 {
 		t.Errorf("Least busy device should be n1 (%v) not %v", n1, lb)
 	}
 
-	na.using(na.leastBusy(devices))
-	if lb := na.leastBusy(devices); lb != n2 {
+	na.using(leastBusy(na, devices), protocol.BlockSize)
+	if lb := leastBusy(na, devices); lb != n2 {
 		t.Errorf("Least busy device should be n2 (%v) not %v", n2, lb)
 	}
 
-	na.using(na.leastBusy(devices))
-	if lb := na.leastBusy(devices); lb != n0 {
+	na.using(leastBusy(na, devices), protocol.BlockSize)
+	if lb := leastBusy(na, devices); lb != n0 {
 		t.Errorf("Least busy device should be n0 (%v) not %v", n0, lb)
 	}
 
-	na.done(n1)
-	if lb := na.leastBusy(devices); lb != n1 {
+	na.done(n1, protocol.BlockSize, true)
+	if lb := leastBusy(na, devices); lb != n1 {
 		t.Errorf("Least busy device should be n1 (%v) not %v", n1, lb)
 	}
 
-	na.done(n2)
-	if lb := na.leastBusy(devices); lb != n1 {
+	na.done(n2, protocol.BlockSize, true)
+	if lb := leastBusy(na, devices); lb != n1 {
 		t.Errorf("Least busy device should still be n1 (%v) not %v", n1, lb)
 	}
 
-	na.done(n0)
-	if lb := na.leastBusy(devices); lb != n0 {
+	na.done(n0, protocol.BlockSize, true)
+	if lb := leastBusy(na, devices); lb != n0 {
 		t.Errorf("Least busy device should be n0 (%v) not %v", n0, lb)
 	}
 }
+
+func leastBusy(na *deviceActivity, devices []protocol.DeviceID) protocol.DeviceID {
+	dev, _ := na.leastBusy(devices, protocol.BlockSize)
+	return dev
+}
+
+func TestDeviceActivityLatency(t *testing.T) {
+	n0 := protocol.DeviceID([32]byte{1, 2, 3, 4})
+	n1 := protocol.DeviceID([32]byte{5, 6, 7, 8})
+	n2 := protocol.DeviceID([32]byte{9, 10, 11, 12})
+	devices := []protocol.DeviceID{n0, n1, n2}
+	na := newDeviceActivity()
+
+	// n2 has unknown latency and is assumed to be at the average, 55 ms.
+	na.setLatency(n0, 100*time.Millisecond)
+	na.setLatency(n1, 10*time.Millisecond)
+
+	dev, expected := na.leastBusy(devices, protocol.BlockSize)
+	if dev != n1 {
+		t.Errorf("Least busy device should be n1 (%v) not %v", n1, dev)
+	}
+	// 10 ms latency plus 128 KiB at the default 1 MiB/s
+	if expected != 135*time.Millisecond {
+		t.Errorf("Unexpected expected time %v", expected)
+	}
+
+	// With the default throughput, a block in the queue takes 125 ms, which
+	// makes n1 slower than n2.
+	na.using(n1, protocol.BlockSize)
+	if lb := leastBusy(na, devices); lb != n2 {
+		t.Errorf("Least busy device should be n2 (%v) not %v", n2, lb)
+	}
+
+	// Without latency, n1 is just as far away as the others and busy.
+	na.setLatency(n1, 0)
+	na.setLatency(n0, 0)
+	if lb := leastBusy(na, devices); lb != n0 {
+		t.Errorf("Least busy device should be n0 (%v) not %v", n0, lb)
+	}
+}
+
+func TestDeviceActivityThroughput(t *testing.T) {
+	n0 := protocol.DeviceID([32]byte{1, 2, 3, 4})
+	n1 := protocol.DeviceID([32]byte{5, 6, 7, 8})
+	devices := []protocol.DeviceID{n0, n1}
+	na := newDeviceActivity()
+
+	na.devices[n0] = &deviceLoad{throughput: 10 << 20}
+	na.devices[n1] = &deviceLoad{throughput: 1 << 20}
+
+	// n0 is ten times as fast as n1 and should get about ten times the
+	// outstanding requests.
+	counts := make(map[protocol.DeviceID]int)
+	for i := 0; i < 22; i++ {
+		dev := leastBusy(na, devices)
+		na.using(dev, protocol.BlockSize)
+		counts[dev]++
+	}
+	if counts[n0] != 20 || counts[n1] != 2 {
+		t.Errorf("Unexpected allocation of requests %v", counts)
+	}
+}
+
+func TestDeviceActivityMeasure(t *testing.T) {
+	n0 := protocol.DeviceID([32]byte{1, 2, 3, 4})
+	na := newDeviceActivity()
+
+	// 1 MiB in four requests taking half a second each, sequentially. The
+	// first one isn't enough for a sample.
+	for i := 0; i < 4; i++ {
+		na.using(n0, 256<<10)
+		na.devices[n0].changed = na.devices[n0].changed.Add(-500 * time.Millisecond)
+		na.done(n0, 256<<10, true)
+		if tp := na.devices[n0].throughput; i < 1 && tp != 0 {
+			t.Errorf("Unexpected throughput %v after %d requests", tp, i+1)
+		}
+	}
+
+	// Two samples, of 512 KiB/s each, give or take the time the test takes.
+	if tp := na.devices[n0].throughput; tp < 510<<10 || tp > 512<<10 {
+		t.Errorf("Unexpected throughput %v", tp)
+	}
+	if na.devices[n0].requests != 0 || na.devices[n0].bytes != 0 {
+		t.Errorf("Unexpected outstanding requests %+v", na.devices[n0])
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	if d := requestDeadline(time.Second); d != minRequestDeadline {
+		t.Errorf("Unexpected deadline %v", d)
+	}
+	if d := requestDeadline(10 * time.Second); d != 40*time.Second {
+		t.Errorf("Unexpected deadline %v", d)
+	}
+}
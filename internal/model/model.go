@@ -25,9 +25,11 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/syncthing/protocol"
@@ -37,11 +39,11 @@ import (
 	"github.com/syncthing/syncthing/internal/ignore"
 	"github.com/syncthing/syncthing/internal/lamport"
 	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/posix"
 	"github.com/syncthing/syncthing/internal/scanner"
 	"github.com/syncthing/syncthing/internal/stats"
 	"github.com/syncthing/syncthing/internal/symlinks"
 	"github.com/syncthing/syncthing/internal/versioner"
-	"github.com/syndtr/goleveldb/leveldb"
 )
 
 type folderState int
@@ -85,7 +87,7 @@ type service interface {
 
 type Model struct {
 	cfg             *config.Wrapper
-	db              *leveldb.DB
+	db              *db.Instance
 	finder          *db.BlockFinder
 	progressEmitter *ProgressEmitter
 
@@ -101,16 +103,32 @@ type Model struct {
 	folderIgnores  map[string]*ignore.Matcher                             // folder -> matcher object
 	folderRunners  map[string]service                                     // folder -> puller or scanner
 	folderStatRefs map[string]*stats.FolderStatisticsReference            // folder -> statsRef
+	folderHistRefs map[string]*stats.FolderHistoryReference               // folder -> historyRef
+	folderErrors   map[string][]FileError                                 // folder -> files that couldn't be scanned
+	pullErrors     map[string]map[string]string                           // folder -> file -> problem applying its metadata
+	folderLimiters map[string]*scanner.Limiter                            // folder -> hashing rate limit
 	fmut           sync.RWMutex                                           // protects the above
 
-	folderState        map[string]folderState // folder -> state
-	folderStateChanged map[string]time.Time   // folder -> time when state changed
+	folderState        map[string]folderState   // folder -> state
+	folderStateChanged map[string]time.Time     // folder -> time when state changed
+	folderScans        map[string]*scanProgress // folder -> progress of the running scan
 	smut               sync.RWMutex
 
-	protoConn map[protocol.DeviceID]protocol.Connection
-	rawConn   map[protocol.DeviceID]io.Closer
-	deviceVer map[protocol.DeviceID]string
-	pmut      sync.RWMutex // protects protoConn and rawConn
+	protoConn    map[protocol.DeviceID][]protocol.Connection // the first connection to each device carries index data
+	rawConn      map[protocol.DeviceID][]io.Closer
+	deviceVer    map[protocol.DeviceID]string
+	deviceClosed map[protocol.DeviceID]CloseInfo // why the last connection to a currently disconnected device closed
+	pmut         sync.RWMutex                    // protects protoConn, rawConn, deviceVer and deviceClosed
+
+	reqCounter uint32 // spreads requests over the connections to a device; accessed atomically
+
+	pullLimit *byteSemaphore // limits the bytes requested but not yet received, over all folders
+
+	hashLimit *scanner.Limiter // limits the hashing rate, over all folders
+	scanMut   sync.Mutex       // held by the running scan while scans are serialized
+
+	stop     chan struct{} // closed on shutdown, to abort scans not run by a folder runner
+	stopOnce sync.Once
 
 	addedFolder bool
 	started     bool
@@ -120,13 +138,15 @@ var (
 	ErrNoSuchFile = errors.New("no such file")
 	ErrInvalid    = errors.New("file is invalid")
 
+	errScanStopped = errors.New("scan stopped")
+
 	SymlinkWarning = sync.Once{}
 )
 
 // NewModel creates and starts a new model. The model starts in read-only mode,
 // where it sends index information to connected peers and responds to requests
 // for file data without altering the local folder in any way.
-func NewModel(cfg *config.Wrapper, deviceName, clientName, clientVersion string, ldb *leveldb.DB) *Model {
+func NewModel(cfg *config.Wrapper, deviceName, clientName, clientVersion string, ldb *db.Instance) *Model {
 	m := &Model{
 		cfg:                cfg,
 		db:                 ldb,
@@ -141,14 +161,25 @@ func NewModel(cfg *config.Wrapper, deviceName, clientName, clientVersion string,
 		folderIgnores:      make(map[string]*ignore.Matcher),
 		folderRunners:      make(map[string]service),
 		folderStatRefs:     make(map[string]*stats.FolderStatisticsReference),
+		folderHistRefs:     make(map[string]*stats.FolderHistoryReference),
+		folderErrors:       make(map[string][]FileError),
+		pullErrors:         make(map[string]map[string]string),
+		folderLimiters:     make(map[string]*scanner.Limiter),
 		folderState:        make(map[string]folderState),
 		folderStateChanged: make(map[string]time.Time),
-		protoConn:          make(map[protocol.DeviceID]protocol.Connection),
-		rawConn:            make(map[protocol.DeviceID]io.Closer),
+		folderScans:        make(map[string]*scanProgress),
+		protoConn:          make(map[protocol.DeviceID][]protocol.Connection),
+		rawConn:            make(map[protocol.DeviceID][]io.Closer),
 		deviceVer:          make(map[protocol.DeviceID]string),
+		deviceClosed:       make(map[protocol.DeviceID]CloseInfo),
 		finder:             db.NewBlockFinder(ldb, cfg),
 		progressEmitter:    NewProgressEmitter(cfg),
+		pullLimit:          newByteSemaphore(cfg.Options().MaxPullInFlightKiB * 1024),
+		hashLimit:          scanner.NewLimiter(cfg.Options().MaxHashMiBps * 1024 * 1024),
+		stop:               make(chan struct{}),
 	}
+	cfg.Subscribe(config.HandlerFunc(m.updateHashLimits))
+	cfg.Subscribe(config.HandlerFunc(m.updatePullLimit))
 	if cfg.Options().ProgressUpdateIntervalS > -1 {
 		go m.progressEmitter.Serve()
 	}
@@ -187,10 +218,14 @@ func (m *Model) StartFolderRW(folder string) {
 		model:           m,
 		ignorePerms:     cfg.IgnorePerms,
 		lenientMtimes:   cfg.LenientMtimes,
+		syncOwnership:   cfg.SyncOwnership && posix.OwnershipSupported,
+		syncXattrs:      cfg.SyncXattrs && posix.XattrsSupported,
+		preallocate:     cfg.PreallocateFiles,
 		progressEmitter: m.progressEmitter,
 		copiers:         cfg.Copiers,
 		pullers:         cfg.Pullers,
 		queue:           newJobQueue(),
+		stop:            make(chan struct{}),
 	}
 	m.folderRunners[folder] = p
 	m.fmut.Unlock()
@@ -225,9 +260,10 @@ func (m *Model) StartFolderRO(folder string) {
 		panic("cannot start already running folder " + folder)
 	}
 	s := &Scanner{
-		folder: folder,
-		intv:   time.Duration(cfg.RescanIntervalS) * time.Second,
-		model:  m,
+		folder:  folder,
+		intv:    time.Duration(cfg.RescanIntervalS) * time.Second,
+		model:   m,
+		stop:    make(chan struct{}),
 	}
 	m.folderRunners[folder] = s
 	m.fmut.Unlock()
@@ -239,9 +275,28 @@ type ConnectionInfo struct {
 	protocol.Statistics
 	Address       string
 	ClientVersion string
+	Connections   []ConnectionStatistics // One entry per connection to the device, the first one carrying index data
+	Closed        *CloseInfo             `json:",omitempty"` // Set for a disconnected device, telling why
+}
+
+type ConnectionStatistics struct {
+	protocol.Statistics
+	Address string
+}
+
+// CloseInfo describes why the connection to a device was closed.
+type CloseInfo struct {
+	At       time.Time
+	Reason   string
+	Code     int32 // The code from the Close message, if any
+	Graceful bool  // True if the device closed the connection with a Close message
 }
 
-// ConnectionStats returns a map with connection statistics for each connected device.
+// ConnectionStats returns a map with connection statistics for each connected
+// device. The statistics for a device are the sum over all connections to
+// it, with the numbers for each connection listed separately. The latency of
+// a device is the average over its connections. Devices that have
+// disconnected are included with only the reason for the disconnect set.
 func (m *Model) ConnectionStats() map[string]ConnectionInfo {
 	type remoteAddrer interface {
 		RemoteAddr() net.Addr
@@ -251,18 +306,45 @@ func (m *Model) ConnectionStats() map[string]ConnectionInfo {
 	m.fmut.RLock()
 
 	var res = make(map[string]ConnectionInfo)
-	for device, conn := range m.protoConn {
+	for device, conns := range m.protoConn {
 		ci := ConnectionInfo{
-			Statistics:    conn.Statistics(),
+			Statistics: protocol.Statistics{
+				At: time.Now(),
+			},
 			ClientVersion: m.deviceVer[device],
+			Connections:   make([]ConnectionStatistics, len(conns)),
+		}
+
+		for i, conn := range conns {
+			cs := ConnectionStatistics{
+				Statistics: conn.Statistics(),
+			}
+			if nc, ok := m.rawConn[device][i].(remoteAddrer); ok {
+				cs.Address = nc.RemoteAddr().String()
+			}
+			ci.Connections[i] = cs
+
+			ci.InBytesTotal += cs.InBytesTotal
+			ci.OutBytesTotal += cs.OutBytesTotal
 		}
-		if nc, ok := m.rawConn[device].(remoteAddrer); ok {
-			ci.Address = nc.RemoteAddr().String()
+		if len(conns) > 0 {
+			ci.Address = ci.Connections[0].Address
 		}
+		ci.Latency, ci.LatencyJitter = averageLatency(conns)
 
 		res[device.String()] = ci
 	}
 
+	for device, closed := range m.deviceClosed {
+		closed := closed
+		res[device.String()] = ConnectionInfo{
+			Statistics: protocol.Statistics{
+				At: time.Now(),
+			},
+			Closed: &closed,
+		}
+	}
+
 	m.fmut.RUnlock()
 	m.pmut.RUnlock()
 
@@ -298,8 +380,6 @@ func (m *Model) FolderStatistics() map[string]stats.FolderStatistics {
 
 // Returns the completion status, in percent, for the given device and folder.
 func (m *Model) Completion(device protocol.DeviceID, folder string) float64 {
-	var tot int64
-
 	m.fmut.RLock()
 	rf, ok := m.folderFiles[folder]
 	m.fmut.RUnlock()
@@ -307,25 +387,12 @@ func (m *Model) Completion(device protocol.DeviceID, folder string) float64 {
 		return 0 // Folder doesn't exist, so we hardly have any of it
 	}
 
-	rf.WithGlobalTruncated(func(f db.FileIntf) bool {
-		if !f.IsDeleted() {
-			tot += f.Size()
-		}
-		return true
-	})
-
+	tot := rf.GlobalCounts().Bytes
 	if tot == 0 {
 		return 100 // Folder is empty, so we have all of it
 	}
 
-	var need int64
-	rf.WithNeedTruncated(device, func(f db.FileIntf) bool {
-		if !f.IsDeleted() {
-			need += f.Size()
-		}
-		return true
-	})
-
+	need := rf.NeedCounts(device).Bytes
 	res := 100 * (1 - float64(need)/float64(tot))
 	if debug {
 		l.Debugf("%v Completion(%s, %q): %f (%d / %d)", m, device, folder, res, need, tot)
@@ -334,39 +401,16 @@ func (m *Model) Completion(device protocol.DeviceID, folder string) float64 {
 	return res
 }
 
-func sizeOf(fs []protocol.FileInfo) (files, deleted int, bytes int64) {
-	for _, f := range fs {
-		fs, de, by := sizeOfFile(f)
-		files += fs
-		deleted += de
-		bytes += by
-	}
-	return
-}
-
-func sizeOfFile(f db.FileIntf) (files, deleted int, bytes int64) {
-	if !f.IsDeleted() {
-		files++
-	} else {
-		deleted++
-	}
-	bytes += f.Size()
-	return
-}
-
 // GlobalSize returns the number of files, deleted files and total bytes for all
 // files in the global model.
 func (m *Model) GlobalSize(folder string) (nfiles, deleted int, bytes int64) {
 	m.fmut.RLock()
 	defer m.fmut.RUnlock()
 	if rf, ok := m.folderFiles[folder]; ok {
-		rf.WithGlobalTruncated(func(f db.FileIntf) bool {
-			fs, de, by := sizeOfFile(f)
-			nfiles += fs
-			deleted += de
-			bytes += by
-			return true
-		})
+		c := rf.GlobalCounts()
+		nfiles = int(c.Files + c.Directories)
+		deleted = int(c.Deleted)
+		bytes = c.Bytes
 	}
 	return
 }
@@ -377,16 +421,10 @@ func (m *Model) LocalSize(folder string) (nfiles, deleted int, bytes int64) {
 	m.fmut.RLock()
 	defer m.fmut.RUnlock()
 	if rf, ok := m.folderFiles[folder]; ok {
-		rf.WithHaveTruncated(protocol.LocalDeviceID, func(f db.FileIntf) bool {
-			if f.IsInvalid() {
-				return true
-			}
-			fs, de, by := sizeOfFile(f)
-			nfiles += fs
-			deleted += de
-			bytes += by
-			return true
-		})
+		c := rf.LocalCounts(protocol.LocalDeviceID)
+		nfiles = int(c.Files + c.Directories)
+		deleted = int(c.Deleted)
+		bytes = c.Bytes
 	}
 	return
 }
@@ -396,12 +434,9 @@ func (m *Model) NeedSize(folder string) (nfiles int, bytes int64) {
 	m.fmut.RLock()
 	defer m.fmut.RUnlock()
 	if rf, ok := m.folderFiles[folder]; ok {
-		rf.WithNeedTruncated(protocol.LocalDeviceID, func(f db.FileIntf) bool {
-			fs, de, by := sizeOfFile(f)
-			nfiles += fs + de
-			bytes += by
-			return true
-		})
+		c := rf.NeedCounts(protocol.LocalDeviceID)
+		nfiles = int(c.Files + c.Directories + c.Deleted)
+		bytes = c.Bytes
 	}
 	bytes -= m.progressEmitter.BytesCompleted(folder)
 	if debug {
@@ -491,6 +526,10 @@ func (m *Model) Index(deviceID protocol.DeviceID, folder string, fs []protocol.F
 			}
 			fs[i] = fs[len(fs)-1]
 			fs = fs[:len(fs)-1]
+		} else if !validBlockSizes(fs[i]) {
+			l.Infof("Dropping update for %q in folder %q from device %v with invalid block sizes", fs[i].Name, folder, deviceID)
+			fs[i] = fs[len(fs)-1]
+			fs = fs[:len(fs)-1]
 		} else {
 			i++
 		}
@@ -534,6 +573,10 @@ func (m *Model) IndexUpdate(deviceID protocol.DeviceID, folder string, fs []prot
 			}
 			fs[i] = fs[len(fs)-1]
 			fs = fs[:len(fs)-1]
+		} else if !validBlockSizes(fs[i]) {
+			l.Infof("Dropping update for %q in folder %q from device %v with invalid block sizes", fs[i].Name, folder, deviceID)
+			fs[i] = fs[len(fs)-1]
+			fs = fs[:len(fs)-1]
 		} else {
 			i++
 		}
@@ -562,6 +605,9 @@ func (m *Model) folderSharedWith(folder string, deviceID protocol.DeviceID) bool
 
 func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterConfigMessage) {
 	m.pmut.Lock()
+	// With several connections to a device we receive the cluster config
+	// once per connection, but only announce the device once.
+	_, seen := m.deviceVer[deviceID]
 	if cm.ClientName == "syncthing" {
 		m.deviceVer[deviceID] = cm.ClientVersion
 	} else {
@@ -574,15 +620,19 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 		"clientVersion": cm.ClientVersion,
 	}
 
-	if conn, ok := m.rawConn[deviceID].(*tls.Conn); ok {
-		event["addr"] = conn.RemoteAddr().String()
+	if conns := m.rawConn[deviceID]; len(conns) > 0 {
+		if conn, ok := conns[0].(*tls.Conn); ok {
+			event["addr"] = conn.RemoteAddr().String()
+		}
 	}
 
 	m.pmut.Unlock()
 
-	events.Default.Log(events.DeviceConnected, event)
+	if !seen {
+		events.Default.Log(events.DeviceConnected, event)
 
-	l.Infof(`Device %s client is "%s %s"`, deviceID, cm.ClientName, cm.ClientVersion)
+		l.Infof(`Device %s client is "%s %s"`, deviceID, cm.ClientName, cm.ClientVersion)
+	}
 
 	var changed bool
 
@@ -665,43 +715,198 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 	}
 }
 
-// Close removes the peer from the model and closes the underlying connection if possible.
+// Close is called when a connection to the peer has been closed. If it was
+// the connection carrying index data, the peer is removed from the model and
+// any other connections to it are closed as well. Otherwise we just forget
+// about the closed connection.
 // Implements the protocol.Model interface.
 func (m *Model) Close(device protocol.DeviceID, err error) {
+	m.pmut.Lock()
+	conns := m.protoConn[device]
+
+	if len(conns) == 0 {
+		// The connection was already removed, when the index carrying
+		// connection to the same device was closed.
+		m.pmut.Unlock()
+		if debug {
+			l.Debugf("%v Close(%s): already removed: %v", m, device, err)
+		}
+		return
+	}
+
+	if !conns[0].Closed() {
+		raws := m.rawConn[device]
+		for i := 1; i < len(conns); {
+			if !conns[i].Closed() {
+				i++
+				continue
+			}
+			closeRawConn(raws[i])
+			conns = append(conns[:i], conns[i+1:]...)
+			raws = append(raws[:i], raws[i+1:]...)
+			l.Infof("Secondary connection to %s closed: %v", device, err)
+		}
+		m.protoConn[device] = conns
+		m.rawConn[device] = raws
+		m.pmut.Unlock()
+		return
+	}
+
 	l.Infof("Connection to %s closed: %v", device, err)
 	events.Default.Log(events.DeviceDisconnected, map[string]string{
 		"id":    device.String(),
 		"error": err.Error(),
 	})
 
-	m.pmut.Lock()
+	closed := CloseInfo{
+		At:     time.Now(),
+		Reason: err.Error(),
+	}
+	if cerr, ok := err.(protocol.CloseError); ok {
+		closed.Reason = cerr.Reason
+		closed.Code = cerr.Code
+		closed.Graceful = true
+	}
+	m.deviceClosed[device] = closed
+
 	m.fmut.RLock()
 	for _, folder := range m.deviceFolders[device] {
 		m.folderFiles[folder].Replace(device, nil)
 	}
 	m.fmut.RUnlock()
 
-	conn, ok := m.rawConn[device]
-	if ok {
-		if conn, ok := conn.(*tls.Conn); ok {
-			// If the underlying connection is a *tls.Conn, Close() does more
-			// than it says on the tin. Specifically, it sends a TLS alert
-			// message, which might block forever if the connection is dead
-			// and we don't have a deadline site.
-			conn.SetWriteDeadline(time.Now().Add(250 * time.Millisecond))
-		}
-		conn.Close()
+	for _, conn := range m.rawConn[device] {
+		closeRawConn(conn)
 	}
 	delete(m.protoConn, device)
 	delete(m.rawConn, device)
 	delete(m.deviceVer, device)
 	m.pmut.Unlock()
+
+	activity.setLatency(device, 0)
+}
+
+// Shutdown prepares the model for the process to exit. It stops all folder
+// scanners and pullers, aborting any scans in progress, waits up to timeout
+// for them to reach a safe point, and then closes the connections to all devices. Each device is sent a
+// Close message with the given reason and code. The return value is false if
+// some folder failed to stop within the timeout, in which case it may still be
+// using the database.
+func (m *Model) Shutdown(reason string, code int32, timeout time.Duration) bool {
+	m.stopOnce.Do(func() { close(m.stop) })
+
+	m.fmut.RLock()
+	var runners []service
+	for _, runner := range m.folderRunners {
+		runners = append(runners, runner)
+	}
+	m.fmut.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, runner := range runners {
+		wg.Add(1)
+		go func(runner service) {
+			runner.Stop()
+			wg.Done()
+		}(runner)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	allStopped := true
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		l.Infoln("Timed out waiting for folders to stop")
+		allStopped = false
+	}
+
+	m.pmut.RLock()
+	var devices []protocol.DeviceID
+	var conns []protocol.Connection
+	for device, dconns := range m.protoConn {
+		devices = append(devices, device)
+		conns = append(conns, dconns...)
+	}
+	m.pmut.RUnlock()
+
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn protocol.Connection) {
+			conn.Close(reason, code)
+			wg.Done()
+		}(conn)
+	}
+	wg.Wait()
+
+	// The connections will call Close on the model by themselves, but
+	// asynchronously. Make sure the teardown is complete before returning.
+	for _, device := range devices {
+		m.Close(device, errors.New(reason))
+	}
+
+	return allStopped
+}
+
+// Implements the protocol.Model interface.
+func (m *Model) Latency(device protocol.DeviceID, rtt time.Duration) {
+	m.pmut.RLock()
+	latency, jitter := averageLatency(m.protoConn[device])
+	m.pmut.RUnlock()
+
+	if debug {
+		l.Debugf("%v Latency(%s): rtt %v, average %v, jitter %v", m, device, rtt, latency, jitter)
+	}
+
+	activity.setLatency(device, latency)
+
+	events.Default.Log(events.DeviceLatency, map[string]interface{}{
+		"id":      device.String(),
+		"rtt":     durationMs(rtt),
+		"latency": durationMs(latency),
+		"jitter":  durationMs(jitter),
+	})
+}
+
+// averageLatency returns the average latency and jitter over the connections
+// that have had their latency measured.
+func averageLatency(conns []protocol.Connection) (latency, jitter time.Duration) {
+	var n time.Duration
+	for _, conn := range conns {
+		if stats := conn.Statistics(); stats.Latency > 0 {
+			latency += stats.Latency
+			jitter += stats.LatencyJitter
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	return latency / n, jitter / n
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func closeRawConn(conn io.Closer) {
+	if conn, ok := conn.(*tls.Conn); ok {
+		// If the underlying connection is a *tls.Conn, Close() does more
+		// than it says on the tin. Specifically, it sends a TLS alert
+		// message, which might block forever if the connection is dead
+		// and we don't have a deadline site.
+		conn.SetWriteDeadline(time.Now().Add(250 * time.Millisecond))
+	}
+	conn.Close()
 }
 
 // Request returns the specified data segment by reading it from local disk.
 // Implements the protocol.Model interface.
 func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset int64, size int) ([]byte, error) {
-	if offset < 0 || size < 0 {
+	if offset < 0 || size < 0 || size > protocol.MaxBlockSize {
 		return nil, ErrNoSuchFile
 	}
 
@@ -769,9 +974,134 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 		return nil, err
 	}
 
+	if !lf.IsSymlink() && folderFiles.IsUnverified(name) {
+		// The file was imported from an index export without being hashed
+		// here, so make sure we don't serve anything but what it promises.
+		if err := verifyRange(reader, lf, offset, buf); err != nil {
+			l.Infof("Imported file %q in folder %q doesn't match the index; marking it for rescan: %v", name, folder, err)
+			lf.Flags |= protocol.FlagInvalid
+			m.updateLocal(folder, lf)
+			return nil, ErrInvalid
+		}
+	}
+
 	return buf, nil
 }
 
+// verifyRange checks the blocks of the file overlapping the data read at the
+// given offset against their hashes. Blocks only partly covered by the data
+// are read in full from r.
+func verifyRange(r io.ReaderAt, f protocol.FileInfo, offset int64, buf []byte) error {
+	end := offset + int64(len(buf))
+	for _, b := range f.Blocks {
+		bstart, bend := b.Offset, b.Offset+int64(b.Size)
+		if bend <= offset || bstart >= end {
+			continue
+		}
+
+		var data []byte
+		if bstart >= offset && bend <= end {
+			data = buf[bstart-offset : bend-offset]
+		} else {
+			data = make([]byte, b.Size)
+			if _, err := r.ReadAt(data, bstart); err != nil {
+				return err
+			}
+		}
+		if _, err := scanner.VerifyBuffer(data, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportIndex adds the files in an index export, as written by
+// db.ExportIndex, to the local index of the folders they belong to. Only
+// files that are not yet in the local index and that have the same size,
+// modification time and permissions on disk are imported; the scanner then
+// takes them as unchanged and doesn't hash them. The blocks of the imported
+// files are verified as they are requested by other devices. Returns the
+// number of files imported.
+func (m *Model) ImportIndex(r io.Reader) (int, error) {
+	er, err := db.NewIndexExportReader(r)
+	if err != nil {
+		return 0, err
+	}
+
+	batches := make(map[string][]protocol.FileInfo)
+	imported := 0
+	flush := func(folder string) {
+		batch := batches[folder]
+		if len(batch) == 0 {
+			return
+		}
+		m.fmut.RLock()
+		m.folderFiles[folder].UpdateUnverified(batch)
+		m.fmut.RUnlock()
+		imported += len(batch)
+		batches[folder] = batch[:0]
+	}
+
+	for {
+		folder, f, err := er.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, err
+		}
+
+		m.fmut.RLock()
+		fs, ok := m.folderFiles[folder]
+		cfg := m.folderCfgs[folder]
+		m.fmut.RUnlock()
+		if !ok {
+			continue
+		}
+
+		f.Name = osutil.NativeFilename(f.Name)
+		if _, ok := fs.Get(protocol.LocalDeviceID, f.Name); ok {
+			continue
+		}
+		if !unchangedOnDisk(cfg, f) {
+			if debug {
+				l.Debugln("not importing changed file", folder, f.Name)
+			}
+			continue
+		}
+
+		lamport.Default.Tick(f.Version)
+		batches[folder] = append(batches[folder], f)
+		if len(batches[folder]) == 1000 {
+			flush(folder)
+		}
+	}
+
+	for folder := range batches {
+		flush(folder)
+	}
+	return imported, nil
+}
+
+// unchangedOnDisk returns true if the file or directory on disk looks like
+// the given one, by the same criteria as the scanner uses.
+func unchangedOnDisk(cfg config.FolderConfiguration, f protocol.FileInfo) bool {
+	if f.IsSymlink() || f.IsDeleted() || f.IsInvalid() {
+		return false
+	}
+
+	info, err := os.Lstat(filepath.Join(cfg.Path, f.Name))
+	if err != nil {
+		return false
+	}
+	permUnchanged := cfg.IgnorePerms || !f.HasPermissionBits() || scanner.PermsEqual(f.Flags, uint32(info.Mode()))
+	if f.IsDirectory() {
+		return permUnchanged && info.IsDir()
+	}
+	modTimeWindow := time.Duration(cfg.ModTimeWindowS) * time.Second
+	return permUnchanged && info.Mode().IsRegular() && scanner.ModTimeEqual(f, info.ModTime(), modTimeWindow) && info.Size() == f.Size()
+}
+
 // ReplaceLocal replaces the local folder index with the given list of files.
 func (m *Model) ReplaceLocal(folder string, fs []protocol.FileInfo) {
 	m.fmut.RLock()
@@ -805,13 +1135,18 @@ func (cf cFiler) CurrentFile(file string) (protocol.FileInfo, bool) {
 
 // ConnectedTo returns true if we are connected to the named device.
 func (m *Model) ConnectedTo(deviceID protocol.DeviceID) bool {
+	return m.NumConnections(deviceID) > 0
+}
+
+// NumConnections returns the number of connections to the named device.
+func (m *Model) NumConnections(deviceID protocol.DeviceID) int {
 	m.pmut.RLock()
-	_, ok := m.protoConn[deviceID]
+	n := len(m.protoConn[deviceID])
 	m.pmut.RUnlock()
-	if ok {
+	if n > 0 {
 		m.deviceWasSeen(deviceID)
 	}
-	return ok
+	return n
 }
 
 func (m *Model) GetIgnores(folder string) ([]string, []string, error) {
@@ -886,31 +1221,30 @@ func (m *Model) SetIgnores(folder string, content []string) error {
 	return m.ScanFolder(folder)
 }
 
-// AddConnection adds a new peer connection to the model. An initial index will
-// be sent to the connected peer, thereafter index updates whenever the local
-// folder changes.
+// AddConnection adds a new peer connection to the model. The first connection
+// to a device carries the index data; an initial index will be sent to the
+// connected peer, thereafter index updates whenever the local folder changes.
+// Block requests are spread over all connections to the device.
 func (m *Model) AddConnection(rawConn io.Closer, protoConn protocol.Connection) {
 	deviceID := protoConn.ID()
 
 	m.pmut.Lock()
-	if _, ok := m.protoConn[deviceID]; ok {
-		panic("add existing device")
-	}
-	m.protoConn[deviceID] = protoConn
-	if _, ok := m.rawConn[deviceID]; ok {
-		panic("add existing device")
-	}
-	m.rawConn[deviceID] = rawConn
+	primary := len(m.protoConn[deviceID]) == 0
+	m.protoConn[deviceID] = append(m.protoConn[deviceID], protoConn)
+	m.rawConn[deviceID] = append(m.rawConn[deviceID], rawConn)
+	delete(m.deviceClosed, deviceID)
 
 	cm := m.clusterConfig(deviceID)
 	protoConn.ClusterConfig(cm)
 
-	m.fmut.RLock()
-	for _, folder := range m.deviceFolders[deviceID] {
-		fs := m.folderFiles[folder]
-		go sendIndexes(protoConn, folder, fs, m.folderIgnores[folder])
+	if primary {
+		m.fmut.RLock()
+		for _, folder := range m.deviceFolders[deviceID] {
+			fs := m.folderFiles[folder]
+			go sendIndexes(protoConn, folder, fs, m.folderIgnores[folder])
+		}
+		m.fmut.RUnlock()
 	}
-	m.fmut.RUnlock()
 	m.pmut.Unlock()
 
 	m.deviceWasSeen(deviceID)
@@ -949,6 +1283,102 @@ func (m *Model) receivedFile(folder, filename string) {
 	m.folderStatRef(folder).ReceivedFile(filename)
 }
 
+func (m *Model) folderHistRef(folder string) *stats.FolderHistoryReference {
+	m.fmut.Lock()
+	defer m.fmut.Unlock()
+
+	hr, ok := m.folderHistRefs[folder]
+	if !ok {
+		var maxAge time.Duration
+		if m.cfg != nil {
+			maxAge = time.Duration(m.cfg.Options().KeepHistoryD) * 24 * time.Hour
+		}
+		hr = stats.NewFolderHistoryReference(m.db, folder, maxAge)
+		m.folderHistRefs[folder] = hr
+	}
+	return hr
+}
+
+// FolderHistory returns the recorded changes to the file in the folder, or
+// to all files if file is empty, oldest first.
+func (m *Model) FolderHistory(folder, file string) ([]stats.FileChange, error) {
+	m.fmut.RLock()
+	_, ok := m.folderFiles[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, errors.New("no such folder")
+	}
+	changes := m.folderHistRef(folder).History(file)
+	for i := range changes {
+		// The device a pulled change was made on isn't known for sure; see
+		// pulledFrom.
+		changes[i].DeviceGuessed = changes[i].Device != protocol.LocalDeviceID
+	}
+	return changes, nil
+}
+
+// recordChange adds the replacement of the local file by the given one to
+// the folder history, unless the version stays the same, as when a file is
+// only marked invalid.
+func recordChange(hr *stats.FolderHistoryReference, fs *db.FileSet, device protocol.DeviceID, f protocol.FileInfo, renamedTo string) {
+	if c, ok := fileChange(fs, device, f, renamedTo); ok {
+		hr.Record(c)
+	}
+}
+
+// recordChanges is recordChange for a batch of files, such as is about to be
+// applied to the index, with the changes written at once.
+func recordChanges(hr *stats.FolderHistoryReference, fs *db.FileSet, device protocol.DeviceID, files []protocol.FileInfo) {
+	var cs []stats.FileChange
+	for _, f := range files {
+		if c, ok := fileChange(fs, device, f, ""); ok {
+			cs = append(cs, c)
+		}
+	}
+	hr.Record(cs...)
+}
+
+func fileChange(fs *db.FileSet, device protocol.DeviceID, f protocol.FileInfo, renamedTo string) (stats.FileChange, bool) {
+	old, ok := fs.Get(protocol.LocalDeviceID, f.Name)
+	if ok && old.Version == f.Version {
+		return stats.FileChange{}, false
+	}
+
+	c := stats.FileChange{
+		Time:       time.Now(),
+		Name:       f.Name,
+		Action:     stats.ChangeUpdate,
+		Device:     device,
+		NewVersion: f.Version,
+	}
+	if ok {
+		c.OldVersion = old.Version
+	}
+	switch {
+	case renamedTo != "":
+		c.Action = stats.ChangeRename
+		c.RenamedTo = renamedTo
+	case f.IsDeleted():
+		c.Action = stats.ChangeDelete
+	default:
+		c.Size = f.Size()
+	}
+	return c, true
+}
+
+// pulledFrom returns the remote device that has had the global version of
+// the file the longest, which is normally the one it was changed on. It's a
+// best guess; the puller doesn't track which device each block came from.
+func pulledFrom(fs *db.FileSet, file string) protocol.DeviceID {
+	devices := fs.Availability(file)
+	for i := len(devices) - 1; i >= 0; i-- {
+		if devices[i] != protocol.LocalDeviceID {
+			return devices[i]
+		}
+	}
+	return protocol.LocalDeviceID
+}
+
 func sendIndexes(conn protocol.Connection, folder string, fs *db.FileSet, ignores *ignore.Matcher) {
 	deviceID := conn.ID()
 	name := conn.Name()
@@ -1042,14 +1472,23 @@ func sendIndexTo(initial bool, minLocalVer int64, conn protocol.Connection, fold
 }
 
 func (m *Model) updateLocal(folder string, f protocol.FileInfo) {
+	m.updateLocalRenamed(folder, f, "")
+}
+
+// updateLocalRenamed is updateLocal for a deleted file that was renamed to
+// the new name instead, which the folder history records as such.
+func (m *Model) updateLocalRenamed(folder string, f protocol.FileInfo, newName string) {
 	f.LocalVersion = 0
+	hr := m.folderHistRef(folder)
 	m.fmut.RLock()
-	m.folderFiles[folder].Update(protocol.LocalDeviceID, []protocol.FileInfo{f})
+	fs := m.folderFiles[folder]
+	recordChange(hr, fs, pulledFrom(fs, f.Name), f, newName)
+	fs.Update(protocol.LocalDeviceID, []protocol.FileInfo{f})
 	m.fmut.RUnlock()
 	events.Default.Log(events.LocalIndexUpdated, map[string]interface{}{
 		"folder":   folder,
 		"name":     f.Name,
-		"modified": time.Unix(f.Modified, 0),
+		"modified": f.ModTime(),
 		"flags":    fmt.Sprintf("0%o", f.Flags),
 		"size":     f.Size(),
 	})
@@ -1057,10 +1496,13 @@ func (m *Model) updateLocal(folder string, f protocol.FileInfo) {
 
 func (m *Model) requestGlobal(deviceID protocol.DeviceID, folder, name string, offset int64, size int, hash []byte) ([]byte, error) {
 	m.pmut.RLock()
-	nc, ok := m.protoConn[deviceID]
+	var nc protocol.Connection
+	if conns := m.protoConn[deviceID]; len(conns) > 0 {
+		nc = conns[atomic.AddUint32(&m.reqCounter, 1)%uint32(len(conns))]
+	}
 	m.pmut.RUnlock()
 
-	if !ok {
+	if nc == nil {
 		return nil, fmt.Errorf("requestGlobal: no such device: %s", deviceID)
 	}
 
@@ -1092,6 +1534,14 @@ func (m *Model) AddFolder(cfg config.FolderConfiguration) {
 	ignores := ignore.New(m.cfg.Options().CacheIgnoredFiles)
 	_ = ignores.Load(filepath.Join(cfg.Path, ".stignore")) // Ignore error, there might not be an .stignore
 	m.folderIgnores[cfg.ID] = ignores
+	m.folderLimiters[cfg.ID] = scanner.NewLimiter(cfg.MaxHashMiBps * 1024 * 1024)
+
+	if cfg.SyncOwnership && !posix.OwnershipSupported {
+		l.Warnf("Folder %q: syncing file ownership is not supported on this platform", cfg.ID)
+	}
+	if cfg.SyncXattrs && !posix.XattrsSupported {
+		l.Warnf("Folder %q: syncing extended attributes is not supported on this platform", cfg.ID)
+	}
 
 	m.addedFolder = true
 	m.fmut.Unlock()
@@ -1111,7 +1561,7 @@ func (m *Model) ScanFolders() {
 		folder := folder
 		go func() {
 			err := m.ScanFolder(folder)
-			if err != nil {
+			if err != nil && err != errScanStopped {
 				m.cfg.InvalidateFolder(folder, err.Error())
 			}
 			wg.Done()
@@ -1125,7 +1575,17 @@ func (m *Model) ScanFolder(folder string) error {
 }
 
 func (m *Model) ScanFolderSub(folder, sub string) error {
-	if p := filepath.Clean(filepath.Join(folder, sub)); !strings.HasPrefix(p, folder) {
+	return m.scanFolderSub(folder, sub, m.stop)
+}
+
+// scanFolderSub scans the folder or the given part of it. If stop is closed
+// the scan is aborted and errScanStopped returned; the files found so far
+// are still recorded, but nothing is marked as deleted.
+func (m *Model) scanFolderSub(folder, sub string, stop chan struct{}) error {
+	sub = filepath.Clean(sub)
+	if sub == "." {
+		sub = ""
+	} else if filepath.IsAbs(sub) || sub == ".." || strings.HasPrefix(sub, ".."+string(filepath.Separator)) {
 		return errors.New("invalid subpath")
 	}
 
@@ -1133,24 +1593,52 @@ func (m *Model) ScanFolderSub(folder, sub string) error {
 	fs, ok := m.folderFiles[folder]
 	folderCfg := m.folderCfgs[folder]
 	ignores := m.folderIgnores[folder]
+	limiter := m.folderLimiters[folder]
 	m.fmut.Unlock()
 
 	if !ok {
 		return errors.New("no such folder")
 	}
 
+	if m.cfg.Options().SerializeScans {
+		m.scanMut.Lock()
+		defer m.scanMut.Unlock()
+	}
+
 	_ = ignores.Load(filepath.Join(folderCfg.Path, ".stignore")) // Ignore error, there might not be an .stignore
 
 	w := &scanner.Walker{
-		Dir:          folderCfg.Path,
-		Sub:          sub,
-		Matcher:      ignores,
-		BlockSize:    protocol.BlockSize,
-		TempNamer:    defTempNamer,
-		TempLifetime: time.Duration(m.cfg.Options().KeepTemporariesH) * time.Hour,
-		CurrentFiler: cFiler{m, folder},
-		IgnorePerms:  folderCfg.IgnorePerms,
-		Hashers:      folderCfg.Hashers,
+		Dir:           folderCfg.Path,
+		Sub:           sub,
+		Matcher:       ignores,
+		TempNamer:     defTempNamer,
+		TempLifetime:  time.Duration(m.cfg.Options().KeepTemporariesH) * time.Hour,
+		CurrentFiler:  cFiler{m, folder},
+		IgnorePerms:   folderCfg.IgnorePerms,
+		Hashers:       folderCfg.Hashers,
+		ModTimeWindow: time.Duration(folderCfg.ModTimeWindowS) * time.Second,
+		SyncOwnership: folderCfg.SyncOwnership && posix.OwnershipSupported,
+		SyncXattrs:    folderCfg.SyncXattrs && posix.XattrsSupported,
+		AutoNormalize: folderCfg.AutoNormalize,
+		Limiters:      []*scanner.Limiter{limiter, m.hashLimit},
+		Stop:          stop,
+	}
+
+	var fileErrors []FileError
+	w.FileError = func(name string, err error) {
+		fileErrors = append(fileErrors, FileError{Path: name, Err: err.Error()})
+	}
+
+	w.Progress = &scanner.Progress{}
+	stopProgress := m.startScanProgress(folder, w.Progress)
+	defer stopProgress()
+
+	// The changes are recorded in the history along with each batch of
+	// updates to the index.
+	hr := m.folderHistRef(folder)
+	update := func(batch []protocol.FileInfo) {
+		recordChanges(hr, fs, protocol.LocalDeviceID, batch)
+		fs.Update(protocol.LocalDeviceID, batch)
 	}
 
 	m.setState(folder, FolderScanning)
@@ -1165,40 +1653,40 @@ func (m *Model) ScanFolderSub(folder, sub string) error {
 		events.Default.Log(events.LocalIndexUpdated, map[string]interface{}{
 			"folder":   folder,
 			"name":     f.Name,
-			"modified": time.Unix(f.Modified, 0),
+			"modified": f.ModTime(),
 			"flags":    fmt.Sprintf("0%o", f.Flags),
 			"size":     f.Size(),
 		})
 		if len(batch) == batchSize {
-			fs.Update(protocol.LocalDeviceID, batch)
+			update(batch)
 			batch = batch[:0]
 		}
 		batch = append(batch, f)
 	}
 	if len(batch) > 0 {
-		fs.Update(protocol.LocalDeviceID, batch)
+		update(batch)
+	}
+
+	// The walk didn't see every file if it was stopped, so the missing ones
+	// can't be taken as deleted.
+	if scanStopped(stop) {
+		return errScanStopped
 	}
 
 	batch = batch[:0]
-	// TODO: We should limit the Have scanning to start at sub
-	seenPrefix := false
-	fs.WithHaveTruncated(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
-		f := fi.(db.FileInfoTruncated)
-		if !strings.HasPrefix(f.Name, sub) {
-			// Return true so that we keep iterating, until we get to the part
-			// of the tree we are interested in. Then return false so we stop
-			// iterating when we've passed the end of the subtree.
-			return !seenPrefix
+	fs.WithPrefixedHaveTruncated(protocol.LocalDeviceID, sub, func(fi db.FileIntf) bool {
+		if scanStopped(stop) {
+			return false
 		}
 
-		seenPrefix = true
+		f := fi.(db.FileInfoTruncated)
 		if !f.IsDeleted() {
 			if f.IsInvalid() {
 				return true
 			}
 
 			if len(batch) == batchSize {
-				fs.Update(protocol.LocalDeviceID, batch)
+				update(batch)
 				batch = batch[:0]
 			}
 
@@ -1208,15 +1696,16 @@ func (m *Model) ScanFolderSub(folder, sub string) error {
 					l.Debugln("setting invalid bit on ignored", f)
 				}
 				nf := protocol.FileInfo{
-					Name:     f.Name,
-					Flags:    f.Flags | protocol.FlagInvalid,
-					Modified: f.Modified,
-					Version:  f.Version, // The file is still the same, so don't bump version
+					Name:       f.Name,
+					Flags:      f.Flags | protocol.FlagInvalid,
+					Modified:   f.Modified,
+					ModifiedNs: f.ModifiedNs,
+					Version:    f.Version, // The file is still the same, so don't bump version
 				}
 				events.Default.Log(events.LocalIndexUpdated, map[string]interface{}{
 					"folder":   folder,
 					"name":     f.Name,
-					"modified": time.Unix(f.Modified, 0),
+					"modified": f.ModTime(),
 					"flags":    fmt.Sprintf("0%o", f.Flags),
 					"size":     f.Size(),
 				})
@@ -1224,15 +1713,16 @@ func (m *Model) ScanFolderSub(folder, sub string) error {
 			} else if _, err := os.Lstat(filepath.Join(folderCfg.Path, f.Name)); err != nil && os.IsNotExist(err) {
 				// File has been deleted
 				nf := protocol.FileInfo{
-					Name:     f.Name,
-					Flags:    f.Flags | protocol.FlagDeleted,
-					Modified: f.Modified,
-					Version:  lamport.Default.Tick(f.Version),
+					Name:       f.Name,
+					Flags:      f.Flags | protocol.FlagDeleted,
+					Modified:   f.Modified,
+					ModifiedNs: f.ModifiedNs,
+					Version:    lamport.Default.Tick(f.Version),
 				}
 				events.Default.Log(events.LocalIndexUpdated, map[string]interface{}{
 					"folder":   folder,
 					"name":     f.Name,
-					"modified": time.Unix(f.Modified, 0),
+					"modified": f.ModTime(),
 					"flags":    fmt.Sprintf("0%o", f.Flags),
 					"size":     f.Size(),
 				})
@@ -1242,13 +1732,186 @@ func (m *Model) ScanFolderSub(folder, sub string) error {
 		return true
 	})
 	if len(batch) > 0 {
-		fs.Update(protocol.LocalDeviceID, batch)
+		update(batch)
+	}
+
+	if scanStopped(stop) {
+		return errScanStopped
 	}
 
+	// The errors found replace those from earlier scans of the same part
+	// of the folder.
+	m.fmut.Lock()
+	for _, fe := range m.folderErrors[folder] {
+		if sub != "" && fe.Path != sub && !strings.HasPrefix(fe.Path, sub+string(filepath.Separator)) {
+			fileErrors = append(fileErrors, fe)
+		}
+	}
+	sort.Sort(fileErrorList(fileErrors))
+	m.folderErrors[folder] = fileErrors
+	m.fmut.Unlock()
+
 	m.setState(folder, FolderIdle)
 	return nil
 }
 
+func scanStopped(stop chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// The interval between FolderScanProgress events during a scan.
+const scanProgressIntv = 2 * time.Second
+
+type scanProgress struct {
+	*scanner.Progress
+	started time.Time
+}
+
+// startScanProgress makes the progress of the scan of the folder available
+// and emits it as FolderScanProgress events until the returned function is
+// called.
+func (m *Model) startScanProgress(folder string, p *scanner.Progress) func() {
+	m.smut.Lock()
+	m.folderScans[folder] = &scanProgress{p, time.Now()}
+	m.smut.Unlock()
+
+	stop := make(chan struct{})
+	go func() {
+		t := time.NewTicker(scanProgressIntv)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				if data := m.ScanProgress(folder); data != nil {
+					events.Default.Log(events.FolderScanProgress, data)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		m.smut.Lock()
+		delete(m.folderScans, folder)
+		m.smut.Unlock()
+	}
+}
+
+// ScanProgress returns the progress of the running scan of the folder: the
+// bytes to hash found so far, the bytes hashed, the hashing rate in bytes
+// per second and the estimated number of seconds left, or -1 if unknown.
+// It returns nil if the folder isn't being scanned.
+func (m *Model) ScanProgress(folder string) map[string]interface{} {
+	m.smut.RLock()
+	p, ok := m.folderScans[folder]
+	m.smut.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	total, hashed := p.Total(), p.Hashed()
+	rate := float64(hashed) / time.Since(p.started).Seconds()
+	eta := -1.0
+	if rate > 0 {
+		eta = float64(total-hashed) / rate
+	}
+	return map[string]interface{}{
+		"folder": folder,
+		"total":  total,
+		"hashed": hashed,
+		"rate":   rate,
+		"eta":    eta,
+	}
+}
+
+// updatePullLimit applies changes to the limit on bytes in flight, also to
+// the pulls already running.
+func (m *Model) updatePullLimit(cfg config.Configuration) error {
+	m.pullLimit.setCapacity(cfg.Options.MaxPullInFlightKiB * 1024)
+	if debug {
+		l.Debugln("updated pull limit to", cfg.Options.MaxPullInFlightKiB, "KiB in flight")
+	}
+	return nil
+}
+
+// updateHashLimits applies changes to the hashing rate limits to the scans,
+// including those already running.
+func (m *Model) updateHashLimits(cfg config.Configuration) error {
+	m.hashLimit.SetRate(cfg.Options.MaxHashMiBps * 1024 * 1024)
+
+	m.fmut.RLock()
+	for _, folderCfg := range cfg.Folders {
+		if limiter, ok := m.folderLimiters[folderCfg.ID]; ok {
+			limiter.SetRate(folderCfg.MaxHashMiBps * 1024 * 1024)
+		}
+	}
+	m.fmut.RUnlock()
+
+	if debug {
+		l.Debugln("updated hashing limits to", cfg.Options.MaxHashMiBps, "MiB/s overall")
+	}
+	return nil
+}
+
+// A FileError is a problem with a file that keeps it from being synced.
+type FileError struct {
+	Path string
+	Err  string
+}
+
+type fileErrorList []FileError
+
+func (l fileErrorList) Len() int {
+	return len(l)
+}
+
+func (l fileErrorList) Less(a, b int) bool {
+	return l[a].Path < l[b].Path
+}
+
+func (l fileErrorList) Swap(a, b int) {
+	l[a], l[b] = l[b], l[a]
+}
+
+// FolderErrors returns the files in the folder that couldn't be scanned at
+// the last scan, and those synced without all of their metadata, and why.
+func (m *Model) FolderErrors(folder string) ([]FileError, error) {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+	if _, ok := m.folderFiles[folder]; !ok {
+		return nil, errors.New("no such folder")
+	}
+	errs := make([]FileError, len(m.folderErrors[folder]), len(m.folderErrors[folder])+len(m.pullErrors[folder]))
+	copy(errs, m.folderErrors[folder])
+	for name, err := range m.pullErrors[folder] {
+		errs = append(errs, FileError{Path: name, Err: err})
+	}
+	sort.Sort(fileErrorList(errs))
+	return errs, nil
+}
+
+// setPullError records the problem applying the metadata of the pulled
+// file, or clears it if err is nil. It stays until the file is pulled again.
+func (m *Model) setPullError(folder, file string, err error) {
+	m.fmut.Lock()
+	if err != nil {
+		if m.pullErrors[folder] == nil {
+			m.pullErrors[folder] = make(map[string]string)
+		}
+		m.pullErrors[folder][file] = err.Error()
+	} else {
+		delete(m.pullErrors[folder], file)
+	}
+	m.fmut.Unlock()
+}
+
 // clusterConfig returns a ClusterConfigMessage that is correct for the given peer device
 func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMessage {
 	cm := protocol.ClusterConfigMessage{
@@ -1426,6 +2089,21 @@ func (m *Model) String() string {
 	return fmt.Sprintf("model@%p", m)
 }
 
+// validBlockSizes returns false if the block size of the file isn't one we
+// use or a block is negative or larger than the largest block size, as no
+// such block can be pulled.
+func validBlockSizes(f protocol.FileInfo) bool {
+	if f.RawBlockSize != 0 && !protocol.ValidBlockSize(int(f.RawBlockSize)) {
+		return false
+	}
+	for _, b := range f.Blocks {
+		if b.Size < 0 || b.Size > protocol.MaxBlockSize {
+			return false
+		}
+	}
+	return true
+}
+
 func symlinkInvalid(isLink bool) bool {
 	if !symlinks.Supported && isLink {
 		SymlinkWarning.Do(func() {
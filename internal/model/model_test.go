@@ -17,6 +17,7 @@ package model
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"testing"
@@ -24,8 +25,8 @@ import (
 
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/config"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/stats"
 )
 
 var device1, device2 protocol.DeviceID
@@ -67,7 +68,7 @@ func init() {
 }
 
 func TestRequest(t *testing.T) {
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.OpenMemory()
 
 	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
 
@@ -146,7 +147,7 @@ func genFiles(n int) []protocol.FileInfo {
 		files[i] = protocol.FileInfo{
 			Name:     fmt.Sprintf("file%d", i),
 			Modified: t,
-			Blocks:   []protocol.BlockInfo{{0, 100, []byte("some hash bytes")}},
+			Blocks:   []protocol.BlockInfo{{0, 100, []byte("some hash bytes"), 0}},
 		}
 	}
 
@@ -154,7 +155,7 @@ func genFiles(n int) []protocol.FileInfo {
 }
 
 func BenchmarkIndex10000(b *testing.B) {
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.OpenMemory()
 	m := NewModel(nil, "device", "syncthing", "dev", db)
 	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
 	m.ScanFolder("default")
@@ -167,7 +168,7 @@ func BenchmarkIndex10000(b *testing.B) {
 }
 
 func BenchmarkIndex00100(b *testing.B) {
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.OpenMemory()
 	m := NewModel(nil, "device", "syncthing", "dev", db)
 	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
 	m.ScanFolder("default")
@@ -180,7 +181,7 @@ func BenchmarkIndex00100(b *testing.B) {
 }
 
 func BenchmarkIndexUpdate10000f10000(b *testing.B) {
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.OpenMemory()
 	m := NewModel(nil, "device", "syncthing", "dev", db)
 	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
 	m.ScanFolder("default")
@@ -194,7 +195,7 @@ func BenchmarkIndexUpdate10000f10000(b *testing.B) {
 }
 
 func BenchmarkIndexUpdate10000f00100(b *testing.B) {
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.OpenMemory()
 	m := NewModel(nil, "device", "syncthing", "dev", db)
 	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
 	m.ScanFolder("default")
@@ -209,7 +210,7 @@ func BenchmarkIndexUpdate10000f00100(b *testing.B) {
 }
 
 func BenchmarkIndexUpdate10000f00001(b *testing.B) {
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.OpenMemory()
 	m := NewModel(nil, "device", "syncthing", "dev", db)
 	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
 	m.ScanFolder("default")
@@ -226,10 +227,11 @@ func BenchmarkIndexUpdate10000f00001(b *testing.B) {
 type FakeConnection struct {
 	id          protocol.DeviceID
 	requestData []byte
+	closed      bool
 }
 
-func (FakeConnection) Close() error {
-	return nil
+func (f *FakeConnection) Close(string, int32) {
+	f.closed = true
 }
 
 func (f FakeConnection) ID() protocol.DeviceID {
@@ -266,8 +268,19 @@ func (FakeConnection) Statistics() protocol.Statistics {
 	return protocol.Statistics{}
 }
 
+func (f FakeConnection) Closed() bool {
+	return f.closed
+}
+
+// nopCloser is the raw connection underlying a FakeConnection.
+type nopCloser struct{}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
 func BenchmarkRequest(b *testing.B) {
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.OpenMemory()
 	m := NewModel(nil, "device", "syncthing", "dev", db)
 	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
 	m.ScanFolder("default")
@@ -279,7 +292,7 @@ func BenchmarkRequest(b *testing.B) {
 		files[i] = protocol.FileInfo{
 			Name:     fmt.Sprintf("file%d", i),
 			Modified: t,
-			Blocks:   []protocol.BlockInfo{{0, 100, []byte("some hash bytes")}},
+			Blocks:   []protocol.BlockInfo{{0, 100, []byte("some hash bytes"), 0}},
 		}
 	}
 
@@ -287,7 +300,7 @@ func BenchmarkRequest(b *testing.B) {
 		id:          device1,
 		requestData: []byte("some data to return"),
 	}
-	m.AddConnection(fc, fc)
+	m.AddConnection(nopCloser{}, &fc)
 	m.Index(device1, "default", files)
 
 	b.ResetTimer()
@@ -302,6 +315,152 @@ func BenchmarkRequest(b *testing.B) {
 	}
 }
 
+func TestMultipleConnections(t *testing.T) {
+	db := db.OpenMemory()
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata", Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}}})
+
+	fc1 := &FakeConnection{id: device1, requestData: []byte("first")}
+	fc2 := &FakeConnection{id: device1, requestData: []byte("second")}
+	m.AddConnection(nopCloser{}, fc1)
+	m.AddConnection(nopCloser{}, fc2)
+	m.Index(device1, "default", []protocol.FileInfo{{Name: "foo", Version: 1}})
+
+	if n := m.NumConnections(device1); n != 2 {
+		t.Fatalf("Unexpected number of connections %d != 2", n)
+	}
+	if cs := m.ConnectionStats()[device1.String()]; len(cs.Connections) != 2 {
+		t.Errorf("Unexpected number of connection statistics %d != 2", len(cs.Connections))
+	}
+
+	// Requests are spread over both connections
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		data, err := m.requestGlobal(device1, "default", "foo", 0, 32, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[string(data)] = true
+	}
+	if !seen["first"] || !seen["second"] {
+		t.Errorf("Requests were not spread over all connections: %v", seen)
+	}
+
+	// Closing the secondary connection keeps the device connected and its
+	// index intact
+	fc2.closed = true
+	m.Close(device1, errors.New("secondary closed"))
+	if n := m.NumConnections(device1); n != 1 {
+		t.Fatalf("Unexpected number of connections %d != 1", n)
+	}
+	if avail := m.availability("default", "foo"); len(avail) != 1 {
+		t.Errorf("Unexpected availability %v after secondary close", avail)
+	}
+
+	// Closing the primary connection removes the device
+	fc1.closed = true
+	m.Close(device1, errors.New("primary closed"))
+	if m.ConnectedTo(device1) {
+		t.Error("Unexpectedly still connected")
+	}
+	if avail := m.availability("default", "foo"); len(avail) != 0 {
+		t.Errorf("Unexpected availability %v after primary close", avail)
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	db := db.OpenMemory()
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+
+	fc := &FakeConnection{id: device1, closed: true}
+	m.AddConnection(nopCloser{}, fc)
+	m.Close(device1, protocol.CloseError{Reason: "restarting", Code: protocol.CloseCodeRestart})
+
+	cs, ok := m.ConnectionStats()[device1.String()]
+	if !ok || cs.Closed == nil {
+		t.Fatal("Missing close reason for disconnected device")
+	}
+	if cs.Closed.Reason != "restarting" || cs.Closed.Code != protocol.CloseCodeRestart || !cs.Closed.Graceful {
+		t.Errorf("Unexpected close info %+v", cs.Closed)
+	}
+
+	// A connection lost without a Close message
+	m.AddConnection(nopCloser{}, fc)
+	if cs := m.ConnectionStats()[device1.String()]; cs.Closed != nil {
+		t.Errorf("Unexpected close info %+v for connected device", cs.Closed)
+	}
+	m.Close(device1, errors.New("read error"))
+	if cs := m.ConnectionStats()[device1.String()]; cs.Closed == nil || cs.Closed.Graceful || cs.Closed.Reason != "read error" {
+		t.Errorf("Unexpected close info %+v", cs.Closed)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	db := db.OpenMemory()
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
+	m.StartFolderRO("default")
+
+	fc1 := &FakeConnection{id: device1}
+	fc2 := &FakeConnection{id: device1}
+	m.AddConnection(nopCloser{}, fc1)
+	m.AddConnection(nopCloser{}, fc2)
+
+	if !m.Shutdown("shutting down", protocol.CloseCodeShutdown, 10*time.Second) {
+		t.Error("Folders should have stopped")
+	}
+
+	if !fc1.closed || !fc2.closed {
+		t.Error("Connections should be closed")
+	}
+	if m.ConnectedTo(device1) {
+		t.Error("Unexpectedly still connected")
+	}
+}
+
+func TestStopNotServing(t *testing.T) {
+	// Stopping a runner whose Serve never ran must not hang, and Serve
+	// must not start after Stop.
+	s := &Scanner{folder: "default", stop: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		s.Stop()
+		s.Serve()
+		s.Stop() // a second Stop is harmless
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop hung")
+	}
+}
+
+func TestScanStopped(t *testing.T) {
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db.OpenMemory())
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
+	fs := m.folderFiles["default"]
+	fs.Replace(protocol.LocalDeviceID, []protocol.FileInfo{{Name: "gone", Version: 1}})
+
+	// A stopped scan doesn't see all files, so it mustn't mark the ones it
+	// didn't see as deleted.
+	stop := make(chan struct{})
+	close(stop)
+	if err := m.scanFolderSub("default", "", stop); err != errScanStopped {
+		t.Errorf("Unexpected error %v from a stopped scan", err)
+	}
+	if f, ok := fs.Get(protocol.LocalDeviceID, "gone"); !ok || f.IsDeleted() {
+		t.Errorf("Unseen file marked as deleted by a stopped scan: %v", f)
+	}
+
+	if err := m.scanFolderSub("default", "", make(chan struct{})); err != nil {
+		t.Fatal(err)
+	}
+	if f, _ := fs.Get(protocol.LocalDeviceID, "gone"); !f.IsDeleted() {
+		t.Errorf("Missing file not marked as deleted by a complete scan: %v", f)
+	}
+}
+
 func TestDeviceRename(t *testing.T) {
 	ccm := protocol.ClusterConfigMessage{
 		ClientName:    "syncthing",
@@ -317,7 +476,7 @@ func TestDeviceRename(t *testing.T) {
 		},
 	}
 
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.OpenMemory()
 	m := NewModel(config.Wrap("tmpconfig.xml", cfg), "device", "syncthing", "dev", db)
 	if cfg.Devices[0].Name != "" {
 		t.Errorf("Device already has a name")
@@ -383,7 +542,7 @@ func TestClusterConfig(t *testing.T) {
 		},
 	}
 
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.OpenMemory()
 
 	m := NewModel(config.Wrap("/tmp/test", cfg), "device", "syncthing", "dev", db)
 	m.AddFolder(cfg.Folders[0])
@@ -450,7 +609,7 @@ func TestIgnores(t *testing.T) {
 		return true
 	}
 
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.OpenMemory()
 	fcfg := config.FolderConfiguration{ID: "default", Path: "testdata"}
 	cfg := config.Wrap("/tmp", config.Configuration{
 		Folders: []config.FolderConfiguration{fcfg},
@@ -525,3 +684,153 @@ func TestIgnores(t *testing.T) {
 		t.Errorf("Expected no ignores, got: %v", ignores)
 	}
 }
+
+func TestFolderHistory(t *testing.T) {
+	db := db.OpenMemory()
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
+	m.ScanFolder("default")
+
+	h, err := m.FolderHistory("default", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h) != 1 {
+		t.Fatalf("Unexpected history for foo: %+v", h)
+	}
+	if c := h[0]; c.Action != stats.ChangeUpdate || c.Device != protocol.LocalDeviceID || c.DeviceGuessed || c.OldVersion != 0 || c.NewVersion == 0 || c.Size != 7 {
+		t.Errorf("Unexpected change for foo: %+v", c)
+	}
+
+	// Scanning unchanged files records nothing.
+
+	all, _ := m.FolderHistory("default", "")
+	m.ScanFolder("default")
+	if all2, _ := m.FolderHistory("default", ""); len(all2) != len(all) {
+		t.Errorf("Rescan changed history length from %d to %d", len(all), len(all2))
+	}
+
+	// A rename is found under both names.
+
+	f, _ := m.CurrentFolderFile("default", "foo")
+	f.Flags |= protocol.FlagDeleted
+	f.Version++
+	m.updateLocalRenamed("default", f, "foo2")
+	h, _ = m.FolderHistory("default", "foo2")
+	if len(h) != 1 || h[0].Action != stats.ChangeRename || h[0].Name != "foo" || h[0].OldVersion != f.Version-1 {
+		t.Errorf("Unexpected history for foo2: %+v", h)
+	}
+	if h, _ = m.FolderHistory("default", "foo"); len(h) != 2 {
+		t.Errorf("Unexpected history for foo: %+v", h)
+	}
+
+	if _, err := m.FolderHistory("nonexistent", ""); err == nil {
+		t.Error("Unexpected nil error for nonexistent folder")
+	}
+}
+
+func TestImportIndex(t *testing.T) {
+	fcfg := config.FolderConfiguration{ID: "default", Path: "testdata", Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}}}
+
+	// Export an index of the test data, with a corrupted hash for bar.
+
+	sdb := db.OpenMemory()
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", sdb)
+	m.AddFolder(fcfg)
+	m.ScanFolder("default")
+	foo, _ := m.CurrentFolderFile("default", "foo")
+	bar, _ := m.CurrentFolderFile("default", "bar")
+	bar.Blocks = append([]protocol.BlockInfo(nil), bar.Blocks...)
+	bar.Blocks[0].Hash = make([]byte, 32)
+	bar.Version++
+	m.updateLocal("default", bar)
+
+	var buf bytes.Buffer
+	if err := db.ExportIndex(sdb, []string{"default"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Import it elsewhere.
+
+	m = NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db.OpenMemory())
+	m.AddFolder(fcfg)
+	n, err := m.ImportIndex(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := len(testDataExpected); n < exp {
+		t.Errorf("Imported %d files, expected at least %d", n, exp)
+	}
+	if f, ok := m.CurrentFolderFile("default", "foo"); !ok || f.Version != foo.Version {
+		t.Errorf("Unexpected imported foo: %v", f)
+	}
+
+	// The imported files are verified as they are served.
+
+	bs, err := m.Request(device1, "default", "foo", 0, int(foo.Blocks[0].Size))
+	if err != nil || string(bs) != "foobar\n" {
+		t.Errorf("Unexpected response %q, %v for foo", bs, err)
+	}
+	lv := m.folderFiles["default"].LocalVersion(protocol.LocalDeviceID)
+	if _, err := m.Request(device1, "default", "bar", 0, int(bar.Blocks[0].Size)); err != ErrInvalid {
+		t.Errorf("Unexpected error %v for corrupt bar", err)
+	}
+	// The invalid file gets a new local version, so it's announced.
+	if f, _ := m.CurrentFolderFile("default", "bar"); !f.IsInvalid() || f.LocalVersion <= lv {
+		t.Errorf("Corrupt bar not marked invalid with a new local version: %v", f)
+	}
+}
+
+func TestRequestUnverifiedUnaligned(t *testing.T) {
+	fcfg := config.FolderConfiguration{ID: "default", Path: "testdata", Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}}}
+
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db.OpenMemory())
+	m.AddFolder(fcfg)
+	m.ScanFolder("default")
+	foo, _ := m.CurrentFolderFile("default", "foo")
+	bar, _ := m.CurrentFolderFile("default", "bar")
+	bar.Blocks = append([]protocol.BlockInfo(nil), bar.Blocks...)
+	bar.Blocks[0].Hash = make([]byte, 32)
+
+	m = NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db.OpenMemory())
+	m.AddFolder(fcfg)
+	m.folderFiles["default"].UpdateUnverified([]protocol.FileInfo{foo, bar})
+
+	// Requests that don't line up with a block are verified against all
+	// the blocks they touch.
+	bs, err := m.Request(device1, "default", "foo", 1, 3)
+	if err != nil || string(bs) != "oob" {
+		t.Errorf("Unexpected response %q, %v for foo", bs, err)
+	}
+	if _, err := m.Request(device1, "default", "bar", 1, 2); err != ErrInvalid {
+		t.Errorf("Unexpected error %v for part of corrupt bar", err)
+	}
+}
+
+func TestIndexInvalidBlockSizes(t *testing.T) {
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db.OpenMemory())
+	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata", Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}}})
+
+	m.Index(device1, "default", []protocol.FileInfo{
+		{Name: "ok", Version: 1, Blocks: []protocol.BlockInfo{{Size: 128 << 10}, {Size: 10}}},
+		{Name: "large", Version: 1, RawBlockSize: 1 << 20, Blocks: []protocol.BlockInfo{{Size: 1 << 20}, {Size: 10}}},
+		{Name: "odd", Version: 1, RawBlockSize: 1000, Blocks: []protocol.BlockInfo{{Size: 1000}, {Size: 10}}},
+		{Name: "negative", Version: 1, Blocks: []protocol.BlockInfo{{Size: -1}}},
+		{Name: "huge", Version: 1, Blocks: []protocol.BlockInfo{{Size: 1<<31 - 1}}},
+	})
+	m.IndexUpdate(device1, "default", []protocol.FileInfo{
+		{Name: "update", Version: 1, Blocks: []protocol.BlockInfo{{Size: protocol.MaxBlockSize + 1}}},
+	})
+
+	fs := m.folderFiles["default"]
+	for _, name := range []string{"ok", "large"} {
+		if _, ok := fs.Get(device1, name); !ok {
+			t.Errorf("Valid file %q was dropped", name)
+		}
+	}
+	for _, name := range []string{"odd", "negative", "huge", "update"} {
+		if _, ok := fs.Get(device1, name); ok {
+			t.Errorf("File %q with invalid block size was accepted", name)
+		}
+	}
+}
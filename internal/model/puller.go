@@ -16,8 +16,12 @@
 package model
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -33,6 +37,7 @@ import (
 	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/ignore"
 	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/posix"
 	"github.com/syncthing/syncthing/internal/scanner"
 	"github.com/syncthing/syncthing/internal/symlinks"
 	"github.com/syncthing/syncthing/internal/versioner"
@@ -46,6 +51,11 @@ const (
 	checkPullIntv = 1 * time.Second
 )
 
+// The number of files queued for pulling at a time. The needed files are
+// handled in windows of this size, to keep the memory usage flat regardless
+// of the size of the folder.
+var pullWindowSize = 1000
+
 // A pullBlockState is passed to the puller routine for each block that needs
 // to be fetched.
 type pullBlockState struct {
@@ -71,9 +81,14 @@ type Puller struct {
 	scanIntv        time.Duration
 	model           *Model
 	stop            chan struct{}
+	stopMut         sync.Mutex     // serializes Stop against Serve starting
+	running         sync.WaitGroup // held while Serve runs
 	versioner       versioner.Versioner
 	ignorePerms     bool
 	lenientMtimes   bool
+	syncOwnership   bool
+	syncXattrs      bool
+	preallocate     bool
 	progressEmitter *ProgressEmitter
 	copiers         int
 	pullers         int
@@ -88,7 +103,14 @@ func (p *Puller) Serve() {
 		defer l.Debugln(p, "exiting")
 	}
 
-	p.stop = make(chan struct{})
+	p.stopMut.Lock()
+	if p.stopping() {
+		p.stopMut.Unlock()
+		return
+	}
+	p.running.Add(1)
+	p.stopMut.Unlock()
+	defer p.running.Done()
 
 	pullTimer := time.NewTimer(checkPullIntv)
 	scanTimer := time.NewTimer(time.Millisecond) // The first scan should be done immediately.
@@ -157,6 +179,10 @@ loop:
 			p.model.setState(p.folder, FolderSyncing)
 			tries := 0
 			for {
+				if p.stopping() {
+					return
+				}
+
 				tries++
 
 				changed := p.pullerIteration(curIgnores)
@@ -212,7 +238,11 @@ loop:
 				l.Debugln(p, "rescan")
 			}
 			p.model.setState(p.folder, FolderScanning)
-			if err := p.model.ScanFolder(p.folder); err != nil {
+			err := p.model.scanFolderSub(p.folder, "", p.stop)
+			if err == errScanStopped {
+				break loop
+			}
+			if err != nil {
 				p.model.cfg.InvalidateFolder(p.folder, err.Error())
 				break loop
 			}
@@ -235,8 +265,25 @@ loop:
 	}
 }
 
+// Stop stops the puller and waits for it to reach a safe point; a scan in
+// progress is aborted, files already being pulled are finished, but no new
+// ones are started. It may be called more than once.
 func (p *Puller) Stop() {
-	close(p.stop)
+	p.stopMut.Lock()
+	if !p.stopping() {
+		close(p.stop)
+	}
+	p.stopMut.Unlock()
+	p.running.Wait()
+}
+
+func (p *Puller) stopping() bool {
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
 }
 
 func (p *Puller) String() string {
@@ -297,11 +344,39 @@ func (p *Puller) pullerIteration(ignores *ignore.Matcher) int {
 
 	changed := 0
 
-	fileDeletions := map[string]protocol.FileInfo{}
-	dirDeletions := []protocol.FileInfo{}
-	buckets := map[string][]protocol.FileInfo{}
+	// Deletions are done last, as a file that is to be deleted may instead
+	// be renamed to a needed file with the same contents. Only the names of
+	// the deleted files and directories are kept, and the local files that
+	// may be renamed are kept by a digest of their blocks.
+	fileDeletions := map[string]struct{}{}
+	var dirDeletions []string
+	candidates := renameCandidates{}
+
+	folderFiles.WithNeedTruncated(protocol.LocalDeviceID, func(intf db.FileIntf) bool {
+		file := intf.(db.FileInfoTruncated)
+
+		if !file.IsDeleted() || ignores.Match(file.Name) {
+			return true
+		}
+
+		if file.IsDirectory() {
+			dirDeletions = append(dirDeletions, file.Name)
+			return true
+		}
+
+		fileDeletions[file.Name] = struct{}{}
+		df, ok := p.model.CurrentFolderFile(p.folder, file.Name)
+		// Local file can be already deleted, but with a lower version
+		// number, hence the deletion coming in again as part of
+		// WithNeed
+		if ok && !df.IsDeleted() {
+			candidates.add(df)
+		}
+		return true
+	})
 
-	folderFiles.WithNeed(protocol.LocalDeviceID, func(intf db.FileIntf) bool {
+	queued := 0
+	folderFiles.WithNeedTruncated(protocol.LocalDeviceID, func(intf db.FileIntf) bool {
 
 		// Needed items are delivered sorted lexicographically. This isn't
 		// really optimal from a performance point of view - it would be
@@ -310,7 +385,7 @@ func (p *Puller) pullerIteration(ignores *ignore.Matcher) int {
 		// handle directories before the files that go inside them, which is
 		// nice.
 
-		file := intf.(protocol.FileInfo)
+		file := intf.(db.FileInfoTruncated)
 
 		if ignores.Match(file.Name) {
 			// This is an ignored file. Skip it, continue iteration.
@@ -328,36 +403,65 @@ func (p *Puller) pullerIteration(ignores *ignore.Matcher) int {
 
 		switch {
 		case file.IsDeleted():
-			// A deleted file, directory or symlink
-			if file.IsDirectory() {
-				dirDeletions = append(dirDeletions, file)
-			} else {
-				fileDeletions[file.Name] = file
-				df, ok := p.model.CurrentFolderFile(p.folder, file.Name)
-				// Local file can be already deleted, but with a lower version
-				// number, hence the deletion coming in again as part of
-				// WithNeed
-				if ok && !df.IsDeleted() {
-					// Put files into buckets per first hash
-					key := string(df.Blocks[0].Hash)
-					buckets[key] = append(buckets[key], df)
-				}
-			}
+			// A deleted file, directory or symlink; handled below.
 		case file.IsDirectory() && !file.IsSymlink():
 			// A new or changed directory
-			p.handleDir(file)
+			if f, ok := p.model.CurrentGlobalFile(p.folder, file.Name); ok {
+				p.handleDir(f)
+			}
 		default:
 			// A new or changed file or symlink. This is the only case where we
-			// do stuff concurrently in the background
+			// do stuff concurrently in the background. The queue is handled
+			// when it's full, so that it holds a bounded number of names no
+			// matter how many files are needed.
 			p.queue.Push(file.Name)
+			queued++
+			if queued >= pullWindowSize {
+				p.handleQueue(candidates, fileDeletions, copyChan, finisherChan)
+				queued = 0
+			}
 		}
 
 		changed++
-		return true
+		return !p.stopping()
 	})
 
-nextFile:
-	for {
+	p.handleQueue(candidates, fileDeletions, copyChan, finisherChan)
+
+	// Signal copy and puller routines that we are done with the in data for
+	// this iteration. Wait for them to finish.
+	close(copyChan)
+	copyWg.Wait()
+	close(pullChan)
+	pullWg.Wait()
+
+	// Signal the finisher chan that there will be no more input.
+	close(finisherChan)
+
+	// Wait for the finisherChan to finish.
+	doneWg.Wait()
+
+	for name := range fileDeletions {
+		if file, ok := p.model.CurrentGlobalFile(p.folder, name); ok && file.IsDeleted() {
+			p.deleteFile(file)
+		}
+	}
+
+	for i := range dirDeletions {
+		name := dirDeletions[len(dirDeletions)-i-1]
+		if file, ok := p.model.CurrentGlobalFile(p.folder, name); ok && file.IsDeleted() {
+			p.deleteDir(file)
+		}
+	}
+
+	return changed
+}
+
+// handleQueue handles the files in the queue until it's empty or the puller
+// is stopped. A file with the same blocks as a file that is to be deleted is
+// created by renaming that file.
+func (p *Puller) handleQueue(candidates renameCandidates, fileDeletions map[string]struct{}, copyChan chan<- copyBlocksState, finisherChan chan<- *sharedPullerState) {
+	for !p.stopping() {
 		fileName, ok := p.queue.Pop()
 		if !ok {
 			break
@@ -374,20 +478,19 @@ nextFile:
 		// number, hence the deletion coming in again as part of
 		// WithNeed
 		if !f.IsSymlink() && !f.IsDeleted() {
-			key := string(f.Blocks[0].Hash)
-			for i, candidate := range buckets[key] {
-				if scanner.BlocksEqual(candidate.Blocks, f.Blocks) {
-					// Remove the candidate from the bucket
-					l := len(buckets[key]) - 1
-					buckets[key][i] = buckets[key][l]
-					buckets[key] = buckets[key][:l]
+			if name, ok := candidates.take(f.Blocks); ok {
+				candidate, ok := p.model.CurrentFolderFile(p.folder, name)
+				deleted, dok := p.model.CurrentGlobalFile(p.folder, name)
+				// The files may have changed since the candidates were
+				// gathered.
+				if ok && dok && deleted.IsDeleted() && !candidate.IsDeleted() && scanner.BlocksEqual(candidate.Blocks, f.Blocks) {
 					// Remove the pending deletion (as we perform it by renaming)
-					delete(fileDeletions, candidate.Name)
+					delete(fileDeletions, name)
 
-					p.renameFile(candidate, f)
+					p.renameFile(deleted, f)
 
 					p.queue.Done(fileName)
-					continue nextFile
+					continue
 				}
 			}
 		}
@@ -395,29 +498,41 @@ nextFile:
 		// Not a rename or a symlink, deal with it.
 		p.handleFile(f, copyChan, finisherChan)
 	}
+}
 
-	// Signal copy and puller routines that we are done with the in data for
-	// this iteration. Wait for them to finish.
-	close(copyChan)
-	copyWg.Wait()
-	close(pullChan)
-	pullWg.Wait()
-
-	// Signal the finisher chan that there will be no more input.
-	close(finisherChan)
+// renameCandidates are the names of local files that are to be deleted,
+// by a digest of their block lists.
+type renameCandidates map[string][]string
 
-	// Wait for the finisherChan to finish.
-	doneWg.Wait()
+func (c renameCandidates) add(f protocol.FileInfo) {
+	key := blocksDigest(f.Blocks)
+	c[key] = append(c[key], f.Name)
+}
 
-	for _, file := range fileDeletions {
-		p.deleteFile(file)
+// take removes and returns the name of a candidate with the given blocks,
+// if there is one. The local file may have changed since it was added, so
+// it must be checked by the caller.
+func (c renameCandidates) take(blocks []protocol.BlockInfo) (string, bool) {
+	key := blocksDigest(blocks)
+	names := c[key]
+	if len(names) == 0 {
+		return "", false
 	}
-
-	for i := range dirDeletions {
-		p.deleteDir(dirDeletions[len(dirDeletions)-i-1])
+	name := names[len(names)-1]
+	if len(names) == 1 {
+		delete(c, key)
+	} else {
+		c[key] = names[:len(names)-1]
 	}
+	return name, true
+}
 
-	return changed
+func blocksDigest(blocks []protocol.BlockInfo) string {
+	h := sha256.New()
+	for _, b := range blocks {
+		h.Write(b.Hash)
+	}
+	return string(h.Sum(nil))
 }
 
 // handleDir creates or updates the given directory
@@ -456,6 +571,7 @@ func (p *Puller) handleDir(file protocol.FileInfo) {
 		}
 
 		if err = osutil.InWritableDir(mkdir, realName); err == nil {
+			p.applyPosix(realName, &file)
 			p.model.updateLocal(p.folder, file)
 		} else {
 			l.Infof("Puller (folder %q, dir %q): %v", p.folder, file.Name, err)
@@ -473,8 +589,10 @@ func (p *Puller) handleDir(file protocol.FileInfo) {
 	// It's OK to change mode bits on stuff within non-writable directories.
 
 	if p.ignorePerms {
+		p.applyPosix(realName, &file)
 		p.model.updateLocal(p.folder, file)
 	} else if err := os.Chmod(realName, mode); err == nil {
+		p.applyPosix(realName, &file)
 		p.model.updateLocal(p.folder, file)
 	} else {
 		l.Infof("Puller (folder %q, dir %q): %v", p.folder, file.Name, err)
@@ -551,7 +669,7 @@ func (p *Puller) renameFile(source, target protocol.FileInfo) {
 	// Source file already has the delete bit set.
 	// Because we got rid of the file (by renaming it), we just need to update
 	// the index, and we're done with it.
-	p.model.updateLocal(p.folder, source)
+	p.model.updateLocalRenamed(p.folder, source, target.Name)
 }
 
 // handleFile queues the copies and pulls as necessary for a single new or
@@ -586,7 +704,7 @@ func (p *Puller) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocksSt
 
 	// Check for an old temporary file which might have some blocks we could
 	// reuse.
-	tempBlocks, err := scanner.HashFile(tempName, protocol.BlockSize)
+	tempBlocks, err := scanner.HashFile(tempName, file.BlockSize())
 	if err == nil {
 		// Check for any reusable blocks in the temp file
 		tempCopyBlocks, _ := scanner.BlockDiff(tempBlocks, file.Blocks)
@@ -626,6 +744,10 @@ func (p *Puller) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocksSt
 		copyTotal:  len(blocks),
 		copyNeeded: len(blocks),
 		reused:     reused,
+		// Holes can only be left in a new temp file, as a reused one may have
+		// other data where the zero blocks go.
+		sparse:      file.IsSparse() && reused == 0,
+		preallocate: p.preallocate,
 	}
 
 	if debug {
@@ -651,7 +773,7 @@ func (p *Puller) shortcutFile(file protocol.FileInfo) {
 		}
 	}
 
-	t := time.Unix(file.Modified, 0)
+	t := file.ModTime()
 	err := os.Chtimes(realName, t, t)
 	if err != nil {
 		if p.lenientMtimes {
@@ -666,6 +788,7 @@ func (p *Puller) shortcutFile(file protocol.FileInfo) {
 		}
 	}
 
+	p.applyPosix(realName, &file)
 	p.model.updateLocal(p.folder, file)
 }
 
@@ -683,7 +806,7 @@ func (p *Puller) shortcutSymlink(file protocol.FileInfo) {
 // copierRoutine reads copierStates until the in channel closes and performs
 // the relevant copies when possible, or passes it to the puller routine.
 func (p *Puller) copierRoutine(in <-chan copyBlocksState, pullChan chan<- pullBlockState, out chan<- *sharedPullerState) {
-	buf := make([]byte, protocol.BlockSize)
+	var buf []byte
 
 	for state := range in {
 		if p.progressEmitter != nil {
@@ -711,6 +834,10 @@ func (p *Puller) copierRoutine(in <-chan copyBlocksState, pullChan chan<- pullBl
 			}
 		}()
 
+		// The block size of each file we copy from, as the blocks are found
+		// by index
+		blockSizes := make(map[string]int64)
+
 		folderRoots := make(map[string]string)
 		p.model.fmut.RLock()
 		for folder, cfg := range p.model.folderCfgs {
@@ -718,7 +845,28 @@ func (p *Puller) copierRoutine(in <-chan copyBlocksState, pullChan chan<- pullBl
 		}
 		p.model.fmut.RUnlock()
 
+		// Copying ranges is given up on for the rest of the file after a
+		// failure, which is usually due to the source being on another
+		// filesystem or the filesystem not supporting it.
+		lw, canCopyRange := dstFd.(lockedWriterAt)
+
+		var missing []protocol.BlockInfo
 		for _, block := range state.blocks {
+			if state.sparse && scanner.IsZeroBlock(block) {
+				// The temp file already has a hole here.
+				state.copyDone()
+				continue
+			}
+
+			// Indexes with invalid block sizes are dropped on receipt, but
+			// the buffer is sized by the block so we make sure.
+			if block.Size < 0 || block.Size > protocol.MaxBlockSize {
+				state.fail("copier", fmt.Errorf("invalid block size %d", block.Size))
+				break
+			}
+			if cap(buf) < int(block.Size) {
+				buf = make([]byte, block.Size)
+			}
 			buf = buf[:int(block.Size)]
 			found := p.model.finder.Iterate(block.Hash, func(folder, file string, index int32) bool {
 				path := filepath.Join(folderRoots[folder], file)
@@ -736,7 +884,17 @@ func (p *Puller) copierRoutine(in <-chan copyBlocksState, pullChan chan<- pullBl
 					fdCache.Set(path, fd)
 				}
 
-				_, err = fd.ReadAt(buf, protocol.BlockSize*int64(index))
+				blockSize, ok := blockSizes[path]
+				if !ok {
+					blockSize = protocol.BlockSize
+					if f, ok := p.model.CurrentFolderFile(folder, file); ok {
+						blockSize = int64(f.BlockSize())
+					}
+					blockSizes[path] = blockSize
+				}
+				srcOffset := blockSize * int64(index)
+
+				_, err = fd.ReadAt(buf, srcOffset)
 				if err != nil {
 					return false
 				}
@@ -757,9 +915,28 @@ func (p *Puller) copierRoutine(in <-chan copyBlocksState, pullChan chan<- pullBl
 					return false
 				}
 
-				_, err = dstFd.WriteAt(buf, block.Offset)
-				if err != nil {
-					state.fail("dst write", err)
+				// Let the filesystem share or copy the block if it can, as
+				// that saves both I/O and disk space on for example btrfs
+				// and XFS. We still needed to read it above for
+				// verification.
+				copied := false
+				if canCopyRange {
+					err = lw.copyRangeFrom(fd, srcOffset, block.Offset, int64(block.Size))
+					if err == nil {
+						copied = true
+					} else {
+						if debug {
+							l.Debugf("%v copy range from %s: %v; falling back to writing", p, path, err)
+						}
+						canCopyRange = false
+					}
+				}
+
+				if !copied {
+					_, err = dstFd.WriteAt(buf, block.Offset)
+					if err != nil {
+						state.fail("dst write", err)
+					}
 				}
 				if file == state.file.Name {
 					state.copiedFromOrigin()
@@ -772,22 +949,130 @@ func (p *Puller) copierRoutine(in <-chan copyBlocksState, pullChan chan<- pullBl
 			}
 
 			if !found {
-				state.pullStarted()
-				ps := pullBlockState{
-					sharedPullerState: state.sharedPullerState,
-					block:             block,
-				}
-				pullChan <- ps
+				missing = append(missing, block)
 			} else {
 				state.copyDone()
 			}
 		}
+
+		// Data that has moved within the file, for example by something
+		// being inserted before it, may still be in the current version at
+		// an offset that isn't a multiple of the block size.
+		if state.failed() == nil && len(missing) > 0 {
+			missing = p.copyShiftedBlocks(state.sharedPullerState, dstFd, missing)
+		}
+
+		for _, block := range missing {
+			if state.failed() != nil {
+				break
+			}
+			state.pullStarted()
+			ps := pullBlockState{
+				sharedPullerState: state.sharedPullerState,
+				block:             block,
+			}
+			pullChan <- ps
+		}
 		fdCache.Evict(fdCache.Len())
 		close(evictionChan)
 		out <- state.sharedPullerState
 	}
 }
 
+// copyShiftedBlocks looks for the given blocks at any offset in the current
+// version of the file, by moving a window over it and comparing the weak
+// hash of the window to those of the blocks. Candidates are verified by the
+// strong hash. The blocks found are written to the temp file and the others
+// are returned.
+func (p *Puller) copyShiftedBlocks(state *sharedPullerState, dstFd io.WriterAt, blocks []protocol.BlockInfo) []protocol.BlockInfo {
+	// Only full size blocks can be found, as that is the size of the window.
+	blockSize := state.file.BlockSize()
+	wanted := make(map[uint32][]int)
+	remaining := 0
+	for i, block := range blocks {
+		if block.WeakHash != 0 && int(block.Size) == blockSize {
+			wanted[block.WeakHash] = append(wanted[block.WeakHash], i)
+			remaining++
+		}
+	}
+	if remaining == 0 {
+		return blocks
+	}
+
+	fd, err := os.Open(state.realName)
+	if err != nil {
+		return blocks
+	}
+	defer fd.Close()
+
+	br := bufio.NewReader(fd)
+	window := make([]byte, blockSize)
+	buf := make([]byte, blockSize)
+	found := make([]bool, len(blocks))
+	var rh scanner.RollingHash
+	start := 0 // The index of the first byte of the window
+	full := false
+
+	for remaining > 0 {
+		if !full {
+			if _, err := io.ReadFull(br, window); err != nil {
+				break
+			}
+			rh.Reset()
+			rh.Write(window)
+			start = 0
+			full = true
+		}
+
+		if idxs, ok := wanted[rh.Sum32()]; ok {
+			n := copy(buf, window[start:])
+			copy(buf[n:], window[:start])
+			hash := sha256.Sum256(buf)
+
+			matched := false
+			for _, i := range idxs {
+				if found[i] || !bytes.Equal(hash[:], blocks[i].Hash) {
+					continue
+				}
+				if _, err := dstFd.WriteAt(buf, blocks[i].Offset); err != nil {
+					state.fail("dst write", err)
+					return blocks
+				}
+				found[i] = true
+				matched = true
+				remaining--
+				state.copiedFromOrigin()
+				state.copyDone()
+			}
+			if matched {
+				// Continue after the data we found, as the blocks following
+				// it have likely moved by the same amount.
+				full = false
+				continue
+			}
+		}
+
+		c, err := br.ReadByte()
+		if err != nil {
+			break
+		}
+		rh.Roll(window[start], c)
+		window[start] = c
+		start = (start + 1) % len(window)
+	}
+
+	var rest []protocol.BlockInfo
+	for i, block := range blocks {
+		if !found[i] {
+			rest = append(rest, block)
+		}
+	}
+	if debug {
+		l.Debugf("%v found %d shifted blocks in %s", p, len(blocks)-len(rest), state.file.Name)
+	}
+	return rest
+}
+
 func (p *Puller) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPullerState) {
 	for state := range in {
 		if state.failed() != nil {
@@ -802,50 +1087,106 @@ func (p *Puller) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPulle
 			continue
 		}
 
-		var lastError error
-		potentialDevices := p.model.availability(p.folder, state.file.Name)
-		for {
-			// Select the least busy device to pull the block from. If we found no
-			// feasible device at all, fail the block (and in the long run, the
-			// file).
-			selected := activity.leastBusy(potentialDevices)
-			if selected == (protocol.DeviceID{}) {
-				if lastError != nil {
-					state.fail("pull", lastError)
-				} else {
-					state.fail("pull", errNoDevice)
-				}
-				break
-			}
+		// Fetch the block and save the data we got from the cluster
+		buf, err := p.pullBlock(state)
+		if err != nil {
+			state.fail("pull", err)
+		} else if _, err = fd.WriteAt(buf, state.block.Offset); err != nil {
+			state.fail("save", err)
+		} else {
+			state.pullDone()
+		}
+		out <- state.sharedPullerState
+	}
+}
 
-			potentialDevices = removeDevice(potentialDevices, selected)
+// A blockResult is the outcome of requesting a block from a device.
+type blockResult struct {
+	buf []byte
+	err error
+}
 
-			// Fetch the block, while marking the selected device as in use so that
-			// leastBusy can select another device when someone else asks.
-			activity.using(selected)
-			buf, lastError := p.model.requestGlobal(selected, p.folder, state.file.Name, state.block.Offset, int(state.block.Size), state.block.Hash)
-			activity.done(selected)
-			if lastError != nil {
-				continue
+// pullBlock fetches the block from the device expected to deliver it the
+// soonest, falling back to the other available devices on error or when the
+// received data doesn't match the block hash. When a device is slow to
+// answer, the block is requested from another device as well, and the first
+// correct answer wins. Every request takes its size from the global limit
+// on bytes in flight.
+func (p *Puller) pullBlock(state pullBlockState) ([]byte, error) {
+	size := int(state.block.Size)
+	potentialDevices := p.model.availability(p.folder, state.file.Name)
+	results := make(chan blockResult, len(potentialDevices))
+	limit := p.model.pullLimit
+
+	// request sends a request to the next device, if there is one, and
+	// returns a channel that fires when the request is considered slow. When
+	// wait is false, no request is made unless the limit allows it right
+	// away.
+	pending := 0
+	request := func(wait bool) (<-chan time.Time, bool) {
+		selected, expected := activity.leastBusy(potentialDevices, size)
+		if selected == (protocol.DeviceID{}) {
+			return nil, false
+		}
+		if wait {
+			limit.take(size)
+		} else if !limit.tryTake(size) {
+			return nil, false
+		}
+		potentialDevices = removeDevice(potentialDevices, selected)
+		pending++
+
+		// Mark the selected device as in use so that leastBusy can select
+		// another device when someone else asks.
+		activity.using(selected, size)
+		go func() {
+			buf, err := p.model.requestGlobal(selected, p.folder, state.file.Name, state.block.Offset, size, state.block.Hash)
+			if err == nil {
+				// Verify that the received block matches the desired hash,
+				// if not try pulling it from another device.
+				_, err = scanner.VerifyBuffer(buf, state.block)
 			}
+			activity.done(selected, size, err == nil)
+			limit.give(size)
+			results <- blockResult{buf, err}
+		}()
+
+		deadline := requestDeadline(expected)
+		if debug {
+			l.Debugf("%v requested %q block %d from %v, deadline %v", p, state.file.Name, state.block.Offset, selected, deadline)
+		}
+		return time.After(deadline), true
+	}
 
-			// Verify that the received block matches the desired hash, if not
-			// try pulling it from another device.
-			_, lastError = scanner.VerifyBuffer(buf, state.block)
-			if lastError != nil {
+	slow, ok := request(true)
+	if !ok {
+		return nil, errNoDevice
+	}
+
+	for {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				return res.buf, nil
+			}
+			if pending > 0 {
+				// A request to another device is still outstanding.
 				continue
 			}
+			if slow, ok = request(true); !ok {
+				return nil, res.err
+			}
 
-			// Save the block data we got from the cluster
-			_, err = fd.WriteAt(buf, state.block.Offset)
-			if err != nil {
-				state.fail("save", err)
-			} else {
-				state.pullDone()
+		case <-slow:
+			// Ask another device as well, if there is one and the limit
+			// allows it. Otherwise keep waiting for the answer we have
+			// coming.
+			slow, ok = request(false)
+			if !ok && len(potentialDevices) > 0 {
+				slow = time.After(time.Second)
 			}
-			break
 		}
-		out <- state.sharedPullerState
 	}
 }
 
@@ -861,7 +1202,7 @@ func (p *Puller) performFinish(state *sharedPullerState) {
 	}
 
 	// Set the correct timestamp on the new file
-	t := time.Unix(state.file.Modified, 0)
+	t := state.file.ModTime()
 	err = os.Chtimes(state.tempName, t, t)
 	if err != nil {
 		if p.lenientMtimes {
@@ -917,12 +1258,38 @@ func (p *Puller) performFinish(state *sharedPullerState) {
 			l.Warnln("puller: final: creating symlink:", err)
 			return
 		}
+	} else {
+		p.applyPosix(state.realName, &state.file)
 	}
 
 	// Record the updated file in the index
 	p.model.updateLocal(p.folder, state.file)
 }
 
+// applyPosix sets the ownership and extended attributes synced in this
+// folder on the file or directory at path. A failure doesn't stop the file
+// from being synced; it's reported instead. What is actually in effect is
+// recorded in the file, so that a difference from what was wanted isn't
+// seen as a local change when scanning.
+func (p *Puller) applyPosix(path string, file *protocol.FileInfo) {
+	if !p.syncOwnership && !p.syncXattrs {
+		return
+	}
+
+	var err error
+	if md, ok := file.PosixMetadata(); ok {
+		err = posix.Apply(path, md, p.syncOwnership, p.syncXattrs)
+		if err != nil {
+			l.Infof("Puller (folder %q, file %q): metadata: %v", p.folder, file.Name, err)
+		}
+	}
+	p.model.setPullError(p.folder, file.Name, err)
+
+	if md, err := posix.Read(path, p.syncOwnership, p.syncXattrs); err == nil {
+		file.Posix = []protocol.PosixMetadata{md}
+	}
+}
+
 func (p *Puller) finisherRoutine(in <-chan *sharedPullerState) {
 	for state := range in {
 		if closed, err := state.finalClose(); closed {
@@ -16,17 +16,22 @@
 package model
 
 import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
 	"time"
 
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/posix"
 	"github.com/syncthing/syncthing/internal/scanner"
-
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syncthing/syncthing/internal/stats"
 )
 
 func init() {
@@ -76,7 +81,7 @@ func TestHandleFile(t *testing.T) {
 	requiredFile := existingFile
 	requiredFile.Blocks = blocks[1:]
 
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.OpenMemory()
 	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
 	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
 	// Update index
@@ -130,7 +135,7 @@ func TestHandleFileWithTemp(t *testing.T) {
 	requiredFile := existingFile
 	requiredFile.Blocks = blocks[1:]
 
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.OpenMemory()
 	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
 	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
 	// Update index
@@ -193,7 +198,7 @@ func TestCopierFinder(t *testing.T) {
 	fcfg := config.FolderConfiguration{ID: "default", Path: "testdata"}
 	cfg := config.Configuration{Folders: []config.FolderConfiguration{fcfg}}
 
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.OpenMemory()
 	m := NewModel(config.Wrap("/tmp/test", cfg), "device", "syncthing", "dev", db)
 	m.AddFolder(fcfg)
 	// Update index
@@ -271,7 +276,7 @@ func TestCopierCleanup(t *testing.T) {
 	fcfg := config.FolderConfiguration{ID: "default", Path: "testdata"}
 	cfg := config.Configuration{Folders: []config.FolderConfiguration{fcfg}}
 
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.OpenMemory()
 	m := NewModel(config.Wrap("/tmp/test", cfg), "device", "syncthing", "dev", db)
 	m.AddFolder(fcfg)
 
@@ -323,7 +328,7 @@ func TestLastResortPulling(t *testing.T) {
 	fcfg := config.FolderConfiguration{ID: "default", Path: "testdata"}
 	cfg := config.Configuration{Folders: []config.FolderConfiguration{fcfg}}
 
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.OpenMemory()
 	m := NewModel(config.Wrap("/tmp/test", cfg), "device", "syncthing", "dev", db)
 	m.AddFolder(fcfg)
 
@@ -395,7 +400,7 @@ func TestDeregisterOnFailInCopy(t *testing.T) {
 	}
 	defer os.Remove("testdata/" + defTempNamer.TempName("filex"))
 
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.OpenMemory()
 	cw := config.Wrap("/tmp/test", config.Configuration{})
 	m := NewModel(cw, "device", "syncthing", "dev", db)
 	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
@@ -483,7 +488,7 @@ func TestDeregisterOnFailInPull(t *testing.T) {
 	}
 	defer os.Remove("testdata/" + defTempNamer.TempName("filex"))
 
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.OpenMemory()
 	cw := config.Wrap("/tmp/test", config.Configuration{})
 	m := NewModel(cw, "device", "syncthing", "dev", db)
 	m.AddFolder(config.FolderConfiguration{ID: "default", Path: "testdata"})
@@ -551,3 +556,378 @@ func TestDeregisterOnFailInPull(t *testing.T) {
 		t.Fatal("Didn't get anything to the finisher")
 	}
 }
+
+// Test that deleted files are renamed to needed files with the same
+// contents, also when these are handled in different windows.
+func TestPullerRenames(t *testing.T) {
+	oldWindowSize := pullWindowSize
+	pullWindowSize = 1
+	defer func() {
+		pullWindowSize = oldWindowSize
+	}()
+
+	dir, err := ioutil.TempDir("", "syncthing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("contents of "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fcfg := config.FolderConfiguration{ID: "default", Path: dir, Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}}}
+	db := db.OpenMemory()
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The remote device renamed a to d and b to c.
+	a, _ := m.CurrentFolderFile("default", "a")
+	b, _ := m.CurrentFolderFile("default", "b")
+	c, d := b, a
+	c.Name, d.Name = "c", "d"
+	a.Flags |= protocol.FlagDeleted
+	b.Flags |= protocol.FlagDeleted
+	var files []protocol.FileInfo
+	for _, f := range []protocol.FileInfo{a, b, c, d} {
+		f.Version++
+		f.LocalVersion = 0
+		files = append(files, f)
+	}
+	m.Index(device1, "default", files)
+
+	p := Puller{
+		folder:  "default",
+		dir:     dir,
+		model:   m,
+		stop:    make(chan struct{}),
+		copiers: 1,
+		pullers: 1,
+		queue:   newJobQueue(),
+	}
+	m.fmut.RLock()
+	ignores := m.folderIgnores["default"]
+	m.fmut.RUnlock()
+
+	if changed := p.pullerIteration(ignores); changed != 4 {
+		t.Errorf("Unexpected number of changes %d != 4", changed)
+	}
+
+	for name, contents := range map[string]string{"c": "contents of b", "d": "contents of a"} {
+		bs, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Error(err)
+		} else if string(bs) != contents {
+			t.Errorf("Unexpected contents of %s: %q", name, bs)
+		}
+	}
+	for _, name := range []string{"a", "b"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("Deleted file %s still exists: %v", name, err)
+		}
+	}
+	if changed := p.pullerIteration(ignores); changed != 0 {
+		t.Errorf("Unexpected number of changes %d != 0 after pulling", changed)
+	}
+
+	h, _ := m.FolderHistory("default", "d")
+	if len(h) != 2 || h[1].Action != stats.ChangeRename || h[1].Name != "a" || h[1].Device != device1 {
+		t.Errorf("Unexpected history for d: %+v", h)
+	}
+}
+
+func TestPullerPosix(t *testing.T) {
+	if !posix.OwnershipSupported || !posix.XattrsSupported {
+		t.Skip("ownership or extended attributes are not supported")
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "a")
+	if err := ioutil.WriteFile(name, []byte("contents of a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fcfg := config.FolderConfiguration{ID: "default", Path: dir, SyncOwnership: true, SyncXattrs: true, Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}}}
+	db := db.OpenMemory()
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The remote device has the file owned by a user unknown here, and
+	// with an extended attribute.
+	a, _ := m.CurrentFolderFile("default", "a")
+	local := a.Posix[0]
+	remote := local
+	remote.User = "syncthing-no-such-user"
+	remote.Xattrs = []protocol.Xattr{{Name: "user.test", Value: []byte("value")}}
+	a.Posix = []protocol.PosixMetadata{remote}
+	a.Version++
+	a.LocalVersion = 0
+	m.Index(device1, "default", []protocol.FileInfo{a})
+
+	p := Puller{
+		folder:        "default",
+		dir:           dir,
+		model:         m,
+		stop:          make(chan struct{}),
+		copiers:       1,
+		pullers:       1,
+		queue:         newJobQueue(),
+		syncOwnership: true,
+		syncXattrs:    true,
+	}
+	m.fmut.RLock()
+	ignores := m.folderIgnores["default"]
+	m.fmut.RUnlock()
+
+	if changed := p.pullerIteration(ignores); changed != 1 {
+		t.Fatalf("Unexpected number of changes %d != 1", changed)
+	}
+
+	md, err := posix.Read(name, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(md.Xattrs) == 0 {
+		t.Skip("extended attributes are not supported on the temporary directory")
+	}
+	if !posix.Equal(md, a.Posix[0], false, true) {
+		t.Errorf("Extended attributes not applied; %v", md.Xattrs)
+	}
+
+	errs, _ := m.FolderErrors("default")
+	if len(errs) != 1 || errs[0].Path != "a" {
+		t.Errorf("Unexpected folder errors %v", errs)
+	}
+
+	// What is on disk is recorded, so the owner that couldn't be set is not
+	// seen as a local change.
+	lv := m.CurrentLocalVersion("default")
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+	if m.CurrentLocalVersion("default") != lv {
+		t.Error("Unexpected local change after pulling")
+	}
+}
+
+func TestCopierSparse(t *testing.T) {
+	// A file of two full blocks and a short block, all of zeroes
+	zeroes, err := scanner.Blocks(bytes.NewReader(make([]byte, 2*protocol.BlockSize+100)), protocol.BlockSize, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sparse := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "syncthing-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		file := protocol.FileInfo{Name: "sparse", Flags: 0644, Blocks: zeroes}
+		if sparse {
+			file.Flags |= protocol.FlagSparse
+		}
+
+		fcfg := config.FolderConfiguration{ID: "default", Path: dir}
+		m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db.OpenMemory())
+		m.AddFolder(fcfg)
+
+		p := Puller{
+			folder: "default",
+			dir:    dir,
+			model:  m,
+		}
+
+		copyChan := make(chan copyBlocksState)
+		pullChan := make(chan pullBlockState, len(zeroes))
+		finisherChan := make(chan *sharedPullerState, 1)
+
+		go p.copierRoutine(copyChan, pullChan, finisherChan)
+		p.handleFile(file, copyChan, finisherChan)
+		finish := <-finisherChan
+		finish.fd.Close()
+
+		// The zero blocks must be fetched for a regular file, but are left
+		// as holes in a sparse one.
+		if sparse && len(pullChan) != 0 {
+			t.Errorf("Sparse file: %d pulls, expected none", len(pullChan))
+		} else if !sparse && len(pullChan) != len(zeroes) {
+			t.Errorf("Regular file: %d pulls, expected %d", len(pullChan), len(zeroes))
+		}
+
+		if sparse {
+			info, err := os.Stat(finish.tempName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != file.Size() {
+				t.Errorf("Temp file size %d != %d", info.Size(), file.Size())
+			}
+			if runtime.GOOS != "windows" && !osutil.IsSparse(info) {
+				t.Error("Temp file is not sparse")
+			}
+			fd, err := os.Open(finish.tempName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := scanner.Verify(fd, protocol.BlockSize, zeroes); err != nil {
+				t.Error(err)
+			}
+			fd.Close()
+		}
+	}
+}
+
+func TestCopierShifted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The current file has a byte inserted before the data of the first
+	// three blocks of the new version, so none of them are at the same
+	// offset. The last block is new data.
+	data := make([]byte, 4*protocol.BlockSize)
+	rand.Read(data)
+	old := append([]byte{42}, data[:3*protocol.BlockSize]...)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), old, 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldBlocks, _ := scanner.Blocks(bytes.NewReader(old), protocol.BlockSize, 0)
+	newBlocks, _ := scanner.Blocks(bytes.NewReader(data), protocol.BlockSize, 0)
+
+	fcfg := config.FolderConfiguration{ID: "default", Path: dir}
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db.OpenMemory())
+	m.AddFolder(fcfg)
+	m.updateLocal("default", protocol.FileInfo{Name: "file", Flags: 0644, Blocks: oldBlocks})
+
+	p := Puller{
+		folder: "default",
+		dir:    dir,
+		model:  m,
+	}
+
+	copyChan := make(chan copyBlocksState)
+	pullChan := make(chan pullBlockState, len(newBlocks))
+	finisherChan := make(chan *sharedPullerState, 1)
+
+	go p.copierRoutine(copyChan, pullChan, finisherChan)
+	p.handleFile(protocol.FileInfo{Name: "file", Flags: 0644, Blocks: newBlocks}, copyChan, finisherChan)
+	finish := <-finisherChan
+	defer finish.fd.Close()
+
+	if len(pullChan) != 1 {
+		t.Fatalf("%d pulls, expected only the new block", len(pullChan))
+	}
+	if ps := <-pullChan; ps.block.Offset != 3*protocol.BlockSize {
+		t.Errorf("Pulling block at %d, expected the last one", ps.block.Offset)
+	}
+
+	bs, err := ioutil.ReadFile(finish.tempName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bs) < 3*protocol.BlockSize || !bytes.Equal(bs[:3*protocol.BlockSize], data[:3*protocol.BlockSize]) {
+		t.Error("Shifted blocks were not copied to the temp file")
+	}
+}
+
+func TestCopierBlockSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A file with blocks twice the standard size, to copy from. The blocks
+	// are found by index, so they must be read at the right offsets.
+	const blockSize = 2 * protocol.BlockSize
+	data := make([]byte, 3*blockSize)
+	rand.Read(data)
+	if err := ioutil.WriteFile(filepath.Join(dir, "src"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srcBlocks, _ := scanner.Blocks(bytes.NewReader(data), blockSize, 0)
+
+	fcfg := config.FolderConfiguration{ID: "default", Path: dir}
+	cfg := config.Configuration{Folders: []config.FolderConfiguration{fcfg}}
+	m := NewModel(config.Wrap("/tmp/test", cfg), "device", "syncthing", "dev", db.OpenMemory())
+	m.AddFolder(fcfg)
+	m.updateLocal("default", protocol.FileInfo{Name: "src", Flags: 0644, RawBlockSize: blockSize, Blocks: srcBlocks})
+
+	p := Puller{
+		folder: "default",
+		dir:    dir,
+		model:  m,
+	}
+
+	copyChan := make(chan copyBlocksState)
+	pullChan := make(chan pullBlockState, len(srcBlocks))
+	finisherChan := make(chan *sharedPullerState, 1)
+
+	go p.copierRoutine(copyChan, pullChan, finisherChan)
+	dstBlocks, _ := scanner.Blocks(bytes.NewReader(data), blockSize, 0)
+	p.handleFile(protocol.FileInfo{Name: "dst", Flags: 0644, RawBlockSize: blockSize, Blocks: dstBlocks}, copyChan, finisherChan)
+	finish := <-finisherChan
+	defer finish.fd.Close()
+
+	if len(pullChan) != 0 {
+		t.Fatalf("%d pulls, expected all blocks to be copied", len(pullChan))
+	}
+
+	bs, err := ioutil.ReadFile(finish.tempName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, data) {
+		t.Error("Temp file does not match the source")
+	}
+}
+
+func TestCopierInvalidBlockSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fcfg := config.FolderConfiguration{ID: "default", Path: dir}
+	m := NewModel(config.Wrap("/tmp/test", config.Configuration{}), "device", "syncthing", "dev", db.OpenMemory())
+	m.AddFolder(fcfg)
+
+	p := Puller{
+		folder: "default",
+		dir:    dir,
+		model:  m,
+	}
+
+	copyChan := make(chan copyBlocksState)
+	pullChan := make(chan pullBlockState, 1)
+	finisherChan := make(chan *sharedPullerState, 1)
+
+	go p.copierRoutine(copyChan, pullChan, finisherChan)
+	blocks := []protocol.BlockInfo{{Size: protocol.MaxBlockSize + 1, Hash: make([]byte, 32)}}
+	p.handleFile(protocol.FileInfo{Name: "file", Flags: 0644, Blocks: blocks}, copyChan, finisherChan)
+	finish := <-finisherChan
+	defer finish.fd.Close()
+
+	if finish.failed() == nil {
+		t.Error("Unexpected nil error for a block larger than the maximum size")
+	}
+	if len(pullChan) != 0 {
+		t.Errorf("%d pulls, expected none", len(pullChan))
+	}
+}
@@ -18,14 +18,17 @@ package model
 import (
 	"fmt"
 	"math/rand"
+	"sync"
 	"time"
 )
 
 type Scanner struct {
-	folder string
-	intv   time.Duration
-	model  *Model
-	stop   chan struct{}
+	folder  string
+	intv    time.Duration
+	model   *Model
+	stop    chan struct{}
+	stopMut sync.Mutex     // serializes Stop against Serve starting
+	running sync.WaitGroup // held while Serve runs
 }
 
 func (s *Scanner) Serve() {
@@ -34,6 +37,17 @@ func (s *Scanner) Serve() {
 		defer l.Debugln(s, "exiting")
 	}
 
+	s.stopMut.Lock()
+	select {
+	case <-s.stop:
+		s.stopMut.Unlock()
+		return
+	default:
+	}
+	s.running.Add(1)
+	s.stopMut.Unlock()
+	defer s.running.Done()
+
 	timer := time.NewTimer(time.Millisecond)
 	defer timer.Stop()
 
@@ -49,7 +63,11 @@ func (s *Scanner) Serve() {
 			}
 
 			s.model.setState(s.folder, FolderScanning)
-			if err := s.model.ScanFolder(s.folder); err != nil {
+			err := s.model.scanFolderSub(s.folder, "", s.stop)
+			if err == errScanStopped {
+				return
+			}
+			if err != nil {
 				s.model.cfg.InvalidateFolder(s.folder, err.Error())
 				return
 			}
@@ -71,8 +89,17 @@ func (s *Scanner) Serve() {
 	}
 }
 
+// Stop stops the scanner, aborting a scan in progress, and waits for it to
+// exit. It may be called more than once.
 func (s *Scanner) Stop() {
-	close(s.stop)
+	s.stopMut.Lock()
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+	s.stopMut.Unlock()
+	s.running.Wait()
 }
 
 func (s *Scanner) String() string {
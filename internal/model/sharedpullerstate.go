@@ -23,17 +23,20 @@ import (
 
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/osutil"
 )
 
 // A sharedPullerState is kept for each file that is being synced and is kept
 // updated along the way.
 type sharedPullerState struct {
 	// Immutable, does not require locking
-	file     protocol.FileInfo
-	folder   string
-	tempName string
-	realName string
-	reused   int // Number of blocks reused from temporary file
+	file        protocol.FileInfo
+	folder      string
+	tempName    string
+	realName    string
+	reused      int  // Number of blocks reused from temporary file
+	sparse      bool // Leave blocks of zeroes as holes in the temporary file
+	preallocate bool // Reserve disk space for the temporary file
 
 	// Mutable, must be locked for access
 	err        error      // The first error we hit
@@ -71,6 +74,18 @@ func (w lockedWriterAt) WriteAt(p []byte, off int64) (n int, err error) {
 	return w.wr.WriteAt(p, off)
 }
 
+// copyRangeFrom copies size bytes at srcOffset in src to dstOffset in the
+// file, as osutil.CopyRange.
+func (w lockedWriterAt) copyRangeFrom(src *os.File, srcOffset, dstOffset, size int64) error {
+	fd, ok := w.wr.(*os.File)
+	if !ok {
+		return osutil.ErrCopyRangeUnsupported
+	}
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	return osutil.CopyRange(fd, src, srcOffset, dstOffset, size)
+}
+
 // tempFile returns the fd for the temporary file, reusing an open fd
 // or creating the file as necessary.
 func (s *sharedPullerState) tempFile() (io.WriterAt, error) {
@@ -128,6 +143,22 @@ func (s *sharedPullerState) tempFile() (io.WriterAt, error) {
 		return nil, err
 	}
 
+	if s.reused == 0 {
+		// Give the new temp file its final size up front. Blocks of zeroes
+		// are not written to a sparse file, so the size must be set for
+		// the holes to exist.
+		if s.sparse {
+			err = fd.Truncate(s.file.Size())
+		} else if s.preallocate {
+			err = osutil.Preallocate(fd, s.file.Size())
+		}
+		if err != nil {
+			fd.Close()
+			s.failLocked("dst allocate", err)
+			return nil, err
+		}
+	}
+
 	// Same fd will be used by all writers
 	s.fd = fd
 
@@ -250,7 +281,7 @@ func (s *sharedPullerState) Progress() *pullerProgress {
 		CopiedFromElsewhere: s.copyTotal - s.copyNeeded - s.copyOrigin,
 		Pulled:              s.pullTotal - s.pullNeeded,
 		Pulling:             s.pullNeeded,
-		BytesTotal:          db.BlocksToSize(total),
-		BytesDone:           db.BlocksToSize(done),
+		BytesTotal:          db.BlocksToSize(total, s.file.BlockSize()),
+		BytesDone:           db.BlocksToSize(done, s.file.BlockSize()),
 	}
 }
@@ -0,0 +1,80 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build linux
+
+package osutil
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const ficlonerange = 0x4020940d // FICLONERANGE, _IOW(0x94, 13, struct file_clone_range)
+
+// The copy_file_range syscall is too new to be in the syscall package.
+var sysCopyFileRange = map[string]uintptr{
+	"386":   377,
+	"amd64": 326,
+	"arm":   391,
+	"arm64": 285,
+}[runtime.GOARCH]
+
+type fileCloneRange struct {
+	srcFd     int64
+	srcOffset uint64
+	srcLength uint64
+	dstOffset uint64
+}
+
+// CopyRange copies size bytes at srcOffset in src to dstOffset in dst
+// without passing the data through user space. The range is shared between
+// the files using a reflink where the filesystem supports that, otherwise
+// it's copied within the kernel. Either requires the files to be on the
+// same filesystem.
+func CopyRange(dst, src *os.File, srcOffset, dstOffset, size int64) error {
+	r := fileCloneRange{
+		srcFd:     int64(src.Fd()),
+		srcOffset: uint64(srcOffset),
+		srcLength: uint64(size),
+		dstOffset: uint64(dstOffset),
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlonerange, uintptr(unsafe.Pointer(&r)))
+	if errno == 0 {
+		return nil
+	}
+	return copyFileRange(dst, src, srcOffset, dstOffset, size)
+}
+
+func copyFileRange(dst, src *os.File, srcOffset, dstOffset, size int64) error {
+	if sysCopyFileRange == 0 {
+		return ErrCopyRangeUnsupported
+	}
+	for size > 0 {
+		// The offsets are advanced by the kernel.
+		n, _, errno := syscall.Syscall6(sysCopyFileRange, src.Fd(), uintptr(unsafe.Pointer(&srcOffset)), dst.Fd(), uintptr(unsafe.Pointer(&dstOffset)), uintptr(size), 0)
+		if errno != 0 {
+			return errno
+		}
+		if n == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		size -= int64(n)
+	}
+	return nil
+}
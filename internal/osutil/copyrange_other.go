@@ -0,0 +1,27 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build !linux
+
+package osutil
+
+import "os"
+
+// CopyRange copies size bytes at srcOffset in src to dstOffset in dst
+// without passing the data through user space. This is not supported on
+// this platform.
+func CopyRange(dst, src *os.File, srcOffset, dstOffset, size int64) error {
+	return ErrCopyRangeUnsupported
+}
@@ -0,0 +1,73 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package osutil_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/osutil"
+)
+
+func TestCopyRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 256<<10)
+	rand.Read(data)
+	if err := ioutil.WriteFile(filepath.Join(dir, "src"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := os.Open(filepath.Join(dir, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := os.Create(filepath.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	// Copy the second half of the source to the start of the destination,
+	// and a short unaligned range after it.
+	err = osutil.CopyRange(dst, src, 128<<10, 0, 128<<10)
+	if err == osutil.ErrCopyRangeUnsupported {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if err := osutil.CopyRange(dst, src, 100, 128<<10, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ioutil.ReadFile(filepath.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append(append([]byte{}, data[128<<10:]...), data[100:1100]...)
+	if !bytes.Equal(res, expected) {
+		t.Error("Copied data does not match the source")
+	}
+}
@@ -29,6 +29,8 @@ import (
 
 var ErrNoHome = errors.New("No home directory found - set $HOME (or the platform equivalent).")
 
+var ErrCopyRangeUnsupported = errors.New("copying file ranges is not supported")
+
 // Try to keep this entire operation atomic-like. We shouldn't be doing this
 // often enough that there is any contention on this lock.
 var renameLock sync.Mutex
@@ -45,6 +47,33 @@ func TryRename(from, to string) error {
 	})
 }
 
+// renameNoReplaceFallback renames a file by linking it to the new name,
+// which fails if the name is taken, and then removing the old one. Where
+// that isn't possible, as for directories, the new name is checked before
+// renaming, leaving a window in which a file created there is replaced.
+func renameNoReplaceFallback(from, to string) error {
+	info, err := os.Lstat(from)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		err := os.Link(from, to)
+		if err == nil {
+			return os.Remove(from)
+		}
+		if os.IsExist(err) {
+			return err
+		}
+	}
+
+	if _, err := os.Lstat(to); err == nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
 // Rename moves a temporary file to it's final place.
 // Will make sure to delete the from file if the operation fails, so use only
 // for situations like committing a temp file to it's final location.
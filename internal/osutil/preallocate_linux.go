@@ -0,0 +1,37 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build linux
+
+package osutil
+
+import (
+	"os"
+	"syscall"
+)
+
+// Preallocate allocates disk space for the first size bytes of the file,
+// extending it if necessary. On filesystems that don't support this the
+// file is only extended.
+func Preallocate(fd *os.File, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	err := syscall.Fallocate(int(fd.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP {
+		return fd.Truncate(size)
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build linux
+
+package osutil
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	atFdcwd             = -100 // AT_FDCWD
+	renameNoReplaceFlag = 1    // RENAME_NOREPLACE
+)
+
+// The renameat2 syscall is too new to be in the syscall package.
+var sysRenameat2 = map[string]uintptr{
+	"386":   353,
+	"amd64": 316,
+	"arm":   382,
+	"arm64": 276,
+}[runtime.GOARCH]
+
+// RenameNoReplace renames from to to, failing with an error satisfying
+// os.IsExist if to already exists. Unlike checking for the target before an
+// os.Rename, nothing created at to in the meantime is replaced.
+func RenameNoReplace(from, to string) error {
+	if sysRenameat2 == 0 {
+		return renameNoReplaceFallback(from, to)
+	}
+
+	fromp, err := syscall.BytePtrFromString(from)
+	if err != nil {
+		return err
+	}
+	top, err := syscall.BytePtrFromString(to)
+	if err != nil {
+		return err
+	}
+	fdcwd := atFdcwd
+	_, _, errno := syscall.Syscall6(sysRenameat2, uintptr(fdcwd), uintptr(unsafe.Pointer(fromp)), uintptr(fdcwd), uintptr(unsafe.Pointer(top)), renameNoReplaceFlag, 0)
+	switch errno {
+	case 0:
+		return nil
+	case syscall.ENOSYS, syscall.EINVAL:
+		// An older kernel, or a filesystem without support for the flag
+		return renameNoReplaceFallback(from, to)
+	default:
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: errno}
+	}
+}
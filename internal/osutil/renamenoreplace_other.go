@@ -0,0 +1,26 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build !linux,!windows
+
+package osutil
+
+// RenameNoReplace renames from to to, failing with an error satisfying
+// os.IsExist if to already exists. Unlike checking for the target before an
+// os.Rename, nothing created at to in the meantime is replaced, except for
+// directories on this platform.
+func RenameNoReplace(from, to string) error {
+	return renameNoReplaceFallback(from, to)
+}
@@ -0,0 +1,73 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package osutil_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/osutil"
+)
+
+func TestRenameNoReplace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, b, c := filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "c")
+	for _, name := range []string{a, b} {
+		if err := ioutil.WriteFile(name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(c, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// A taken name is left alone, whether a file or a directory.
+	if err := osutil.RenameNoReplace(a, b); !os.IsExist(err) {
+		t.Errorf("Unexpected error %v renaming onto a file", err)
+	}
+	if bs, _ := ioutil.ReadFile(b); string(bs) != b {
+		t.Errorf("Existing file was replaced: %q", bs)
+	}
+	if err := osutil.RenameNoReplace(c, b); !os.IsExist(err) {
+		t.Errorf("Unexpected error %v renaming a directory onto a file", err)
+	}
+
+	// A free one is taken.
+	d := filepath.Join(dir, "d")
+	if err := osutil.RenameNoReplace(a, d); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(a); !os.IsNotExist(err) {
+		t.Errorf("Renamed file still exists: %v", err)
+	}
+	if bs, _ := ioutil.ReadFile(d); string(bs) != a {
+		t.Errorf("Renamed file has unexpected contents %q", bs)
+	}
+	e := filepath.Join(dir, "e")
+	if err := osutil.RenameNoReplace(c, e); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Lstat(e); err != nil || !info.IsDir() {
+		t.Errorf("Renamed directory is missing: %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build windows
+
+package osutil
+
+import (
+	"os"
+	"syscall"
+)
+
+// RenameNoReplace renames from to to, failing with an error satisfying
+// os.IsExist if to already exists. Unlike checking for the target before an
+// os.Rename, nothing created at to in the meantime is replaced.
+func RenameNoReplace(from, to string) error {
+	fromp, err := syscall.UTF16PtrFromString(from)
+	if err != nil {
+		return err
+	}
+	top, err := syscall.UTF16PtrFromString(to)
+	if err != nil {
+		return err
+	}
+	// Without MOVEFILE_REPLACE_EXISTING, which os.Rename uses
+	if err := syscall.MoveFile(fromp, top); err != nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+	}
+	return nil
+}
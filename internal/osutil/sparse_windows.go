@@ -0,0 +1,34 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build windows
+
+package osutil
+
+import (
+	"os"
+	"syscall"
+)
+
+const fileAttributeSparseFile = 0x200 // FILE_ATTRIBUTE_SPARSE_FILE
+
+// IsSparse returns true if the file has the sparse file attribute set.
+func IsSparse(info os.FileInfo) bool {
+	attrs, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return false
+	}
+	return attrs.FileAttributes&fileAttributeSparseFile != 0
+}
@@ -0,0 +1,106 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// +build !windows
+
+package posix
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/syncthing/protocol"
+)
+
+const OwnershipSupported = true
+
+// The names of user and group IDs, or "" for IDs without a name, as looking
+// them up may mean reading the whole passwd or group file.
+var (
+	userNames  = make(map[uint32]string)
+	groupNames = make(map[uint32]string)
+	namesMut   sync.Mutex
+)
+
+func readOwnership(path string, md *protocol.PosixMetadata) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errOwnershipUnsupported
+	}
+
+	md.UID, md.GID = st.Uid, st.Gid
+	md.User, md.Group = ownerNames(st.Uid, st.Gid)
+	return nil
+}
+
+func ownerNames(uid, gid uint32) (string, string) {
+	namesMut.Lock()
+	defer namesMut.Unlock()
+
+	userName, ok := userNames[uid]
+	if !ok {
+		if u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10)); err == nil {
+			userName = u.Username
+		}
+		userNames[uid] = userName
+	}
+	groupName, ok := groupNames[gid]
+	if !ok {
+		if g, err := user.LookupGroupId(strconv.FormatUint(uint64(gid), 10)); err == nil {
+			groupName = g.Name
+		}
+		groupNames[gid] = groupName
+	}
+	return userName, groupName
+}
+
+func applyOwnership(path string, md protocol.PosixMetadata) error {
+	var firstErr error
+	uid, gid := int(md.UID), int(md.GID)
+	if md.User != "" {
+		uid = -1
+		if u, err := user.Lookup(md.User); err != nil {
+			firstErr = fmt.Errorf("unknown user %q", md.User)
+		} else if id, err := strconv.Atoi(u.Uid); err == nil {
+			uid = id
+		}
+	}
+	if md.Group != "" {
+		gid = -1
+		if g, err := user.LookupGroup(md.Group); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("unknown group %q", md.Group)
+			}
+		} else if id, err := strconv.Atoi(g.Gid); err == nil {
+			gid = id
+		}
+	}
+
+	if uid == -1 && gid == -1 {
+		return firstErr
+	}
+	if err := os.Lchown(path, uid, gid); err != nil {
+		return err
+	}
+	return firstErr
+}
@@ -0,0 +1,87 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package posix reads and applies the ownership and extended attributes of
+// files.
+package posix
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/syncthing/protocol"
+)
+
+var (
+	errOwnershipUnsupported = errors.New("file ownership is not supported on this platform")
+	errXattrsUnsupported    = errors.New("extended attributes are not supported on this platform")
+)
+
+// Read returns the ownership, if ownership is true, and the extended
+// attributes, if xattrs is true, of the file or directory at path.
+func Read(path string, ownership, xattrs bool) (protocol.PosixMetadata, error) {
+	var md protocol.PosixMetadata
+	if ownership {
+		if err := readOwnership(path, &md); err != nil {
+			return protocol.PosixMetadata{}, err
+		}
+	}
+	if xattrs {
+		xs, err := readXattrs(path)
+		if err != nil {
+			return protocol.PosixMetadata{}, err
+		}
+		md.Xattrs = xs
+	}
+	return md, nil
+}
+
+// Apply sets the ownership, if ownership is true, and the extended
+// attributes, if xattrs is true, of the file or directory at path to those
+// in the metadata. Owners are looked up by name, or used by their numeric ID
+// when there is no name. An owner name unknown on this system is reported as
+// an error and the owner left as it is; the rest of the metadata is still
+// applied. The first error encountered is returned.
+func Apply(path string, md protocol.PosixMetadata, ownership, xattrs bool) error {
+	var firstErr error
+	if ownership {
+		firstErr = applyOwnership(path, md)
+	}
+	if xattrs {
+		if err := applyXattrs(path, md.Xattrs); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Equal returns true if the ownership, if ownership is true, and the
+// extended attributes, if xattrs is true, are the same in a and b.
+func Equal(a, b protocol.PosixMetadata, ownership, xattrs bool) bool {
+	if ownership && (a.UID != b.UID || a.GID != b.GID || a.User != b.User || a.Group != b.Group) {
+		return false
+	}
+	if xattrs {
+		if len(a.Xattrs) != len(b.Xattrs) {
+			return false
+		}
+		for i := range a.Xattrs {
+			if a.Xattrs[i].Name != b.Xattrs[i].Name || !bytes.Equal(a.Xattrs[i].Value, b.Xattrs[i].Value) {
+				return false
+			}
+		}
+	}
+	return true
+}
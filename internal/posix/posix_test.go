@@ -0,0 +1,92 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package posix
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syncthing/protocol"
+)
+
+func tempFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "syncthing-posix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(name, []byte("data"), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return name, func() { os.RemoveAll(dir) }
+}
+
+func TestOwnership(t *testing.T) {
+	if !OwnershipSupported {
+		t.Skip("ownership is not supported")
+	}
+	name, cleanup := tempFile(t)
+	defer cleanup()
+
+	md, err := Read(name, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.UID != uint32(os.Getuid()) {
+		t.Errorf("unexpected owner %d != %d", md.UID, os.Getuid())
+	}
+	if len(md.Xattrs) != 0 {
+		t.Errorf("unexpected extended attributes %v", md.Xattrs)
+	}
+
+	// Setting the current owner works for anyone.
+	if err := Apply(name, md, true, false); err != nil {
+		t.Error(err)
+	}
+
+	// An unknown user is reported, and the known group still applied.
+	unknown := md
+	unknown.User = "syncthing-no-such-user"
+	if err := Apply(name, unknown, true, false); err == nil {
+		t.Error("unexpected nil error for unknown user")
+	}
+	if md2, _ := Read(name, true, false); !Equal(md, md2, true, false) {
+		t.Errorf("ownership changed from %v to %v", md, md2)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	a := protocol.PosixMetadata{UID: 1000, GID: 100, User: "jb", Group: "users"}
+	b := a
+	b.Xattrs = []protocol.Xattr{{Name: "user.x", Value: []byte("x")}}
+
+	if !Equal(a, b, true, false) {
+		t.Error("ownership should be equal")
+	}
+	if Equal(a, b, false, true) {
+		t.Error("extended attributes should differ")
+	}
+	b.Group = "staff"
+	if Equal(a, b, true, false) {
+		t.Error("ownership should differ")
+	}
+	if !Equal(a, b, false, false) {
+		t.Error("nothing compared should be equal")
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package posix
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/syncthing/protocol"
+)
+
+const XattrsSupported = true
+
+// syncedXattr returns true for the extended attributes that are synced:
+// those in the user namespace and the POSIX ACLs. The ACLs refer to users
+// and groups by numeric ID.
+func syncedXattr(name string) bool {
+	return strings.HasPrefix(name, "user.") || name == "system.posix_acl_access" || name == "system.posix_acl_default"
+}
+
+type xattrList []protocol.Xattr
+
+func (l xattrList) Len() int           { return len(l) }
+func (l xattrList) Less(a, b int) bool { return l[a].Name < l[b].Name }
+func (l xattrList) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
+
+// readXattrs returns the synced extended attributes of the file, sorted by
+// name.
+func readXattrs(path string) ([]protocol.Xattr, error) {
+	names, err := listXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var xattrs []protocol.Xattr
+	for _, name := range names {
+		if !syncedXattr(name) {
+			continue
+		}
+		val, err := getXattr(path, name)
+		if err == syscall.ENODATA {
+			// Removed since it was listed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		xattrs = append(xattrs, protocol.Xattr{Name: name, Value: val})
+	}
+	sort.Sort(xattrList(xattrs))
+	return xattrs, nil
+}
+
+func listXattrs(path string) ([]string, error) {
+	for {
+		size, err := syscall.Listxattr(path, nil)
+		if err == syscall.ENOTSUP {
+			return nil, nil
+		} else if err != nil || size == 0 {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := syscall.Listxattr(path, buf)
+		if err == syscall.ERANGE {
+			// The list grew since we asked for its size
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var names []string
+		for _, name := range bytes.Split(buf[:n], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	for {
+		size, err := syscall.Getxattr(path, name, nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := syscall.Getxattr(path, name, buf)
+		if err == syscall.ERANGE {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// applyXattrs sets the synced extended attributes of the file to the given
+// ones, removing those not among them.
+func applyXattrs(path string, xattrs []protocol.Xattr) error {
+	cur, err := readXattrs(path)
+	if err != nil {
+		return err
+	}
+	have := make(map[string][]byte, len(cur))
+	for _, x := range cur {
+		have[x.Name] = x.Value
+	}
+
+	var firstErr error
+	want := make(map[string]struct{}, len(xattrs))
+	for _, x := range xattrs {
+		want[x.Name] = struct{}{}
+		if !syncedXattr(x.Name) {
+			continue
+		}
+		if val, ok := have[x.Name]; ok && bytes.Equal(val, x.Value) {
+			continue
+		}
+		if err := syscall.Setxattr(path, x.Name, x.Value, 0); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("setting extended attribute %s: %v", x.Name, err)
+		}
+	}
+	for name := range have {
+		if _, ok := want[name]; !ok {
+			if err := syscall.Removexattr(path, name); err != nil && err != syscall.ENODATA && firstErr == nil {
+				firstErr = fmt.Errorf("removing extended attribute %s: %v", name, err)
+			}
+		}
+	}
+	return firstErr
+}
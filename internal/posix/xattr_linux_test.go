@@ -0,0 +1,64 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package posix
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/syncthing/protocol"
+)
+
+func TestXattrs(t *testing.T) {
+	name, cleanup := tempFile(t)
+	defer cleanup()
+
+	if err := syscall.Setxattr(name, "user.old", []byte("old"), 0); err == syscall.ENOTSUP {
+		t.Skip("extended attributes are not supported on the temporary directory")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	want := protocol.PosixMetadata{
+		Xattrs: []protocol.Xattr{
+			{Name: "user.a", Value: []byte("one")},
+			{Name: "user.b", Value: []byte{}},
+			{Name: "user.old", Value: []byte("new")},
+		},
+	}
+	if err := Apply(name, want, false, true); err != nil {
+		t.Fatal(err)
+	}
+	md, err := Read(name, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Equal(md, want, false, true) {
+		t.Errorf("unexpected extended attributes %v", md.Xattrs)
+	}
+
+	// Attributes not in the metadata are removed.
+	want.Xattrs = want.Xattrs[:1]
+	if err := Apply(name, want, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if md, err = Read(name, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if !Equal(md, want, false, true) {
+		t.Errorf("unexpected extended attributes %v", md.Xattrs)
+	}
+}
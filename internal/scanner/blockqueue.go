@@ -16,9 +16,12 @@
 package scanner
 
 import (
+	"errors"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/syncthing/protocol"
 )
@@ -28,13 +31,17 @@ import (
 // workers are used in parallel. The outbox will become closed when the inbox
 // is closed and all items handled.
 
-func newParallelHasher(dir string, blockSize, workers int, outbox, inbox chan protocol.FileInfo) {
+// The bytes read when hashing are counted by the progress, if not nil, and
+// read no faster than the limiters allow. Files that keep changing while
+// being hashed are passed to fileError instead of the outbox. Once stop is
+// closed the files left in the inbox are dropped without hashing.
+func newParallelHasher(dir string, blockSize, workers int, outbox, inbox chan protocol.FileInfo, progress *Progress, limiters []*Limiter, fileError func(string, error), stop chan struct{}) {
 	var wg sync.WaitGroup
 	wg.Add(workers)
 
 	for i := 0; i < workers; i++ {
 		go func() {
-			hashFiles(dir, blockSize, outbox, inbox)
+			hashFiles(dir, blockSize, outbox, inbox, progress, limiters, fileError, stop)
 			wg.Done()
 		}()
 	}
@@ -45,7 +52,41 @@ func newParallelHasher(dir string, blockSize, workers int, outbox, inbox chan pr
 	}()
 }
 
+// queueFiles passes the files from the inbox to the outbox in order, queueing
+// as many as needed to never block the sender. The outbox is closed when the
+// inbox is closed and all files passed on.
+func queueFiles(outbox, inbox chan protocol.FileInfo) {
+	var queue []protocol.FileInfo
+	for inbox != nil || len(queue) > 0 {
+		var out chan protocol.FileInfo
+		var next protocol.FileInfo
+		if len(queue) > 0 {
+			out = outbox
+			next = queue[0]
+		}
+
+		select {
+		case f, ok := <-inbox:
+			if !ok {
+				inbox = nil
+				continue
+			}
+			queue = append(queue, f)
+		case out <- next:
+			queue[0] = protocol.FileInfo{}
+			queue = queue[1:]
+		}
+	}
+	close(outbox)
+}
+
+// HashFile returns the blocks of the file. A zero blockSize chooses it by
+// the size of the file, as protocol.BlockSizeFor.
 func HashFile(path string, blockSize int) ([]protocol.BlockInfo, error) {
+	return hashFile(path, blockSize, nil, nil, nil)
+}
+
+func hashFile(path string, blockSize int, progress *Progress, limiters []*Limiter, stop chan struct{}) ([]protocol.BlockInfo, error) {
 	fd, err := os.Open(path)
 	if err != nil {
 		if debug {
@@ -63,17 +104,31 @@ func HashFile(path string, blockSize int) ([]protocol.BlockInfo, error) {
 		return []protocol.BlockInfo{}, err
 	}
 	defer fd.Close()
-	return Blocks(fd, blockSize, fi.Size())
+	if blockSize == 0 {
+		blockSize = protocol.BlockSizeFor(fi.Size())
+	}
+	return Blocks(stoppableReader(limitedReader(progress.reader(fd), limiters), stop), blockSize, fi.Size())
 }
 
-func hashFiles(dir string, blockSize int, outbox, inbox chan protocol.FileInfo) {
+func hashFiles(dir string, blockSize int, outbox, inbox chan protocol.FileInfo, progress *Progress, limiters []*Limiter, fileError func(string, error), stop chan struct{}) {
 	for f := range inbox {
-		if f.IsDirectory() || f.IsDeleted() || f.IsSymlink() {
+		if stopped(stop) {
+			// Keep draining the inbox so that the walker isn't blocked.
+			continue
+		}
+
+		if f.IsDirectory() || f.IsDeleted() || f.IsSymlink() || len(f.Blocks) > 0 {
+			// Nothing to hash, or a file already hashed that only had its
+			// metadata changed.
 			outbox <- f
 			continue
 		}
 
-		blocks, err := HashFile(filepath.Join(dir, f.Name), blockSize)
+		blocks, info, err := hashStableFile(filepath.Join(dir, f.Name), blockSize, progress, limiters, stop)
+		if err == errFileChanging {
+			fileError(f.Name, err)
+			continue
+		}
 		if err != nil {
 			if debug {
 				l.Debugln("hash error:", f.Name, err)
@@ -81,7 +136,100 @@ func hashFiles(dir string, blockSize int, outbox, inbox chan protocol.FileInfo)
 			continue
 		}
 
+		// The file may have changed since it was found by the walker, so
+		// the modification time is the one that goes with the blocks.
+		f.Modified = info.ModTime().Unix()
+		f.ModifiedNs = int32(info.ModTime().Nanosecond())
+		if blockSize == 0 {
+			f.RawBlockSize = protocol.RawBlockSize(protocol.BlockSizeFor(info.Size()))
+		} else {
+			f.RawBlockSize = protocol.RawBlockSize(blockSize)
+		}
 		f.Blocks = blocks
 		outbox <- f
 	}
 }
+
+var errFileChanging = errors.New("file keeps changing while being hashed; skipped until it's stable")
+
+// A file that changes while being hashed is hashed again after each of
+// these delays in turn, and skipped for this scan if it's still changing
+// after the last one.
+var changingFileDelays = []time.Duration{time.Second, 5 * time.Second}
+
+// hashStableFile hashes the file and returns the blocks along with the info
+// of the file, which didn't change during the hashing.
+func hashStableFile(path string, blockSize int, progress *Progress, limiters []*Limiter, stop chan struct{}) ([]protocol.BlockInfo, os.FileInfo, error) {
+	for i := 0; ; i++ {
+		before, err := os.Lstat(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		blocks, err := hashFile(path, blockSize, progress, limiters, stop)
+		if err != nil {
+			return nil, nil, err
+		}
+		after, err := os.Lstat(path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if after.Size() == before.Size() && after.ModTime().Equal(before.ModTime()) && after.Size() == blocksSize(blocks) {
+			return blocks, after, nil
+		}
+		if i == len(changingFileDelays) {
+			return nil, nil, errFileChanging
+		}
+
+		if debug {
+			l.Debugln("changed while hashing:", path)
+		}
+		select {
+		case <-stop:
+			return nil, nil, errStopped
+		case <-time.After(changingFileDelays[i]):
+		}
+		progress.addTotal(after.Size())
+	}
+}
+
+func blocksSize(blocks []protocol.BlockInfo) int64 {
+	var size int64
+	for _, b := range blocks {
+		size += int64(b.Size)
+	}
+	return size
+}
+
+var errStopped = errors.New("walk stopped")
+
+// stopped returns true if stop is closed.
+func stopped(stop chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// stoppableReader returns a reader that fails with errStopped once stop is
+// closed, to abort the hashing of a large file.
+func stoppableReader(r io.Reader, stop chan struct{}) io.Reader {
+	if stop == nil {
+		return r
+	}
+	return stopReader{r, stop}
+}
+
+type stopReader struct {
+	r    io.Reader
+	stop chan struct{}
+}
+
+func (r stopReader) Read(bs []byte) (int, error) {
+	if stopped(r.stop) {
+		return 0, errStopped
+	}
+	return r.r.Read(bs)
+}
@@ -20,13 +20,21 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/syncthing/protocol"
 )
 
 var SHA256OfNothing = []uint8{0xe3, 0xb0, 0xc4, 0x42, 0x98, 0xfc, 0x1c, 0x14, 0x9a, 0xfb, 0xf4, 0xc8, 0x99, 0x6f, 0xb9, 0x24, 0x27, 0xae, 0x41, 0xe4, 0x64, 0x9b, 0x93, 0x4c, 0xa4, 0x95, 0x99, 0x1b, 0x78, 0x52, 0xb8, 0x55}
 
-// Blocks returns the blockwise hash of the reader.
+// The hashes of full size blocks of zeroes, by block size
+var (
+	zeroBlockHashes    = make(map[int32][]byte)
+	zeroBlockHashesMut sync.Mutex
+)
+
+// Blocks returns the blockwise hash of the reader, with the weak hash of
+// each block.
 func Blocks(r io.Reader, blocksize int, sizehint int64) ([]protocol.BlockInfo, error) {
 	var blocks []protocol.BlockInfo
 	if sizehint > 0 {
@@ -34,9 +42,11 @@ func Blocks(r io.Reader, blocksize int, sizehint int64) ([]protocol.BlockInfo, e
 	}
 	var offset int64
 	hf := sha256.New()
+	var wh RollingHash
+	mw := io.MultiWriter(hf, &wh)
 	for {
 		lr := &io.LimitedReader{R: r, N: int64(blocksize)}
-		n, err := io.Copy(hf, lr)
+		n, err := io.Copy(mw, lr)
 		if err != nil {
 			return nil, err
 		}
@@ -46,14 +56,16 @@ func Blocks(r io.Reader, blocksize int, sizehint int64) ([]protocol.BlockInfo, e
 		}
 
 		b := protocol.BlockInfo{
-			Size:   int32(n),
-			Offset: offset,
-			Hash:   hf.Sum(nil),
+			Size:     int32(n),
+			Offset:   offset,
+			Hash:     hf.Sum(nil),
+			WeakHash: wh.Sum32(),
 		}
 		blocks = append(blocks, b)
 		offset += int64(n)
 
 		hf.Reset()
+		wh.Reset()
 	}
 
 	if len(blocks) == 0 {
@@ -148,6 +160,34 @@ func VerifyBuffer(buf []byte, block protocol.BlockInfo) ([]byte, error) {
 	return hash, nil
 }
 
+// IsZeroBlock returns true if the block consists of only zeroes, judging by
+// its hash. Blocks of no or an invalid size never are.
+func IsZeroBlock(block protocol.BlockInfo) bool {
+	if block.Size <= 0 || block.Size > protocol.MaxBlockSize {
+		return false
+	}
+	return bytes.Equal(block.Hash, zeroBlockHash(block.Size))
+}
+
+func zeroBlockHash(size int32) []byte {
+	// All blocks but the last of each file are of a power of two size, and
+	// only those hashes are worth caching.
+	full := size >= protocol.BlockSize && size&(size-1) == 0
+	if full {
+		zeroBlockHashesMut.Lock()
+		defer zeroBlockHashesMut.Unlock()
+		if h, ok := zeroBlockHashes[size]; ok {
+			return h
+		}
+	}
+
+	h := sha256.Sum256(make([]byte, size))
+	if full {
+		zeroBlockHashes[size] = h[:]
+	}
+	return h[:]
+}
+
 // BlockEqual returns whether two slices of blocks are exactly the same hash
 // and index pair wise.
 func BlocksEqual(src, tgt []protocol.BlockInfo) bool {
@@ -101,15 +101,15 @@ var diffTestData = []struct {
 	{"contents", "contents", 1024, []protocol.BlockInfo{}},
 	{"", "", 1024, []protocol.BlockInfo{}},
 	{"contents", "contents", 3, []protocol.BlockInfo{}},
-	{"contents", "cantents", 3, []protocol.BlockInfo{{0, 3, nil}}},
-	{"contents", "contants", 3, []protocol.BlockInfo{{3, 3, nil}}},
-	{"contents", "cantants", 3, []protocol.BlockInfo{{0, 3, nil}, {3, 3, nil}}},
-	{"contents", "", 3, []protocol.BlockInfo{{0, 0, nil}}},
-	{"", "contents", 3, []protocol.BlockInfo{{0, 3, nil}, {3, 3, nil}, {6, 2, nil}}},
-	{"con", "contents", 3, []protocol.BlockInfo{{3, 3, nil}, {6, 2, nil}}},
+	{"contents", "cantents", 3, []protocol.BlockInfo{{0, 3, nil, 0}}},
+	{"contents", "contants", 3, []protocol.BlockInfo{{3, 3, nil, 0}}},
+	{"contents", "cantants", 3, []protocol.BlockInfo{{0, 3, nil, 0}, {3, 3, nil, 0}}},
+	{"contents", "", 3, []protocol.BlockInfo{{0, 0, nil, 0}}},
+	{"", "contents", 3, []protocol.BlockInfo{{0, 3, nil, 0}, {3, 3, nil, 0}, {6, 2, nil, 0}}},
+	{"con", "contents", 3, []protocol.BlockInfo{{3, 3, nil, 0}, {6, 2, nil, 0}}},
 	{"contents", "con", 3, nil},
-	{"contents", "cont", 3, []protocol.BlockInfo{{3, 1, nil}}},
-	{"cont", "contents", 3, []protocol.BlockInfo{{3, 3, nil}, {6, 2, nil}}},
+	{"contents", "cont", 3, []protocol.BlockInfo{{3, 1, nil, 0}}},
+	{"cont", "contents", 3, []protocol.BlockInfo{{3, 3, nil, 0}, {6, 2, nil, 0}}},
 }
 
 func TestDiff(t *testing.T) {
@@ -131,3 +131,41 @@ func TestDiff(t *testing.T) {
 		}
 	}
 }
+
+func TestIsZeroBlock(t *testing.T) {
+	data := make([]byte, 2*protocol.BlockSize+100)
+	data[protocol.BlockSize+1] = 1
+	blocks, err := Blocks(bytes.NewReader(data), protocol.BlockSize, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []bool{true, false, true} {
+		if res := IsZeroBlock(blocks[i]); res != expected {
+			t.Errorf("IsZeroBlock(block %d) = %v, expected %v", i, res, expected)
+		}
+	}
+
+	// Sizes that can't be right are rejected without hashing.
+	for _, size := range []int32{0, -1, protocol.MaxBlockSize + 1, 1<<31 - 1} {
+		if IsZeroBlock(protocol.BlockInfo{Size: size, Hash: blocks[0].Hash}) {
+			t.Errorf("IsZeroBlock true for block of size %d", size)
+		}
+	}
+}
+
+func TestBlocksWeakHash(t *testing.T) {
+	data := []byte("contents of some length")
+	blocks, err := Blocks(bytes.NewReader(data), 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, b := range blocks {
+		var h RollingHash
+		h.Write(data[b.Offset : b.Offset+int64(b.Size)])
+		if b.WeakHash != h.Sum32() {
+			t.Errorf("Block %d has weak hash %08x, expected %08x", i, b.WeakHash, h.Sum32())
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package scanner
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// A Limiter limits the rate at which files are read for hashing. The same
+// limiter may be shared by several walks running at the same time, in which
+// case the rate is divided between them. The rate can be changed at any
+// time. It's safe for concurrent use.
+type Limiter struct {
+	rate  float64 // bytes per second, zero for no limit
+	avail float64 // may go negative, meaning readers have to wait
+	last  time.Time
+	mut   sync.Mutex
+}
+
+// NewLimiter returns a limiter for the given number of bytes per second. A
+// rate of zero or less means no limit.
+func NewLimiter(bytesPerSecond int) *Limiter {
+	l := &Limiter{}
+	l.SetRate(bytesPerSecond)
+	return l
+}
+
+// SetRate changes the limit to the given number of bytes per second. A rate
+// of zero or less means no limit.
+func (l *Limiter) SetRate(bytesPerSecond int) {
+	l.mut.Lock()
+	if bytesPerSecond < 0 {
+		bytesPerSecond = 0
+	}
+	if float64(bytesPerSecond) != l.rate {
+		l.rate = float64(bytesPerSecond)
+		l.avail = 0
+		l.last = time.Now()
+	}
+	l.mut.Unlock()
+}
+
+// Rate returns the current limit in bytes per second, zero for no limit.
+func (l *Limiter) Rate() int {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return int(l.rate)
+}
+
+// wait blocks for as long as it takes to allow n more bytes at the current
+// rate. At most one second worth of unused allowance is saved up, to allow
+// for bursts.
+func (l *Limiter) wait(n int) {
+	l.mut.Lock()
+	if l.rate == 0 {
+		l.mut.Unlock()
+		return
+	}
+	now := time.Now()
+	l.avail += now.Sub(l.last).Seconds() * l.rate
+	if l.avail > l.rate {
+		l.avail = l.rate
+	}
+	l.last = now
+	l.avail -= float64(n)
+	var delay time.Duration
+	if l.avail < 0 {
+		delay = time.Duration(-l.avail / l.rate * float64(time.Second))
+	}
+	l.mut.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// limitedReader returns a reader that reads no faster than all of the
+// limiters allow.
+func limitedReader(r io.Reader, limiters []*Limiter) io.Reader {
+	if len(limiters) == 0 {
+		return r
+	}
+	return limitReader{r, limiters}
+}
+
+type limitReader struct {
+	r        io.Reader
+	limiters []*Limiter
+}
+
+func (r limitReader) Read(bs []byte) (int, error) {
+	n, err := r.r.Read(bs)
+	for _, l := range r.limiters {
+		if l != nil {
+			l.wait(n)
+		}
+	}
+	return n, err
+}
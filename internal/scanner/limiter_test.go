@@ -0,0 +1,45 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package scanner
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(100000)
+
+	t0 := time.Now()
+	for i := 0; i < 5; i++ {
+		l.wait(10000)
+	}
+	if d := time.Since(t0); d < 400*time.Millisecond || d > 2*time.Second {
+		t.Errorf("reading 50000 bytes at 100000 bytes/s took %v, expected about 500ms", d)
+	}
+
+	l.SetRate(0)
+	if l.Rate() != 0 {
+		t.Errorf("rate %d != 0 after removing the limit", l.Rate())
+	}
+	t0 = time.Now()
+	for i := 0; i < 5; i++ {
+		l.wait(10000000)
+	}
+	if d := time.Since(t0); d > 100*time.Millisecond {
+		t.Errorf("reading without a limit took %v", d)
+	}
+}
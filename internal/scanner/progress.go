@@ -0,0 +1,64 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package scanner
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// A Progress counts the bytes to hash during a walk and the bytes hashed so
+// far. The total grows as the walk finds files to hash, so it's only an
+// estimate until the walk is done. It's safe for concurrent use.
+type Progress struct {
+	total  int64 // accessed atomically
+	hashed int64 // accessed atomically
+}
+
+// Total returns the number of bytes to hash found so far.
+func (p *Progress) Total() int64 {
+	return atomic.LoadInt64(&p.total)
+}
+
+// Hashed returns the number of bytes hashed so far.
+func (p *Progress) Hashed() int64 {
+	return atomic.LoadInt64(&p.hashed)
+}
+
+func (p *Progress) addTotal(n int64) {
+	if p != nil {
+		atomic.AddInt64(&p.total, n)
+	}
+}
+
+// reader returns a reader that counts what is read from r as hashed.
+func (p *Progress) reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return progressReader{r, p}
+}
+
+type progressReader struct {
+	r io.Reader
+	p *Progress
+}
+
+func (r progressReader) Read(bs []byte) (int, error) {
+	n, err := r.r.Read(bs)
+	atomic.AddInt64(&r.p.hashed, int64(n))
+	return n, err
+}
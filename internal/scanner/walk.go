@@ -17,15 +17,19 @@ package scanner
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/ignore"
 	"github.com/syncthing/syncthing/internal/lamport"
+	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/posix"
 	"github.com/syncthing/syncthing/internal/symlinks"
 	"golang.org/x/text/unicode/norm"
 )
@@ -35,7 +39,8 @@ type Walker struct {
 	Dir string
 	// Limit walking to this path within Dir, or no limit if Sub is blank
 	Sub string
-	// BlockSize controls the size of the block used when hashing.
+	// BlockSize controls the size of the block used when hashing. If zero,
+	// it's chosen for each file by its size.
 	BlockSize int
 	// If Matcher is not nil, it is used to identify files to ignore which were specified by the user.
 	Matcher *ignore.Matcher
@@ -51,8 +56,36 @@ type Walker struct {
 	IgnorePerms bool
 	// Number of routines to use for hashing
 	Hashers int
+	// Modification times differing by no more than ModTimeWindow are
+	// considered equal, for filesystems that round them.
+	ModTimeWindow time.Duration
+	// If SyncOwnership or SyncXattrs is true, the ownership or extended
+	// attributes of files and directories are recorded, and changes to
+	// them detected.
+	SyncOwnership bool
+	SyncXattrs    bool
+	// If AutoNormalize is true, files and directories with names that are
+	// not in NFC form are renamed to it, unless the normalized name is
+	// already taken. Otherwise they are not scanned.
+	AutoNormalize bool
+	// If FileError is not nil, it is called for each file or directory that
+	// is not scanned because of a problem with it. It's not called
+	// concurrently.
+	FileError func(name string, err error)
+	// If Progress is not nil, it counts the bytes to hash and hashed.
+	Progress *Progress
+	// Reading files for hashing is slowed down to stay within the rate of
+	// each of the Limiters.
+	Limiters []*Limiter
+	// If Stop is not nil, closing it aborts the walk. The files not yet
+	// hashed are dropped and the returned channel is closed soon after.
+	Stop chan struct{}
+
+	fileErrorMut sync.Mutex
 }
 
+var errNotNormalized = errors.New("name contains non-NFC UTF-8 sequences and cannot be synced; consider renaming it or enabling automatic normalization")
+
 type TempNamer interface {
 	// Temporary returns a temporary name for the filed referred to by filepath.
 	TempName(path string) string
@@ -82,9 +115,13 @@ func (w *Walker) Walk() (chan protocol.FileInfo, error) {
 		workers = runtime.NumCPU()
 	}
 
+	// The walk runs ahead of the hashing, so that the total size to hash is
+	// known long before the hashing is done.
 	files := make(chan protocol.FileInfo)
+	toHash := make(chan protocol.FileInfo)
 	hashedFiles := make(chan protocol.FileInfo)
-	newParallelHasher(w.Dir, w.BlockSize, workers, hashedFiles, files)
+	go queueFiles(toHash, files)
+	newParallelHasher(w.Dir, w.BlockSize, workers, hashedFiles, toHash, w.Progress, w.Limiters, w.fileError, w.Stop)
 
 	go func() {
 		hashFiles := w.walkAndHashFiles(files)
@@ -97,7 +134,12 @@ func (w *Walker) Walk() (chan protocol.FileInfo, error) {
 
 func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFunc {
 	now := time.Now()
-	return func(p string, info os.FileInfo, err error) error {
+	var walkFn filepath.WalkFunc
+	walkFn = func(p string, info os.FileInfo, err error) error {
+		if stopped(w.Stop) {
+			return errStopped
+		}
+
 		if err != nil {
 			if debug {
 				l.Debugln("error:", p, info, err)
@@ -144,8 +186,30 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 		}
 
 		if (runtime.GOOS == "linux" || runtime.GOOS == "windows") && !norm.NFC.IsNormalString(rn) {
-			l.Warnf("File %q contains non-NFC UTF-8 sequences and cannot be synced. Consider renaming.", rn)
-			return nil
+			// The contents of a directory that isn't normalized can't be
+			// synced either, so they're skipped.
+			var skip error
+			if info.IsDir() {
+				skip = filepath.SkipDir
+			}
+
+			if !w.AutoNormalize {
+				l.Warnf("File %q contains non-NFC UTF-8 sequences and cannot be synced. Consider renaming.", rn)
+				w.fileError(rn, errNotNormalized)
+				return skip
+			}
+
+			np, err := w.normalize(rn)
+			if err != nil {
+				l.Infof("File %q: %v", rn, err)
+				w.fileError(rn, err)
+				return skip
+			}
+
+			// Scan it again by the new name, along with the contents if it's
+			// a directory.
+			filepath.Walk(np, walkFn)
+			return skip
 		}
 
 		// Index wise symlinks are always files, regardless of what the target
@@ -180,7 +244,11 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 				return rval
 			}
 
-			blocks, err := Blocks(strings.NewReader(target), w.BlockSize, 0)
+			blockSize := w.BlockSize
+			if blockSize == 0 {
+				blockSize = protocol.BlockSizeFor(int64(len(target)))
+			}
+			blocks, err := Blocks(strings.NewReader(target), blockSize, 0)
 			if err != nil {
 				if debug {
 					l.Debugln("hash link error:", p, err)
@@ -203,11 +271,12 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 			}
 
 			f := protocol.FileInfo{
-				Name:     rn,
-				Version:  lamport.Default.Tick(0),
-				Flags:    protocol.FlagSymlink | flags | protocol.FlagNoPermBits | 0666,
-				Modified: 0,
-				Blocks:   blocks,
+				Name:         rn,
+				Version:      lamport.Default.Tick(0),
+				Flags:        protocol.FlagSymlink | flags | protocol.FlagNoPermBits | 0666,
+				Modified:     0,
+				RawBlockSize: protocol.RawBlockSize(blockSize),
+				Blocks:       blocks,
 			}
 
 			if debug {
@@ -220,6 +289,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 		}
 
 		if info.Mode().IsDir() {
+			var pmd []protocol.PosixMetadata
 			if w.CurrentFiler != nil {
 				// A directory is "unchanged", if it
 				//  - exists
@@ -228,11 +298,15 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 				//  - was a directory previously (not a file or something else)
 				//  - was not a symlink (since it's a directory now)
 				//  - was not invalid (since it looks valid now)
+				//  - has the same ownership and extended attributes, if synced
 				cf, ok := w.CurrentFiler.CurrentFile(rn)
+				pmd = w.readPosix(p, rn, cf)
 				permUnchanged := w.IgnorePerms || !cf.HasPermissionBits() || PermsEqual(cf.Flags, uint32(info.Mode()))
-				if ok && permUnchanged && !cf.IsDeleted() && cf.IsDirectory() && !cf.IsSymlink() && !cf.IsInvalid() {
+				if ok && permUnchanged && !cf.IsDeleted() && cf.IsDirectory() && !cf.IsSymlink() && !cf.IsInvalid() && w.posixEqual(cf, pmd) {
 					return nil
 				}
+			} else {
+				pmd = w.readPosix(p, rn, protocol.FileInfo{})
 			}
 
 			flags := uint32(protocol.FlagDirectory)
@@ -242,10 +316,12 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 				flags |= uint32(info.Mode() & os.ModePerm)
 			}
 			f := protocol.FileInfo{
-				Name:     rn,
-				Version:  lamport.Default.Tick(0),
-				Flags:    flags,
-				Modified: info.ModTime().Unix(),
+				Name:       rn,
+				Version:    lamport.Default.Tick(0),
+				Flags:      flags,
+				Modified:   info.ModTime().Unix(),
+				ModifiedNs: int32(info.ModTime().Nanosecond()),
+				Posix:      pmd,
 			}
 			if debug {
 				l.Debugln("dir:", p, f)
@@ -255,6 +331,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 		}
 
 		if info.Mode().IsRegular() {
+			var pmd []protocol.PosixMetadata
 			if w.CurrentFiler != nil {
 				// A file is "unchanged", if it
 				//  - exists
@@ -265,37 +342,113 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 				//  - was not a symlink (since it's a file now)
 				//  - was not invalid (since it looks valid now)
 				//  - has the same size as previously
+				//  - has the same ownership and extended attributes, if synced
 				cf, ok := w.CurrentFiler.CurrentFile(rn)
+				pmd = w.readPosix(p, rn, cf)
 				permUnchanged := w.IgnorePerms || !cf.HasPermissionBits() || PermsEqual(cf.Flags, uint32(info.Mode()))
-				if ok && permUnchanged && !cf.IsDeleted() && cf.Modified == info.ModTime().Unix() && !cf.IsDirectory() &&
-					!cf.IsSymlink() && !cf.IsInvalid() && cf.Size() == info.Size() {
+				contentUnchanged := ok && !cf.IsDeleted() && ModTimeEqual(cf, info.ModTime(), w.ModTimeWindow) && !cf.IsDirectory() &&
+					!cf.IsSymlink() && !cf.IsInvalid() && cf.Size() == info.Size()
+				if contentUnchanged && permUnchanged && w.posixEqual(cf, pmd) {
+					return nil
+				}
+				if contentUnchanged && permUnchanged {
+					// Only the ownership or extended attributes changed, so
+					// there is no need to hash the file again.
+					f := cf
+					f.Version = lamport.Default.Tick(cf.Version)
+					f.LocalVersion = 0
+					f.Posix = pmd
+					if debug {
+						l.Debugln("metadata changed:", p, f)
+					}
+					fchan <- f
 					return nil
 				}
 
 				if debug {
-					l.Debugln("rescan:", cf, info.ModTime().Unix(), info.Mode()&os.ModePerm)
+					l.Debugln("rescan:", cf, info.ModTime(), info.Mode()&os.ModePerm)
 				}
+			} else {
+				pmd = w.readPosix(p, rn, protocol.FileInfo{})
 			}
 
 			var flags = uint32(info.Mode() & os.ModePerm)
 			if w.IgnorePerms {
 				flags = protocol.FlagNoPermBits | 0666
 			}
+			if osutil.IsSparse(info) {
+				flags |= protocol.FlagSparse
+			}
 
 			f := protocol.FileInfo{
-				Name:     rn,
-				Version:  lamport.Default.Tick(0),
-				Flags:    flags,
-				Modified: info.ModTime().Unix(),
+				Name:       rn,
+				Version:    lamport.Default.Tick(0),
+				Flags:      flags,
+				Modified:   info.ModTime().Unix(),
+				ModifiedNs: int32(info.ModTime().Nanosecond()),
+				Posix:      pmd,
 			}
 			if debug {
 				l.Debugln("to hash:", p, f)
 			}
+			w.Progress.addTotal(info.Size())
 			fchan <- f
 		}
 
 		return nil
 	}
+	return walkFn
+}
+
+// normalize renames the file or directory to the NFC form of its name and
+// returns the new path, unless a file already has that name. The directory
+// it's in must be normalized already.
+func (w *Walker) normalize(rn string) (string, error) {
+	nn := filepath.Join(filepath.Dir(rn), norm.NFC.String(filepath.Base(rn)))
+	np := filepath.Join(w.Dir, nn)
+	// The rename fails, rather than replacing it, if a file by the
+	// normalized name exists or is created while we're at it.
+	if err := osutil.RenameNoReplace(filepath.Join(w.Dir, rn), np); os.IsExist(err) {
+		return "", fmt.Errorf("cannot normalize name; %q already exists", nn)
+	} else if err != nil {
+		return "", err
+	}
+	l.Infof("Renamed %q to the normalized form of its name", rn)
+	return np, nil
+}
+
+// readPosix returns the ownership and extended attributes to record for the
+// file, if they are synced. When they can't be read the problem is reported
+// and those of the current file are kept.
+func (w *Walker) readPosix(p, rn string, cf protocol.FileInfo) []protocol.PosixMetadata {
+	if !w.SyncOwnership && !w.SyncXattrs {
+		return nil
+	}
+	md, err := posix.Read(p, w.SyncOwnership, w.SyncXattrs)
+	if err != nil {
+		w.fileError(rn, err)
+		return cf.Posix
+	}
+	return []protocol.PosixMetadata{md}
+}
+
+// posixEqual returns true if the ownership and extended attributes that are
+// synced are the same for the current file and on disk.
+func (w *Walker) posixEqual(cf protocol.FileInfo, pmd []protocol.PosixMetadata) bool {
+	if !w.SyncOwnership && !w.SyncXattrs {
+		return true
+	}
+	a, aok := cf.PosixMetadata()
+	b, bok := protocol.FileInfo{Posix: pmd}.PosixMetadata()
+	return aok == bok && posix.Equal(a, b, w.SyncOwnership, w.SyncXattrs)
+}
+
+func (w *Walker) fileError(rn string, err error) {
+	if w.FileError != nil {
+		w.fileErrorMut.Lock()
+		w.FileError(rn, err)
+		w.fileErrorMut.Unlock()
+	}
 }
 
 func checkDir(dir string) error {
@@ -321,6 +474,24 @@ func PermsEqual(a, b uint32) bool {
 	}
 }
 
+// ModTimeEqual returns true if the modification time read from disk is the
+// one recorded for the file, give or take the window. When either time has
+// no sub-second part, such as on filesystems that store whole seconds or in
+// files recorded before sub-second times were, only the seconds are
+// compared.
+func ModTimeEqual(f protocol.FileInfo, t time.Time, window time.Duration) bool {
+	ft := f.ModTime()
+	if f.ModifiedNs == 0 || t.Nanosecond() == 0 {
+		ft = time.Unix(f.Modified, 0)
+		t = time.Unix(t.Unix(), 0)
+	}
+	d := t.Sub(ft)
+	if d < 0 {
+		d = -d
+	}
+	return d <= window
+}
+
 // If the target is missing, Unix never knows what type of symlink it is
 // and Windows always knows even if there is no target.
 // Which means that without this special check a Unix node would be fighting
@@ -18,14 +18,19 @@ package scanner
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	rdebug "runtime/debug"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/ignore"
+	"github.com/syncthing/syncthing/internal/posix"
 )
 
 type testfile struct {
@@ -93,6 +98,36 @@ func TestWalkSub(t *testing.T) {
 	}
 }
 
+func TestWalkBlockSize(t *testing.T) {
+	for _, blockSize := range []int{0, protocol.BlockSize, 1 << 20} {
+		w := Walker{
+			Dir:       "testdata",
+			Sub:       filepath.Join("dir2", "cfile"),
+			BlockSize: blockSize,
+		}
+		fchan, err := w.Walk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []protocol.FileInfo
+		for f := range fchan {
+			files = append(files, f)
+		}
+
+		if len(files) != 1 {
+			t.Fatalf("Incorrect length %d != 1", len(files))
+		}
+		expected := blockSize
+		if expected == 0 {
+			// Small files use the standard block size
+			expected = protocol.BlockSize
+		}
+		if bs := files[0].BlockSize(); bs != expected {
+			t.Errorf("Block size %d, expected %d", bs, expected)
+		}
+	}
+}
+
 func TestWalk(t *testing.T) {
 	ignores := ignore.New(false)
 	err := ignores.Load("testdata/.stignore")
@@ -124,6 +159,122 @@ func TestWalk(t *testing.T) {
 	}
 }
 
+func TestWalkProgress(t *testing.T) {
+	ignores := ignore.New(false)
+	err := ignores.Load("testdata/.stignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := Walker{
+		Dir:       "testdata",
+		BlockSize: 128 * 1024,
+		Matcher:   ignores,
+		Progress:  &Progress{},
+	}
+
+	fchan, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var size int64
+	for f := range fchan {
+		if !f.IsDirectory() {
+			size += f.Size()
+		}
+	}
+
+	if total := w.Progress.Total(); total != size {
+		t.Errorf("Total %d != size of files %d", total, size)
+	}
+	if hashed := w.Progress.Hashed(); hashed != size {
+		t.Errorf("Hashed %d != size of files %d", hashed, size)
+	}
+}
+
+func TestWalkProgressTotalFirst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-scanner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const files, size = 5, 256 << 10
+	for i := 0; i < files; i++ {
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprint(i)), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Hashing a file takes a quarter of a second at this rate, which is
+	// plenty of time for the walk to find the rest.
+	w := &Walker{
+		Dir:       dir,
+		BlockSize: 128 * 1024,
+		Hashers:   1,
+		Limiters:  []*Limiter{NewLimiter(1 << 20)},
+		Progress:  &Progress{},
+		Stop:      make(chan struct{}),
+	}
+	fchan, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		close(w.Stop)
+		for range fchan {
+		}
+	}()
+
+	<-fchan
+	if total := w.Progress.Total(); total != files*size {
+		t.Errorf("Total %d after the first file is hashed, expected %d", total, files*size)
+	}
+	if hashed := w.Progress.Hashed(); hashed >= files*size {
+		t.Errorf("Hashed %d, expected less than %d", hashed, files*size)
+	}
+}
+
+func TestWalkStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-scanner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "large"), make([]byte, 10<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hashing the file takes ten seconds at this rate.
+	w := &Walker{
+		Dir:       dir,
+		BlockSize: 128 * 1024,
+		Limiters:  []*Limiter{NewLimiter(1 << 20)},
+		Stop:      make(chan struct{}),
+	}
+	fchan, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(w.Stop)
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case f, ok := <-fchan:
+			if !ok {
+				return
+			}
+			t.Errorf("Unexpected file %v after stopping", f)
+		case <-timeout:
+			t.Fatal("Walk didn't stop")
+		}
+	}
+}
+
 func TestWalkError(t *testing.T) {
 	w := Walker{
 		Dir:       "testdata-missing",
@@ -146,6 +297,76 @@ func TestWalkError(t *testing.T) {
 	}
 }
 
+func TestWalkNormalization(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "windows" {
+		t.Skip("names are only checked for normalization on Linux and Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// "ä" decomposed (NFD) and composed (NFC)
+	nfd, nfc := "a\u0308", "\u00e4"
+	for _, name := range []string{
+		nfd + "1",
+		nfd + "2", nfc + "2",
+		filepath.Join(nfd+"3", "file"),
+	} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	walk := func(autoNormalize bool) ([]string, []string) {
+		var names, errs []string
+		w := Walker{
+			Dir:           dir,
+			BlockSize:     128 * 1024,
+			AutoNormalize: autoNormalize,
+			FileError: func(name string, err error) {
+				errs = append(errs, name)
+			},
+		}
+		fchan, err := w.Walk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for f := range fchan {
+			names = append(names, f.Name)
+		}
+		sort.Strings(names)
+		return names, errs
+	}
+
+	// Without normalization, the files with decomposed names are reported
+	// and skipped.
+
+	names, errs := walk(false)
+	if exp := []string{nfc + "2"}; fmt.Sprint(names) != fmt.Sprint(exp) {
+		t.Errorf("Unexpected files %q != %q", names, exp)
+	}
+	if exp := []string{nfd + "1", nfd + "2", nfd + "3"}; fmt.Sprint(errs) != fmt.Sprint(exp) {
+		t.Errorf("Unexpected errors for %q != %q", errs, exp)
+	}
+
+	// With it, they are renamed unless the normalized name is taken.
+
+	names, errs = walk(true)
+	if exp := []string{nfc + "1", nfc + "2", nfc + "3", filepath.Join(nfc+"3", "file")}; fmt.Sprint(names) != fmt.Sprint(exp) {
+		t.Errorf("Unexpected files %q != %q", names, exp)
+	}
+	if exp := []string{nfd + "2"}; fmt.Sprint(errs) != fmt.Sprint(exp) {
+		t.Errorf("Unexpected errors for %q != %q", errs, exp)
+	}
+	if _, err := os.Stat(filepath.Join(dir, nfd+"2")); err != nil {
+		t.Error("Colliding file was removed:", err)
+	}
+}
+
 func TestVerify(t *testing.T) {
 	blocksize := 16
 	// data should be an even multiple of blocksize long
@@ -190,6 +411,224 @@ func TestVerify(t *testing.T) {
 	}
 }
 
+func TestModTimeEqual(t *testing.T) {
+	f := protocol.FileInfo{Modified: 1000, ModifiedNs: 500000000}
+	sec := protocol.FileInfo{Modified: 1000}
+
+	cases := []struct {
+		f      protocol.FileInfo
+		t      time.Time
+		window time.Duration
+		equal  bool
+	}{
+		{f, time.Unix(1000, 500000000), 0, true},
+		{f, time.Unix(1000, 500000001), 0, false},
+		{f, time.Unix(1000, 900000000), 0, false},
+		{f, time.Unix(1001, 0), 0, false},
+		{f, time.Unix(1000, 0), 0, true}, // the filesystem stores whole seconds
+		{sec, time.Unix(1000, 500000000), 0, true},
+		{sec, time.Unix(1001, 500000000), 0, false},
+		{f, time.Unix(1002, 0), 2 * time.Second, true},
+		{f, time.Unix(998, 0), 2 * time.Second, true},
+		{f, time.Unix(1002, 500000000), 2 * time.Second, true},
+		{f, time.Unix(1002, 500000001), 2 * time.Second, false},
+	}
+
+	for i, tc := range cases {
+		if eq := ModTimeEqual(tc.f, tc.t, tc.window); eq != tc.equal {
+			t.Errorf("%d: ModTimeEqual(%v, %v, %v) = %v, expected %v", i, tc.f.ModTime(), tc.t, tc.window, eq, tc.equal)
+		}
+	}
+}
+
+func TestWalkSubSecondChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-scanner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(name, []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Unix(1234567890, 100000000)
+	if err := os.Chtimes(name, t0, t0); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &Walker{
+		Dir:       dir,
+		BlockSize: 128 * 1024,
+	}
+	files := walkAll(t, w)
+	if len(files) != 1 || !files[0].ModTime().Equal(t0) {
+		t.Fatalf("unexpected scan result %v", files)
+	}
+	if info, _ := os.Stat(name); info.ModTime().Nanosecond() == 0 {
+		t.Skip("filesystem does not store sub-second modification times")
+	}
+
+	// The same size and second, but rewritten a moment later.
+	if err := ioutil.WriteFile(name, []byte("again"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t1 := t0.Add(200 * time.Millisecond)
+	if err := os.Chtimes(name, t1, t1); err != nil {
+		t.Fatal(err)
+	}
+
+	w.CurrentFiler = fakeCurrentFiler{files[0].Name: files[0]}
+	files = walkAll(t, w)
+	if len(files) != 1 || !files[0].ModTime().Equal(t1) {
+		t.Errorf("change within the same second was not detected; %v", files)
+	}
+
+	// Within the window the change is not seen.
+	w.ModTimeWindow = time.Second
+	if files = walkAll(t, w); len(files) != 0 {
+		t.Errorf("change within the window was detected; %v", files)
+	}
+}
+
+func TestWalkChangingFile(t *testing.T) {
+	defer func(d []time.Duration) {
+		changingFileDelays = d
+	}(changingFileDelays)
+	changingFileDelays = []time.Duration{10 * time.Millisecond}
+
+	dir, err := ioutil.TempDir("", "syncthing-scanner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "log")
+	if err := ioutil.WriteFile(name, make([]byte, 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep touching the file while it's hashed, slowly.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mt := time.Unix(1234567890, 0)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+				mt = mt.Add(time.Second)
+				os.Chtimes(name, mt, mt)
+			}
+		}
+	}()
+
+	var errs []string
+	w := &Walker{
+		Dir:       dir,
+		BlockSize: 128 * 1024,
+		Limiters:  []*Limiter{NewLimiter(10 << 20)},
+		FileError: func(name string, err error) {
+			errs = append(errs, name)
+		},
+	}
+	files := walkAll(t, w)
+	close(stop)
+	<-done
+
+	if len(files) != 0 {
+		t.Errorf("changing file was scanned; %v", files)
+	}
+	if len(errs) != 1 || errs[0] != "log" {
+		t.Errorf("unexpected file errors %v", errs)
+	}
+
+	// Once it's stable it's scanned as usual, with the modification time it
+	// had when hashed.
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs = nil
+	files = walkAll(t, w)
+	if len(files) != 1 || !files[0].ModTime().Equal(info.ModTime()) || len(errs) != 0 {
+		t.Errorf("unexpected scan result %v, errors %v", files, errs)
+	}
+}
+
+func TestWalkPosixChange(t *testing.T) {
+	if !posix.XattrsSupported {
+		t.Skip("extended attributes are not supported")
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing-scanner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(name, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &Walker{
+		Dir:        dir,
+		BlockSize:  128 * 1024,
+		SyncXattrs: true,
+	}
+	files := walkAll(t, w)
+	if len(files) != 1 || len(files[0].Posix) != 1 || len(files[0].Posix[0].Xattrs) != 0 {
+		t.Fatalf("unexpected scan result %v", files)
+	}
+
+	md := protocol.PosixMetadata{Xattrs: []protocol.Xattr{{Name: "user.test", Value: []byte("value")}}}
+	if err := posix.Apply(name, md, false, true); err != nil {
+		t.Skip("extended attributes are not supported on the temporary directory:", err)
+	}
+
+	// The change is detected, and the file is not hashed again.
+	w.CurrentFiler = fakeCurrentFiler{files[0].Name: files[0]}
+	w.Progress = &Progress{}
+	changed := walkAll(t, w)
+	if len(changed) != 1 || changed[0].Version <= files[0].Version || !BlocksEqual(changed[0].Blocks, files[0].Blocks) {
+		t.Fatalf("unexpected scan result %v", changed)
+	}
+	if got, _ := changed[0].PosixMetadata(); !posix.Equal(got, md, false, true) {
+		t.Errorf("unexpected metadata %v", got)
+	}
+	if w.Progress.Hashed() != 0 {
+		t.Errorf("file with only changed metadata was hashed")
+	}
+
+	// Without syncing extended attributes, nothing changed.
+	w.SyncXattrs = false
+	if files = walkAll(t, w); len(files) != 0 {
+		t.Errorf("unexpected scan result %v", files)
+	}
+}
+
+func walkAll(t *testing.T, w *Walker) []protocol.FileInfo {
+	fchan, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []protocol.FileInfo
+	for f := range fchan {
+		files = append(files, f)
+	}
+	return files
+}
+
+type fakeCurrentFiler map[string]protocol.FileInfo
+
+func (f fakeCurrentFiler) CurrentFile(name string) (protocol.FileInfo, bool) {
+	fi, ok := f[name]
+	return fi, ok
+}
+
 type fileList []protocol.FileInfo
 
 func (l fileList) Len() int {
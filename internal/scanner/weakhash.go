@@ -0,0 +1,52 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package scanner
+
+// A RollingHash is the rsync style weak checksum of a window of data. Once
+// the window is written, it can be moved forward a byte at a time with
+// Roll, which is cheap enough to look for blocks at every offset of a file.
+// The zero value is the hash of an empty window.
+type RollingHash struct {
+	a, b uint32
+	n    uint32
+}
+
+// Write adds the data to the end of the window.
+func (h *RollingHash) Write(p []byte) (int, error) {
+	for _, c := range p {
+		h.a += uint32(c)
+		h.b += h.a
+	}
+	h.n += uint32(len(p))
+	return len(p), nil
+}
+
+// Roll moves the window forward by one byte, dropping out from the start and
+// adding in at the end.
+func (h *RollingHash) Roll(out, in byte) {
+	h.a += uint32(in) - uint32(out)
+	h.b += h.a - h.n*uint32(out)
+}
+
+// Sum32 returns the weak hash of the window.
+func (h *RollingHash) Sum32() uint32 {
+	return h.a&0xffff | h.b<<16
+}
+
+// Reset empties the window.
+func (h *RollingHash) Reset() {
+	*h = RollingHash{}
+}
@@ -0,0 +1,38 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package scanner
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestRollingHash(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.Read(data)
+	const window = 100
+
+	var rh RollingHash
+	rh.Write(data[:window])
+	for i := 0; i+window < len(data); i++ {
+		var h RollingHash
+		h.Write(data[i : i+window])
+		if rh.Sum32() != h.Sum32() {
+			t.Fatalf("Rolled hash at offset %d is %08x, expected %08x", i, rh.Sum32(), h.Sum32())
+		}
+		rh.Roll(data[i], data[i+window])
+	}
+}
@@ -19,7 +19,7 @@ import (
 	"time"
 
 	"github.com/syncthing/protocol"
-	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syncthing/syncthing/internal/db"
 )
 
 const (
@@ -35,13 +35,13 @@ type DeviceStatistics struct {
 }
 
 type DeviceStatisticsReference struct {
-	db     *leveldb.DB
+	db     db.Backend
 	device protocol.DeviceID
 }
 
-func NewDeviceStatisticsReference(db *leveldb.DB, device protocol.DeviceID) *DeviceStatisticsReference {
+func NewDeviceStatisticsReference(ldb db.Backend, device protocol.DeviceID) *DeviceStatisticsReference {
 	return &DeviceStatisticsReference{
-		db:     db,
+		db:     ldb,
 		device: device,
 	}
 }
@@ -55,9 +55,9 @@ func (s *DeviceStatisticsReference) key(stat byte) []byte {
 }
 
 func (s *DeviceStatisticsReference) GetLastSeen() time.Time {
-	value, err := s.db.Get(s.key(deviceStatisticTypeLastSeen), nil)
+	value, err := s.db.Get(s.key(deviceStatisticTypeLastSeen))
 	if err != nil {
-		if err != leveldb.ErrNotFound {
+		if err != db.ErrNotFound {
 			l.Warnln("DeviceStatisticsReference: Failed loading last seen value for", s.device, ":", err)
 		}
 		return time.Unix(0, 0)
@@ -85,7 +85,7 @@ func (s *DeviceStatisticsReference) WasSeen() {
 		return
 	}
 
-	err = s.db.Put(s.key(deviceStatisticTypeLastSeen), value, nil)
+	err = s.db.Put(s.key(deviceStatisticTypeLastSeen), value)
 	if err != nil {
 		l.Warnln("Failed serializing last seen value for", s.device, ":", err)
 	}
@@ -95,11 +95,11 @@ func (s *DeviceStatisticsReference) WasSeen() {
 // or maybe because we have no easy way of knowing that a device has been removed.
 func (s *DeviceStatisticsReference) Delete() error {
 	for _, stype := range deviceStatisticsTypes {
-		err := s.db.Delete(s.key(stype), nil)
+		err := s.db.Delete(s.key(stype))
 		if debug && err == nil {
 			l.Debugln("stats.DeviceStatisticsReference.Delete:", s.device, stype)
 		}
-		if err != nil && err != leveldb.ErrNotFound {
+		if err != nil && err != db.ErrNotFound {
 			return err
 		}
 	}
@@ -19,7 +19,7 @@ import (
 	"encoding/binary"
 	"time"
 
-	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syncthing/syncthing/internal/db"
 )
 
 const (
@@ -35,13 +35,13 @@ type FolderStatistics struct {
 }
 
 type FolderStatisticsReference struct {
-	db     *leveldb.DB
+	db     db.Backend
 	folder string
 }
 
-func NewFolderStatisticsReference(db *leveldb.DB, folder string) *FolderStatisticsReference {
+func NewFolderStatisticsReference(ldb db.Backend, folder string) *FolderStatisticsReference {
 	return &FolderStatisticsReference{
-		db:     db,
+		db:     ldb,
 		folder: folder,
 	}
 }
@@ -55,9 +55,9 @@ func (s *FolderStatisticsReference) key(stat byte) []byte {
 }
 
 func (s *FolderStatisticsReference) GetLastFile() *LastFile {
-	value, err := s.db.Get(s.key(folderStatisticTypeLastFile), nil)
+	value, err := s.db.Get(s.key(folderStatisticTypeLastFile))
 	if err != nil {
-		if err != leveldb.ErrNotFound {
+		if err != db.ErrNotFound {
 			l.Warnln("FolderStatisticsReference: Failed loading last file filename value for", s.folder, ":", err)
 		}
 		return nil
@@ -87,7 +87,7 @@ func (s *FolderStatisticsReference) ReceivedFile(filename string) {
 		return
 	}
 
-	err = s.db.Put(s.key(folderStatisticTypeLastFile), value, nil)
+	err = s.db.Put(s.key(folderStatisticTypeLastFile), value)
 	if err != nil {
 		l.Warnln("Failed update last file value for", s.folder, ":", err)
 	}
@@ -97,11 +97,11 @@ func (s *FolderStatisticsReference) ReceivedFile(filename string) {
 // or maybe because we have no easy way of knowing that a folder has been removed.
 func (s *FolderStatisticsReference) Delete() error {
 	for _, stype := range folderStatisticsTypes {
-		err := s.db.Delete(s.key(stype), nil)
+		err := s.db.Delete(s.key(stype))
 		if debug && err == nil {
 			l.Debugln("stats.FolderStatisticsReference.Delete:", s.folder, stype)
 		}
-		if err != nil && err != leveldb.ErrNotFound {
+		if err != nil && err != db.ErrNotFound {
 			return err
 		}
 	}
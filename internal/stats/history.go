@@ -0,0 +1,230 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for
+// more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package stats
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/db"
+)
+
+// The maximum number of changes kept for a folder. When it's reached the
+// oldest tenth is dropped.
+const maxHistoryEntries = 10000
+
+// The kinds of FileChange
+const (
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+	ChangeRename = "rename"
+)
+
+// A FileChange is a change applied to a file in a folder, either found when
+// scanning or pulled from another device.
+type FileChange struct {
+	Time          time.Time
+	Name          string
+	Action        string            // ChangeUpdate, ChangeDelete or ChangeRename
+	RenamedTo     string            `json:",omitempty"`
+	Device        protocol.DeviceID // Where the change was made, as far as we know
+	DeviceGuessed bool              // True if Device is a best guess, as for changes pulled from other devices
+	OldVersion    int64             // Zero for a new file
+	NewVersion    int64
+	Size          int64 // Of the new version; zero when deleted or renamed
+}
+
+// A FolderHistoryReference records the changes to the files in a folder. The
+// history is limited in size and, if a maximum age is set, in time.
+type FolderHistoryReference struct {
+	db         db.Backend
+	folder     string
+	maxAge     time.Duration
+	maxEntries int
+	entries    int
+	last       int64 // Time of the last change, in nanoseconds
+	lastPrune  time.Time
+	mut        sync.Mutex
+}
+
+func NewFolderHistoryReference(ldb db.Backend, folder string, maxAge time.Duration) *FolderHistoryReference {
+	h := &FolderHistoryReference{
+		db:         ldb,
+		folder:     folder,
+		maxAge:     maxAge,
+		maxEntries: maxHistoryEntries,
+	}
+
+	dbi := ldb.NewPrefixIterator(h.prefix())
+	for dbi.Next() {
+		h.entries++
+		h.last = h.keyTime(dbi.Key())
+	}
+	dbi.Release()
+
+	if maxAge > 0 {
+		h.Prune(maxAge)
+	}
+	return h
+}
+
+// prefix returns the start of the keys for the folder:
+//
+//	keyTypeFolderHistory (1 byte)
+//	folder length (2 bytes)
+//	folder (variable size)
+func (h *FolderHistoryReference) prefix() []byte {
+	k := make([]byte, 1+2+len(h.folder))
+	k[0] = keyTypeFolderHistory
+	binary.BigEndian.PutUint16(k[1:], uint16(len(h.folder)))
+	copy(k[1+2:], h.folder)
+	return k
+}
+
+// key returns the key of a change, being the prefix followed by the time of
+// the change in nanoseconds (8 bytes).
+func (h *FolderHistoryReference) key(t int64) []byte {
+	p := h.prefix()
+	k := make([]byte, len(p)+8)
+	copy(k, p)
+	binary.BigEndian.PutUint64(k[len(p):], uint64(t))
+	return k
+}
+
+func (h *FolderHistoryReference) keyTime(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key[len(key)-8:]))
+}
+
+// Record adds the changes to the history, all written at once, dropping the
+// oldest changes if it has grown too long.
+func (h *FolderHistoryReference) Record(cs ...FileChange) {
+	if len(cs) == 0 {
+		return
+	}
+
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	batch := h.db.NewBatch()
+	last := h.last
+	for _, c := range cs {
+		if debug {
+			l.Debugln("stats.FolderHistoryReference.Record:", h.folder, c.Name, c.Action)
+		}
+
+		r := fileChangeRecord{
+			Name:       c.Name,
+			Action:     c.Action,
+			RenamedTo:  c.RenamedTo,
+			Device:     c.Device[:],
+			OldVersion: c.OldVersion,
+			NewVersion: c.NewVersion,
+			Size:       c.Size,
+		}
+
+		// Changes are kept in order, and each needs a key of its own.
+		t := c.Time.UnixNano()
+		if t <= last {
+			t = last + 1
+		}
+		last = t
+		batch.Put(h.key(t), r.MustMarshalXDR())
+	}
+
+	if err := h.db.Write(batch); err != nil {
+		l.Warnln("FolderHistoryReference: Failed recording changes for", h.folder, ":", err)
+		return
+	}
+	h.last = last
+	h.entries += len(cs)
+
+	if h.entries > h.maxEntries {
+		h.drop(h.entries-h.maxEntries*9/10, 0)
+	}
+	if h.maxAge > 0 && time.Since(h.lastPrune) > time.Hour {
+		h.dropOlder(time.Now().Add(-h.maxAge))
+	}
+}
+
+// Prune removes the changes older than the given age.
+func (h *FolderHistoryReference) Prune(maxAge time.Duration) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	h.dropOlder(time.Now().Add(-maxAge))
+}
+
+func (h *FolderHistoryReference) dropOlder(t time.Time) {
+	h.lastPrune = time.Now()
+	if n := h.drop(h.entries, t.UnixNano()); n > 0 && debug {
+		l.Debugln("stats.FolderHistoryReference: pruned", n, "changes for", h.folder)
+	}
+}
+
+// drop removes up to n of the oldest changes, stopping at the first one
+// from the given time or later unless that is zero. It returns the number
+// removed.
+func (h *FolderHistoryReference) drop(n int, before int64) int {
+	batch := h.db.NewBatch()
+	dbi := h.db.NewPrefixIterator(h.prefix())
+	for batch.Len() < n && dbi.Next() {
+		if before != 0 && h.keyTime(dbi.Key()) >= before {
+			break
+		}
+		batch.Delete(dbi.Key())
+	}
+	dbi.Release()
+
+	if err := h.db.Write(batch); err != nil {
+		l.Warnln("FolderHistoryReference: Failed dropping changes for", h.folder, ":", err)
+		return 0
+	}
+	h.entries -= batch.Len()
+	return batch.Len()
+}
+
+// History returns the recorded changes, oldest first. If file is not empty
+// only the changes to that file, including renames of other files to it,
+// are returned.
+func (h *FolderHistoryReference) History(file string) []FileChange {
+	var changes []FileChange
+	dbi := h.db.NewPrefixIterator(h.prefix())
+	defer dbi.Release()
+	for dbi.Next() {
+		var r fileChangeRecord
+		if err := r.UnmarshalXDR(dbi.Value()); err != nil {
+			l.Warnln("FolderHistoryReference: Failed loading change for", h.folder, ":", err)
+			continue
+		}
+		if file != "" && r.Name != file && r.RenamedTo != file {
+			continue
+		}
+
+		c := FileChange{
+			Time:       time.Unix(0, h.keyTime(dbi.Key())),
+			Name:       r.Name,
+			Action:     r.Action,
+			RenamedTo:  r.RenamedTo,
+			OldVersion: r.OldVersion,
+			NewVersion: r.NewVersion,
+			Size:       r.Size,
+		}
+		copy(c.Device[:], r.Device)
+		changes = append(changes, c)
+	}
+	return changes
+}
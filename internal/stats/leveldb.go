@@ -19,4 +19,5 @@ package stats
 const (
 	keyTypeDeviceStatistic = iota + 30
 	keyTypeFolderStatistic
+	keyTypeFolderHistory
 )